@@ -0,0 +1,191 @@
+// Package admin is the minitwit admin command, it does the routine
+// operations on users and messages that used to need raw SQL:
+//
+//	minitwit admin users list
+//	minitwit admin users disable alice
+//	minitwit admin -json messages list -flagged
+//
+// It connects with the same settings as the web app (config file and DB_*
+// variables), so in production it runs as a one-off container of the app
+// image with the environment file of the stack:
+//
+//	docker run --rm --env-file .env pbjh/minitwit-app ./main admin users list
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"minitwit/cache"
+	"minitwit/config"
+	"minitwit/db"
+
+	"gorm.io/gorm"
+)
+
+const usage = `usage: minitwit admin [-json] <command> [flags] [args]
+
+Commands:
+`
+
+// command is one "<group> <action>" of the admin command. parse checks
+// the arguments before the database is opened and returns what to run.
+type command struct {
+	args  string
+	help  string
+	parse func(args []string) (action, error)
+}
+
+type action func(e *env) error
+
+var commands = map[string]command{
+	"users list":           {"[-disabled] [-limit n]", "list users", listUsers},
+	"users create":         {"[-password p] <username> <email>", "create a user, the password is generated if not given", createUser},
+	"users disable":        {"<username>", "stop a user from logging in", disableUser},
+	"users enable":         {"<username>", "allow a disabled user to log in again", enableUser},
+	"users delete":         {"<username>", "delete a user with their messages and follows", deleteUser},
+	"users rename":         {"<username> <new-username>", "change a username", renameUser},
+	"users recount":        {"[-fix] [-limit n]", "compare the follower, following and message counters with the tables, -fix corrects them", recountUsers},
+	"users reset-password": {"[-password p] <username>", "set a new password, it is generated if not given", resetPassword},
+	"messages list":        {"[-user name] [-flagged] [-limit n]", "list the newest messages, flagged ones included", listMessages},
+	"messages flag":        {"<id>...", "hide messages from the timelines", flagMessages},
+	"messages unflag":      {"<id>...", "show flagged messages again", unflagMessages},
+	"followers recount":    {"[-fix] [-limit n]", "count the follows of every user and find follows of deleted users", recountFollowers},
+	"logins list":          {"[-user name] [-ip addr] [-limit n]", "list the newest failed logins", listFailedLogins},
+	"logins unlock":        {"<username>", "end the login delays of a username", unlockLogins},
+	"timelines rebuild":    {"[-max-followers n] [-backfill n]", "fill the fanned out home timelines from the messages already posted", rebuildTimelines},
+}
+
+// errUsage is returned for invalid arguments, Main prints the usage for it
+var errUsage = errors.New("invalid arguments")
+
+// env is what the commands run with
+type env struct {
+	db *gorm.DB
+	// timelines is cleared by the commands that change the timelines
+	timelines *cache.Timelines
+	out       io.Writer
+	json      bool
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, usage)
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", name, commands[name].args, commands[name].help)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\nFlags:\n  -json\toutput JSON instead of a table")
+}
+
+// parse reads the global flags and the arguments of the command
+func parse(args []string) (asJSON bool, run action, err error) {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&asJSON, "json", false, "")
+	if err := fs.Parse(args); err != nil {
+		return false, nil, err
+	}
+	if fs.NArg() < 2 {
+		return false, nil, errUsage
+	}
+	name := fs.Arg(0) + " " + fs.Arg(1)
+	cmd, ok := commands[name]
+	if !ok {
+		return false, nil, fmt.Errorf("unknown command %q: %w", name, errUsage)
+	}
+	run, err = cmd.parse(fs.Args()[2:])
+	if err != nil {
+		return false, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return asJSON, run, nil
+}
+
+// Main runs the admin command and returns the exit code
+func Main(args []string, stdout, stderr io.Writer) int {
+	if _, _, err := parse(args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) && err != errUsage {
+			fmt.Fprintln(stderr, err)
+		}
+		printUsage(stderr)
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	// the database settings come from the config file and environment
+	cfg, err := config.Load("admin", nil)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	database := db.GormConnectDB(cfg.Database)
+	defer db.Close(database)
+	// changes to the timelines clear a shared cache, a memory cache of the
+	// web app only drops them after the TTL
+	timelines, err := cache.FromConfig(cfg.Cache, database)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if err := Run(database, timelines, args, stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Run runs the command in args on database and writes the result to
+// stdout, timelines may be nil
+func Run(database *gorm.DB, timelines *cache.Timelines, args []string, stdout io.Writer) error {
+	asJSON, run, err := parse(args)
+	if err != nil {
+		return err
+	}
+	return run(&env{db: database, timelines: timelines, out: stdout, json: asJSON})
+}
+
+// flags parses the flags of a command, it expects nargs positional
+// arguments, or at least one if nargs is -1
+func flags(args []string, nargs int, define func(fs *flag.FlagSet)) ([]string, error) {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if define != nil {
+		define(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("%v: %w", err, errUsage)
+	}
+	if (nargs >= 0 && fs.NArg() != nargs) || (nargs < 0 && fs.NArg() == 0) {
+		return nil, fmt.Errorf("wrong number of arguments: %w", errUsage)
+	}
+	return fs.Args(), nil
+}
+
+// write prints rows as an aligned table, or v as JSON with -json
+func (e *env) write(v any, header []string, rows [][]string) error {
+	if e.json {
+		enc := json.NewEncoder(e.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(e.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
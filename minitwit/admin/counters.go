@@ -0,0 +1,64 @@
+package admin
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"minitwit/db"
+)
+
+func recountUsers(args []string) (action, error) {
+	var fix bool
+	var limit int
+	if _, err := flags(args, 0, func(fs *flag.FlagSet) {
+		fs.BoolVar(&fix, "fix", false, "")
+		fs.IntVar(&limit, "limit", 20, "")
+	}); err != nil {
+		return nil, err
+	}
+	return func(e *env) error {
+		drift, err := db.QueryCounterDrift(e.db, limit)
+		if err != nil {
+			return err
+		}
+		var fixed int64
+		if fix && len(drift) > 0 {
+			if fixed, err = db.FixCounters(e.db); err != nil {
+				return err
+			}
+		}
+		if e.json {
+			return e.write(struct {
+				Users []db.CounterDrift `json:"users"`
+				Fixed int64             `json:"fixed"`
+			}{drift, fixed}, nil, nil)
+		}
+		if len(drift) == 0 {
+			fmt.Fprintln(e.out, "the counters of all users are right")
+			return nil
+		}
+		rows := make([][]string, len(drift))
+		for i, d := range drift {
+			rows[i] = []string{strconv.Itoa(d.UserID), d.Username,
+				counter(d.Follower_count, d.Followers), counter(d.Following_count, d.Following), counter(d.Message_count, d.Messages)}
+		}
+		if err := e.write(nil, []string{"ID", "USERNAME", "FOLLOWERS", "FOLLOWING", "MESSAGES"}, rows); err != nil {
+			return err
+		}
+		if fix {
+			fmt.Fprintf(e.out, "\ncorrected the counters of %d users\n", fixed)
+		} else {
+			fmt.Fprintln(e.out, "\nrerun with -fix to correct the counters")
+		}
+		return nil
+	}, nil
+}
+
+// counter shows a stored counter and the count of the table if they differ
+func counter(stored, counted int64) string {
+	if stored == counted {
+		return strconv.FormatInt(stored, 10)
+	}
+	return fmt.Sprintf("%d (is %d)", stored, counted)
+}
@@ -0,0 +1,64 @@
+package admin
+
+import (
+	"flag"
+	"strconv"
+	"time"
+
+	"minitwit/db"
+	"minitwit/service"
+)
+
+type failedLoginRow struct {
+	Time      string `json:"time"`
+	Username  string `json:"username"`
+	UserID    int    `json:"user_id,omitempty"`
+	IP        string `json:"ip"`
+	Reason    string `json:"reason"`
+	Cleared   bool   `json:"cleared"`
+	UserAgent string `json:"user_agent"`
+}
+
+func listFailedLogins(args []string) (action, error) {
+	var user, ip string
+	var limit int
+	if _, err := flags(args, 0, func(fs *flag.FlagSet) {
+		fs.StringVar(&user, "user", "", "")
+		fs.StringVar(&ip, "ip", "", "")
+		fs.IntVar(&limit, "limit", 50, "")
+	}); err != nil {
+		return nil, err
+	}
+	return func(e *env) error {
+		failures, err := db.QueryFailedLogins(e.db, user, ip, limit)
+		if err != nil {
+			return err
+		}
+		result := make([]failedLoginRow, len(failures))
+		rows := make([][]string, len(failures))
+		for i, f := range failures {
+			at := time.Unix(f.Created_at, 0).UTC().Format(time.RFC3339)
+			result[i] = failedLoginRow{at, f.Username, f.User_id, f.IP, f.Reason, f.Cleared, f.User_agent}
+			rows[i] = []string{at, f.Username, f.IP, f.Reason, strconv.FormatBool(f.Cleared), shorten(f.User_agent, 40)}
+		}
+		return e.write(result, []string{"TIME", "USERNAME", "IP", "REASON", "CLEARED", "USER AGENT"}, rows)
+	}, nil
+}
+
+func unlockLogins(args []string) (action, error) {
+	args, err := flags(args, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	return func(e *env) error {
+		cleared, err := service.ClearFailedLogins(e.db, args[0])
+		if err != nil {
+			return err
+		}
+		result := struct {
+			Username string `json:"username"`
+			Cleared  int    `json:"cleared"`
+		}{args[0], len(cleared)}
+		return e.write(result, []string{"USERNAME", "CLEARED"}, [][]string{{args[0], strconv.Itoa(len(cleared))}})
+	}, nil
+}
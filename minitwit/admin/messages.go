@@ -0,0 +1,140 @@
+package admin
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"minitwit/db"
+	"minitwit/service"
+)
+
+type messageRow struct {
+	ID      int    `json:"id"`
+	Author  string `json:"author"`
+	PubDate string `json:"pub_date"`
+	Flagged bool   `json:"flagged"`
+	Text    string `json:"text"`
+}
+
+// shorten keeps table rows on one line
+func shorten(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+func listMessages(args []string) (action, error) {
+	var user string
+	var flagged bool
+	var limit int
+	if _, err := flags(args, 0, func(fs *flag.FlagSet) {
+		fs.StringVar(&user, "user", "", "")
+		fs.BoolVar(&flagged, "flagged", false, "")
+		fs.IntVar(&limit, "limit", 20, "")
+	}); err != nil {
+		return nil, err
+	}
+	return func(e *env) error {
+		messages, err := db.QueryMessagesForReview(e.db, user, flagged, limit)
+		if err != nil {
+			return err
+		}
+		result := make([]messageRow, len(messages))
+		rows := make([][]string, len(messages))
+		for i, m := range messages {
+			result[i] = messageRow{m.Message_id, m.Author, m.PubDate, m.Flagged != 0, m.Text}
+			rows[i] = []string{strconv.Itoa(m.Message_id), m.Author, m.PubDate, strconv.FormatBool(m.Flagged != 0), shorten(m.Text, 60)}
+		}
+		return e.write(result, []string{"ID", "AUTHOR", "DATE", "FLAGGED", "TEXT"}, rows)
+	}, nil
+}
+
+func setFlagged(args []string, flagged bool) (action, error) {
+	args, err := flags(args, -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(args))
+	for i, arg := range args {
+		if ids[i], err = strconv.Atoi(arg); err != nil {
+			return nil, fmt.Errorf("%q is not a message id: %w", arg, errUsage)
+		}
+	}
+	return func(e *env) error {
+		updated, err := db.SetMessagesFlagged(e.db, ids, flagged)
+		if err != nil {
+			return err
+		}
+		e.timelines.Clear(context.Background())
+		if updated == 0 {
+			return service.ErrMessageNotFound
+		}
+		result := struct {
+			Updated int64 `json:"updated"`
+			Flagged bool  `json:"flagged"`
+		}{updated, flagged}
+		return e.write(result, []string{"UPDATED", "FLAGGED"}, [][]string{{strconv.FormatInt(updated, 10), strconv.FormatBool(flagged)}})
+	}, nil
+}
+
+func flagMessages(args []string) (action, error) {
+	return setFlagged(args, true)
+}
+
+func unflagMessages(args []string) (action, error) {
+	return setFlagged(args, false)
+}
+
+func recountFollowers(args []string) (action, error) {
+	var fix bool
+	var limit int
+	if _, err := flags(args, 0, func(fs *flag.FlagSet) {
+		fs.BoolVar(&fix, "fix", false, "")
+		fs.IntVar(&limit, "limit", 20, "")
+	}); err != nil {
+		return nil, err
+	}
+	return func(e *env) error {
+		// follows of deleted users are counted by nobody, -fix removes them
+		dangling, err := db.CountDanglingFollows(e.db)
+		if err != nil {
+			return err
+		}
+		if fix && dangling > 0 {
+			if dangling, err = db.DeleteDanglingFollows(e.db); err != nil {
+				return err
+			}
+		}
+
+		counts, err := db.QueryFollowCounts(e.db, limit)
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.write(struct {
+				Users    []db.FollowCount `json:"users"`
+				Dangling int64            `json:"dangling_follows"`
+				Removed  bool             `json:"dangling_removed"`
+			}{counts, dangling, fix && dangling > 0}, nil, nil)
+		}
+		rows := make([][]string, len(counts))
+		for i, c := range counts {
+			rows[i] = []string{strconv.Itoa(c.UserID), c.Username, strconv.FormatInt(c.Followers, 10), strconv.FormatInt(c.Following, 10)}
+		}
+		if err := e.write(nil, []string{"ID", "USERNAME", "FOLLOWERS", "FOLLOWING"}, rows); err != nil {
+			return err
+		}
+		switch {
+		case dangling == 0:
+		case fix:
+			fmt.Fprintf(e.out, "\nremoved %d follows of deleted users\n", dangling)
+		default:
+			fmt.Fprintf(e.out, "\n%d follows of deleted users, rerun with -fix to remove them\n", dangling)
+		}
+		return nil
+	}, nil
+}
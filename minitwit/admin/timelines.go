@@ -0,0 +1,31 @@
+package admin
+
+import (
+	"context"
+	"flag"
+	"strconv"
+
+	"minitwit/config"
+	"minitwit/fanout"
+)
+
+func rebuildTimelines(args []string) (action, error) {
+	cfg := config.Default().Timeline
+	if _, err := flags(args, 0, func(fs *flag.FlagSet) {
+		fs.IntVar(&cfg.MaxFollowers, "max-followers", cfg.MaxFollowers, "")
+		fs.IntVar(&cfg.Backfill, "backfill", cfg.Backfill, "")
+	}); err != nil {
+		return nil, err
+	}
+	return func(e *env) error {
+		entries, err := fanout.Rebuild(e.db, cfg)
+		if err != nil {
+			return err
+		}
+		e.timelines.Clear(context.Background())
+		result := struct {
+			Entries int64 `json:"entries"`
+		}{entries}
+		return e.write(result, []string{"ENTRIES"}, [][]string{{strconv.FormatInt(entries, 10)}})
+	}, nil
+}
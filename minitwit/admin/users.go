@@ -0,0 +1,219 @@
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"minitwit/db"
+	"minitwit/models"
+	"minitwit/service"
+)
+
+type userRow struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Disabled bool   `json:"disabled"`
+	// only set when the password was generated
+	Password string `json:"password,omitempty"`
+}
+
+func (e *env) writeUsers(users []userRow) error {
+	header := []string{"ID", "USERNAME", "EMAIL", "DISABLED"}
+	withPassword := len(users) > 0 && users[0].Password != ""
+	if withPassword {
+		header = append(header, "PASSWORD")
+	}
+	rows := make([][]string, len(users))
+	for i, u := range users {
+		rows[i] = []string{strconv.Itoa(u.ID), u.Username, u.Email, strconv.FormatBool(u.Disabled)}
+		if withPassword {
+			rows[i] = append(rows[i], u.Password)
+		}
+	}
+	return e.write(users, header, rows)
+}
+
+func toRow(user *models.User) userRow {
+	return userRow{ID: user.User_id, Username: user.Username, Email: user.Email, Disabled: user.Disabled}
+}
+
+// lookup finds a local user by username
+func (e *env) lookup(username string) (*models.User, error) {
+	user, err := models.GetUserByUsername(e.db, username)
+	if err != nil {
+		return nil, fmt.Errorf("user %q: %w", username, service.ErrUserNotFound)
+	}
+	return user, nil
+}
+
+// generatePassword returns a random password that is shown once
+func generatePassword() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func listUsers(args []string) (action, error) {
+	var disabled bool
+	var limit int
+	if _, err := flags(args, 0, func(fs *flag.FlagSet) {
+		fs.BoolVar(&disabled, "disabled", false, "")
+		fs.IntVar(&limit, "limit", 50, "")
+	}); err != nil {
+		return nil, err
+	}
+	return func(e *env) error {
+		users, err := db.QueryUsers(e.db, disabled, limit)
+		if err != nil {
+			return err
+		}
+		rows := make([]userRow, len(users))
+		for i := range users {
+			rows[i] = toRow(&users[i])
+		}
+		return e.writeUsers(rows)
+	}, nil
+}
+
+func createUser(args []string) (action, error) {
+	var password string
+	args, err := flags(args, 2, func(fs *flag.FlagSet) {
+		fs.StringVar(&password, "password", "", "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(e *env) error {
+		generated := password == ""
+		if generated {
+			if password, err = generatePassword(); err != nil {
+				return err
+			}
+		}
+		user, err := service.RegisterVerifiedUser(e.db, args[0], args[1], password)
+		if err != nil {
+			return err
+		}
+		row := toRow(user)
+		if generated {
+			row.Password = password
+		}
+		return e.writeUsers([]userRow{row})
+	}, nil
+}
+
+func setDisabled(args []string, disabled bool) (action, error) {
+	args, err := flags(args, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	return func(e *env) error {
+		user, err := e.lookup(args[0])
+		if err != nil {
+			return err
+		}
+		if err := db.SetUserDisabled(e.db, user.User_id, disabled); err != nil {
+			return err
+		}
+		user.Disabled = disabled
+		return e.writeUsers([]userRow{toRow(user)})
+	}, nil
+}
+
+func disableUser(args []string) (action, error) {
+	return setDisabled(args, true)
+}
+
+func enableUser(args []string) (action, error) {
+	return setDisabled(args, false)
+}
+
+func deleteUser(args []string) (action, error) {
+	args, err := flags(args, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	return func(e *env) error {
+		user, err := e.lookup(args[0])
+		if err != nil {
+			return err
+		}
+		deleted, err := db.DeleteUser(e.db, user.User_id)
+		if err != nil {
+			return err
+		}
+		e.timelines.Clear(context.Background())
+		result := struct {
+			userRow
+			Messages int64 `json:"deleted_messages"`
+			Follows  int64 `json:"deleted_follows"`
+		}{toRow(user), deleted.Messages, deleted.Follows}
+		return e.write(result, []string{"ID", "USERNAME", "DELETED MESSAGES", "DELETED FOLLOWS"}, [][]string{{
+			strconv.Itoa(user.User_id), user.Username, strconv.FormatInt(deleted.Messages, 10), strconv.FormatInt(deleted.Follows, 10),
+		}})
+	}, nil
+}
+
+func renameUser(args []string) (action, error) {
+	args, err := flags(args, 2, nil)
+	if err != nil {
+		return nil, err
+	}
+	newName := args[1]
+	if newName == "" {
+		return nil, &service.ValidationError{Msg: "You have to enter a username"}
+	}
+	return func(e *env) error {
+		user, err := e.lookup(args[0])
+		if err != nil {
+			return err
+		}
+		if _, err := db.GormGetUserId(e.db, newName); err == nil {
+			return fmt.Errorf("%q: %w", newName, service.ErrUsernameTaken)
+		}
+		if err := db.RenameUser(e.db, user.User_id, newName); err != nil {
+			return err
+		}
+		// the cached messages carry the old name
+		e.timelines.Clear(context.Background())
+		user.Username = newName
+		return e.writeUsers([]userRow{toRow(user)})
+	}, nil
+}
+
+func resetPassword(args []string) (action, error) {
+	var password string
+	args, err := flags(args, 1, func(fs *flag.FlagSet) {
+		fs.StringVar(&password, "password", "", "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(e *env) error {
+		user, err := e.lookup(args[0])
+		if err != nil {
+			return err
+		}
+		generated := password == ""
+		if generated {
+			if password, err = generatePassword(); err != nil {
+				return err
+			}
+		}
+		if err := service.SetPassword(e.db, user.User_id, password); err != nil {
+			return err
+		}
+		row := toRow(user)
+		if generated {
+			row.Password = password
+		}
+		return e.writeUsers([]userRow{row})
+	}, nil
+}
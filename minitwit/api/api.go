@@ -1,37 +1,73 @@
-package main
+package api
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
+	"minitwit/apiv2"
+	"minitwit/config"
 	"minitwit/db"
+	"minitwit/health"
+	"minitwit/logging"
+	"minitwit/metrics"
 	"minitwit/middleware"
-	"minitwit/models"
+	"minitwit/service"
+	"minitwit/tracing"
+	"minitwit/utils"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gorm.io/gorm"
 )
 
 var noUserFoundError = "User not found."
 var DecodeError = "Failed to decode request body."
 var dbInsertError = "Failed to insert in database."
+var notAuthorizedError = "You are not authorized to access this resource!"
+var dbReadError = "Failed to load messages."
+var dbFollowsReadError = "Failed to load follows."
+var dbDeleteError = "Failed to delete from database."
+var followOrUnfollowError = "Either follow or unfollow must be given."
+var rateLimitedError = "Too many requests, retry after the time in Retry-After."
+
+// messageTypes are the message_type label values of the known error
+// messages. Messages can contain user input, so they are never used as
+// label values themselves.
+var messageTypes = map[string]string{
+	noUserFoundError:      "user_not_found",
+	DecodeError:           "decode_error",
+	dbInsertError:         "db_insert_error",
+	notAuthorizedError:    "not_authorized",
+	dbReadError:           "db_read_error",
+	dbFollowsReadError:    "db_read_error",
+	dbDeleteError:         "db_delete_error",
+	followOrUnfollowError: "invalid_request",
+	rateLimitedError:      "rate_limited",
+	errKeyInProgress:      "idempotency_key_in_progress",
+	errKeyReused:          "idempotency_key_reused",
+}
+
+func messageType(code int, message string) string {
+	if t, ok := messageTypes[message]; ok {
+		return t
+	}
+	// validation errors of the spec and the service layer
+	if code == http.StatusBadRequest {
+		return "invalid_request"
+	}
+	return "internal_error"
+}
 
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	response := map[string]any{"status": code, "error_msg": message}
-	middleware.RecordResponseMessage(code, message)
+	response := ErrorResponse{Status: code, ErrorMsg: message}
+	middleware.RecordResponseMessage(code, messageType(code, message))
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Failed to encode error response: %v", err)
+		slog.Error("Failed to encode error response", "err", err)
 	}
 }
 
@@ -39,116 +75,105 @@ func respondWithSuccess(w http.ResponseWriter, code int, payload any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	if err := json.NewEncoder(w).Encode(payload); err != nil {
-		log.Printf("Failed to encode success response: %v", err)
+		slog.Error("Failed to encode success response", "err", err)
 	}
 }
 
-func notReqFromSimulator(w http.ResponseWriter, r *http.Request) bool {
+func notReqFromSimulator(w http.ResponseWriter, r *http.Request, cfg *config.Config) bool {
 	fromSimulator := r.Header.Get("Authorization")
-	if fromSimulator != "Basic c2ltdWxhdG9yOnN1cGVyX3NhZmUh" {
-		respondWithError(w, http.StatusForbidden, "You are not authorized to access this resource!")
+	if fromSimulator != cfg.Simulator.Authorization() {
+		respondWithError(w, http.StatusForbidden, notAuthorizedError)
 		return true
 	}
 	return false
 }
 
-func updateLatest(r *http.Request) {
-	// Get arg value associated with 'latest' & convert to int
-	parsedCommandId := r.FormValue("latest")
-	if parsedCommandId != "-1" && parsedCommandId != "" {
-		//f, err := os.OpenFile("./latest_processed_sim_action_id.txt", os.O_WRONLY, os.)//, os.ModeAppend)
-		f, err := os.Create("./latest_processed_sim_action_id.txt")
-		if err != nil {
-			log.Fatalf("Failed to read latest_id file: %v", err)
-		}
+// LatestFile stores the id of the latest processed simulator action, it
+// is the path set by api.latest_file
+type LatestFile string
 
-		//this returns an int as well, but not sure what its used to signal lol
-		_, err = f.WriteString(parsedCommandId)
-		if err != nil {
-			log.Fatalf("Failed to convert write id to file: %v", err)
-		}
+// Set stores the id of the latest processed simulator action.
+// Empty and -1 mean the request did not carry an id and are ignored.
+func (f LatestFile) Set(parsedCommandId string) error {
+	if parsedCommandId == "-1" || parsedCommandId == "" {
+		return nil
 	}
+	return os.WriteFile(string(f), []byte(parsedCommandId), 0644)
 }
 
-func getLatest(w http.ResponseWriter, r *http.Request) {
-	content, err := os.ReadFile("./latest_processed_sim_action_id.txt")
+// Read returns the id of the latest processed simulator action
+func (f LatestFile) Read() (int, error) {
+	content, err := os.ReadFile(string(f))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to read the latest ID. Try reloading the page and try again.")
-		return
+		return 0, err
 	}
+	return strconv.Atoi(string(content))
+}
 
-	//we need to convert to int, otherwise tests fail
-	latest := string(content)
-	latestInt, err := strconv.Atoi(latest)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to convert string to int.")
-		return
+func updateLatest(latest LatestFile, r *http.Request) {
+	// Get arg value associated with 'latest'
+	if err := latest.Set(r.URL.Query().Get("latest")); err != nil {
+		logging.Fatal("Failed to write latest_id file", "err", err)
 	}
-
-	respondWithSuccess(w, http.StatusOK, map[string]int{"latest": latestInt})
 }
 
-func checkRegisterUserInput(t models.User, database *gorm.DB) string {
-	var erro string = ""
-	if t.Username == "" {
-		erro = "You have to enter a username"
-	} else if t.Email == "" || !strings.ContainsAny(t.Email, "@") {
-		erro = "You have to enter a valid email address"
-	} else if t.Pwd == "" {
-		erro = "You have to enter a password"
-	} else if _, err := db.GormGetUserId(database, t.Username); err == nil {
-		erro = "The username is already taken"
-	}
+func getLatest(latest LatestFile) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		content, err := os.ReadFile(string(latest))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read the latest ID. Try reloading the page and try again.")
+			return
+		}
 
-	return erro
+		//we need to convert to int, otherwise tests fail
+		latestInt, err := strconv.Atoi(string(content))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to convert string to int.")
+			return
+		}
+
+		respondWithSuccess(w, http.StatusOK, LatestResponse{Latest: latestInt})
+	}
 }
 
 func register(database *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		updateLatest(r)
+		database := db.WithContext(database, r.Context())
 
 		//must decode into struct bc data sent as json, which golang bitches abt
 		d := json.NewDecoder(r.Body)
-		var t models.User
+		var t RegisterRequest
 		if err := d.Decode(&t); err != nil {
 			respondWithError(w, http.StatusBadRequest, DecodeError)
 			return
 		}
 
-		var erro string = ""
-		if r.Method == "POST" {
-			erro = checkRegisterUserInput(t, database)
-			//If input ok, register user in db
-			if erro == "" {
-				// hash the password
-				hash := md5.New()
-				hash.Write([]byte(r.Form.Get("pwd")))
-				pwHash := hex.EncodeToString(hash.Sum(nil))
-				// insert the user into the database
-				user := models.User{Username: t.Username, Email: t.Email, PwHash: pwHash}
-				result := database.Create(&user)
-				if result.Error != nil {
-					respondWithError(w, http.StatusInternalServerError, dbInsertError)
-					return
-				}
-			}
+		_, err := service.RegisterSimulatorUser(database, t.Username, t.Email, t.Pwd)
+		var validationErr *service.ValidationError
+		if errors.As(err, &validationErr) || errors.Is(err, service.ErrUsernameTaken) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
 		}
-
-		if erro != "" {
-			respondWithError(w, http.StatusBadRequest, erro)
-		} else {
-			w.WriteHeader(http.StatusCreated) // return 201
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, dbInsertError)
+			return
 		}
+		metrics.UsersRegistered.WithLabelValues(metrics.SourceAPI).Inc()
+		w.WriteHeader(http.StatusCreated) // return 201
 	}
 }
 
+func toMessageResponses(list *service.MessageList) []MessageResponse {
+	filteredMsgs := make([]MessageResponse, 0, len(list.Messages))
+	for _, message := range list.Messages {
+		filteredMsgs = append(filteredMsgs, MessageResponse{Content: message.Text, PubDate: message.Pub_date, User: message.Author})
+	}
+	return filteredMsgs
+}
+
 func messages(database *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		updateLatest(r)
-
-		if notReqFromSimulator(w, r) {
-			return
-		}
+		database := db.WithContext(database, r.Context())
 
 		// no_msgs = request.args.get("no", type=int, default=100)
 		noMsgs, err := strconv.Atoi(r.URL.Query().Get("no"))
@@ -156,27 +181,12 @@ func messages(database *gorm.DB) http.HandlerFunc {
 			noMsgs = 100
 		}
 
-		if r.Method == "GET" {
-			// modified the given API to remove some unnecessary select
-			// might improve performance a bit
-			var users []models.User
-			database.Model(&models.User{}).Preload("Messages", "flagged = 0", func(database *gorm.DB) *gorm.DB {
-				db := database.Order("pub_date DESC")
-				return db
-			}).Limit(noMsgs).Find(&users)
-
-			var filteredMsgs []map[string]any
-			for _, user := range users {
-				for _, message := range user.Messages {
-					filteredMsg := make(map[string]any)
-					filteredMsg["content"] = message.Text
-					filteredMsg["pub_date"] = message.Pub_date
-					filteredMsg["user"] = user.Username
-					filteredMsgs = append(filteredMsgs, filteredMsg)
-				}
-			}
-			respondWithSuccess(w, http.StatusOK, filteredMsgs)
+		list, err := service.ListPublicMessages(database, service.Page{Limit: noMsgs})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, dbReadError)
+			return
 		}
+		respondWithSuccess(w, http.StatusOK, toMessageResponses(list))
 	}
 }
 
@@ -187,55 +197,48 @@ func messagesPerUserGET(w http.ResponseWriter, database *gorm.DB, username strin
 		return
 	}
 
-	var users []models.User
-	database.Model(&models.User{}).Preload("Messages", "flagged = 0", func(database *gorm.DB) *gorm.DB {
-		db := database.Order("pub_date DESC")
-		return db
-	}).Where("user_id = ?", userId).Limit(noMsgs).Find(&users)
-
-	var filteredMsgs []map[string]any
-	for _, user := range users {
-		for _, message := range user.Messages {
-			filteredMsg := make(map[string]any)
-			filteredMsg["content"] = message.Text
-			filteredMsg["pub_date"] = message.Pub_date
-			filteredMsg["user"] = user.Username
-			filteredMsgs = append(filteredMsgs, filteredMsg)
-		}
+	list, err := service.ListUserMessages(database, userId, service.Page{Limit: noMsgs})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, dbReadError)
+		return
 	}
-	respondWithSuccess(w, http.StatusOK, filteredMsgs)
+	respondWithSuccess(w, http.StatusOK, toMessageResponses(list))
 }
 
-func messagesPerUserPOST(w http.ResponseWriter, r *http.Request, database *gorm.DB, username string) {
-	var req map[string]interface{}
+func messagesPerUserPOST(w http.ResponseWriter, r *http.Request, database *gorm.DB, svc *service.Service, username string) {
+	var req MessageRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondWithError(w, http.StatusBadRequest, DecodeError)
 		return
 	}
-	content := req["content"]
 
 	userId, err := db.GormGetUserId(database, username)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, noUserFoundError)
 		return
 	}
-	message := models.Message{Author_id: uint(userId), Text: content.(string), Pub_date: time.Now().Unix()}
 
-	result := database.Create(&message)
-	if result.Error != nil {
+	_, err = svc.PostMessage(database, userId, req.Content)
+	var validationErr *service.ValidationError
+	if errors.As(err, &validationErr) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, service.ErrUnverified) {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, dbInsertError)
 		return
 	}
+	metrics.MessagesPosted.WithLabelValues(metrics.SourceAPI).Inc()
 	w.WriteHeader(204)
 }
 
-func messagesPerUser(database *gorm.DB) http.HandlerFunc {
+func messagesPerUser(database *gorm.DB, svc *service.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		updateLatest(r)
-
-		if notReqFromSimulator(w, r) {
-			return
-		}
+		database := db.WithContext(database, r.Context())
 
 		vars := mux.Vars(r)
 		username := vars["username"]
@@ -248,12 +251,12 @@ func messagesPerUser(database *gorm.DB) http.HandlerFunc {
 			messagesPerUserGET(w, database, username, noMsgs)
 
 		} else if r.Method == "POST" {
-			messagesPerUserPOST(w, r, database, username)
+			messagesPerUserPOST(w, r, database, svc, username)
 		}
 	}
 }
 
-func followUser(database *gorm.DB, w http.ResponseWriter, curUserId int, toFollowUsername string) {
+func followUser(database *gorm.DB, svc *service.Service, w http.ResponseWriter, curUserId int, toFollowUsername string) {
 	followsUsername := toFollowUsername
 	followsUserId, err := db.GormGetUserId(database, followsUsername)
 	if err != nil {
@@ -261,16 +264,20 @@ func followUser(database *gorm.DB, w http.ResponseWriter, curUserId int, toFollo
 		return
 	}
 
-	follower := models.Follower{Who_id: curUserId, Whom_id: followsUserId}
-	result := database.Create(&follower)
-	if result.Error != nil {
+	// following twice or oneself is not an error for the simulator, it
+	// got 204 for both before the service checked them
+	err = svc.Follow(database, curUserId, followsUserId)
+	if err != nil && !errors.Is(err, service.ErrAlreadyFollowing) && !errors.Is(err, service.ErrFollowSelf) {
 		respondWithError(w, http.StatusInternalServerError, dbInsertError)
 		return
 	}
+	if err == nil {
+		metrics.Follows.WithLabelValues(metrics.SourceAPI).Inc()
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func unfollowUser(database *gorm.DB, w http.ResponseWriter, curUserId int, toUnfollowUsername string) {
+func unfollowUser(database *gorm.DB, svc *service.Service, w http.ResponseWriter, curUserId int, toUnfollowUsername string) {
 	unfollowsUsername := toUnfollowUsername
 	unfollowsUserId, err := db.GormGetUserId(database, unfollowsUsername)
 	if err != nil {
@@ -278,36 +285,37 @@ func unfollowUser(database *gorm.DB, w http.ResponseWriter, curUserId int, toUnf
 		return
 	}
 
-	err = database.Where("who_id=? AND whom_id=?", curUserId, unfollowsUserId).Delete(&models.Follower{}).Error
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to delete from database.")
+	err = svc.Unfollow(database, curUserId, unfollowsUserId)
+	if err != nil && !errors.Is(err, service.ErrNotFollowing) {
+		respondWithError(w, http.StatusInternalServerError, dbDeleteError)
 		return
 	}
+	if err == nil {
+		metrics.Unfollows.WithLabelValues(metrics.SourceAPI).Inc()
+	}
 	w.WriteHeader(http.StatusNoContent)
 
 }
 
-func getFollowers(database *gorm.DB, w http.ResponseWriter, curUserId int, noMsgs int) {
-	var users []models.User
-	database.Model(&models.User{}).Preload("Followers").Where("user_id=?", curUserId).Limit(noMsgs).Find(&users)
+// getFollows lists the users curUserId follows. The simulator protocol
+// calls them followers, /api/v2/users/{user}/followers has the other way.
+func getFollows(database *gorm.DB, w http.ResponseWriter, curUserId int, noMsgs int) {
+	list, err := service.ListFollowing(database, curUserId, service.Page{Limit: noMsgs})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, dbFollowsReadError)
+		return
+	}
 
-	var followerNames []string
-	for _, user := range users {
-		for _, follows := range user.Followers {
-			followerNames = append(followerNames, follows.Username)
-		}
+	names := make([]string, 0, len(list.Users))
+	for _, follows := range list.Users {
+		names = append(names, follows.Username)
 	}
-	followersResponse := map[string]any{"follows": followerNames}
-	respondWithSuccess(w, http.StatusOK, followersResponse)
+	respondWithSuccess(w, http.StatusOK, FollowsResponse{Follows: names})
 }
 
-func follow(database *gorm.DB) http.HandlerFunc {
+func follow(database *gorm.DB, svc *service.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		updateLatest(r)
-
-		if notReqFromSimulator(w, r) {
-			return
-		}
+		database := db.WithContext(database, r.Context())
 
 		vars := mux.Vars(r)
 		username := vars["username"]
@@ -322,49 +330,77 @@ func follow(database *gorm.DB) http.HandlerFunc {
 			noMsgs = 100
 		}
 
-		var req map[string]string
+		if r.Method == "GET" {
+			getFollows(database, w, userId, noMsgs)
+			return
+		}
+
+		// only POST requests have a body
+		var req FollowRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			respondWithError(w, http.StatusBadRequest, DecodeError)
 			return
 		}
 
-		if r.Method == "POST" && req["follow"] != "" {
-			followsUsername := req["follow"]
-			followUser(database, w, userId, followsUsername)
-
-		} else if r.Method == "POST" && req["unfollow"] != "" {
-			unfollowsUsername := req["unfollow"]
-			unfollowUser(database, w, userId, unfollowsUsername)
-
-		} else if r.Method == "GET" {
-			getFollowers(database, w, userId, noMsgs)
+		if req.Follow != "" {
+			followUser(database, svc, w, userId, req.Follow)
+		} else if req.Unfollow != "" {
+			unfollowUser(database, svc, w, userId, req.Unfollow)
+		} else {
+			respondWithError(w, http.StatusBadRequest, followOrUnfollowError)
 		}
 	}
 }
 
-func main() {
-	// Db logic
-	//this MUST be called, otherwise tests fail
-	//seems grom cant read already existing database w/out migration stuff
-	db.AutoMigrateDB()
-	gormDB := db.GormConnectDB()
+// rateLimited answers in the error format of the API the request is for,
+// API v2 shares the router
+func rateLimited(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, apiv2.Prefix+"/") {
+		apiv2.RateLimited(w, r)
+		return
+	}
+	respondWithError(w, http.StatusTooManyRequests, rateLimitedError)
+}
+
+// NewRouter sets up the simulator API routes
+func NewRouter(gormDB *gorm.DB, cfg *config.Config, svc *service.Service) *mux.Router {
+	spec, err := LoadSpec()
+	if err != nil {
+		logging.Fatal("Invalid OpenAPI document", "err", err)
+	}
+
+	rateLimit, err := middleware.RateLimit(gormDB, cfg, rateLimited)
+	if err != nil {
+		logging.Fatal("Invalid rate limit rules", "err", err)
+	}
 
 	r := mux.NewRouter()
 
 	// Middleware
+	r.Use(middleware.RequestID)
+	r.Use(tracing.Middleware)
 	r.Use(middleware.PrometheusMiddleware)
+	r.Use(utils.TrustProxies(cfg.Server.ClientIPHeader, cfg.Server.TrustedProxies))
+	r.Use(rateLimit)
+	// unauthorized requests get 403 whatever their body, the simulator's
+	// get latest recorded even if they are invalid
+	r.Use(requireSimulator(spec, cfg))
+	r.Use(trackLatest(spec, LatestFile(cfg.API.LatestFile)))
+	r.Use(validateRequests(spec))
+	r.Use(idempotentWrites(gormDB, cfg.API.IdempotencyTTL, cfg.API.LatestRetryTTL))
 
 	// expose metrics
-	r.Handle("/metrics", promhttp.Handler())
+	r.Handle("/metrics", middleware.MetricsHandler())
+	r.HandleFunc("/openapi.json", openAPIHandler).Methods("GET")
+	r.HandleFunc("/healthz", health.Liveness()).Methods("GET")
+	r.HandleFunc("/readyz", health.Readiness(gormDB)).Methods("GET")
 
 	// Define routes
 	r.HandleFunc("/register", register(gormDB)).Methods("POST")
-	r.HandleFunc("/latest", getLatest).Methods("GET")
+	r.HandleFunc("/latest", getLatest(LatestFile(cfg.API.LatestFile))).Methods("GET")
 	r.HandleFunc("/msgs", messages(gormDB)).Methods("GET")
-	r.HandleFunc("/msgs/{username}", messagesPerUser(gormDB)).Methods("GET", "POST")
-	r.HandleFunc("/fllws/{username}", follow(gormDB)).Methods("GET", "POST")
+	r.HandleFunc("/msgs/{username}", messagesPerUser(gormDB, svc)).Methods("GET", "POST")
+	r.HandleFunc("/fllws/{username}", follow(gormDB, svc)).Methods("GET", "POST")
 
-	// Start the server
-	fmt.Println("API is running on http://localhost:8081")
-	log.Fatal(http.ListenAndServe(":8081", r))
+	return r
 }
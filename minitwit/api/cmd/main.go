@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"minitwit/api"
+	"minitwit/apiv2"
+	"minitwit/cache"
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/fanout"
+	"minitwit/federation"
+	"minitwit/grpcapi"
+	"minitwit/jobs"
+	"minitwit/logging"
+	"minitwit/metrics"
+	"minitwit/server"
+	"minitwit/service"
+	"minitwit/tracing"
+	"minitwit/worker"
+
+	"google.golang.org/grpc"
+)
+
+func main() {
+	cfg := config.MustLoad("minitwit-api", os.Args[1:])
+	logging.Setup(cfg.Log)
+	slog.Info("Configuration loaded", "config", cfg)
+	shutdownTracing, err := tracing.Setup(context.Background(), "minitwit-api")
+	if err != nil {
+		logging.Fatal("Failed to set up tracing", "err", err)
+	}
+
+	// Db logic
+	//this MUST be called, otherwise tests fail
+	//seems grom cant read already existing database w/out migration stuff
+	db.AutoMigrateDB(cfg.Database)
+	gormDB := db.GormConnectDB(cfg.Database)
+	if err := metrics.RegisterDB(gormDB); err != nil {
+		slog.Error("Failed to register database metrics", "err", err)
+	}
+	svc := service.New(cfg)
+	// the API does not read timelines, it only drops the stale ones of a
+	// shared cache. It cannot reach the memory caches of the web replicas,
+	// which would serve old timelines until the TTL.
+	if cfg.Cache.Enabled && cfg.Cache.Backend != cache.BackendPostgres {
+		logging.Fatal("The API needs the postgres cache backend to drop the timelines it changes", "backend", cfg.Cache.Backend)
+	}
+	svc.Timelines, err = cache.FromConfig(cfg.Cache, gormDB)
+	if err != nil {
+		logging.Fatal("Failed to set up the timeline cache", "err", err)
+	}
+	queue, err := jobs.FromConfig(cfg.Jobs, gormDB)
+	if err != nil {
+		logging.Fatal("Failed to set up the job queue", "err", err)
+	}
+	svc.Fanout = fanout.FromConfig(gormDB, cfg.Timeline, queue, svc.Timelines.MessagePosted)
+	// only deliver messages, the web app serves the ActivityPub endpoints
+	svc.Federation = federation.NewFromConfig(gormDB, cfg.Federation, svc.Timelines, svc.Fanout, queue)
+	stopJobs := func() {}
+	if cfg.Jobs.Embedded {
+		stopJobs = worker.NewPool(cfg.Jobs, queue, svc.Fanout, svc.Federation).Start()
+	}
+
+	r := api.NewRouter(gormDB, cfg, svc)
+	apiv2.Register(r, gormDB, svc)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// gRPC for internal services
+	lis, err := net.Listen("tcp", cfg.API.GRPCAddr)
+	if err != nil {
+		logging.Fatal("Failed to listen for gRPC", "err", err)
+	}
+	grpcServer := grpcapi.NewServer(gormDB, cfg, svc)
+	go func() {
+		slog.Info("gRPC is running", "addr", cfg.API.GRPCAddr)
+		if err := grpcServer.Serve(lis); err != nil {
+			logging.Fatal("gRPC server stopped", "err", err)
+		}
+	}()
+
+	// Start the server, SIGTERM drains the open requests
+	opts := server.FromConfig(cfg.API.Addr, cfg.Server)
+	slog.Info("API is running", "addr", opts.Addr, "tls", opts.TLSCert != "")
+	if err := server.New(r, opts).Run(ctx); err != nil {
+		slog.Error("Server stopped", "err", err)
+	}
+	stopGRPC(grpcServer, opts.ShutdownTimeout)
+	stopJobs()
+
+	// metrics are scraped, only the buffered spans need flushing
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Failed to flush traces", "err", err)
+	}
+	if err := db.Close(gormDB); err != nil {
+		slog.Error("Failed to close the database pool", "err", err)
+	}
+	slog.Info("API stopped")
+}
+
+// stopGRPC waits for the open calls, timeline streams may take longer
+// than the timeout and are cancelled
+func stopGRPC(s *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.Stop()
+	}
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"minitwit/db"
+	"minitwit/models"
+	"minitwit/utils"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errKeyInProgress = "A request with this Idempotency-Key is still being processed."
+	errKeyReused     = "The Idempotency-Key was already used for a different request."
+)
+
+// idempotencyKey returns the key identifying a write and the fingerprint of
+// the request. Keys belong to the credentials of the request, so nobody can
+// answer the retries of another client. Without an Idempotency-Key header the
+// latest action id of the simulator is used. The simulator restarts its
+// counter on every run, so the fingerprint is part of that key and only
+// identical requests are replayed, and only for a short time.
+func idempotencyKey(r *http.Request, body []byte) (key string, fingerprint string, latest bool) {
+	sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+	fingerprint = hex.EncodeToString(sum[:])
+	credentials := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	owner := hex.EncodeToString(credentials[:8])
+
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return "key:" + owner + ":" + key, fingerprint, false
+	}
+	if latest := r.URL.Query().Get("latest"); latest != "" && latest != "-1" {
+		return "latest:" + owner + ":" + latest + ":" + fingerprint, fingerprint, true
+	}
+	return "", fingerprint, false
+}
+
+// reservationLease is how long a request holds its key. An older record
+// without a response was left by a request that never finished, like on a
+// replica that died, and the next request with the key takes it over.
+const reservationLease = time.Minute
+
+// keySweepInterval is how often expired keys are deleted from the table
+const keySweepInterval = time.Minute
+
+// idempotencyKeys keeps the reserved keys and the stored responses in the
+// idempotency_keys table, so retries hitting another replica are replayed too
+type idempotencyKeys struct {
+	db *gorm.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// reserve stores an in-progress record for key that expires after ttl. It
+// returns the existing record if the key is already taken.
+func (k *idempotencyKeys) reserve(database *gorm.DB, key, fingerprint string, ttl time.Duration) (*models.IdempotencyKey, error) {
+	now := time.Now()
+	if err := k.sweep(database, now); err != nil {
+		return nil, err
+	}
+
+	record := models.IdempotencyKey{Key: key, Fingerprint: fingerprint, Created_at: now.Unix(), Expires_at: now.Add(ttl).Unix()}
+	result := database.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return nil, nil
+	}
+
+	// expired keys and abandoned reservations can be used again
+	result = database.Model(&models.IdempotencyKey{}).
+		Where("key = ? AND (expires_at < ? OR (status = 0 AND created_at < ?))", key, now.Unix(), now.Add(-reservationLease).Unix()).
+		Updates(map[string]any{
+			"fingerprint":  fingerprint,
+			"status":       0,
+			"content_type": "",
+			"body":         nil,
+			"created_at":   record.Created_at,
+			"expires_at":   record.Expires_at,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return nil, nil
+	}
+
+	var existing models.IdempotencyKey
+	if err := database.Where("key = ?", key).First(&existing).Error; err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+// release deletes the reservation of key, so a retry runs the request again
+func (k *idempotencyKeys) release(database *gorm.DB, key string) error {
+	return database.Where("key = ?", key).Delete(&models.IdempotencyKey{}).Error
+}
+
+// sweep deletes the expired keys, at most once a minute per replica
+func (k *idempotencyKeys) sweep(database *gorm.DB, now time.Time) error {
+	k.mu.Lock()
+	if now.Sub(k.lastSweep) < keySweepInterval {
+		k.mu.Unlock()
+		return nil
+	}
+	k.lastSweep = now
+	k.mu.Unlock()
+	return database.Where("expires_at < ?", now.Unix()).Delete(&models.IdempotencyKey{}).Error
+}
+
+// idempotentWrites makes POST requests safe to retry. The first successful
+// response for a key is stored and sent again for retries within ttl, or
+// latestTTL for keys made of the latest id.
+func idempotentWrites(database *gorm.DB, ttl, latestTTL time.Duration) func(http.Handler) http.Handler {
+	keys := &idempotencyKeys{db: database}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, DecodeError)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			key, fingerprint, latest := idempotencyKey(r, body)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			database := db.WithContext(database, r.Context())
+			keyTTL := ttl
+			if latest {
+				keyTTL = latestTTL
+			}
+			existing, err := keys.reserve(database, key, fingerprint, keyTTL)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to reserve idempotency key", "err", err)
+				respondWithError(w, http.StatusInternalServerError, "Failed to check the Idempotency-Key.")
+				return
+			}
+			if existing != nil {
+				replay(w, existing, fingerprint)
+				return
+			}
+
+			// the outcome is stored even if the client went away, a retry
+			// is what it is kept for
+			finish := db.WithContext(keys.db, context.WithoutCancel(r.Context()))
+			defer func() {
+				if p := recover(); p != nil {
+					if err := keys.release(finish, key); err != nil {
+						slog.ErrorContext(r.Context(), "Failed to release idempotency key", "err", err)
+					}
+					panic(p)
+				}
+			}()
+
+			// keep a copy of the response so it can be replayed
+			rec := utils.NewStatusRecorder(w)
+			rec.Body = &bytes.Buffer{}
+			next.ServeHTTP(rec, r)
+
+			// errors may not happen again, like a follow of a user that is
+			// registered by now, let the retry run
+			if rec.Status >= http.StatusBadRequest {
+				err = keys.release(finish, key)
+			} else {
+				err = finish.Model(&models.IdempotencyKey{}).Where("key = ?", key).Updates(map[string]any{
+					"status":       rec.Status,
+					"content_type": rec.Header().Get("Content-Type"),
+					"body":         rec.Body.Bytes(),
+				}).Error
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to store idempotent response", "err", err)
+			}
+		})
+	}
+}
+
+func replay(w http.ResponseWriter, record *models.IdempotencyKey, fingerprint string) {
+	switch {
+	case record.Fingerprint != fingerprint:
+		respondWithError(w, http.StatusUnprocessableEntity, errKeyReused)
+	case record.Status == 0:
+		respondWithError(w, http.StatusConflict, errKeyInProgress)
+	default:
+		if record.Content_type != "" {
+			w.Header().Set("Content-Type", record.Content_type)
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(record.Status)
+		if _, err := w.Write(record.Body); err != nil {
+			slog.Error("Failed to replay response", "err", err)
+		}
+	}
+}
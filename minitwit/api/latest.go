@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"minitwit/metrics"
+	"minitwit/utils"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gorilla/mux"
+)
+
+// trackLatest records the latest id sent to the simulator API and exposes
+// how far processed writes are behind it
+func trackLatest(doc *openapi3.T, file LatestFile) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := RouteFor(doc, r)
+			if route == nil || route.Operation.Parameters.GetByInAndName("query", "latest") == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			updateLatest(file, r)
+			latest, err := strconv.Atoi(r.URL.Query().Get("latest"))
+			if err != nil || latest <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			metrics.SimulatorReceived(latest)
+
+			sw := utils.NewStatusRecorder(w)
+			next.ServeHTTP(sw, r)
+			if r.Method == http.MethodPost && sw.Status < http.StatusInternalServerError {
+				metrics.SimulatorProcessed(latest)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"minitwit/config"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gorilla/mux"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// LoadSpec parses and validates the checked-in OpenAPI document
+func LoadSpec() (*openapi3.T, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(openAPISpec); err != nil {
+		http.Error(w, "Failed to write OpenAPI document", http.StatusInternalServerError)
+	}
+}
+
+// RouteFor finds the operation in the spec that handles the matched mux route
+func RouteFor(doc *openapi3.T, r *http.Request) *routers.Route {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return nil
+	}
+	path, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+	pathItem := doc.Paths.Value(path)
+	if pathItem == nil {
+		return nil
+	}
+	operation := pathItem.GetOperation(r.Method)
+	if operation == nil {
+		return nil
+	}
+	return &routers.Route{Spec: doc, Path: path, PathItem: pathItem, Method: r.Method, Operation: operation}
+}
+
+// requireSimulator answers requests to operations with a security
+// requirement with 403 unless they carry the simulator credentials
+func requireSimulator(doc *openapi3.T, cfg *config.Config) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := RouteFor(doc, r)
+			if route == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			security := doc.Security
+			if route.Operation.Security != nil {
+				security = *route.Operation.Security
+			}
+			if len(security) > 0 && notReqFromSimulator(w, r, cfg) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// validateRequests rejects requests that don't match the OpenAPI document
+// before they reach the handlers. Routes missing from the document are let through.
+func validateRequests(doc *openapi3.T) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := RouteFor(doc, r)
+			if route == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			input := &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: mux.Vars(r),
+				Route:      route,
+				Options: &openapi3filter.Options{
+					// requireSimulator checked the credentials already
+					AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+				},
+			}
+			if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+				respondWithError(w, http.StatusBadRequest, validationMessage(err))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// validationMessage turns a validation error into a short error_msg
+func validationMessage(err error) string {
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return err.Error()
+	}
+
+	reason := reqErr.Reason
+	var schemaErr *openapi3.SchemaError
+	if errors.As(reqErr.Err, &schemaErr) {
+		reason = schemaErr.Reason
+		if field := strings.Join(schemaErr.JSONPointer(), "."); field != "" {
+			reason = field + ": " + reason
+		}
+	} else if reqErr.Err != nil && reason == "" {
+		reason = reqErr.Err.Error()
+	}
+
+	if reqErr.Parameter != nil {
+		return fmt.Sprintf("Invalid %s parameter %q: %s", reqErr.Parameter.In, reqErr.Parameter.Name, reason)
+	}
+	return "Invalid request body: " + reason
+}
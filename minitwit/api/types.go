@@ -0,0 +1,38 @@
+package api
+
+// Request and response bodies of the simulator API, see openapi.json
+
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Pwd      string `json:"pwd"`
+}
+
+type MessageRequest struct {
+	Content string `json:"content"`
+}
+
+// Exactly one of Follow and Unfollow is expected to be set
+type FollowRequest struct {
+	Follow   string `json:"follow,omitempty"`
+	Unfollow string `json:"unfollow,omitempty"`
+}
+
+type MessageResponse struct {
+	Content string `json:"content"`
+	PubDate int64  `json:"pub_date"`
+	User    string `json:"user"`
+}
+
+type FollowsResponse struct {
+	Follows []string `json:"follows"`
+}
+
+type LatestResponse struct {
+	Latest int `json:"latest"`
+}
+
+type ErrorResponse struct {
+	Status   int    `json:"status"`
+	ErrorMsg string `json:"error_msg"`
+}
@@ -0,0 +1,439 @@
+// Package apiv2 is the API for our own clients, served under /api/v2.
+// The simulator API in package api is frozen, both share the service layer.
+package apiv2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"minitwit/db"
+	"minitwit/metrics"
+	"minitwit/models"
+	"minitwit/service"
+	"minitwit/utils"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const maxLimit = 100
+
+// OTPHeader carries the TOTP or recovery code of users with two-factor auth
+// for the endpoints that need a second factor
+const OTPHeader = "X-OTP"
+
+// Prefix is the path all routes of API v2 start with
+const Prefix = "/api/v2"
+
+// Register mounts API v2 on the router. Middleware of r, like
+// middleware.PrometheusMiddleware, applies to these routes as well.
+func Register(r *mux.Router, database *gorm.DB, svc *service.Service) {
+	v2 := r.PathPrefix(Prefix).Subrouter()
+
+	v2.HandleFunc("/users", createUser(database)).Methods("POST")
+	v2.HandleFunc("/users/{user}", getUser(database)).Methods("GET")
+	v2.HandleFunc("/users/{user}", deleteUser(database, svc)).Methods("DELETE")
+	v2.HandleFunc("/users/{user}/archive", getArchive(database)).Methods("GET")
+	v2.HandleFunc("/users/{user}/messages", listUserMessages(database)).Methods("GET")
+	v2.HandleFunc("/users/{user}/timeline", getTimeline(database, svc)).Methods("GET")
+	v2.HandleFunc("/users/{user}/following", listFollowing(database)).Methods("GET")
+	v2.HandleFunc("/users/{user}/following", createFollow(database, svc)).Methods("POST")
+	v2.HandleFunc("/users/{user}/following/{target}", deleteFollow(database, svc)).Methods("DELETE")
+	v2.HandleFunc("/users/{user}/followers", listFollowers(database)).Methods("GET")
+	v2.HandleFunc("/messages", listMessages(database)).Methods("GET")
+	v2.HandleFunc("/messages", createMessage(database, svc)).Methods("POST")
+	v2.HandleFunc("/messages/{id:[0-9]+}", getMessage(database)).Methods("GET")
+}
+
+func writeJSON(w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		slog.Error("Failed to encode response", "err", err)
+	}
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Failed to decode request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// page reads the cursor and limit query parameters
+func page(w http.ResponseWriter, r *http.Request) (service.Page, bool) {
+	p := service.Page{Cursor: r.URL.Query().Get("cursor")}
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxLimit {
+			writeProblem(w, r, http.StatusBadRequest, "limit must be a number between 1 and 100")
+			return p, false
+		}
+		p.Limit = limit
+	}
+	return p, true
+}
+
+// authenticate checks the basic auth credentials of the request
+func authenticate(w http.ResponseWriter, r *http.Request, database *gorm.DB) (*models.User, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		writeProblem(w, r, http.StatusUnauthorized, "This endpoint requires basic authentication")
+		return nil, false
+	}
+	// users with two-factor auth also send a code to change anything, see
+	// secondFactor
+	user, err := service.Authenticate(database, service.LoginAttempt{
+		Username:  username,
+		Password:  password,
+		IP:        utils.ClientIP(r),
+		SharedIP:  !utils.ClientIPForwarded(r),
+		UserAgent: r.UserAgent(),
+	}, time.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// optionalViewer authenticates the request if it has credentials, the
+// viewer is nil for anonymous requests
+func optionalViewer(w http.ResponseWriter, r *http.Request, database *gorm.DB) (*models.User, bool) {
+	if _, _, ok := r.BasicAuth(); !ok {
+		return nil, true
+	}
+	return authenticate(w, r, database)
+}
+
+// pathUser resolves the {user} route variable, which is an id or a username
+func pathUser(w http.ResponseWriter, r *http.Request, database *gorm.DB) (*models.User, bool) {
+	user, err := service.GetUser(database, mux.Vars(r)["user"])
+	if err != nil {
+		writeError(w, r, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// actingAs authenticates the request and checks it is made by the {user} of the path
+func actingAs(w http.ResponseWriter, r *http.Request, database *gorm.DB) (*models.User, bool) {
+	user, ok := pathUser(w, r, database)
+	if !ok {
+		return nil, false
+	}
+	authUser, ok := authenticate(w, r, database)
+	if !ok {
+		return nil, false
+	}
+	if authUser.User_id != user.User_id {
+		writeProblem(w, r, http.StatusForbidden, "You can only access your own account, follows and timeline")
+		return nil, false
+	}
+	return user, true
+}
+
+// actingAsWithSecondFactor is actingAs for the writes and the export of
+// the account, see secondFactor
+func actingAsWithSecondFactor(w http.ResponseWriter, r *http.Request, database *gorm.DB) (*models.User, bool) {
+	user, ok := actingAs(w, r, database)
+	if !ok || !secondFactor(w, r, database, user) {
+		return nil, false
+	}
+	return user, true
+}
+
+// secondFactor checks the code in OTPHeader of users with two-factor auth,
+// a password alone does not change their account. Codes are used once, so
+// every request needs a new one.
+func secondFactor(w http.ResponseWriter, r *http.Request, database *gorm.DB, user *models.User) bool {
+	enabled, err := service.TwoFactorEnabled(database, user.User_id)
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	if !enabled {
+		return true
+	}
+	code := r.Header.Get(OTPHeader)
+	if code == "" {
+		writeProblem(w, r, http.StatusUnauthorized, "This endpoint requires the code of your authenticator app in the "+OTPHeader+" header")
+		return false
+	}
+	_, err = service.AuthenticateSecondFactor(database, user.User_id, code, service.LoginAttempt{
+		IP:        utils.ClientIP(r),
+		SharedIP:  !utils.ClientIPForwarded(r),
+		UserAgent: r.UserAgent(),
+	}, time.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	return true
+}
+
+func createUser(database *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		var req CreateUserRequest
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		user, err := service.RegisterUser(database, req.Username, req.Email, req.Password)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		metrics.UsersRegistered.WithLabelValues(metrics.SourceAPIv2).Inc()
+		w.Header().Set("Location", "/api/v2/users/"+strconv.Itoa(user.User_id))
+		writeJSON(w, http.StatusCreated, toUser(*user))
+	}
+}
+
+func getUser(database *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user, ok := pathUser(w, r, database)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, toUser(*user))
+	}
+}
+
+// deleteUser deletes the account with its messages and follows
+func deleteUser(database *gorm.DB, svc *service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user, ok := actingAsWithSecondFactor(w, r, database)
+		if !ok {
+			return
+		}
+		if err := svc.DeleteAccount(database, user.User_id); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		slog.InfoContext(r.Context(), "Account deleted", "user_id", user.User_id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// getArchive returns all data of the user as a zip, or as JSON when the
+// client accepts only that
+func getArchive(database *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user, ok := actingAsWithSecondFactor(w, r, database)
+		if !ok {
+			return
+		}
+		data, err := service.ExportUserData(database, user.User_id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if r.Header.Get("Accept") == "application/json" {
+			writeJSON(w, http.StatusOK, data)
+			return
+		}
+		var buf bytes.Buffer
+		if err := service.WriteArchive(&buf, data); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "minitwit-"+user.Username+".zip"))
+		w.Write(buf.Bytes())
+	}
+}
+
+func listUserMessages(database *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user, ok := pathUser(w, r, database)
+		if !ok {
+			return
+		}
+		p, ok := page(w, r)
+		if !ok {
+			return
+		}
+		list, err := service.ListUserMessages(database, user.User_id, p)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toMessageList(list))
+	}
+}
+
+func getTimeline(database *gorm.DB, svc *service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user, ok := actingAs(w, r, database)
+		if !ok {
+			return
+		}
+		p, ok := page(w, r)
+		if !ok {
+			return
+		}
+		list, err := svc.Timeline(database, user.User_id, p)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toMessageList(list))
+	}
+}
+
+func listFollowing(database *gorm.DB) http.HandlerFunc {
+	return listUsers(database, service.ListFollowing)
+}
+
+func listFollowers(database *gorm.DB) http.HandlerFunc {
+	return listUsers(database, service.ListFollowers)
+}
+
+// listUsers returns a page of the users list gives for {user}. If the
+// request is authenticated every user says whether the caller follows them.
+func listUsers(database *gorm.DB, list func(database *gorm.DB, userID int, p service.Page) (*service.UserList, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		viewer, ok := optionalViewer(w, r, database)
+		if !ok {
+			return
+		}
+		user, ok := pathUser(w, r, database)
+		if !ok {
+			return
+		}
+		p, ok := page(w, r)
+		if !ok {
+			return
+		}
+		users, err := list(database, user.User_id, p)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		var followed map[int]bool
+		if viewer != nil {
+			followed, err = service.FollowedBy(database, viewer.User_id, users.Users)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, toUserList(users, followed))
+	}
+}
+
+func createFollow(database *gorm.DB, svc *service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user, ok := actingAsWithSecondFactor(w, r, database)
+		if !ok {
+			return
+		}
+		var req CreateFollowRequest
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		target, err := service.GetUser(database, req.User)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := svc.Follow(database, user.User_id, target.User_id); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		metrics.Follows.WithLabelValues(metrics.SourceAPIv2).Inc()
+		// both users were read before the follow
+		user.Following_count++
+		target.Follower_count++
+		w.Header().Set("Location", "/api/v2/users/"+strconv.Itoa(user.User_id)+"/following/"+strconv.Itoa(target.User_id))
+		writeJSON(w, http.StatusCreated, Follow{Follower: toUser(*user), Followee: toUser(*target)})
+	}
+}
+
+func deleteFollow(database *gorm.DB, svc *service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user, ok := actingAsWithSecondFactor(w, r, database)
+		if !ok {
+			return
+		}
+		target, err := service.GetUser(database, mux.Vars(r)["target"])
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := svc.Unfollow(database, user.User_id, target.User_id); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		metrics.Unfollows.WithLabelValues(metrics.SourceAPIv2).Inc()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func listMessages(database *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		p, ok := page(w, r)
+		if !ok {
+			return
+		}
+		list, err := service.ListPublicMessages(database, p)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toMessageList(list))
+	}
+}
+
+func createMessage(database *gorm.DB, svc *service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user, ok := authenticate(w, r, database)
+		if !ok || !secondFactor(w, r, database, user) {
+			return
+		}
+		var req CreateMessageRequest
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		message, err := svc.PostMessage(database, user.User_id, req.Text)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		metrics.MessagesPosted.WithLabelValues(metrics.SourceAPIv2).Inc()
+		w.Header().Set("Location", "/api/v2/messages/"+strconv.Itoa(message.Message_id))
+		writeJSON(w, http.StatusCreated, toMessage(*message))
+	}
+}
+
+func getMessage(database *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+		message, err := service.GetMessage(database, id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toMessage(*message))
+	}
+}
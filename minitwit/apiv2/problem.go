@@ -0,0 +1,77 @@
+package apiv2
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"minitwit/middleware"
+	"minitwit/ratelimit"
+	"minitwit/service"
+)
+
+// Problem is an RFC 7807 error response
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	problem := Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="minitwit"`)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	middleware.RecordResponseMessage(status, problem.Title)
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode problem response", "err", err)
+	}
+}
+
+// writeError maps errors from the service layer to problems
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var validationErr *service.ValidationError
+	var locked *service.LockedError
+	switch {
+	case errors.As(err, &validationErr),
+		errors.Is(err, service.ErrInvalidCursor),
+		errors.Is(err, service.ErrFollowSelf):
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrUserNotFound),
+		errors.Is(err, service.ErrMessageNotFound),
+		errors.Is(err, service.ErrNotFollowing):
+		writeProblem(w, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, service.ErrUsernameTaken),
+		errors.Is(err, service.ErrAlreadyFollowing):
+		writeProblem(w, r, http.StatusConflict, err.Error())
+	case errors.Is(err, service.ErrInvalidPassword),
+		errors.Is(err, service.ErrInvalidCode):
+		writeProblem(w, r, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, service.ErrUserDisabled),
+		errors.Is(err, service.ErrUnverified):
+		writeProblem(w, r, http.StatusForbidden, err.Error())
+	case errors.As(err, &locked):
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(locked.RetryAfter))
+		writeProblem(w, r, http.StatusTooManyRequests, err.Error())
+	default:
+		slog.ErrorContext(r.Context(), "API v2 request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+	}
+}
+
+// RateLimited answers a request rejected by the rate limiter, which sets
+// Retry-After
+func RateLimited(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusTooManyRequests, "Too many requests, retry after the time in Retry-After")
+}
@@ -0,0 +1,100 @@
+package apiv2
+
+import (
+	"time"
+
+	"minitwit/models"
+	"minitwit/service"
+)
+
+// Resources returned by API v2. Users can be addressed by their numeric
+// id or by their username, both are part of the user resource.
+
+type User struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	// Counts are left out where the user is only referenced, like the
+	// author of a message
+	Counts *UserCounts `json:"counts,omitempty"`
+	// Followed tells whether the caller follows the user, only in lists
+	// requested with credentials
+	Followed *bool `json:"followed,omitempty"`
+}
+
+type UserCounts struct {
+	Followers int64 `json:"followers"`
+	Following int64 `json:"following"`
+	Messages  int64 `json:"messages"`
+}
+
+type Message struct {
+	ID      int       `json:"id"`
+	Author  User      `json:"author"`
+	Text    string    `json:"text"`
+	PubDate time.Time `json:"pub_date"`
+}
+
+type Follow struct {
+	Follower User `json:"follower"`
+	Followee User `json:"followee"`
+}
+
+// List is one page of a collection. NextCursor is empty on the last page.
+type List[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type CreateMessageRequest struct {
+	Text string `json:"text"`
+}
+
+// User may be a numeric id or a username
+type CreateFollowRequest struct {
+	User string `json:"user"`
+}
+
+func toUser(u models.User) User {
+	return User{
+		ID:       u.User_id,
+		Username: u.Username,
+		Counts:   &UserCounts{Followers: u.Follower_count, Following: u.Following_count, Messages: u.Message_count},
+	}
+}
+
+func toMessage(m models.Message) Message {
+	return Message{
+		ID:      m.Message_id,
+		Author:  User{ID: int(m.Author_id), Username: m.Author},
+		Text:    m.Text,
+		PubDate: time.Unix(m.Pub_date, 0).UTC(),
+	}
+}
+
+func toMessageList(list *service.MessageList) List[Message] {
+	items := make([]Message, 0, len(list.Messages))
+	for _, m := range list.Messages {
+		items = append(items, toMessage(m))
+	}
+	return List[Message]{Items: items, NextCursor: list.NextCursor}
+}
+
+// toUserList sets Followed from followed unless it is nil
+func toUserList(list *service.UserList, followed map[int]bool) List[User] {
+	items := make([]User, 0, len(list.Users))
+	for _, u := range list.Users {
+		item := toUser(u)
+		if followed != nil {
+			f := followed[u.User_id]
+			item.Followed = &f
+		}
+		items = append(items, item)
+	}
+	return List[User]{Items: items, NextCursor: list.NextCursor}
+}
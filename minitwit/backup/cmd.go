@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"minitwit/cache"
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/fanout"
+	"minitwit/logging"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const exportUsage = `usage: minitwit export [flags]
+
+Writes the users, messages, follows and the latest simulator action id as
+gzipped NDJSON.
+
+`
+
+const importUsage = `usage: minitwit import [flags] <file>
+
+Imports an export, or the SQLite database of the Python MiniTwit, keeping
+the ids. An interrupted import is continued with -resume.
+
+`
+
+// openDatabase opens the SQLite file if path is set, otherwise postgres
+// with the settings of the config file and environment
+func openDatabase(name, path string) (*gorm.DB, *config.Config, error) {
+	cfg, err := config.Load(name, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if path == "" {
+		return db.GormConnectDB(cfg.Database), cfg, nil
+	}
+	database, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logging.NewGormLogger(cfg.Database.SlowQuery)})
+	return database, cfg, err
+}
+
+// ExportMain runs the export command and returns the exit code
+func ExportMain(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	out := fs.String("o", "-", "output file, - for stdout")
+	sqlitePath := fs.String("sqlite", "", "export this SQLite database instead of postgres")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, exportUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	database, cfg, err := openDatabase("export", *sqlitePath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer db.Close(database)
+
+	// the API may run elsewhere, then there is no latest id to export
+	var latest *int
+	if content, err := os.ReadFile(cfg.API.LatestFile); err == nil {
+		if id, err := strconv.Atoi(strings.TrimSpace(string(content))); err == nil {
+			latest = &id
+		}
+	}
+
+	w := stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	counts, err := Export(database, w, latest)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stderr, "exported %d users, %d messages and %d follows\n", counts.Users, counts.Messages, counts.Followers)
+	return 0
+}
+
+// ImportMain runs the import command and returns the exit code
+func ImportMain(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	sqlitePath := fs.String("sqlite", "", "import into this SQLite database instead of postgres, it is created if missing")
+	var opts Options
+	fs.BoolVar(&opts.Resume, "resume", false, "skip rows that already exist, to continue an interrupted import")
+	fs.BoolVar(&opts.SkipInvalid, "skip-invalid", false, "drop messages and follows of missing users instead of failing")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "only read and validate the file")
+	noLatest := fs.Bool("no-latest", false, "do not overwrite the latest simulator action id")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, importUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || fs.Arg(0) == "-" {
+		// the file is read twice, so stdin does not work
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+
+	var database *gorm.DB
+	var cfg *config.Config
+	if !opts.DryRun {
+		var err error
+		database, cfg, err = openDatabase("import", *sqlitePath)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer db.Close(database)
+		if !*noLatest {
+			opts.LatestFile = cfg.API.LatestFile
+		}
+	}
+
+	report, err := Import(database, func() (Source, error) { return Open(path) }, opts)
+	if database != nil && *sqlitePath == "" {
+		if cfg.Timeline.Mode == fanout.ModeFanout && report != nil && report.Imported.Messages+report.Imported.Followers > 0 {
+			// the imported messages are in no fanned out timeline yet
+			if entries, err := fanout.Rebuild(database, cfg.Timeline); err != nil {
+				fmt.Fprintln(stderr, "failed to rebuild the timelines, run minitwit admin timelines rebuild:", err)
+			} else {
+				fmt.Fprintf(stderr, "rebuilt the timelines with %d entries\n", entries)
+			}
+		}
+		// the web app would show the old timelines from a shared cache
+		if timelines, err := cache.FromConfig(cfg.Cache, database); err == nil {
+			timelines.Clear(context.Background())
+		}
+	}
+	if report != nil {
+		writeReport(stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func writeReport(w io.Writer, r *Report) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tREAD\tIMPORTED\tSKIPPED\tINVALID")
+	rows := []struct {
+		name string
+		get  func(Counts) int64
+	}{
+		{"users", func(c Counts) int64 { return c.Users }},
+		{"messages", func(c Counts) int64 { return c.Messages }},
+		{"follows", func(c Counts) int64 { return c.Followers }},
+	}
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", row.name, row.get(r.Read), row.get(r.Imported), row.get(r.Skipped), row.get(r.Invalid))
+	}
+	tw.Flush()
+	if r.Latest != nil {
+		fmt.Fprintf(w, "latest simulator action: %d\n", *r.Latest)
+	}
+}
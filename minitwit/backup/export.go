@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// stage streams one table
+type stage struct {
+	query string
+	scan  func(rows *sql.Rows) (Record, error)
+}
+
+func scanUser(rows *sql.Rows) (Record, error) {
+	var u User
+	err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.PwHash, &u.Disabled)
+	return Record{Kind: KindUser, User: &u}, err
+}
+
+func scanMessage(rows *sql.Rows) (Record, error) {
+	var m Message
+	err := rows.Scan(&m.ID, &m.AuthorID, &m.Text, &m.PubDate, &m.Flagged)
+	return Record{Kind: KindMessage, Message: &m}, err
+}
+
+func scanFollower(rows *sql.Rows) (Record, error) {
+	var f Follower
+	err := rows.Scan(&f.WhoID, &f.WhomID)
+	return Record{Kind: KindFollower, Follower: &f}, err
+}
+
+// the tables of AutoMigrateDB
+var tables = []stage{
+	{"SELECT user_id, username, email, pw_hash, disabled FROM users ORDER BY user_id", scanUser},
+	{"SELECT message_id, author_id, text, COALESCE(pub_date, 0), COALESCE(flagged, 0) FROM messages ORDER BY message_id", scanMessage},
+	{"SELECT who_id, whom_id FROM followers ORDER BY who_id, whom_id", scanFollower},
+}
+
+// the tables of schema.sql, used by the Python MiniTwit
+var legacyTables = []stage{
+	{`SELECT user_id, username, email, pw_hash, 0 FROM "user" ORDER BY user_id`, scanUser},
+	{`SELECT message_id, author_id, text, COALESCE(pub_date, 0), COALESCE(flagged, 0) FROM "message" ORDER BY message_id`, scanMessage},
+	{`SELECT DISTINCT who_id, whom_id FROM "follower" WHERE who_id IS NOT NULL AND whom_id IS NOT NULL ORDER BY who_id, whom_id`, scanFollower},
+}
+
+// tableReader is a Source reading the rows of a database one table after
+// the other
+type tableReader struct {
+	db     *gorm.DB
+	stages []stage
+	rows   *sql.Rows
+	close  func() error
+}
+
+func (t *tableReader) Next() (Record, error) {
+	for {
+		if len(t.stages) == 0 {
+			return Record{}, io.EOF
+		}
+		if t.rows == nil {
+			rows, err := t.db.Raw(t.stages[0].query).Rows()
+			if err != nil {
+				return Record{}, err
+			}
+			t.rows = rows
+		}
+		if t.rows.Next() {
+			return t.stages[0].scan(t.rows)
+		}
+		err := t.rows.Err()
+		t.rows.Close()
+		t.rows = nil
+		t.stages = t.stages[1:]
+		if err != nil {
+			return Record{}, err
+		}
+	}
+}
+
+func (t *tableReader) Close() error {
+	if t.rows != nil {
+		t.rows.Close()
+	}
+	if t.close != nil {
+		return t.close()
+	}
+	return nil
+}
+
+// OpenLegacy reads the SQLite database of the Python MiniTwit
+func OpenLegacy(path string) (Source, error) {
+	database, err := gorm.Open(sqlite.Open("file:"+path+"?mode=ro"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := database.DB()
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range []string{"user", "message", "follower"} {
+		if !database.Migrator().HasTable(table) {
+			sqlDB.Close()
+			return nil, fmt.Errorf("%s: table %q of schema.sql is missing", path, table)
+		}
+	}
+	return &tableReader{db: database, stages: legacyTables, close: sqlDB.Close}, nil
+}
+
+// Export writes the users, messages and follows of database and the latest
+// simulator action id, if not nil, to w. All tables are read from one
+// snapshot, so a running server cannot add follows or messages of users
+// that are missing from the backup.
+func Export(database *gorm.DB, w io.Writer, latest *int) (Counts, error) {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	var counts Counts
+
+	tx := database.Begin(&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if tx.Error != nil {
+		return counts, tx.Error
+	}
+	defer tx.Rollback()
+	if err := enc.Encode(Record{Kind: KindHeader, Header: &Header{Version: Version, Created: time.Now().UTC()}}); err != nil {
+		return counts, err
+	}
+	src := &tableReader{db: tx, stages: tables}
+	defer src.Close()
+	for {
+		rec, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return counts, err
+		}
+		if err := enc.Encode(rec); err != nil {
+			return counts, err
+		}
+		counts.add(rec.Kind)
+	}
+	if latest != nil {
+		if err := enc.Encode(Record{Kind: KindLatest, Latest: latest}); err != nil {
+			return counts, err
+		}
+	}
+	if err := enc.Encode(Record{Kind: KindEnd, Counts: &counts}); err != nil {
+		return counts, err
+	}
+	return counts, gz.Close()
+}
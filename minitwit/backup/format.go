@@ -0,0 +1,217 @@
+// Package backup exports the users, messages, follows and the latest
+// simulator action id of a MiniTwit instance to a portable file, and
+// imports such a file into another instance, e.g. production Postgres into
+// a local SQLite database:
+//
+//	minitwit export -o minitwit.ndjson.gz
+//	minitwit import -sqlite debug.db minitwit.ndjson.gz
+//
+// The file is gzipped NDJSON. The first line is a header with the format
+// version, the last one holds the number of records so a truncated file is
+// detected. Users come before the messages and follows that refer to them:
+//
+//	{"kind":"header","header":{"version":1,"created":"2025-01-01T00:00:00Z"}}
+//	{"kind":"user","user":{"id":1,"username":"a","email":"a@a","pw_hash":"…"}}
+//	{"kind":"message","message":{"id":1,"author_id":1,"text":"hi","pub_date":1700000000}}
+//	{"kind":"follower","follower":{"who_id":1,"whom_id":2}}
+//	{"kind":"latest","latest":42}
+//	{"kind":"end","counts":{"users":1,"messages":1,"followers":1}}
+//
+// Import also reads the SQLite database of the original Python MiniTwit
+// (the tables of schema.sql). Its password hashes are not md5, so those
+// users need a new password from minitwit admin users reset-password.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Version of the format, files of newer versions are rejected
+const Version = 1
+
+// Kinds of records
+const (
+	KindHeader   = "header"
+	KindUser     = "user"
+	KindMessage  = "message"
+	KindFollower = "follower"
+	KindLatest   = "latest"
+	KindEnd      = "end"
+)
+
+type Header struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type User struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	PwHash   string `json:"pw_hash"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+type Message struct {
+	ID       int    `json:"id"`
+	AuthorID int    `json:"author_id"`
+	Text     string `json:"text"`
+	PubDate  int64  `json:"pub_date"`
+	Flagged  int    `json:"flagged,omitempty"`
+}
+
+type Follower struct {
+	WhoID  int `json:"who_id"`
+	WhomID int `json:"whom_id"`
+}
+
+// Counts is the number of records of each kind
+type Counts struct {
+	Users     int64 `json:"users"`
+	Messages  int64 `json:"messages"`
+	Followers int64 `json:"followers"`
+}
+
+func (c *Counts) add(kind string) {
+	switch kind {
+	case KindUser:
+		c.Users++
+	case KindMessage:
+		c.Messages++
+	case KindFollower:
+		c.Followers++
+	}
+}
+
+// Record is one line of the file, the field named by Kind is set
+type Record struct {
+	Kind     string    `json:"kind"`
+	Header   *Header   `json:"header,omitempty"`
+	User     *User     `json:"user,omitempty"`
+	Message  *Message  `json:"message,omitempty"`
+	Follower *Follower `json:"follower,omitempty"`
+	Latest   *int      `json:"latest,omitempty"`
+	Counts   *Counts   `json:"counts,omitempty"`
+}
+
+// Source yields the records of an export, Next returns io.EOF at the end
+type Source interface {
+	Next() (Record, error)
+	Close() error
+}
+
+var (
+	ErrTruncated = errors.New("the export is incomplete, the end record is missing")
+	ErrVersion   = errors.New("unsupported export version")
+)
+
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	sqliteMagic = []byte("SQLite format 3\x00")
+)
+
+// decoder reads an NDJSON export
+type decoder struct {
+	dec    *json.Decoder
+	closer io.Closer
+	seen   Counts
+	done   bool
+}
+
+// NewReader reads an export from r, gzipped or not. The header is read
+// and checked right away.
+func NewReader(r io.Reader) (Source, error) {
+	br := bufio.NewReader(r)
+	var in io.Reader = br
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		in = gz
+	}
+
+	d := &decoder{dec: json.NewDecoder(in)}
+	var first Record
+	if err := d.dec.Decode(&first); err != nil {
+		return nil, fmt.Errorf("reading the header: %w", err)
+	}
+	if first.Kind != KindHeader || first.Header == nil {
+		return nil, fmt.Errorf("the first record is %q, not the header", first.Kind)
+	}
+	if first.Header.Version < 1 || first.Header.Version > Version {
+		return nil, fmt.Errorf("%w %d, this build reads up to version %d", ErrVersion, first.Header.Version, Version)
+	}
+	return d, nil
+}
+
+func (d *decoder) Next() (Record, error) {
+	if d.done {
+		return Record{}, io.EOF
+	}
+	var rec Record
+	err := d.dec.Decode(&rec)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return Record{}, ErrTruncated
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	switch {
+	case rec.Kind == KindUser && rec.User != nil,
+		rec.Kind == KindMessage && rec.Message != nil,
+		rec.Kind == KindFollower && rec.Follower != nil,
+		rec.Kind == KindLatest && rec.Latest != nil:
+		d.seen.add(rec.Kind)
+		return rec, nil
+	case rec.Kind == KindEnd && rec.Counts != nil:
+		if *rec.Counts != d.seen {
+			return Record{}, fmt.Errorf("the export is corrupt, it should hold %+v records but has %+v", *rec.Counts, d.seen)
+		}
+		d.done = true
+		return Record{}, io.EOF
+	}
+	return Record{}, fmt.Errorf("invalid record of kind %q", rec.Kind)
+}
+
+func (d *decoder) Close() error {
+	if d.closer != nil {
+		return d.closer.Close()
+	}
+	return nil
+}
+
+// Open opens an export file, or the SQLite database of the Python MiniTwit
+func Open(path string) (Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(sqliteMagic))
+	n, _ := io.ReadFull(f, magic)
+	if bytes.Equal(magic[:n], sqliteMagic) {
+		f.Close()
+		return OpenLegacy(path)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	src, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	src.(*decoder).closer = f
+	return src, nil
+}
@@ -0,0 +1,331 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"minitwit/db"
+	"minitwit/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrNotEmpty = errors.New("the database is not empty, use -resume to continue an interrupted import")
+
+// Options of Import
+type Options struct {
+	// Resume skips the rows that already exist instead of refusing to
+	// import into a database that is not empty
+	Resume bool
+	// SkipInvalid drops records that refer to missing users instead of
+	// failing the import
+	SkipInvalid bool
+	// DryRun only reads and validates the source
+	DryRun bool
+	// LatestFile receives the latest simulator action id, if set
+	LatestFile string
+	// BatchSize is the number of rows per INSERT, 500 if zero
+	BatchSize int
+}
+
+// Report is the outcome of Import
+type Report struct {
+	Read     Counts
+	Imported Counts
+	// Skipped rows already existed
+	Skipped Counts
+	// Invalid records refer to missing users
+	Invalid Counts
+	Latest  *int
+}
+
+// IntegrityError lists records that refer to missing users
+type IntegrityError struct {
+	Invalid  Counts
+	Problems []string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("%d messages and %d follows refer to missing users, e.g. %s; use -skip-invalid to drop them",
+		e.Invalid.Messages, e.Invalid.Followers, strings.Join(e.Problems, ", "))
+}
+
+// checker tracks the known users to validate references
+type checker struct {
+	users map[int]bool
+}
+
+func newChecker(database *gorm.DB, resume bool) (*checker, error) {
+	c := &checker{users: map[int]bool{}}
+	if resume {
+		var ids []int
+		if err := database.Model(&models.User{}).Pluck("user_id", &ids).Error; err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			c.users[id] = true
+		}
+	}
+	return c, nil
+}
+
+// check returns a description of the problem of an invalid record
+func (c *checker) check(rec Record) string {
+	switch rec.Kind {
+	case KindUser:
+		if rec.User.ID <= 0 || rec.User.Username == "" {
+			return fmt.Sprintf("user %d has no id or username", rec.User.ID)
+		}
+		c.users[rec.User.ID] = true
+	case KindMessage:
+		if !c.users[rec.Message.AuthorID] {
+			return fmt.Sprintf("message %d by missing user %d", rec.Message.ID, rec.Message.AuthorID)
+		}
+	case KindFollower:
+		for _, id := range []int{rec.Follower.WhoID, rec.Follower.WhomID} {
+			if !c.users[id] {
+				return fmt.Sprintf("follow %d->%d of missing user %d", rec.Follower.WhoID, rec.Follower.WhomID, id)
+			}
+		}
+	}
+	return ""
+}
+
+// Import reads the source twice: first to validate it, then to insert the
+// records with their ids. Rows are inserted in batches and existing ids
+// are skipped, so after a failure the import is resumed with
+// Options.Resume.
+func Import(database *gorm.DB, open func() (Source, error), opts Options) (*Report, error) {
+	if opts.BatchSize == 0 {
+		opts.BatchSize = 500
+	}
+	report := &Report{}
+
+	if !opts.DryRun {
+		if err := database.AutoMigrate(db.Models...); err != nil {
+			return nil, err
+		}
+		if err := db.MigrateFollowers(database); err != nil {
+			return nil, err
+		}
+		if !opts.Resume {
+			empty, err := isEmpty(database)
+			if err != nil {
+				return nil, err
+			}
+			if !empty {
+				return nil, ErrNotEmpty
+			}
+		}
+	}
+
+	// validate
+	c, err := newChecker(database, opts.Resume && !opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	err = each(open, func(rec Record) error {
+		report.Read.add(rec.Kind)
+		if rec.Kind == KindLatest {
+			report.Latest = rec.Latest
+		}
+		if problem := c.check(rec); problem != "" {
+			if rec.Kind == KindUser {
+				return fmt.Errorf("invalid record: %s", problem)
+			}
+			report.Invalid.add(rec.Kind)
+			if len(problems) < 5 {
+				problems = append(problems, problem)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if report.Invalid != (Counts{}) && !opts.SkipInvalid {
+		return report, &IntegrityError{report.Invalid, problems}
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+
+	// import
+	c, err = newChecker(database, opts.Resume)
+	if err != nil {
+		return nil, err
+	}
+	w := &batchWriter{db: database, size: opts.BatchSize, report: report}
+	err = each(open, func(rec Record) error {
+		if c.check(rec) != "" {
+			return nil
+		}
+		return w.add(rec)
+	})
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		return report, err
+	}
+	if err := resetSequences(database); err != nil {
+		return report, err
+	}
+	// the rows were inserted in bulk, past the counters on users
+	if _, err := db.FixCounters(database); err != nil {
+		return report, err
+	}
+	if report.Latest != nil && opts.LatestFile != "" {
+		if err := os.WriteFile(opts.LatestFile, []byte(strconv.Itoa(*report.Latest)), 0644); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// each calls fn for every record of a freshly opened source
+func each(open func() (Source, error), fn func(Record) error) error {
+	src, err := open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	for {
+		rec, err := src.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+func isEmpty(database *gorm.DB) (bool, error) {
+	for _, model := range []any{&models.User{}, &models.Message{}, &models.Follower{}} {
+		var count int64
+		if err := database.Model(model).Count(&count).Error; err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// batchWriter buffers the rows of one kind, records come grouped by kind
+type batchWriter struct {
+	db       *gorm.DB
+	size     int
+	report   *Report
+	kind     string
+	users    []models.User
+	messages []models.Message
+	follows  []models.Follower
+}
+
+func (w *batchWriter) add(rec Record) error {
+	if rec.Kind != w.kind {
+		if err := w.flush(); err != nil {
+			return err
+		}
+		w.kind = rec.Kind
+	}
+	switch rec.Kind {
+	case KindUser:
+		u := rec.User
+		w.users = append(w.users, models.User{User_id: u.ID, Username: u.Username, Email: u.Email, PwHash: u.PwHash, Disabled: u.Disabled})
+	case KindMessage:
+		m := rec.Message
+		w.messages = append(w.messages, models.Message{Message_id: m.ID, Author_id: uint(m.AuthorID), Text: m.Text, Pub_date: m.PubDate, Flagged: m.Flagged})
+	case KindFollower:
+		w.follows = append(w.follows, models.Follower{Who_id: rec.Follower.WhoID, Whom_id: rec.Follower.WhomID})
+	}
+	if len(w.users)+len(w.messages)+len(w.follows) >= w.size {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *batchWriter) flush() error {
+	var err error
+	switch {
+	case len(w.users) > 0:
+		err = insertNew(w.db, w.users, "user_id", func(u models.User) int { return u.User_id }, &w.report.Imported.Users, &w.report.Skipped.Users)
+		w.users = w.users[:0]
+	case len(w.messages) > 0:
+		err = insertNew(w.db, w.messages, "message_id", func(m models.Message) int { return m.Message_id }, &w.report.Imported.Messages, &w.report.Skipped.Messages)
+		w.messages = w.messages[:0]
+	case len(w.follows) > 0:
+		// followers has no column with a default, so gorm does not add
+		// RETURNING and RowsAffected counts the inserted rows
+		result := w.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&w.follows)
+		err = result.Error
+		w.report.Imported.Followers += result.RowsAffected
+		w.report.Skipped.Followers += int64(len(w.follows)) - result.RowsAffected
+		w.follows = w.follows[:0]
+	}
+	return err
+}
+
+// insertNew inserts the rows whose id is not in the table yet. With
+// RETURNING, which gorm adds for the id column, RowsAffected does not tell
+// skipped rows apart, so existing ids are looked up first.
+func insertNew[T any](database *gorm.DB, rows []T, column string, id func(T) int, imported, skipped *int64) error {
+	ids := make([]int, len(rows))
+	for i, row := range rows {
+		ids[i] = id(row)
+	}
+	var found []int
+	if err := database.Model(new(T)).Where(column+" IN ?", ids).Pluck(column, &found).Error; err != nil {
+		return err
+	}
+	existing := make(map[int]bool, len(found))
+	for _, id := range found {
+		existing[id] = true
+	}
+
+	var fresh []T
+	for _, row := range rows {
+		if !existing[id(row)] {
+			fresh = append(fresh, row)
+			// duplicates within the batch are inserted once
+			existing[id(row)] = true
+		}
+	}
+	*skipped += int64(len(rows) - len(fresh))
+	if len(fresh) == 0 {
+		return nil
+	}
+	if err := database.Clauses(clause.OnConflict{DoNothing: true}).Create(&fresh).Error; err != nil {
+		return err
+	}
+	*imported += int64(len(fresh))
+	return nil
+}
+
+// resetSequences moves the postgres id sequences past the imported ids,
+// SQLite picks the next id from the table itself
+func resetSequences(database *gorm.DB) error {
+	if database.Dialector.Name() != "postgres" {
+		return nil
+	}
+	for _, seq := range []struct{ table, column string }{{"users", "user_id"}, {"messages", "message_id"}} {
+		query := fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', '%s'), COALESCE((SELECT MAX(%s) FROM %s), 0) + 1, false)",
+			seq.table, seq.column, seq.column, seq.table)
+		if err := database.Exec(query).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// Package cache keeps the public, user and home timelines of the web app,
+// so rendering them does not run the timeline queries every time. The
+// timelines live in a Cache, in memory per replica or in the database to
+// share them between replicas.
+//
+// Writers drop the timelines they change: posting drops
+// the timelines the message shows up in, following drops the home
+// timeline of the follower, and flagging, deleting and renaming drop
+// everything. Changes made by other processes reach a memory cache only
+// after the TTL, so the API, which writes without reading timelines, needs
+// the shared postgres backend.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/fanout"
+	"minitwit/metrics"
+	"minitwit/models"
+
+	"gorm.io/gorm"
+)
+
+// Backends of FromConfig
+const (
+	BackendMemory   = "memory"
+	BackendPostgres = "postgres"
+)
+
+// Timelines, the timeline label of metrics.TimelineCache
+const (
+	TimelinePublic = "public"
+	TimelineUser   = "user"
+	TimelineHome   = "home"
+)
+
+// Entry is a cached timeline, the newest Limit messages
+type Entry struct {
+	Limit    int              `json:"limit"`
+	Messages []models.Message `json:"messages"`
+}
+
+// Cache keeps timelines by key
+type Cache interface {
+	// Get returns the entry of key, false if there is none or it expired
+	Get(ctx context.Context, key string) (*Entry, bool, error)
+	// Generation counts the Deletes and Clears of everybody sharing the
+	// cache
+	Generation(ctx context.Context) (uint64, error)
+	// Set stores the entry if the cache is still at generation. A query
+	// that ran across an invalidation may have read the old timeline.
+	Set(ctx context.Context, key string, entry *Entry, ttl time.Duration, generation uint64) error
+	Delete(ctx context.Context, keys ...string) error
+	// Clear deletes every entry
+	Clear(ctx context.Context) error
+}
+
+// Timelines reads the timelines through a cache. Its methods work on a
+// nil *Timelines too, without caching.
+type Timelines struct {
+	Cache Cache
+	TTL   time.Duration
+}
+
+// FromConfig returns the configured timeline cache, nil if it is disabled
+func FromConfig(cfg config.Cache, database *gorm.DB) (*Timelines, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	switch cfg.Backend {
+	case BackendMemory:
+		return &Timelines{Cache: NewLRU(cfg.Size), TTL: cfg.TTL}, nil
+	case BackendPostgres:
+		return &Timelines{Cache: NewDBCache(database), TTL: cfg.TTL}, nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q, use memory or postgres", cfg.Backend)
+	}
+}
+
+func publicKey() string         { return TimelinePublic }
+func userKey(userID int) string { return TimelineUser + ":" + strconv.Itoa(userID) }
+func homeKey(userID int) string { return TimelineHome + ":" + strconv.Itoa(userID) }
+
+// Public is the public timeline
+func (t *Timelines) Public(ctx context.Context, database *gorm.DB, limit int) ([]models.Message, error) {
+	return t.get(ctx, TimelinePublic, publicKey(), limit, func() ([]models.Message, error) {
+		return db.QueryPublicTimelineLimit(database, limit)
+	})
+}
+
+// User is the timeline of the messages of user
+func (t *Timelines) User(ctx context.Context, database *gorm.DB, user *models.User, limit int) ([]models.Message, error) {
+	return t.get(ctx, TimelineUser, userKey(user.User_id), limit, func() ([]models.Message, error) {
+		return db.QueryUserTimelineLimit(database, user.Username, limit)
+	})
+}
+
+// Home is the timeline of the user and the users they follow, built by f
+func (t *Timelines) Home(ctx context.Context, database *gorm.DB, f *fanout.Fanout, userID int, limit int) ([]models.Message, error) {
+	return t.get(ctx, TimelineHome, homeKey(userID), limit, func() ([]models.Message, error) {
+		return f.Home(database, userID, nil, limit)
+	})
+}
+
+// get returns the cached timeline if it has enough messages, else it runs
+// query and caches the result. Cache errors are logged and the database
+// answers instead.
+func (t *Timelines) get(ctx context.Context, timeline, key string, limit int, query func() ([]models.Message, error)) ([]models.Message, error) {
+	if t == nil {
+		return query()
+	}
+	entry, ok, err := t.Cache.Get(ctx, key)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read the timeline cache", "key", key, "err", err)
+	}
+	// an entry with fewer messages than its limit is the whole timeline
+	if ok && (entry.Limit >= limit || len(entry.Messages) < entry.Limit) {
+		metrics.TimelineCache.WithLabelValues(timeline, "hit").Inc()
+		return entry.Messages[:min(limit, len(entry.Messages))], nil
+	}
+	metrics.TimelineCache.WithLabelValues(timeline, "miss").Inc()
+
+	generation, err := t.Cache.Generation(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read the timeline cache", "key", key, "err", err)
+		return query()
+	}
+	messages, err := query()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Cache.Set(ctx, key, &Entry{Limit: limit, Messages: messages}, t.TTL, generation); err != nil {
+		slog.WarnContext(ctx, "Failed to write the timeline cache", "key", key, "err", err)
+	}
+	return messages, nil
+}
+
+// MessagePosted drops the timelines a new message of authorID shows up in:
+// the public one, the author's and the home timelines of the author and
+// the followers
+func (t *Timelines) MessagePosted(ctx context.Context, database *gorm.DB, authorID int) {
+	if t == nil {
+		return
+	}
+	keys := []string{publicKey(), userKey(authorID), homeKey(authorID)}
+	followers, err := db.GetFollowerIDs(database, authorID)
+	if err != nil {
+		// the home timelines of the followers stay until the TTL
+		slog.ErrorContext(ctx, "Failed to get the followers to drop their timelines", "user_id", authorID, "err", err)
+	}
+	for _, id := range followers {
+		keys = append(keys, homeKey(id))
+	}
+	t.delete(ctx, keys...)
+}
+
+// FollowsChanged drops the home timeline of a user that followed or
+// unfollowed someone
+func (t *Timelines) FollowsChanged(ctx context.Context, userID int) {
+	if t == nil {
+		return
+	}
+	t.delete(ctx, homeKey(userID))
+}
+
+// Clear drops every timeline, for changes to many timelines at once like
+// flagging messages or deleting a user
+func (t *Timelines) Clear(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	if err := t.Cache.Clear(ctx); err != nil {
+		slog.ErrorContext(ctx, "Failed to clear the timeline cache", "err", err)
+	}
+}
+
+func (t *Timelines) delete(ctx context.Context, keys ...string) {
+	if err := t.Cache.Delete(ctx, keys...); err != nil {
+		slog.ErrorContext(ctx, "Failed to drop timelines from the cache", "keys", len(keys), "err", err)
+	}
+}
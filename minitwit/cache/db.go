@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"minitwit/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sweepInterval is how often expired entries are deleted from the table
+const sweepInterval = time.Minute
+
+// generationID is the row of timeline_cache_generations
+const generationID = 1
+
+// DBCache keeps the timelines in the timeline_caches table, so all
+// replicas share them and see each other's invalidations
+type DBCache struct {
+	db *gorm.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewDBCache(database *gorm.DB) *DBCache {
+	return &DBCache{db: database}
+}
+
+func (c *DBCache) Get(ctx context.Context, key string) (*Entry, bool, error) {
+	var rows []models.TimelineCache
+	err := c.db.WithContext(ctx).Where("key = ? AND expires_at > ?", key, time.Now().UnixMilli()).Limit(1).Find(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return nil, false, err
+	}
+	var entry Entry
+	if err := json.Unmarshal([]byte(rows[0].Data), &entry); err != nil {
+		return nil, false, err
+	}
+	return &entry, true, nil
+}
+
+// Generation creates the generation row if it is missing, so Set always
+// has one to hold
+func (c *DBCache) Generation(ctx context.Context) (uint64, error) {
+	database := c.db.WithContext(ctx)
+	generation, found, err := readGeneration(database)
+	if err != nil || found {
+		return generation, err
+	}
+	return 0, database.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.TimelineCacheGeneration{ID: generationID}).Error
+}
+
+func readGeneration(query *gorm.DB) (uint64, bool, error) {
+	var generations []uint64
+	err := query.Model(&models.TimelineCacheGeneration{}).Where("id = ?", generationID).Pluck("generation", &generations).Error
+	if err != nil || len(generations) == 0 {
+		return 0, false, err
+	}
+	return generations[0], true, nil
+}
+
+// Set holds the generation row while it writes, so an invalidation either
+// waits for the entry and deletes it or Set sees the new generation
+func (c *DBCache) Set(ctx context.Context, key string, entry *Entry, ttl time.Duration, generation uint64) error {
+	database := c.db.WithContext(ctx)
+	now := time.Now()
+	if err := c.sweep(database, now); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return database.Transaction(func(tx *gorm.DB) error {
+		query := tx
+		if tx.Dialector.Name() == "postgres" {
+			query = query.Clauses(clause.Locking{Strength: "SHARE"})
+		}
+		current, _, err := readGeneration(query)
+		if err != nil || current != generation {
+			return err
+		}
+		row := models.TimelineCache{Key: key, Data: string(data), Expires_at: now.Add(ttl).UnixMilli()}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key"}},
+			DoUpdates: clause.AssignmentColumns([]string{"data", "expires_at"}),
+		}).Create(&row).Error
+	})
+}
+
+func (c *DBCache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.invalidate(ctx, func(tx *gorm.DB) *gorm.DB { return tx.Where("key IN ?", keys) })
+}
+
+func (c *DBCache) Clear(ctx context.Context) error {
+	return c.invalidate(ctx, func(tx *gorm.DB) *gorm.DB { return tx.Where("1 = 1") })
+}
+
+// invalidate bumps the generation and deletes the entries where selects
+// in one transaction
+func (c *DBCache) invalidate(ctx context.Context, where func(tx *gorm.DB) *gorm.DB) error {
+	return c.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		bump := models.TimelineCacheGeneration{ID: generationID, Generation: 1}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "id"}},
+			DoUpdates: clause.Assignments(map[string]any{"generation": gorm.Expr("timeline_cache_generations.generation + 1")}),
+		}).Create(&bump).Error; err != nil {
+			return err
+		}
+		return where(tx).Delete(&models.TimelineCache{}).Error
+	})
+}
+
+// sweep deletes the expired entries, at most once a minute per replica
+func (c *DBCache) sweep(database *gorm.DB, now time.Time) error {
+	c.mu.Lock()
+	if now.Sub(c.lastSweep) < sweepInterval {
+		c.mu.Unlock()
+		return nil
+	}
+	c.lastSweep = now
+	c.mu.Unlock()
+	return database.Where("expires_at <= ?", now.UnixMilli()).Delete(&models.TimelineCache{}).Error
+}
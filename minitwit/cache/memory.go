@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"minitwit/models"
+)
+
+type lruItem struct {
+	key     string
+	entry   Entry
+	expires time.Time
+}
+
+// LRU keeps the timelines of one process, the least recently used are
+// evicted beyond Size entries
+type LRU struct {
+	size int
+
+	mu         sync.Mutex
+	order      *list.List
+	items      map[string]*list.Element
+	generation uint64
+}
+
+func NewLRU(size int) *LRU {
+	return &LRU{size: size, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *LRU) Get(ctx context.Context, key string) (*Entry, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	item := el.Value.(*lruItem)
+	if !time.Now().Before(item.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil, false, nil
+	}
+	c.order.MoveToFront(el)
+	// callers get their own slice
+	entry := Entry{Limit: item.entry.Limit, Messages: append([]models.Message(nil), item.entry.Messages...)}
+	return &entry, true, nil
+}
+
+func (c *LRU) Generation(ctx context.Context) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation, nil
+}
+
+func (c *LRU) Set(ctx context.Context, key string, entry *Entry, ttl time.Duration, generation uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return nil
+	}
+	item := &lruItem{key: key, entry: *entry, expires: time.Now().Add(ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = item
+		c.order.MoveToFront(el)
+		return nil
+	}
+	c.items[key] = c.order.PushFront(item)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruItem).key)
+	}
+	return nil
+}
+
+func (c *LRU) Delete(ctx context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, key := range keys {
+		if el, ok := c.items[key]; ok {
+			c.order.Remove(el)
+			delete(c.items, key)
+		}
+	}
+	return nil
+}
+
+func (c *LRU) Clear(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.order.Init()
+	c.items = map[string]*list.Element{}
+	return nil
+}
+
+// Len is the number of entries, expired ones included
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
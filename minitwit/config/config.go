@@ -0,0 +1,394 @@
+// Package config loads the settings of the web app, the API and the tools.
+// Every setting has a default, which is overridden by the config file, then
+// by the environment and last by command line flags.
+//
+// The file is YAML or TOML, picked by its extension, and is given with
+// -config or MINITWIT_CONFIG. Its keys are the ones printed at startup:
+//
+//	per_page: 50
+//	database:
+//	  host: localhost
+//	  slow_query: 500ms
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"minitwit/ratelimit"
+)
+
+// DefaultSecretKey only works for development, sessions can be forged with it
+const DefaultSecretKey = "development key"
+
+type Config struct {
+	PerPage int `key:"per_page" env:"MINITWIT_PER_PAGE" help:"messages per timeline page"`
+
+	Web        Web        `key:"web"`
+	API        API        `key:"api"`
+	Simulator  Simulator  `key:"simulator"`
+	Server     Server     `key:"server"`
+	Database   Database   `key:"database"`
+	Log        Log        `key:"log"`
+	Federation Federation `key:"federation"`
+	RateLimit  RateLimit  `key:"rate_limit"`
+	Mail       Mail       `key:"mail"`
+	OIDC       OIDC       `key:"oidc"`
+	Cache      Cache      `key:"cache"`
+	Timeline   Timeline   `key:"timeline"`
+	Jobs       Jobs       `key:"jobs"`
+}
+
+type Web struct {
+	Addr      string `key:"addr" env:"MINITWIT_ADDR" help:"listen address of the web app"`
+	SecretKey string `key:"secret_key" env:"MINITWIT_SECRET_KEY" secret:"true" help:"key that signs the session cookies and the email links"`
+	BaseURL   string `key:"base_url" env:"MINITWIT_WEB_URL" help:"public URL of the web app, used for the links in emails"`
+	// UnverifiedPostLimit keeps accounts that never confirmed their email
+	// from spamming
+	UnverifiedPostLimit int `key:"unverified_post_limit" env:"MINITWIT_UNVERIFIED_POST_LIMIT" help:"messages a day before the email is verified, -1 for no limit"`
+}
+
+type API struct {
+	Addr           string        `key:"addr" env:"MINITWIT_API_ADDR" help:"listen address of the simulator API"`
+	GRPCAddr       string        `key:"grpc_addr" env:"MINITWIT_GRPC_ADDR" help:"listen address of the gRPC service"`
+	LatestFile     string        `key:"latest_file" env:"MINITWIT_LATEST_FILE" help:"file storing the latest simulator action id"`
+	IdempotencyTTL time.Duration `key:"idempotency_ttl" env:"MINITWIT_IDEMPOTENCY_TTL" help:"how long responses are kept for retried requests"`
+	LatestRetryTTL time.Duration `key:"latest_retry_ttl" env:"MINITWIT_LATEST_RETRY_TTL" help:"how long requests repeating a latest id are replayed, the simulator restarts its ids every run"`
+}
+
+// Simulator holds the basic auth credentials the simulator sends
+type Simulator struct {
+	Username string `key:"username" env:"MINITWIT_SIMULATOR_USERNAME" help:"simulator basic auth user"`
+	Password string `key:"password" env:"MINITWIT_SIMULATOR_PASSWORD" secret:"true" help:"simulator basic auth password"`
+}
+
+// Authorization is the Authorization header the simulator sends
+func (s Simulator) Authorization() string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(s.Username+":"+s.Password))
+}
+
+type Server struct {
+	ReadHeaderTimeout time.Duration `key:"read_header_timeout" env:"MINITWIT_READ_HEADER_TIMEOUT" help:"time to read the request headers"`
+	ReadTimeout       time.Duration `key:"read_timeout" env:"MINITWIT_READ_TIMEOUT" help:"time to read a whole request"`
+	WriteTimeout      time.Duration `key:"write_timeout" env:"MINITWIT_WRITE_TIMEOUT" help:"time to write a response"`
+	IdleTimeout       time.Duration `key:"idle_timeout" env:"MINITWIT_IDLE_TIMEOUT" help:"how long idle keep-alive connections stay open"`
+	ShutdownTimeout   time.Duration `key:"shutdown_timeout" env:"MINITWIT_SHUTDOWN_TIMEOUT" help:"how long in-flight requests get on SIGTERM"`
+	TLSCert           string        `key:"tls_cert" env:"MINITWIT_TLS_CERT" help:"PEM certificate, enables TLS with tls_key"`
+	TLSKey            string        `key:"tls_key" env:"MINITWIT_TLS_KEY" help:"PEM private key"`
+	ClientIPHeader    string        `key:"client_ip_header" env:"MINITWIT_CLIENT_IP_HEADER" help:"header with the client IP set by the proxy, like X-Forwarded-For, per-IP limits are off without it"`
+	TrustedProxies    int           `key:"trusted_proxies" env:"MINITWIT_TRUSTED_PROXIES" help:"proxies in front of the app that append to client_ip_header"`
+}
+
+type Database struct {
+	Host           string        `key:"host" env:"DB_HOST" help:"postgres host"`
+	Port           string        `key:"port" env:"DB_PORT" help:"postgres port"`
+	User           string        `key:"user" env:"DB_USER" help:"postgres user"`
+	Password       string        `key:"password" env:"DB_PASSWORD" secret:"true" help:"postgres password"`
+	Name           string        `key:"name" env:"DB_DBNAME" help:"postgres database"`
+	SSLMode        string        `key:"sslmode" env:"DB_SSLMODE" help:"postgres sslmode"`
+	TimeZone       string        `key:"timezone" env:"DB_TIMEZONE" help:"time zone of the connection"`
+	ConnectTimeout time.Duration `key:"connect_timeout" env:"MINITWIT_DB_CONNECT_TIMEOUT" help:"how long to retry connecting on startup"`
+	SlowQuery      time.Duration `key:"slow_query" env:"MINITWIT_SLOW_QUERY" help:"queries slower than this are logged"`
+}
+
+// DSN is the postgres connection string
+func (d Database) DSN() string {
+	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=%s TimeZone=%s", d.Host, d.User, d.Password, d.Name, d.Port, d.SSLMode, d.TimeZone)
+}
+
+type Log struct {
+	Level  string `key:"level" env:"MINITWIT_LOG_LEVEL" help:"debug, info, warn or error"`
+	Format string `key:"format" env:"MINITWIT_LOG_FORMAT" help:"json or text"`
+}
+
+// Federation is enabled by setting BaseURL
+type Federation struct {
+	BaseURL string `key:"base_url" env:"MINITWIT_BASE_URL" help:"public URL of the web app, enables ActivityPub"`
+	Scheme  string `key:"scheme" env:"MINITWIT_FEDERATION_SCHEME" help:"scheme used to reach other servers"`
+	// the inbox fetches the urls remote servers send, keep this off in
+	// production
+	AllowPrivate bool `key:"allow_private" env:"MINITWIT_FEDERATION_ALLOW_PRIVATE" help:"also connect to loopback and private addresses, for local testing"`
+}
+
+// RateLimit rules are checked with ratelimit.ParseRules, see there for the
+// syntax
+type RateLimit struct {
+	Enabled         bool   `key:"enabled" env:"MINITWIT_RATE_LIMIT_ENABLED" help:"limit requests with the rules"`
+	Rules           string `key:"rules" env:"MINITWIT_RATE_LIMIT_RULES" help:"rules like \"POST /login ip 10/m burst 5\" separated by ;"`
+	Backend         string `key:"backend" env:"MINITWIT_RATE_LIMIT_BACKEND" help:"memory or postgres, postgres shares the limits between replicas"`
+	ExemptSimulator bool   `key:"exempt_simulator" env:"MINITWIT_RATE_LIMIT_EXEMPT_SIMULATOR" help:"do not limit requests with the simulator credentials"`
+}
+
+// Mail is how the web app sends the verification and password reset emails
+type Mail struct {
+	Backend      string `key:"backend" env:"MINITWIT_MAIL_BACKEND" help:"log, file or smtp"`
+	From         string `key:"from" env:"MINITWIT_MAIL_FROM" help:"sender of the emails"`
+	Dir          string `key:"dir" env:"MINITWIT_MAIL_DIR" help:"directory the file backend writes .eml files to"`
+	SMTPAddr     string `key:"smtp_addr" env:"MINITWIT_SMTP_ADDR" help:"host:port of the SMTP server"`
+	SMTPUsername string `key:"smtp_username" env:"MINITWIT_SMTP_USERNAME" help:"SMTP user, no authentication if empty"`
+	SMTPPassword string `key:"smtp_password" env:"MINITWIT_SMTP_PASSWORD" secret:"true" help:"SMTP password"`
+}
+
+// OIDC is the login with the company identity provider, enabled by setting
+// Issuer. The provider must allow web.base_url + /login/oidc/callback as
+// redirect URI.
+type OIDC struct {
+	Issuer       string `key:"issuer" env:"MINITWIT_OIDC_ISSUER" help:"issuer URL of the OpenID Connect provider, enables logging in with it"`
+	ClientID     string `key:"client_id" env:"MINITWIT_OIDC_CLIENT_ID" help:"client id of MiniTwit at the provider"`
+	ClientSecret string `key:"client_secret" env:"MINITWIT_OIDC_CLIENT_SECRET" secret:"true" help:"client secret, empty for a public client"`
+	Name         string `key:"name" env:"MINITWIT_OIDC_NAME" help:"name of the provider on the login page"`
+}
+
+// Cache keeps the timelines of the web app. The memory backend is per
+// replica, so posts on other replicas show up after TTL, the postgres
+// backend is shared. The API only starts with the postgres backend.
+type Cache struct {
+	Enabled bool          `key:"enabled" env:"MINITWIT_CACHE_ENABLED" help:"cache the public, user and home timelines"`
+	Backend string        `key:"backend" env:"MINITWIT_CACHE_BACKEND" help:"memory or postgres, postgres shares the cache between replicas"`
+	Size    int           `key:"size" env:"MINITWIT_CACHE_SIZE" help:"timelines the memory backend keeps"`
+	TTL     time.Duration `key:"ttl" env:"MINITWIT_CACHE_TTL" help:"how long a timeline is cached"`
+}
+
+// Timeline picks how home timelines are built. pull reads the messages of
+// the followed users on every request, fanout copies new messages into the
+// timeline of every follower with a background job.
+type Timeline struct {
+	Mode         string `key:"mode" env:"MINITWIT_TIMELINE_MODE" help:"pull or fanout"`
+	MaxFollowers int    `key:"max_followers" env:"MINITWIT_FANOUT_MAX_FOLLOWERS" help:"authors with more followers are read at request time instead of fanned out"`
+	Backfill     int    `key:"backfill" env:"MINITWIT_FANOUT_BACKFILL" help:"newest messages of a user copied into the timeline on follow"`
+}
+
+// Jobs runs the background work. The memory queue lives in the process
+// and loses its jobs on restart, the postgres queue keeps them and shares
+// them with the other replicas and minitwit worker.
+type Jobs struct {
+	Backend  string        `key:"backend" env:"MINITWIT_JOBS_BACKEND" help:"memory or postgres"`
+	Workers  int           `key:"workers" env:"MINITWIT_JOBS_WORKERS" help:"jobs a process runs at once"`
+	Embedded bool          `key:"embedded" env:"MINITWIT_JOBS_EMBEDDED" help:"run the jobs in the web app and the API, false leaves them to minitwit worker"`
+	Poll     time.Duration `key:"poll" env:"MINITWIT_JOBS_POLL" help:"how often idle workers look for due jobs"`
+	Lease    time.Duration `key:"lease" env:"MINITWIT_JOBS_LEASE" help:"how long a job may run before another worker runs it again"`
+	Addr     string        `key:"addr" env:"MINITWIT_JOBS_ADDR" help:"address of the metrics and health endpoints of minitwit worker"`
+}
+
+// DefaultRateLimitRules protect the login, the sign up, the emails and
+// posting
+const DefaultRateLimitRules = "POST /login ip 10/m; POST /register ip 5/m; POST /forgot ip 5/m; POST /settings/verify user 2/m; " +
+	"POST /add_message user 30/m burst 10; POST /api/v2/users ip 5/m; * /api/v2/* ip 300/m burst 50"
+
+func Default() *Config {
+	return &Config{
+		PerPage: 30,
+		Web: Web{
+			Addr:                ":8080",
+			SecretKey:           DefaultSecretKey,
+			BaseURL:             "http://localhost:8080",
+			UnverifiedPostLimit: 3,
+		},
+		API: API{
+			Addr:           ":8081",
+			GRPCAddr:       ":50051",
+			LatestFile:     "./latest_processed_sim_action_id.txt",
+			IdempotencyTTL: 24 * time.Hour,
+			LatestRetryTTL: 2 * time.Minute,
+		},
+		Simulator: Simulator{
+			Username: "simulator",
+			Password: "super_safe!",
+		},
+		Server: Server{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   20 * time.Second,
+			TrustedProxies:    1,
+		},
+		Database: Database{
+			Port:           "5432",
+			SSLMode:        "disable",
+			TimeZone:       "UTC",
+			ConnectTimeout: 2 * time.Minute,
+			SlowQuery:      200 * time.Millisecond,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "json",
+		},
+		Federation: Federation{
+			Scheme: "https",
+		},
+		RateLimit: RateLimit{
+			Enabled:         true,
+			Rules:           DefaultRateLimitRules,
+			Backend:         "memory",
+			ExemptSimulator: true,
+		},
+		Mail: Mail{
+			Backend: "log",
+			From:    "MiniTwit <noreply@localhost>",
+			Dir:     "./mail",
+		},
+		OIDC: OIDC{
+			Name: "company account",
+		},
+		Cache: Cache{
+			Enabled: true,
+			Backend: "postgres",
+			Size:    10000,
+			TTL:     10 * time.Second,
+		},
+		Timeline: Timeline{
+			Mode:         "pull",
+			MaxFollowers: 10000,
+			Backfill:     100,
+		},
+		Jobs: Jobs{
+			Backend:  "memory",
+			Workers:  4,
+			Embedded: true,
+			Poll:     time.Second,
+			Lease:    5 * time.Minute,
+			Addr:     ":8082",
+		},
+	}
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.PerPage >= 1 && c.PerPage <= 1000, "per_page must be between 1 and 1000, got %d", c.PerPage)
+	check(c.Web.SecretKey != "", "web.secret_key must be set")
+	u, err := url.Parse(c.Web.BaseURL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "web.base_url %q is not an http(s) URL", c.Web.BaseURL)
+	check(c.Web.UnverifiedPostLimit >= -1, "web.unverified_post_limit must be -1 or more")
+	addrs := []struct{ key, addr string }{{"web.addr", c.Web.Addr}, {"api.addr", c.API.Addr}, {"api.grpc_addr", c.API.GRPCAddr}}
+	for _, a := range addrs {
+		_, _, err := net.SplitHostPort(a.addr)
+		check(err == nil, "%s %q is not a host:port address", a.key, a.addr)
+	}
+	check(c.API.LatestFile != "", "api.latest_file must be set")
+	check(c.API.IdempotencyTTL > 0, "api.idempotency_ttl must be positive")
+	check(c.API.LatestRetryTTL > 0, "api.latest_retry_ttl must be positive")
+	check(c.Simulator.Username != "" && c.Simulator.Password != "", "simulator.username and simulator.password must be set")
+
+	durations := []struct {
+		key string
+		d   time.Duration
+	}{
+		{"server.read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+		{"database.slow_query", c.Database.SlowQuery},
+	}
+	for _, d := range durations {
+		check(d.d >= 0, "%s must not be negative", d.key)
+	}
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.TrustedProxies >= 1, "server.trusted_proxies must be at least 1")
+	check((c.Server.TLSCert == "") == (c.Server.TLSKey == ""), "server.tls_cert and server.tls_key must be set together")
+	for _, file := range []string{c.Server.TLSCert, c.Server.TLSKey} {
+		if file != "" {
+			_, err := os.Stat(file)
+			check(err == nil, "%v", err)
+		}
+	}
+
+	check(c.Database.Host != "", "database.host must be set")
+	check(c.Database.User != "", "database.user must be set")
+	check(c.Database.Name != "", "database.name must be set")
+	check(c.Database.ConnectTimeout > 0, "database.connect_timeout must be positive")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level %q is not debug, info, warn or error", c.Log.Level)
+	format := strings.ToLower(c.Log.Format)
+	check(format == "json" || format == "text", "log.format %q is not json or text", c.Log.Format)
+
+	check(c.Federation.Scheme == "http" || c.Federation.Scheme == "https", "federation.scheme %q is not http or https", c.Federation.Scheme)
+	if c.Federation.BaseURL != "" {
+		u, err := url.Parse(c.Federation.BaseURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "federation.base_url %q is not an http(s) URL", c.Federation.BaseURL)
+	}
+
+	if c.RateLimit.Enabled {
+		_, err := ratelimit.ParseRules(c.RateLimit.Rules)
+		check(err == nil, "rate_limit.rules: %v", err)
+	}
+	check(c.RateLimit.Backend == ratelimit.BackendMemory || c.RateLimit.Backend == ratelimit.BackendPostgres,
+		"rate_limit.backend %q is not memory or postgres", c.RateLimit.Backend)
+
+	_, err = mail.ParseAddress(c.Mail.From)
+	check(err == nil, "mail.from %q is not an email address", c.Mail.From)
+	switch c.Mail.Backend {
+	case "log":
+		// nobody could verify their email or reset their password
+		check(localhost(c.Web.BaseURL), "mail.backend log only works with a localhost web.base_url, set up smtp for %q", c.Web.BaseURL)
+	case "file":
+		check(c.Mail.Dir != "", "mail.dir must be set for the file backend")
+	case "smtp":
+		_, _, err := net.SplitHostPort(c.Mail.SMTPAddr)
+		check(err == nil, "mail.smtp_addr %q is not a host:port address", c.Mail.SMTPAddr)
+	default:
+		check(false, "mail.backend %q is not log, file or smtp", c.Mail.Backend)
+	}
+
+	check(c.Cache.Backend == "memory" || c.Cache.Backend == "postgres", "cache.backend %q is not memory or postgres", c.Cache.Backend)
+	check(c.Cache.Size >= 1, "cache.size must be positive")
+	check(c.Cache.TTL > 0, "cache.ttl must be positive")
+
+	check(c.Timeline.Mode == "pull" || c.Timeline.Mode == "fanout", "timeline.mode %q is not pull or fanout", c.Timeline.Mode)
+	check(c.Timeline.MaxFollowers >= 1, "timeline.max_followers must be positive")
+	check(c.Timeline.Backfill >= 0, "timeline.backfill must not be negative")
+
+	check(c.Jobs.Backend == "memory" || c.Jobs.Backend == "postgres", "jobs.backend %q is not memory or postgres", c.Jobs.Backend)
+	check(c.Jobs.Backend != "memory" || c.Jobs.Embedded, "jobs.embedded must be true with the memory backend, minitwit worker cannot see its jobs")
+	check(c.Jobs.Workers >= 1, "jobs.workers must be positive")
+	check(c.Jobs.Poll > 0, "jobs.poll must be positive")
+	check(c.Jobs.Lease > 0, "jobs.lease must be positive")
+
+	if c.OIDC.Issuer != "" {
+		u, err := url.Parse(c.OIDC.Issuer)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "oidc.issuer %q is not an http(s) URL", c.OIDC.Issuer)
+		check(c.OIDC.ClientID != "", "oidc.client_id must be set with oidc.issuer")
+		check(c.OIDC.Name != "", "oidc.name must be set with oidc.issuer")
+	}
+
+	return errors.Join(errs...)
+}
+
+// localhost reports whether rawURL points at this machine
+func localhost(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	return host == "localhost"
+}
+
+// LogValue lists the effective settings with the secrets redacted, so the
+// config can be logged as is
+func (c *Config) LogValue() slog.Value {
+	var attrs []slog.Attr
+	for _, s := range settings(c) {
+		attrs = append(attrs, slog.String(s.key, s.redacted()))
+	}
+	return slog.GroupValue(attrs...)
+}
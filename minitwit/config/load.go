@@ -0,0 +1,225 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// setting is one leaf field of Config, addressed by its dotted key
+type setting struct {
+	key, env, help string
+	secret         bool
+	value          reflect.Value
+}
+
+// settings walks the struct tags of Config
+func settings(c *Config) []setting {
+	var out []setting
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			key := prefix + field.Tag.Get("key")
+			if field.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), key+".")
+				continue
+			}
+			out = append(out, setting{
+				key:    key,
+				env:    field.Tag.Get("env"),
+				help:   field.Tag.Get("help"),
+				secret: field.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return out
+}
+
+// flagName turns database.slow_query into database-slow-query
+func (s setting) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+func (s setting) set(raw string) error {
+	switch s.value.Interface().(type) {
+	case string:
+		s.value.SetString(raw)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", s.key, raw)
+		}
+		s.value.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not true or false", s.key, raw)
+		}
+		s.value.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a duration like 10s", s.key, raw)
+		}
+		s.value.SetInt(int64(d))
+	default:
+		return fmt.Errorf("%s: unsupported type %s", s.key, s.value.Type())
+	}
+	return nil
+}
+
+func (s setting) String() string {
+	return fmt.Sprint(s.value.Interface())
+}
+
+func (s setting) redacted() string {
+	if s.secret && s.String() != "" {
+		return "[redacted]"
+	}
+	return s.String()
+}
+
+// flagValue collects flags while parsing, they are applied after the file
+// and the environment
+type flagValue struct {
+	setting
+	overrides *[]func() error
+}
+
+func (f flagValue) String() string { return "" }
+
+// IsBoolFlag lets bool settings be given as -rate-limit-enabled
+func (f flagValue) IsBoolFlag() bool { return f.value.Kind() == reflect.Bool }
+
+func (f flagValue) Set(raw string) error {
+	*f.overrides = append(*f.overrides, func() error { return f.set(raw) })
+	return nil
+}
+
+// Load builds the config from the defaults, the config file, the
+// environment and the flags in args. It does not validate the result.
+func Load(name string, args []string) (*Config, error) {
+	cfg := Default()
+	all := settings(cfg)
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("MINITWIT_CONFIG"), "YAML or TOML config file (env MINITWIT_CONFIG)")
+	var overrides []func() error
+	for _, s := range all {
+		usage := s.help
+		if s.env != "" {
+			usage += " (env " + s.env + ")"
+		}
+		if def := s.redacted(); def != "" {
+			usage += " (default " + def + ")"
+		}
+		fs.Var(flagValue{s, &overrides}, s.flagName(), usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	if *path != "" {
+		if err := loadFile(*path, all); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range all {
+		// compose passes unset variables as empty strings
+		if raw := os.Getenv(s.env); s.env != "" && raw != "" {
+			if err := s.set(raw); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	for _, override := range overrides {
+		if err := override(); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func loadFile(path string, all []setting) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &values)
+	case ".toml":
+		err = toml.Unmarshal(content, &values)
+	default:
+		return fmt.Errorf("%s: unknown config format %q, use .yaml or .toml", path, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	flat := map[string]string{}
+	flatten(values, "", flat)
+	byKey := map[string]setting{}
+	for _, s := range all {
+		byKey[s.key] = s
+	}
+	keys := make([]string, 0, len(flat))
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %s", path, key)
+		}
+		if err := s.set(flat[key]); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func flatten(values map[string]any, prefix string, out map[string]string) {
+	for key, value := range values {
+		if nested, ok := value.(map[string]any); ok {
+			flatten(nested, prefix+key+".", out)
+			continue
+		}
+		out[prefix+key] = fmt.Sprint(value)
+	}
+}
+
+// MustLoad loads and validates the config of a binary, it exits with the
+// usage for -h and with the errors for an invalid config
+func MustLoad(name string, args []string) *Config {
+	cfg, err := Load(name, args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid configuration:\n%v\n", name, err)
+		os.Exit(2)
+	}
+	return cfg
+}
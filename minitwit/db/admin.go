@@ -0,0 +1,204 @@
+package db
+
+import (
+	"minitwit/models"
+	"minitwit/utils"
+
+	"gorm.io/gorm"
+)
+
+// Queries used by the admin command, they are not on a request path so
+// they are not timed
+
+// QueryUsers lists users ordered by id, only the disabled ones if disabledOnly
+func QueryUsers(db *gorm.DB, disabledOnly bool, limit int) ([]models.User, error) {
+	var users []models.User
+	query := db.Order("user_id").Limit(limit)
+	if disabledOnly {
+		query = query.Where("disabled = ?", true)
+	}
+	err := query.Find(&users).Error
+	return users, err
+}
+
+// QueryFailedLogins lists the newest failed logins, optionally only those
+// for one username or from one IP
+func QueryFailedLogins(db *gorm.DB, username, ip string, limit int) ([]models.FailedLogin, error) {
+	var failures []models.FailedLogin
+	query := db.Order("created_at DESC, id DESC").Limit(limit)
+	if username != "" {
+		query = query.Where("username = ?", username)
+	}
+	if ip != "" {
+		query = query.Where("ip = ?", ip)
+	}
+	err := query.Find(&failures).Error
+	return failures, err
+}
+
+// SetUserDisabled disables or enables the account of userID
+func SetUserDisabled(db *gorm.DB, userID int, disabled bool) error {
+	return db.Model(&models.User{}).Where("user_id = ?", userID).Update("disabled", disabled).Error
+}
+
+// RenameUser changes the username of userID
+func RenameUser(db *gorm.DB, userID int, username string) error {
+	return db.Model(&models.User{}).Where("user_id = ?", userID).Update("username", username).Error
+}
+
+// DeletedUser counts the rows removed with a user
+type DeletedUser struct {
+	Messages int64
+	Follows  int64
+}
+
+// DeleteUser removes a user with their messages and follows in one transaction
+func DeleteUser(db *gorm.DB, userID int) (DeletedUser, error) {
+	var deleted DeletedUser
+	err := db.Transaction(func(tx *gorm.DB) error {
+		messageIDs := tx.Model(&models.Message{}).Select("message_id").Where("author_id = ?", userID)
+		if err := tx.Where("message_id IN (?)", messageIDs).Delete(&models.RemoteNote{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("author_id = ?", userID).Delete(&models.Message{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted.Messages = result.RowsAffected
+
+		// the users they followed lose a follower and their followers
+		// follow one user less
+		followed := tx.Model(&models.Follower{}).Select("whom_id").Where("who_id = ?", userID)
+		err := tx.Model(&models.User{}).Where("user_id IN (?)", followed).UpdateColumn("follower_count", gorm.Expr("follower_count - 1")).Error
+		if err != nil {
+			return err
+		}
+		followers := tx.Model(&models.Follower{}).Select("who_id").Where("whom_id = ?", userID)
+		err = tx.Model(&models.User{}).Where("user_id IN (?)", followers).UpdateColumn("following_count", gorm.Expr("following_count - 1")).Error
+		if err != nil {
+			return err
+		}
+		result = tx.Where("who_id = ? OR whom_id = ?", userID, userID).Delete(&models.Follower{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted.Follows = result.RowsAffected
+
+		if err := tx.Where("user_id = ? OR author_id = ?", userID, userID).Delete(&models.TimelineEntry{}).Error; err != nil {
+			return err
+		}
+		for _, model := range []any{&models.ActorKey{}, &models.RemoteActor{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}, &models.Identity{}, &models.PopularAuthor{}} {
+			if err := tx.Where("user_id = ?", userID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.User{}).Error
+	})
+	return deleted, err
+}
+
+// QueryMessagesForReview lists the newest messages including flagged ones,
+// optionally only the flagged ones or those of one author
+func QueryMessagesForReview(db *gorm.DB, username string, flaggedOnly bool, limit int) ([]models.Message, error) {
+	var rows []struct {
+		MessageID int    `gorm:"column:message_id"`
+		AuthorID  uint   `gorm:"column:author_id"`
+		Username  string `gorm:"column:username"`
+		Email     string `gorm:"column:email"`
+		Text      string `gorm:"column:text"`
+		PubDate   int64  `gorm:"column:pub_date"`
+		Flagged   int    `gorm:"column:flagged"`
+	}
+	query := db.Table("messages").
+		Select("messages.message_id, messages.author_id, users.username, users.email, messages.text, messages.pub_date, messages.flagged").
+		Joins("JOIN users ON messages.author_id = users.user_id")
+	if username != "" {
+		query = query.Where("users.username = ?", username)
+	}
+	if flaggedOnly {
+		query = query.Where("messages.flagged != 0")
+	}
+	err := query.
+		Order("messages.pub_date DESC, messages.message_id DESC").
+		Limit(limit).
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]models.Message, len(rows))
+	for i, m := range rows {
+		messages[i] = models.Message{
+			Message_id: m.MessageID,
+			Author_id:  m.AuthorID,
+			Author:     m.Username,
+			Email:      m.Email,
+			Text:       m.Text,
+			Pub_date:   m.PubDate,
+			PubDate:    utils.FormatTime(m.PubDate),
+			Flagged:    m.Flagged,
+		}
+	}
+	return messages, nil
+}
+
+// SetMessagesFlagged flags or unflags messages, it returns how many exist.
+// The authors are recounted, flagged messages do not count.
+func SetMessagesFlagged(db *gorm.DB, messageIDs []int, flagged bool) (int64, error) {
+	value := 0
+	if flagged {
+		value = 1
+	}
+	var updated int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Message{}).Where("message_id IN ?", messageIDs).Update("flagged", value)
+		if result.Error != nil {
+			return result.Error
+		}
+		updated = result.RowsAffected
+		authors := tx.Model(&models.Message{}).Select("author_id").Where("message_id IN ?", messageIDs)
+		return tx.Model(&models.User{}).Where("user_id IN (?)", authors).UpdateColumn("message_count", gorm.Expr(countedMessages)).Error
+	})
+	return updated, err
+}
+
+// FollowCount is the number of followers and followed users of a user
+type FollowCount struct {
+	UserID    int    `gorm:"column:user_id" json:"id"`
+	Username  string `gorm:"column:username" json:"username"`
+	Followers int64  `gorm:"column:followers" json:"followers"`
+	Following int64  `gorm:"column:following" json:"following"`
+}
+
+// QueryFollowCounts counts the follows of every user from the followers
+// table, users with the most followers first
+func QueryFollowCounts(db *gorm.DB, limit int) ([]FollowCount, error) {
+	var counts []FollowCount
+	err := db.Table("users").
+		Select(`users.user_id, users.username,
+			(SELECT COUNT(*) FROM followers WHERE followers.whom_id = users.user_id) AS followers,
+			(SELECT COUNT(*) FROM followers WHERE followers.who_id = users.user_id) AS following`).
+		Order("followers DESC, users.user_id").
+		Limit(limit).
+		Find(&counts).Error
+	return counts, err
+}
+
+// danglingFollows are follows whose user no longer exists
+func danglingFollows(db *gorm.DB) *gorm.DB {
+	users := db.Model(&models.User{}).Select("user_id")
+	return db.Where("who_id NOT IN (?) OR whom_id NOT IN (?)", users, users)
+}
+
+// CountDanglingFollows counts the follows of deleted users
+func CountDanglingFollows(db *gorm.DB) (int64, error) {
+	var count int64
+	err := danglingFollows(db).Model(&models.Follower{}).Count(&count).Error
+	return count, err
+}
+
+// DeleteDanglingFollows removes the follows of deleted users
+func DeleteDanglingFollows(db *gorm.DB) (int64, error) {
+	result := danglingFollows(db).Delete(&models.Follower{})
+	return result.RowsAffected, result.Error
+}
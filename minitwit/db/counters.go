@@ -0,0 +1,127 @@
+package db
+
+import (
+	"minitwit/metrics"
+	"minitwit/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The counters on users save a COUNT(*) over followers and messages on
+// every profile. Follows and messages are written through the functions
+// below, which change the counters in the same transaction.
+
+// counted are the values of the counters computed from the tables
+const (
+	countedFollowers = "(SELECT COUNT(*) FROM followers WHERE followers.whom_id = users.user_id)"
+	countedFollowing = "(SELECT COUNT(*) FROM followers WHERE followers.who_id = users.user_id)"
+	countedMessages  = "(SELECT COUNT(*) FROM messages WHERE messages.author_id = users.user_id AND messages.flagged = 0)"
+)
+
+// AddFollow makes whoID follow whomID, false if they already did
+func AddFollow(db *gorm.DB, whoID, whomID int) (bool, error) {
+	defer metrics.ObserveQuery("AddFollow")()
+	added := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// followers has no column with a default, so RowsAffected counts
+		// the inserted row
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Follower{Who_id: whoID, Whom_id: whomID})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		added = true
+		return changeFollowCounts(tx, whoID, whomID, 1)
+	})
+	return added, err
+}
+
+// RemoveFollow ends the follow from whoID to whomID, false if there was
+// none
+func RemoveFollow(db *gorm.DB, whoID, whomID int) (bool, error) {
+	defer metrics.ObserveQuery("RemoveFollow")()
+	removed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("who_id = ? AND whom_id = ?", whoID, whomID).Delete(&models.Follower{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		removed = true
+		return changeFollowCounts(tx, whoID, whomID, -1)
+	})
+	return removed, err
+}
+
+func changeFollowCounts(tx *gorm.DB, whoID, whomID int, delta int) error {
+	updates := []struct {
+		userID int
+		column string
+	}{{whoID, "following_count"}, {whomID, "follower_count"}}
+	// lock the rows in user_id order, two users following each other at
+	// once would deadlock otherwise
+	if whomID < whoID {
+		updates[0], updates[1] = updates[1], updates[0]
+	}
+	for _, u := range updates {
+		err := tx.Model(&models.User{}).Where("user_id = ?", u.userID).UpdateColumn(u.column, gorm.Expr(u.column+" + ?", delta)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateMessage stores message and counts it for its author
+func CreateMessage(db *gorm.DB, message *models.Message) error {
+	defer metrics.ObserveQuery("CreateMessage")()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+		if message.Flagged != 0 {
+			return nil
+		}
+		return tx.Model(&models.User{}).Where("user_id = ?", message.Author_id).
+			UpdateColumn("message_count", gorm.Expr("message_count + 1")).Error
+	})
+}
+
+// CounterDrift is a user whose counters differ from the tables
+type CounterDrift struct {
+	UserID          int    `gorm:"column:user_id" json:"id"`
+	Username        string `gorm:"column:username" json:"username"`
+	Follower_count  int64  `gorm:"column:follower_count" json:"follower_count"`
+	Following_count int64  `gorm:"column:following_count" json:"following_count"`
+	Message_count   int64  `gorm:"column:message_count" json:"message_count"`
+	Followers       int64  `gorm:"column:followers" json:"followers"`
+	Following       int64  `gorm:"column:following" json:"following"`
+	Messages        int64  `gorm:"column:messages" json:"messages"`
+}
+
+// drifted are the users whose counters are wrong
+func drifted(db *gorm.DB) *gorm.DB {
+	return db.Where("follower_count <> " + countedFollowers + " OR following_count <> " + countedFollowing + " OR message_count <> " + countedMessages)
+}
+
+// QueryCounterDrift lists the users whose counters are wrong, ordered by id
+func QueryCounterDrift(db *gorm.DB, limit int) ([]CounterDrift, error) {
+	var drift []CounterDrift
+	err := drifted(db.Table("users")).
+		Select("user_id, username, follower_count, following_count, message_count, " +
+			countedFollowers + " AS followers, " + countedFollowing + " AS following, " + countedMessages + " AS messages").
+		Order("user_id").
+		Limit(limit).
+		Find(&drift).Error
+	return drift, err
+}
+
+// FixCounters recounts the users whose counters are wrong and returns how
+// many there were
+func FixCounters(db *gorm.DB) (int64, error) {
+	result := drifted(db.Model(&models.User{})).UpdateColumns(map[string]any{
+		"follower_count":  gorm.Expr(countedFollowers),
+		"following_count": gorm.Expr(countedFollowing),
+		"message_count":   gorm.Expr(countedMessages),
+	})
+	return result.RowsAffected, result.Error
+}
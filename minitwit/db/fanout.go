@@ -0,0 +1,123 @@
+package db
+
+import (
+	"minitwit/metrics"
+	"minitwit/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CountFollowers counts the users that follow userID
+func CountFollowers(db *gorm.DB, userID int) (int64, error) {
+	defer metrics.ObserveQuery("CountFollowers")()
+	var count int64
+	err := db.Model(&models.Follower{}).Where("whom_id = ?", userID).Count(&count).Error
+	return count, err
+}
+
+// IsPopularAuthor tells if the messages of userID are read at request time
+func IsPopularAuthor(db *gorm.DB, userID int) (bool, error) {
+	var count int64
+	err := db.Model(&models.PopularAuthor{}).Where("user_id = ?", userID).Count(&count).Error
+	return count > 0, err
+}
+
+// AddPopularAuthor stops fanning out the messages of userID
+func AddPopularAuthor(db *gorm.DB, userID int) error {
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.PopularAuthor{User_id: userID}).Error
+}
+
+// GetPopularFollowingIDs returns the popular authors userID follows
+func GetPopularFollowingIDs(db *gorm.DB, userID int) ([]int, error) {
+	defer metrics.ObserveQuery("GetPopularFollowingIDs")()
+	var ids []int
+	err := db.Model(&models.PopularAuthor{}).
+		Joins("JOIN followers ON followers.whom_id = popular_authors.user_id").
+		Where("followers.who_id = ?", userID).
+		Pluck("popular_authors.user_id", &ids).Error
+	return ids, err
+}
+
+// FanOutMessage copies a message into the timelines of the followers of
+// its author and returns how many it reached
+func FanOutMessage(db *gorm.DB, message models.Message) (int64, error) {
+	defer metrics.ObserveQuery("FanOutMessage")()
+	result := db.Exec(`INSERT INTO timeline_entries (user_id, message_id, author_id, pub_date)
+		SELECT who_id, ?, ?, ? FROM followers WHERE whom_id = ?
+		ON CONFLICT DO NOTHING`,
+		message.Message_id, message.Author_id, message.Pub_date, message.Author_id)
+	return result.RowsAffected, result.Error
+}
+
+// BackfillTimeline copies the newest limit messages of authorID into the
+// timeline of userID
+func BackfillTimeline(db *gorm.DB, userID, authorID, limit int) error {
+	defer metrics.ObserveQuery("BackfillTimeline")()
+	return db.Exec(`INSERT INTO timeline_entries (user_id, message_id, author_id, pub_date)
+		SELECT ?, message_id, author_id, pub_date FROM messages WHERE author_id = ?
+		ORDER BY pub_date DESC, message_id DESC LIMIT ?
+		ON CONFLICT DO NOTHING`, userID, authorID, limit).Error
+}
+
+// PruneTimeline removes the messages of authorID from the timeline of userID
+func PruneTimeline(db *gorm.DB, userID, authorID int) error {
+	defer metrics.ObserveQuery("PruneTimeline")()
+	return db.Where("user_id = ? AND author_id = ?", userID, authorID).Delete(&models.TimelineEntry{}).Error
+}
+
+// RebuildTimelines fans out the messages already posted: authors with
+// more than maxFollowers followers become popular, every user gets the
+// newest perUser messages of the others they follow. It returns the
+// number of timeline entries.
+func RebuildTimelines(db *gorm.DB, maxFollowers, perUser int) (int64, error) {
+	var entries int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{&models.TimelineEntry{}, &models.PopularAuthor{}} {
+			if err := tx.Where("1 = 1").Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		err := tx.Exec(`INSERT INTO popular_authors (user_id)
+			SELECT whom_id FROM followers GROUP BY whom_id HAVING COUNT(*) > ?`, maxFollowers).Error
+		if err != nil {
+			return err
+		}
+		result := tx.Exec(`INSERT INTO timeline_entries (user_id, message_id, author_id, pub_date)
+			SELECT user_id, message_id, author_id, pub_date FROM (
+				SELECT followers.who_id AS user_id, messages.message_id, messages.author_id, messages.pub_date,
+					ROW_NUMBER() OVER (PARTITION BY followers.who_id ORDER BY messages.pub_date DESC, messages.message_id DESC) AS n
+				FROM followers JOIN messages ON messages.author_id = followers.whom_id
+				WHERE followers.whom_id NOT IN (SELECT user_id FROM popular_authors)
+			) AS newest WHERE n <= ?`, perUser)
+		entries = result.RowsAffected
+		return result.Error
+	})
+	return entries, err
+}
+
+// QueryTimelineEntriesPage works like QueryMessagesPage on the fanned out
+// timeline of userID
+func QueryTimelineEntriesPage(db *gorm.DB, userID int, cursor *MessageCursor, limit int) ([]models.Message, error) {
+	defer metrics.ObserveQuery("QueryTimelineEntriesPage")()
+	var messages []tempMessage
+
+	query := db.Table("timeline_entries").
+		Select("messages.message_id, messages.author_id, users.username, users.email, messages.text, messages.pub_date").
+		Joins("JOIN messages ON messages.message_id = timeline_entries.message_id").
+		Joins("JOIN users ON messages.author_id = users.user_id").
+		Where("timeline_entries.user_id = ? AND messages.flagged = 0", userID)
+	if cursor != nil {
+		query = query.Where("timeline_entries.pub_date < ? OR (timeline_entries.pub_date = ? AND timeline_entries.message_id < ?)", cursor.PubDate, cursor.PubDate, cursor.MessageID)
+	}
+	err := query.
+		Order("timeline_entries.pub_date DESC, timeline_entries.message_id DESC").
+		Limit(limit).
+		Find(&messages).Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	return convertToMessages(messages), nil
+}
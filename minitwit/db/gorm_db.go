@@ -1,43 +1,123 @@
 package db
 
 import (
-	"fmt"
+	"context"
+	"log/slog"
+	"minitwit/config"
+	"minitwit/logging"
+	"minitwit/metrics"
 	"minitwit/models"
+	"minitwit/tracing"
 	"minitwit/utils"
-	"os"
+	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 )
 
+// PER_PAGE is the page size of API v2 and the default of the timeline
+// queries, the web app uses config.PerPage
 var PER_PAGE = 30
 
-func GormConnectDB() *gorm.DB {
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=%s TimeZone=%s", os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_DBNAME"), os.Getenv("DB_PORT"), os.Getenv("DB_SSLMODE"), os.Getenv("DB_TIMEZONE"))
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		// make gorm stop printing errors in terminal as otherwise
-		// gorm will print errors even if they are handled
-		Logger: logger.Default.LogMode(logger.Warn),
-	})
+// Models are the tables created by AutoMigrateDB, followers is migrated
+// separately by MigrateFollowers
+var Models = []any{&models.User{}, &models.Message{}, &models.RemoteActor{}, &models.ActorKey{}, &models.RemoteNote{}, &models.IdempotencyKey{}, &models.RateLimitBucket{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}, &models.Identity{}, &models.TimelineCache{}, &models.TimelineCacheGeneration{}, &models.TimelineEntry{}, &models.PopularAuthor{}, &models.Job{}}
+
+// GormConnectDB connects to postgres. The database may still be starting,
+// e.g. when the whole stack comes up at once, so failed attempts are
+// retried with backoff until cfg.ConnectTimeout has passed.
+func GormConnectDB(cfg config.Database) *gorm.DB {
+	db, err := ConnectWithRetry(func() (*gorm.DB, error) {
+		return gorm.Open(postgres.Open(cfg.DSN()), &gorm.Config{
+			// errors are logged by the callers, gorm only logs slow queries
+			Logger: logging.NewGormLogger(cfg.SlowQuery),
+		})
+	}, cfg.ConnectTimeout)
 	if err != nil {
-		panic("failed to connect database")
+		logging.Fatal("Failed to connect to the database", "host", cfg.Host, "err", err)
+	}
+	if err := db.Use(tracing.GormPlugin()); err != nil {
+		logging.Fatal("Failed to register the tracing plugin", "err", err)
 	}
 
 	return db
 }
 
-func AutoMigrateDB() {
+// ConnectWithRetry calls open until it succeeds, waiting 500ms after the
+// first failure and doubling the wait up to 10s. It gives up with the last
+// error once timeout has passed.
+func ConnectWithRetry(open func() (*gorm.DB, error), timeout time.Duration) (*gorm.DB, error) {
+	deadline := time.Now().Add(timeout)
+	wait := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		db, err := open()
+		if err == nil {
+			return db, nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return nil, err
+		}
+		slog.Warn("Database is not reachable yet, retrying", "attempt", attempt, "retry_in", wait, "err", err)
+		time.Sleep(wait)
+		wait = min(wait*2, 10*time.Second)
+	}
+}
+
+// Close closes the connection pool, used on shutdown
+func Close(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+func AutoMigrateDB(cfg config.Database) {
 	// Creates/Connects to the database tables
-	db := GormConnectDB()
-	err := db.AutoMigrate(&models.User{}, &models.Message{})
+	db := GormConnectDB(cfg)
+	defer Close(db)
+	// the counters of existing users start at 0 and are counted once
+	newCounters := db.Migrator().HasTable(&models.User{}) && !db.Migrator().HasColumn(&models.User{}, "message_count")
+	err := db.AutoMigrate(Models...)
 	if err != nil {
-		fmt.Println("Error in AutoMigrateDB - if api and db are running at the same time, this is expected")
+		slog.Warn("AutoMigrateDB failed, this is expected if api and web app start at the same time", "err", err)
 		return
 	}
+	if err := MigrateFollowers(db); err != nil {
+		slog.Error("AutoMigrateDB could not add the unique index on followers", "err", err)
+	}
+	if newCounters {
+		fixed, err := FixCounters(db)
+		if err != nil {
+			slog.Error("AutoMigrateDB could not count the follows and messages, run minitwit admin users recount -fix", "err", err)
+		} else {
+			slog.Info("Counted the follows and messages of the existing users", "users", fixed)
+		}
+	}
+}
+
+// MigrateFollowers removes duplicate follows, which retried simulator
+// requests used to insert, and adds the unique index on (who_id, whom_id)
+func MigrateFollowers(db *gorm.DB) error {
+	if db.Migrator().HasIndex(&models.Follower{}, "idx_followers_who_whom") {
+		// no duplicates left, only later indexes can be missing
+		return db.AutoMigrate(&models.Follower{})
+	}
+	// keep one row of every pair
+	dedupe := `DELETE FROM followers WHERE rowid NOT IN (
+		SELECT MIN(rowid) FROM followers GROUP BY who_id, whom_id)`
+	if db.Dialector.Name() == "postgres" {
+		dedupe = `DELETE FROM followers a USING followers b
+		WHERE a.ctid > b.ctid AND a.who_id = b.who_id AND a.whom_id = b.whom_id`
+	}
+	if err := db.Exec(dedupe).Error; err != nil {
+		return err
+	}
+	return db.AutoMigrate(&models.Follower{})
 }
 
 func GormGetUserId(db *gorm.DB, username string) (int, error) {
+	defer metrics.ObserveQuery("GormGetUserId")()
 	user := models.User{}
 	// Get first matched record
 	result := db.Select("user_id").Where("username = ?", username).First(&user)
@@ -74,7 +154,7 @@ func convertToMessages(messages []tempMessage) []models.Message {
 
 // flexible query function to query messages with where clause and args
 // fits for all timeline queries
-func queryMessages(db *gorm.DB, whereClause string, args ...interface{}) ([]models.Message, error) {
+func queryMessages(db *gorm.DB, limit int, whereClause string, args ...interface{}) ([]models.Message, error) {
 	var messages []tempMessage
 
 	err := db.Table("messages").
@@ -82,7 +162,7 @@ func queryMessages(db *gorm.DB, whereClause string, args ...interface{}) ([]mode
 		Joins("JOIN users ON messages.author_id = users.user_id").
 		Where(whereClause, args...).
 		Order("messages.pub_date DESC").
-		Limit(PER_PAGE).
+		Limit(limit).
 		Find(&messages).Error
 
 	if err != nil {
@@ -94,27 +174,42 @@ func queryMessages(db *gorm.DB, whereClause string, args ...interface{}) ([]mode
 
 // Queries the timeline ("/")
 func QueryTimeline(db *gorm.DB, userID int) ([]models.Message, error) {
-	// Get list of whom user is following
-	var followers []int
-	db.Model(&models.Follower{}).Where("Who_id = ?", userID).Select("whom_id").Find(&followers).Limit(32)
-
-	// Add current user to followers for the query
-	followersWithUser := append(followers, userID)
+	return QueryTimelineLimit(db, userID, PER_PAGE)
+}
 
-	return queryMessages(db, "messages.flagged = 0 AND users.user_id IN ?", followersWithUser)
+// QueryTimelineLimit returns the newest limit messages of the timeline
+func QueryTimelineLimit(db *gorm.DB, userID int, limit int) ([]models.Message, error) {
+	defer metrics.ObserveQuery("QueryTimeline")()
+	// all followed users, limit applies to the messages
+	following, err := GetFollowingIDs(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	return queryMessages(db, limit, "messages.flagged = 0 AND users.user_id IN ?", append(following, userID))
 }
 
 // Queries the user's timeline ("/<username>")
 func QueryUserTimeline(db *gorm.DB, username string) ([]models.Message, error) {
-	return queryMessages(db, "messages.flagged = 0 AND users.username = ?", username)
+	return QueryUserTimelineLimit(db, username, PER_PAGE)
+}
+
+func QueryUserTimelineLimit(db *gorm.DB, username string, limit int) ([]models.Message, error) {
+	defer metrics.ObserveQuery("QueryUserTimeline")()
+	return queryMessages(db, limit, "messages.flagged = 0 AND users.username = ?", username)
 }
 
 // Queries the public timeline ("/public")
 func QueryPublicTimeline(db *gorm.DB) ([]models.Message, error) {
-	return queryMessages(db, "messages.flagged = 0")
+	return QueryPublicTimelineLimit(db, PER_PAGE)
+}
+
+func QueryPublicTimelineLimit(db *gorm.DB, limit int) ([]models.Message, error) {
+	defer metrics.ObserveQuery("QueryPublicTimeline")()
+	return queryMessages(db, limit, "messages.flagged = 0")
 }
 
 func IsUserFollowing(db *gorm.DB, whoID, whomID int) (bool, error) {
+	defer metrics.ObserveQuery("IsUserFollowing")()
 	var count int64
 	err := db.Table("followers").Where("who_id = ? AND whom_id = ?", whoID, whomID).Count(&count).Error
 	if err != nil {
@@ -122,3 +217,99 @@ func IsUserFollowing(db *gorm.DB, whoID, whomID int) (bool, error) {
 	}
 	return count > 0, nil
 }
+
+// MessageCursor marks the last message of a page.
+// Pages are ordered by pub_date, ties broken by message_id.
+type MessageCursor struct {
+	PubDate   int64
+	MessageID int
+}
+
+// QueryMessagesPage works like queryMessages, but returns the page of
+// messages after cursor (or the first page if cursor is nil)
+func QueryMessagesPage(db *gorm.DB, cursor *MessageCursor, limit int, whereClause string, args ...interface{}) ([]models.Message, error) {
+	defer metrics.ObserveQuery("QueryMessagesPage")()
+	var messages []tempMessage
+
+	query := db.Table("messages").
+		Select("messages.message_id, messages.author_id, users.username, users.email, messages.text, messages.pub_date").
+		Joins("JOIN users ON messages.author_id = users.user_id").
+		Where(whereClause, args...)
+	if cursor != nil {
+		query = query.Where("messages.pub_date < ? OR (messages.pub_date = ? AND messages.message_id < ?)", cursor.PubDate, cursor.PubDate, cursor.MessageID)
+	}
+	err := query.
+		Order("messages.pub_date DESC, messages.message_id DESC").
+		Limit(limit).
+		Find(&messages).Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	return convertToMessages(messages), nil
+}
+
+// QueryFollowedAmong returns the ids of whomIDs that whoID follows
+func QueryFollowedAmong(db *gorm.DB, whoID int, whomIDs []int) ([]int, error) {
+	defer metrics.ObserveQuery("QueryFollowedAmong")()
+	var ids []int
+	if len(whomIDs) == 0 {
+		return ids, nil
+	}
+	err := db.Model(&models.Follower{}).Where("who_id = ? AND whom_id IN ?", whoID, whomIDs).Pluck("whom_id", &ids).Error
+	return ids, err
+}
+
+// Ids of the users whoID follows
+func GetFollowingIDs(db *gorm.DB, whoID int) ([]int, error) {
+	defer metrics.ObserveQuery("GetFollowingIDs")()
+	var ids []int
+	err := db.Model(&models.Follower{}).Where("who_id = ?", whoID).Pluck("whom_id", &ids).Error
+	return ids, err
+}
+
+// Ids of the users that follow whomID
+func GetFollowerIDs(db *gorm.DB, whomID int) ([]int, error) {
+	defer metrics.ObserveQuery("GetFollowerIDs")()
+	var ids []int
+	err := db.Model(&models.Follower{}).Where("whom_id = ?", whomID).Pluck("who_id", &ids).Error
+	return ids, err
+}
+
+// Users that userID follows, ordered by user_id and starting after afterID
+func QueryFollowing(db *gorm.DB, userID int, afterID int, limit int) ([]models.User, error) {
+	defer metrics.ObserveQuery("QueryFollowing")()
+	var users []models.User
+	err := db.Table("users").
+		Select("users.*").
+		Joins("JOIN followers ON followers.whom_id = users.user_id").
+		Where("followers.who_id = ? AND users.user_id > ?", userID, afterID).
+		Order("users.user_id").
+		Limit(limit).
+		Find(&users).Error
+	return users, err
+}
+
+// Users that follow userID, ordered by user_id and starting after afterID
+func QueryFollowers(db *gorm.DB, userID int, afterID int, limit int) ([]models.User, error) {
+	defer metrics.ObserveQuery("QueryFollowers")()
+	var users []models.User
+	err := db.Table("users").
+		Select("users.*").
+		Joins("JOIN followers ON followers.who_id = users.user_id").
+		Where("followers.whom_id = ? AND users.user_id > ?", userID, afterID).
+		Order("users.user_id").
+		Limit(limit).
+		Find(&users).Error
+	return users, err
+}
+
+// WithContext binds the database to a request context, so slow query logs
+// carry the request id. Handlers tested without a database get nil back.
+func WithContext(database *gorm.DB, ctx context.Context) *gorm.DB {
+	if database == nil {
+		return nil
+	}
+	return database.WithContext(ctx)
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"fmt"
+
+	"minitwit/models"
+
+	"gorm.io/gorm"
+)
+
+// CheckMigrations reports the first table, column or index that
+// AutoMigrateDB would still have to create
+func CheckMigrations(db *gorm.DB) error {
+	migrator := db.Migrator()
+	for _, model := range append(Models, &models.Follower{}) {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		table := stmt.Schema.Table
+		if !migrator.HasTable(model) {
+			return fmt.Errorf("table %s is missing", table)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !migrator.HasColumn(model, field.DBName) {
+				return fmt.Errorf("column %s.%s is missing", table, field.DBName)
+			}
+		}
+	}
+	if !migrator.HasIndex(&models.Follower{}, "idx_followers_who_whom") {
+		return fmt.Errorf("index idx_followers_who_whom is missing")
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+// Package fanout builds home timelines on write. A new message is copied
+// into the timeline_entries of every follower by a background job, so
+// reading a home timeline is one indexed query instead of searching the
+// messages of every followed user.
+//
+// Authors with more than MaxFollowers followers become popular and are not
+// copied, reading pulls their messages and the reader's own at request
+// time and merges them in. An author stays popular until the timelines are
+// rebuilt. Following copies the newest Backfill messages of the followed
+// user, unfollowing removes them.
+package fanout
+
+import (
+	"context"
+	"log/slog"
+
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/jobs"
+	"minitwit/metrics"
+	"minitwit/models"
+
+	"gorm.io/gorm"
+)
+
+// Modes of config.Timeline
+const (
+	ModePull   = "pull"
+	ModeFanout = "fanout"
+)
+
+// JobKind is the job that fans out a message
+const JobKind = "fanout.message"
+
+// job is the payload of JobKind
+type job struct {
+	MessageID int   `json:"message_id"`
+	AuthorID  int   `json:"author_id"`
+	PubDate   int64 `json:"pub_date"`
+}
+
+// Fanout keeps the timeline_entries up to date. Its methods work on a nil
+// *Fanout too, which builds the timelines at read time.
+type Fanout struct {
+	db           *gorm.DB
+	maxFollowers int
+	backfill     int
+	// done runs once the followers of authorID have the message, so their
+	// cached timelines can be dropped
+	done  func(ctx context.Context, database *gorm.DB, authorID int)
+	queue jobs.Queue
+}
+
+// New fans out through queue, done may be nil. The jobs run in the pools
+// that Register added the handler to.
+func New(database *gorm.DB, cfg config.Timeline, queue jobs.Queue, done func(ctx context.Context, database *gorm.DB, authorID int)) *Fanout {
+	return &Fanout{
+		db:           database,
+		maxFollowers: cfg.MaxFollowers,
+		backfill:     cfg.Backfill,
+		done:         done,
+		queue:        queue,
+	}
+}
+
+// FromConfig returns the fan out of cfg, nil in pull mode
+func FromConfig(database *gorm.DB, cfg config.Timeline, queue jobs.Queue, done func(ctx context.Context, database *gorm.DB, authorID int)) *Fanout {
+	if cfg.Mode != ModeFanout {
+		return nil
+	}
+	return New(database, cfg, queue, done)
+}
+
+// Register runs the fan out jobs in pool
+func (f *Fanout) Register(pool *jobs.Pool) {
+	if f == nil {
+		return
+	}
+	pool.Handle(JobKind, f.handle)
+}
+
+// MessagePosted queues a new message for the timelines of the followers
+// of its author. If the queue fails the message is fanned out right away,
+// so posting slows down instead of losing it.
+func (f *Fanout) MessagePosted(message models.Message) {
+	if f == nil {
+		return
+	}
+	ctx := context.Background()
+	payload := job{MessageID: message.Message_id, AuthorID: int(message.Author_id), PubDate: message.Pub_date}
+	err := jobs.Enqueue(ctx, f.queue, JobKind, payload)
+	if err == nil {
+		return
+	}
+	slog.Error("Failed to queue fan out", "message_id", message.Message_id, "err", err)
+	if err := f.fanOut(ctx, message); err != nil {
+		// the followers miss the message until the timelines are rebuilt
+		slog.Error("Failed to fan out message", "message_id", message.Message_id, "author_id", payload.AuthorID, "err", err)
+	}
+}
+
+// handle runs a JobKind job, a failed fan out is retried
+func (f *Fanout) handle(ctx context.Context, j *jobs.Job) error {
+	var payload job
+	if err := j.Decode(&payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	return f.fanOut(ctx, models.Message{Message_id: payload.MessageID, Author_id: uint(payload.AuthorID), Pub_date: payload.PubDate})
+}
+
+func (f *Fanout) fanOut(ctx context.Context, message models.Message) error {
+	database := f.db.WithContext(ctx)
+	result, err := f.copyToFollowers(database, message)
+	if err != nil {
+		metrics.FanoutMessages.WithLabelValues("failed").Inc()
+		return err
+	}
+	metrics.FanoutMessages.WithLabelValues(result).Inc()
+	if f.done != nil {
+		f.done(ctx, database, int(message.Author_id))
+	}
+	return nil
+}
+
+// copyToFollowers fans out message unless its author is popular
+func (f *Fanout) copyToFollowers(database *gorm.DB, message models.Message) (string, error) {
+	authorID := int(message.Author_id)
+	popular, err := db.IsPopularAuthor(database, authorID)
+	if err != nil || popular {
+		return "pulled", err
+	}
+	followers, err := db.CountFollowers(database, authorID)
+	if err != nil {
+		return "", err
+	}
+	if followers > int64(f.maxFollowers) {
+		slog.Info("Author became popular, their messages are pulled", "author_id", authorID, "followers", followers)
+		return "pulled", db.AddPopularAuthor(database, authorID)
+	}
+	_, err = db.FanOutMessage(database, message)
+	return "fanned_out", err
+}
+
+// Followed copies the newest messages of whomID into the timeline of whoID
+func (f *Fanout) Followed(database *gorm.DB, whoID, whomID int) {
+	if f == nil {
+		return
+	}
+	popular, err := db.IsPopularAuthor(database, whomID)
+	if err == nil && !popular {
+		err = db.BackfillTimeline(database, whoID, whomID, f.backfill)
+	}
+	if err != nil {
+		slog.ErrorContext(database.Statement.Context, "Failed to backfill timeline", "user_id", whoID, "author_id", whomID, "err", err)
+	}
+}
+
+// Unfollowed removes the messages of whomID from the timeline of whoID
+func (f *Fanout) Unfollowed(database *gorm.DB, whoID, whomID int) {
+	if f == nil {
+		return
+	}
+	if err := db.PruneTimeline(database, whoID, whomID); err != nil {
+		slog.ErrorContext(database.Statement.Context, "Failed to prune timeline", "user_id", whoID, "author_id", whomID, "err", err)
+	}
+}
+
+// Home returns the page of the home timeline of userID after cursor, the
+// first page if cursor is nil: their own messages and those of the users
+// they follow
+func (f *Fanout) Home(database *gorm.DB, userID int, cursor *db.MessageCursor, limit int) ([]models.Message, error) {
+	if f == nil {
+		following, err := db.GetFollowingIDs(database, userID)
+		if err != nil {
+			return nil, err
+		}
+		return db.QueryMessagesPage(database, cursor, limit, "messages.flagged = 0 AND messages.author_id IN ?", append(following, userID))
+	}
+
+	copied, err := db.QueryTimelineEntriesPage(database, userID, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	popular, err := db.GetPopularFollowingIDs(database, userID)
+	if err != nil {
+		return nil, err
+	}
+	pulled, err := db.QueryMessagesPage(database, cursor, limit, "messages.flagged = 0 AND messages.author_id IN ?", append(popular, userID))
+	if err != nil {
+		return nil, err
+	}
+	return merge(copied, pulled, limit), nil
+}
+
+// merge joins two timelines ordered newest first into one of at most limit
+// messages. Messages of an author that became popular can be in both.
+func merge(a, b []models.Message, limit int) []models.Message {
+	messages := make([]models.Message, 0, min(len(a)+len(b), limit))
+	seen := make(map[int]bool, len(a)+len(b))
+	for len(messages) < limit && (len(a) > 0 || len(b) > 0) {
+		var next models.Message
+		if len(b) == 0 || (len(a) > 0 && newer(a[0], b[0])) {
+			next, a = a[0], a[1:]
+		} else {
+			next, b = b[0], b[1:]
+		}
+		if !seen[next.Message_id] {
+			seen[next.Message_id] = true
+			messages = append(messages, next)
+		}
+	}
+	return messages
+}
+
+func newer(a, b models.Message) bool {
+	if a.Pub_date != b.Pub_date {
+		return a.Pub_date > b.Pub_date
+	}
+	return a.Message_id > b.Message_id
+}
+
+// Rebuild fills the timelines from the messages already posted, after
+// switching to fanout mode or importing a backup
+func Rebuild(database *gorm.DB, cfg config.Timeline) (int64, error) {
+	return db.RebuildTimelines(database, cfg.MaxFollowers, cfg.Backfill)
+}
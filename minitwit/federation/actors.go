@@ -0,0 +1,194 @@
+package federation
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"minitwit/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrNotRemote is returned for handles that belong to this instance
+var ErrNotRemote = errors.New("handle is not a remote account")
+
+// localKey returns the signing key of a local user, creating it on first use
+func (s *Service) localKey(userID int) (*rsa.PrivateKey, string, error) {
+	var key models.ActorKey
+	err := s.DB.Where("user_id = ?", userID).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		privPem, pubPem, err := generateKeyPair()
+		if err != nil {
+			return nil, "", err
+		}
+		// another replica might have created the key in the meantime
+		key = models.ActorKey{User_id: userID, Private_key: privPem, Public_key: pubPem}
+		if err := s.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&key).Error; err != nil {
+			return nil, "", err
+		}
+		err = s.DB.Where("user_id = ?", userID).First(&key).Error
+		if err != nil {
+			return nil, "", err
+		}
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	priv, err := parsePrivateKey(key.Private_key)
+	if err != nil {
+		return nil, "", err
+	}
+	return priv, key.Public_key, nil
+}
+
+// IsRemote reports whether userID is the local copy of a remote account
+func (s *Service) IsRemote(userID int) (*models.RemoteActor, bool) {
+	var actor models.RemoteActor
+	if err := s.DB.Where("user_id = ?", userID).First(&actor).Error; err != nil {
+		return nil, false
+	}
+	return &actor, true
+}
+
+func (s *Service) getJSON(uri string, accept string, v any) error {
+	if err := checkURL(uri); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", accept)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %d", uri, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// fetchActor downloads an actor document and stores it as a remote user
+func (s *Service) fetchActor(actorURI string) (*models.RemoteActor, error) {
+	actor, err := s.getActor(actorURI)
+	if err != nil {
+		return nil, err
+	}
+	return s.storeActor(actor)
+}
+
+// getActor downloads an actor document without storing it
+func (s *Service) getActor(actorURI string) (Actor, error) {
+	var actor Actor
+	if err := s.getJSON(actorURI, activityContentType, &actor); err != nil {
+		return actor, err
+	}
+	if actor.ID != actorURI || actor.Inbox == "" || actor.PreferredUsername == "" || checkURL(actor.Inbox) != nil {
+		return actor, fmt.Errorf("invalid actor document at %s", actorURI)
+	}
+	return actor, nil
+}
+
+func (s *Service) storeActor(actor Actor) (*models.RemoteActor, error) {
+	u, err := url.Parse(actor.ID)
+	if err != nil {
+		return nil, err
+	}
+	username := actor.PreferredUsername + "@" + u.Host
+
+	remote := models.RemoteActor{}
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("actor_uri = ?", actor.ID).First(&remote).Error
+		if err == nil {
+			// refresh inbox and key, they can be rotated
+			remote.Inbox = actor.Inbox
+			remote.Public_key = actor.PublicKey.PublicKeyPem
+			return tx.Save(&remote).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		user := models.User{Username: username}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		remote = models.RemoteActor{
+			User_id:    user.User_id,
+			Actor_uri:  actor.ID,
+			Inbox:      actor.Inbox,
+			Public_key: actor.PublicKey.PublicKeyPem,
+		}
+		return tx.Create(&remote).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &remote, nil
+}
+
+// remoteActor looks up a known remote actor, fetching it if it is new
+func (s *Service) remoteActor(actorURI string) (*models.RemoteActor, error) {
+	var remote models.RemoteActor
+	err := s.DB.Where("actor_uri = ?", actorURI).First(&remote).Error
+	if err == nil {
+		return &remote, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return s.fetchActor(actorURI)
+}
+
+// splitHandle turns "user@host" or "acct:user@host" into its parts
+func splitHandle(handle string) (string, string, bool) {
+	handle = strings.TrimPrefix(strings.TrimPrefix(handle, "acct:"), "@")
+	user, host, ok := strings.Cut(handle, "@")
+	if !ok || user == "" || host == "" {
+		return "", "", false
+	}
+	return user, host, true
+}
+
+// ResolveHandle finds a remote account by its user@host handle via
+// webfinger and stores it locally.
+func (s *Service) ResolveHandle(handle string) (*models.RemoteActor, error) {
+	user, host, ok := splitHandle(handle)
+	if !ok {
+		return nil, fmt.Errorf("invalid handle %q", handle)
+	}
+	if host == s.Host() {
+		return nil, ErrNotRemote
+	}
+
+	// already known, no need to ask the other server
+	var existing models.RemoteActor
+	err := s.DB.Table("remote_actors").
+		Joins("JOIN users ON users.user_id = remote_actors.user_id").
+		Where("users.username = ?", user+"@"+host).
+		First(&existing).Error
+	if err == nil {
+		return &existing, nil
+	}
+
+	wfURL := fmt.Sprintf("%s://%s/.well-known/webfinger?resource=%s", s.Scheme, host, url.QueryEscape("acct:"+user+"@"+host))
+	var wf webFingerResponse
+	if err := s.getJSON(wfURL, "application/jrd+json", &wf); err != nil {
+		return nil, err
+	}
+	for _, link := range wf.Links {
+		if link.Rel == "self" && strings.HasPrefix(link.Type, "application/") {
+			return s.remoteActor(link.Href)
+		}
+	}
+	return nil, fmt.Errorf("no actor link for %s", handle)
+}
@@ -0,0 +1,251 @@
+package federation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"minitwit/jobs"
+	"minitwit/models"
+
+	"gorm.io/gorm"
+)
+
+var activityContext = "https://www.w3.org/ns/activitystreams"
+
+// Jobs of the deliveries. A NoteJobKind job queues a DeliveryJobKind job
+// for every inbox, so a failed inbox is retried without sending the note
+// to the others again.
+const (
+	NoteJobKind     = "federation.note"
+	DeliveryJobKind = "federation.deliver"
+)
+
+// noteJob is the payload of NoteJobKind
+type noteJob struct {
+	MessageID int `json:"message_id"`
+}
+
+// deliveryJob is the payload of DeliveryJobKind
+type deliveryJob struct {
+	UserID   int      `json:"user_id"`
+	Username string   `json:"username"`
+	Inbox    string   `json:"inbox"`
+	Activity Activity `json:"activity"`
+}
+
+// deliver signs and POSTs an activity to a remote inbox on behalf of a local user
+func (s *Service) deliver(fromUserID int, fromUsername string, inbox string, activity Activity) error {
+	key, _, err := s.localKey(fromUserID)
+	if err != nil {
+		return err
+	}
+	activity.Context = activityContext
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	if err := checkURL(inbox); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", activityContentType)
+	if err := SignRequest(req, body, s.actorURI(fromUsername)+"#main-key", key); err != nil {
+		return err
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("delivery to %s failed with status %d", inbox, resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *Service) noteActivity(message models.Message, username string) Activity {
+	actor := s.actorURI(username)
+	return Activity{
+		ID:           s.noteURI(message.Message_id),
+		Type:         "Note",
+		AttributedTo: actor,
+		Content:      message.Text,
+		Published:    time.Unix(message.Pub_date, 0).UTC().Format(time.RFC3339),
+		To:           []string{publicCollection},
+	}
+}
+
+func (s *Service) createActivity(message models.Message, username string) Activity {
+	note := s.noteActivity(message, username)
+	return Activity{
+		ID:        note.ID + "/activity",
+		Type:      "Create",
+		Actor:     note.AttributedTo,
+		Published: note.Published,
+		To:        note.To,
+		Object:    note,
+	}
+}
+
+// DeliverNote sends a Create{Note} for a new local message to every
+// remote follower of its author.
+func (s *Service) DeliverNote(message models.Message) error {
+	author, inboxes, err := s.noteInboxes(message)
+	if err != nil {
+		return err
+	}
+	activity := s.createActivity(message, author.Username)
+	var errs []error
+	for _, inbox := range inboxes {
+		if err := s.deliver(author.User_id, author.Username, inbox, activity); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// noteInboxes returns the author of message and the inboxes of its remote
+// followers
+func (s *Service) noteInboxes(message models.Message) (*models.User, []string, error) {
+	var author models.User
+	if err := s.DB.Where("user_id = ?", message.Author_id).First(&author).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var inboxes []string
+	err := s.DB.Table("followers").
+		Joins("JOIN remote_actors ON remote_actors.user_id = followers.who_id").
+		Where("followers.whom_id = ?", author.User_id).
+		Distinct().
+		Pluck("remote_actors.inbox", &inboxes).Error
+	return &author, inboxes, err
+}
+
+func (s *Service) followActivity(localUsername string, remote *models.RemoteActor) Activity {
+	actor := s.actorURI(localUsername)
+	return Activity{
+		ID:     actor + "#follows/" + fmt.Sprint(remote.User_id),
+		Type:   "Follow",
+		Actor:  actor,
+		Object: remote.Actor_uri,
+	}
+}
+
+// SendFollow tells a remote server that a local user follows one of its accounts.
+// The follower row itself is written by the caller, like for local follows.
+func (s *Service) SendFollow(localUserID int, localUsername string, remote *models.RemoteActor) error {
+	return s.deliver(localUserID, localUsername, remote.Inbox, s.followActivity(localUsername, remote))
+}
+
+// SendUnfollow undoes an earlier SendFollow
+func (s *Service) SendUnfollow(localUserID int, localUsername string, remote *models.RemoteActor) error {
+	follow := s.followActivity(localUsername, remote)
+	undo := Activity{
+		ID:     follow.ID + "/undo",
+		Type:   "Undo",
+		Actor:  follow.Actor,
+		Object: follow,
+	}
+	return s.deliver(localUserID, localUsername, remote.Inbox, undo)
+}
+
+// Deliver queues a new local message for the remote followers, if
+// federation is enabled. Without a Queue, or if it fails, the message is
+// sent right away. It does nothing on a nil *Service.
+func (s *Service) Deliver(message models.Message) {
+	if s == nil {
+		return
+	}
+	if s.Queue != nil {
+		err := jobs.Enqueue(context.Background(), s.Queue, NoteJobKind, noteJob{MessageID: message.Message_id})
+		if err == nil {
+			return
+		}
+		slog.Error("Failed to queue message delivery", "message_id", message.Message_id, "err", err)
+	}
+	if err := s.DeliverNote(message); err != nil {
+		slog.Error("Failed to deliver message", "message_id", message.Message_id, "err", err)
+	}
+}
+
+// send queues activity for inbox like Deliver
+func (s *Service) send(fromUserID int, fromUsername string, inbox string, activity Activity) {
+	if s.Queue != nil {
+		payload := deliveryJob{UserID: fromUserID, Username: fromUsername, Inbox: inbox, Activity: activity}
+		err := jobs.Enqueue(context.Background(), s.Queue, DeliveryJobKind, payload, jobs.Unique(deliveryKey(activity, inbox)))
+		if err == nil {
+			return
+		}
+		slog.Error("Failed to queue delivery", "activity", activity.ID, "inbox", inbox, "err", err)
+	}
+	if err := s.deliver(fromUserID, fromUsername, inbox, activity); err != nil {
+		slog.Error("Failed to deliver activity", "activity", activity.ID, "inbox", inbox, "err", err)
+	}
+}
+
+// deliveryKey keeps an activity from being queued twice for an inbox when
+// a NoteJobKind job runs again
+func deliveryKey(activity Activity, inbox string) string {
+	return DeliveryJobKind + " " + activity.ID + " " + inbox
+}
+
+// RegisterJobs runs the delivery jobs in pool
+func (s *Service) RegisterJobs(pool *jobs.Pool) {
+	if s == nil {
+		return
+	}
+	pool.Handle(NoteJobKind, s.handleNoteJob)
+	pool.Handle(DeliveryJobKind, s.handleDeliveryJob)
+}
+
+// handleNoteJob queues the deliveries of a message, a deleted message is
+// not sent anymore
+func (s *Service) handleNoteJob(ctx context.Context, j *jobs.Job) error {
+	var payload noteJob
+	if err := j.Decode(&payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	var message models.Message
+	err := s.DB.WithContext(ctx).Where("message_id = ?", payload.MessageID).First(&message).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	author, inboxes, err := s.noteInboxes(message)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	activity := s.createActivity(message, author.Username)
+	for _, inbox := range inboxes {
+		payload := deliveryJob{UserID: author.User_id, Username: author.Username, Inbox: inbox, Activity: activity}
+		if err := jobs.Enqueue(ctx, s.Queue, DeliveryJobKind, payload, jobs.Unique(deliveryKey(activity, inbox))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleDeliveryJob sends one activity, a failed delivery is retried
+func (s *Service) handleDeliveryJob(ctx context.Context, j *jobs.Job) error {
+	var payload deliveryJob
+	if err := j.Decode(&payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	return s.deliver(payload.UserID, payload.Username, payload.Inbox, payload.Activity)
+}
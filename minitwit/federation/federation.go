@@ -0,0 +1,149 @@
+package federation
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"minitwit/cache"
+	"minitwit/config"
+	"minitwit/fanout"
+	"minitwit/jobs"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	activityContentType = "application/activity+json"
+	publicCollection    = "https://www.w3.org/ns/activitystreams#Public"
+)
+
+// Service implements the ActivityPub side of MiniTwit for one instance.
+type Service struct {
+	DB *gorm.DB
+	// public base url of this instance, e.g. https://minitwit.example.com
+	BaseURL string
+	// scheme used when resolving handles of other servers via webfinger
+	Scheme string
+	// Client only reaches public addresses unless federation.allow_private
+	// is set
+	Client *http.Client
+	// Timelines and Fanout learn about the notes of remote users, both may
+	// be nil
+	Timelines *cache.Timelines
+	Fanout    *fanout.Fanout
+	// Queue delivers the activities in the pools that RegisterJobs added
+	// the handlers to, they are sent right away without it
+	Queue jobs.Queue
+}
+
+func New(database *gorm.DB, baseURL string) *Service {
+	return &Service{
+		DB:      database,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Scheme:  "https",
+		Client:  publicClient(10 * time.Second),
+	}
+}
+
+// NewFromConfig enables federation if the base URL is set, the deliveries
+// go through queue
+func NewFromConfig(database *gorm.DB, cfg config.Federation, timelines *cache.Timelines, f *fanout.Fanout, queue jobs.Queue) *Service {
+	if cfg.BaseURL == "" {
+		return nil
+	}
+	s := New(database, cfg.BaseURL)
+	s.Timelines = timelines
+	s.Fanout = f
+	s.Queue = queue
+	if cfg.Scheme != "" {
+		s.Scheme = cfg.Scheme
+	}
+	if cfg.AllowPrivate {
+		s.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return s
+}
+
+// Register adds the webfinger and ActivityPub routes to the router.
+// Must be called before the catch-all "/{username}" routes.
+func (s *Service) Register(r *mux.Router) {
+	r.HandleFunc("/.well-known/webfinger", s.WebFingerHandler()).Methods("GET")
+	r.HandleFunc("/ap/users/{username}", s.ActorHandler()).Methods("GET")
+	r.HandleFunc("/ap/users/{username}/inbox", s.InboxHandler()).Methods("POST")
+	r.HandleFunc("/ap/users/{username}/outbox", s.OutboxHandler()).Methods("GET")
+	r.HandleFunc("/ap/notes/{id:[0-9]+}", s.NoteHandler()).Methods("GET")
+}
+
+// Host of this instance as used in acct: handles
+func (s *Service) Host() string {
+	u, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func (s *Service) actorURI(username string) string {
+	return s.BaseURL + "/ap/users/" + url.PathEscape(username)
+}
+
+func (s *Service) noteURI(messageID int) string {
+	return s.BaseURL + "/ap/notes/" + strconv.Itoa(messageID)
+}
+
+// Activity is the subset of an ActivityStreams object we read and write.
+// Object is either a string (an id) or a nested object.
+type Activity struct {
+	Context      any      `json:"@context,omitempty"`
+	ID           string   `json:"id,omitempty"`
+	Type         string   `json:"type"`
+	Actor        string   `json:"actor,omitempty"`
+	AttributedTo string   `json:"attributedTo,omitempty"`
+	Content      string   `json:"content,omitempty"`
+	Published    string   `json:"published,omitempty"`
+	To           []string `json:"to,omitempty"`
+	Cc           []string `json:"cc,omitempty"`
+	Object       any      `json:"object,omitempty"`
+}
+
+type PublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type Actor struct {
+	Context           any       `json:"@context"`
+	ID                string    `json:"id"`
+	Type              string    `json:"type"`
+	PreferredUsername string    `json:"preferredUsername"`
+	Name              string    `json:"name,omitempty"`
+	URL               string    `json:"url,omitempty"`
+	Inbox             string    `json:"inbox"`
+	Outbox            string    `json:"outbox,omitempty"`
+	PublicKey         PublicKey `json:"publicKey"`
+}
+
+type OrderedCollection struct {
+	Context      any        `json:"@context"`
+	ID           string     `json:"id"`
+	Type         string     `json:"type"`
+	TotalItems   int        `json:"totalItems"`
+	OrderedItems []Activity `json:"orderedItems"`
+}
+
+type webFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+type webFingerResponse struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []webFingerLink `json:"links"`
+}
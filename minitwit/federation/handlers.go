@@ -0,0 +1,354 @@
+package federation
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"minitwit/db"
+	"minitwit/models"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func respondWithActivityJSON(w http.ResponseWriter, contentType string, payload any) {
+	w.Header().Set("Content-Type", contentType)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		slog.Error("Failed to encode activitypub response", "err", err)
+	}
+}
+
+// localUser returns the user for the route, remote users don't have actors here
+func (s *Service) localUser(username string) (*models.User, error) {
+	user, err := models.GetUserByUsername(s.DB, username)
+	if err != nil {
+		return nil, err
+	}
+	if _, remote := s.IsRemote(user.User_id); remote {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return user, nil
+}
+
+func (s *Service) WebFingerHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, host, ok := splitHandle(r.URL.Query().Get("resource"))
+		if !ok || host != s.Host() {
+			http.Error(w, "Unknown resource", http.StatusNotFound)
+			return
+		}
+		user, err := s.localUser(username)
+		if err != nil {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+			return
+		}
+
+		respondWithActivityJSON(w, "application/jrd+json", webFingerResponse{
+			Subject: "acct:" + user.Username + "@" + host,
+			Aliases: []string{s.actorURI(user.Username)},
+			Links: []webFingerLink{
+				{Rel: "self", Type: activityContentType, Href: s.actorURI(user.Username)},
+				{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: s.BaseURL + "/" + user.Username},
+			},
+		})
+	}
+}
+
+func (s *Service) ActorHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.localUser(mux.Vars(r)["username"])
+		if err != nil {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+			return
+		}
+		_, pubPem, err := s.localKey(user.User_id)
+		if err != nil {
+			http.Error(w, "Failed to load actor key", http.StatusInternalServerError)
+			return
+		}
+
+		id := s.actorURI(user.Username)
+		respondWithActivityJSON(w, activityContentType, Actor{
+			Context:           []string{activityContext, "https://w3id.org/security/v1"},
+			ID:                id,
+			Type:              "Person",
+			PreferredUsername: user.Username,
+			Name:              user.Username,
+			URL:               s.BaseURL + "/" + user.Username,
+			Inbox:             id + "/inbox",
+			Outbox:            id + "/outbox",
+			PublicKey:         PublicKey{ID: id + "#main-key", Owner: id, PublicKeyPem: pubPem},
+		})
+	}
+}
+
+func (s *Service) OutboxHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.localUser(mux.Vars(r)["username"])
+		if err != nil {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+			return
+		}
+		messages, err := db.QueryUserTimeline(s.DB, user.Username)
+		if err != nil {
+			http.Error(w, "Failed to load outbox", http.StatusInternalServerError)
+			return
+		}
+
+		items := make([]Activity, 0, len(messages))
+		for _, m := range messages {
+			items = append(items, s.createActivity(m, user.Username))
+		}
+		respondWithActivityJSON(w, activityContentType, OrderedCollection{
+			Context:      activityContext,
+			ID:           s.actorURI(user.Username) + "/outbox",
+			Type:         "OrderedCollection",
+			TotalItems:   len(items),
+			OrderedItems: items,
+		})
+	}
+}
+
+func (s *Service) NoteHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+		var message models.Message
+		if err := s.DB.Where("message_id = ? AND flagged = 0", id).First(&message).Error; err != nil {
+			http.Error(w, "Note does not exist", http.StatusNotFound)
+			return
+		}
+		var author models.User
+		if err := s.DB.Where("user_id = ?", message.Author_id).First(&author).Error; err != nil {
+			http.Error(w, "Note does not exist", http.StatusNotFound)
+			return
+		}
+		if _, remote := s.IsRemote(author.User_id); remote {
+			http.Error(w, "Note does not exist", http.StatusNotFound)
+			return
+		}
+		note := s.noteActivity(message, author.Username)
+		note.Context = activityContext
+		respondWithActivityJSON(w, activityContentType, note)
+	}
+}
+
+// verifiedActor checks the request signature and returns the signing actor.
+// New actors are only stored once they signed the request.
+func (s *Service) verifiedActor(r *http.Request, body []byte) (*models.RemoteActor, error) {
+	keyID, err := KeyID(r)
+	if err != nil {
+		return nil, err
+	}
+	actorURI, _, _ := strings.Cut(keyID, "#")
+
+	var known models.RemoteActor
+	err = s.DB.Where("actor_uri = ?", actorURI).First(&known).Error
+	if err == nil {
+		key, err := parsePublicKey(known.Public_key)
+		if err == nil && VerifyRequest(r, body, key) == nil {
+			return &known, nil
+		}
+		// the actor may have rotated its key, fetch it again
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	actor, err := s.getActor(actorURI)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePublicKey(actor.PublicKey.PublicKeyPem)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyRequest(r, body, key); err != nil {
+		return nil, err
+	}
+	return s.storeActor(actor)
+}
+
+func (s *Service) InboxHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.localUser(mux.Vars(r)["username"])
+		if err != nil {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		remote, err := s.verifiedActor(r, body)
+		if err != nil {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		var activity Activity
+		if err := json.Unmarshal(body, &activity); err != nil {
+			http.Error(w, "Failed to decode activity", http.StatusBadRequest)
+			return
+		}
+		if activity.Actor != remote.Actor_uri {
+			http.Error(w, "Activity actor does not match signature", http.StatusForbidden)
+			return
+		}
+
+		switch activity.Type {
+		case "Follow":
+			err = s.handleFollow(user, remote, activity)
+		case "Undo":
+			err = s.handleUndo(user, remote, activity)
+		case "Create":
+			err = s.handleCreate(remote, activity)
+		case "Accept", "Reject":
+			// follows are stored optimistically, nothing to do
+		default:
+			http.Error(w, "Unsupported activity type", http.StatusNotImplemented)
+			return
+		}
+		if errors.Is(err, errNotFollowed) {
+			http.Error(w, "Nobody here follows the actor", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			slog.WarnContext(r.Context(), "Failed to handle activity", "type", activity.Type, "actor", remote.Actor_uri, "err", err)
+			http.Error(w, "Failed to handle activity", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+var (
+	errWrongObject = errors.New("activity object does not match")
+	errNotFollowed = errors.New("no local user follows the actor")
+)
+
+// decodeObject reads a nested object, Object is only a string for ids
+func decodeObject(obj any) (Activity, error) {
+	var a Activity
+	if id, ok := obj.(string); ok {
+		a.ID = id
+		return a, nil
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return a, err
+	}
+	err = json.Unmarshal(b, &a)
+	return a, err
+}
+
+func (s *Service) handleFollow(user *models.User, remote *models.RemoteActor, activity Activity) error {
+	object, err := decodeObject(activity.Object)
+	if err != nil {
+		return err
+	}
+	if object.ID != s.actorURI(user.Username) {
+		return errWrongObject
+	}
+
+	// a repeated Follow is accepted again
+	if _, err := db.AddFollow(s.DB, remote.User_id, user.User_id); err != nil {
+		return err
+	}
+
+	accept := Activity{
+		ID:     s.actorURI(user.Username) + "#accepts/" + strconv.Itoa(remote.User_id),
+		Type:   "Accept",
+		Actor:  s.actorURI(user.Username),
+		Object: activity,
+	}
+	s.send(user.User_id, user.Username, remote.Inbox, accept)
+	return nil
+}
+
+func (s *Service) handleUndo(user *models.User, remote *models.RemoteActor, activity Activity) error {
+	object, err := decodeObject(activity.Object)
+	if err != nil {
+		return err
+	}
+	if object.Type != "Follow" {
+		// undoing likes, announces etc. is not supported, ignore them
+		return nil
+	}
+	if object.Actor != "" && object.Actor != remote.Actor_uri {
+		return errWrongObject
+	}
+	_, err = db.RemoveFollow(s.DB, remote.User_id, user.User_id)
+	return err
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// notes arrive as html and are stored as plain text, the templates escape
+// it again
+func plainText(content string) string {
+	content = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p><p>", "\n\n").Replace(content)
+	return strings.TrimSpace(html.UnescapeString(htmlTag.ReplaceAllString(content, "")))
+}
+
+func (s *Service) handleCreate(remote *models.RemoteActor, activity Activity) error {
+	note, err := decodeObject(activity.Object)
+	if err != nil {
+		return err
+	}
+	if note.Type != "Note" {
+		return nil
+	}
+	if note.ID == "" || note.AttributedTo != remote.Actor_uri {
+		return errWrongObject
+	}
+	// notes land on the public timeline, only take them from followed actors
+	followers, err := db.CountFollowers(s.DB, remote.User_id)
+	if err != nil {
+		return err
+	}
+	if followers == 0 {
+		return errNotFollowed
+	}
+
+	pubDate := time.Now().Unix()
+	if published, err := time.Parse(time.RFC3339, note.Published); err == nil {
+		pubDate = published.Unix()
+	}
+
+	var message models.Message
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.RemoteNote{}).Where("note_uri = ?", note.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			// already received, e.g. delivered to several local inboxes
+			return nil
+		}
+
+		message = models.Message{Author_id: uint(remote.User_id), Text: plainText(note.Content), Pub_date: pubDate, Flagged: 0}
+		if err := db.CreateMessage(tx, &message); err != nil {
+			return err
+		}
+		ref := models.RemoteNote{Message_id: message.Message_id, Note_uri: note.ID}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ref).Error
+	})
+	if err != nil {
+		return err
+	}
+	if message.Message_id != 0 {
+		s.Timelines.MessagePosted(s.DB.Statement.Context, s.DB, remote.User_id)
+		s.Fanout.MessagePosted(message)
+	}
+	return nil
+}
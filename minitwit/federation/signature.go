@@ -0,0 +1,196 @@
+package federation
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// HTTP signatures as used by Mastodon and friends
+// (draft-cavage-http-signatures, rsa-sha256).
+
+var errBadSignature = errors.New("invalid http signature")
+
+// how far the Date header may be off before a signature is rejected
+const maxClockSkew = time.Hour
+
+// requiredHeaders must be signed, so a signature cannot be sent again to
+// another inbox or later. Requests with a body also sign the digest.
+var requiredHeaders = []string{"(request-target)", "host", "date"}
+
+func generateKeyPair() (privPem, pubPem string, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+	privBytes := x509.MarshalPKCS1PrivateKey(key)
+	pubBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	privPem = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: privBytes}))
+	pubPem = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}))
+	return privPem, pubPem, nil
+}
+
+func parsePrivateKey(privPem string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privPem))
+	if block == nil {
+		return nil, errors.New("no pem block in private key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func parsePublicKey(pubPem string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pubPem))
+	if block == nil {
+		return nil, errors.New("no pem block in public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		// some servers still publish PKCS1 keys
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerValue(r *http.Request, name string) string {
+	switch name {
+	case "(request-target)":
+		return strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+	case "host":
+		if r.Host != "" {
+			return r.Host
+		}
+		return r.URL.Host
+	default:
+		return r.Header.Get(name)
+	}
+}
+
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		lines[i] = h + ": " + headerValue(r, h)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SignRequest adds Date, Digest (when there is a body) and Signature headers
+func SignRequest(r *http.Request, body []byte, keyID string, key *rsa.PrivateKey) error {
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if r.Host == "" {
+		r.Host = r.URL.Host
+	}
+	headers := slices.Clone(requiredHeaders)
+	if body != nil {
+		r.Header.Set("Digest", digest(body))
+		headers = append(headers, "digest")
+	}
+
+	hashed := sha256.Sum256([]byte(signingString(r, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+type signature struct {
+	keyID     string
+	headers   []string
+	signature []byte
+}
+
+func parseSignature(header string) (*signature, error) {
+	if header == "" {
+		return nil, errBadSignature
+	}
+	sig := &signature{headers: []string{"date"}}
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		v = strings.Trim(v, `"`)
+		switch k {
+		case "keyId":
+			sig.keyID = v
+		case "headers":
+			sig.headers = strings.Fields(strings.ToLower(v))
+		case "signature":
+			b, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, errBadSignature
+			}
+			sig.signature = b
+		}
+	}
+	if sig.keyID == "" || sig.signature == nil {
+		return nil, errBadSignature
+	}
+	return sig, nil
+}
+
+// KeyID returns the keyId of the request signature without verifying it
+func KeyID(r *http.Request) (string, error) {
+	sig, err := parseSignature(r.Header.Get("Signature"))
+	if err != nil {
+		return "", err
+	}
+	return sig.keyID, nil
+}
+
+// VerifyRequest checks the Signature header of r against key.
+// body is the already read request body, used to check the Digest header.
+func VerifyRequest(r *http.Request, body []byte, key *rsa.PublicKey) error {
+	sig, err := parseSignature(r.Header.Get("Signature"))
+	if err != nil {
+		return err
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return errBadSignature
+	}
+	if skew := time.Since(date); skew > maxClockSkew || skew < -maxClockSkew {
+		return errBadSignature
+	}
+
+	for _, h := range requiredHeaders {
+		if !slices.Contains(sig.headers, h) {
+			return errBadSignature
+		}
+	}
+	// a signed body must have a matching digest, and the digest must be signed
+	if body != nil && (!slices.Contains(sig.headers, "digest") || r.Header.Get("Digest") != digest(body)) {
+		return errBadSignature
+	}
+
+	hashed := sha256.Sum256([]byte(signingString(r, sig.headers)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig.signature); err != nil {
+		return errBadSignature
+	}
+	return nil
+}
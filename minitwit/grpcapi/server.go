@@ -0,0 +1,245 @@
+// Package grpcapi serves the MiniTwit gRPC service defined in
+// proto/minitwit/v1/minitwit.proto. It offers the simulator operations
+// to internal services and shares the service layer with the HTTP APIs.
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+
+	"minitwit/api"
+	"minitwit/config"
+	"minitwit/db"
+	pb "minitwit/grpcapi/minitwitv1"
+	"minitwit/metrics"
+	"minitwit/middleware"
+	"minitwit/models"
+	"minitwit/service"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+// limits of GetTimeline, the maximum is the one of API v2
+const (
+	defaultTimelineLimit = 100
+	maxTimelineLimit     = 100
+)
+
+type server struct {
+	pb.UnimplementedMiniTwitServer
+	database *gorm.DB
+	svc      *service.Service
+	latest   api.LatestFile
+}
+
+// NewServer returns a gRPC server with the MiniTwit service, the
+// Prometheus interceptors and the simulator authorization check, which
+// accepts the same credentials as the simulator API
+func NewServer(database *gorm.DB, cfg *config.Config, svc *service.Service, opts ...grpc.ServerOption) *grpc.Server {
+	auth := cfg.Simulator.Authorization()
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(middleware.PrometheusUnaryInterceptor, authUnary(auth)),
+		grpc.ChainStreamInterceptor(middleware.PrometheusStreamInterceptor, authStream(auth)),
+	)
+	s := grpc.NewServer(opts...)
+	pb.RegisterMiniTwitServer(s, &server{database: database, svc: svc, latest: api.LatestFile(cfg.API.LatestFile)})
+	return s
+}
+
+func authorize(ctx context.Context, auth string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) == 1 && values[0] == auth {
+		return nil
+	}
+	return status.Error(codes.PermissionDenied, "You are not authorized to access this resource!")
+}
+
+func authUnary(auth string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := authorize(ctx, auth); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func authStream(auth string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := authorize(ss.Context(), auth); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// toStatus maps errors from the service layer to gRPC status errors
+func toStatus(err error) error {
+	var validationErr *service.ValidationError
+	switch {
+	case errors.As(err, &validationErr),
+		errors.Is(err, service.ErrFollowSelf):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, service.ErrUserNotFound),
+		errors.Is(err, service.ErrNotFollowing):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, service.ErrUsernameTaken),
+		errors.Is(err, service.ErrAlreadyFollowing):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, service.ErrUnverified):
+		return status.Error(codes.PermissionDenied, err.Error())
+	default:
+		slog.Error("gRPC request failed", "err", err)
+		return status.Error(codes.Internal, "Internal error")
+	}
+}
+
+func (s *server) setLatest(latest int64) error {
+	if latest == 0 {
+		return nil
+	}
+	if err := s.latest.Set(strconv.FormatInt(latest, 10)); err != nil {
+		slog.Error("Failed to write latest id", "err", err)
+		return status.Error(codes.Internal, "Failed to store latest id")
+	}
+	return nil
+}
+
+func userID(database *gorm.DB, username string) (int, error) {
+	id, err := db.GormGetUserId(database, username)
+	if err != nil {
+		return 0, toStatus(service.ErrUserNotFound)
+	}
+	return id, nil
+}
+
+func toMessage(m models.Message) *pb.Message {
+	return &pb.Message{
+		Id:       int64(m.Message_id),
+		Username: m.Author,
+		Content:  m.Text,
+		PubDate:  m.Pub_date,
+	}
+}
+
+func (s *server) RegisterUser(ctx context.Context, req *pb.RegisterUserRequest) (*pb.User, error) {
+	if err := s.setLatest(req.GetLatest()); err != nil {
+		return nil, err
+	}
+	user, err := service.RegisterSimulatorUser(db.WithContext(s.database, ctx), req.GetUsername(), req.GetEmail(), req.GetPassword())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	metrics.UsersRegistered.WithLabelValues(metrics.SourceGRPC).Inc()
+	return &pb.User{Id: int64(user.User_id), Username: user.Username}, nil
+}
+
+func (s *server) PostMessage(ctx context.Context, req *pb.PostMessageRequest) (*pb.Message, error) {
+	if err := s.setLatest(req.GetLatest()); err != nil {
+		return nil, err
+	}
+	database := db.WithContext(s.database, ctx)
+	id, err := userID(database, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+	message, err := s.svc.PostMessage(database, id, req.GetContent())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	metrics.MessagesPosted.WithLabelValues(metrics.SourceGRPC).Inc()
+	return toMessage(*message), nil
+}
+
+func (s *server) follows(database *gorm.DB, req *pb.FollowRequest) (int, int, error) {
+	if err := s.setLatest(req.GetLatest()); err != nil {
+		return 0, 0, err
+	}
+	who, err := userID(database, req.GetUsername())
+	if err != nil {
+		return 0, 0, err
+	}
+	whom, err := userID(database, req.GetTarget())
+	if err != nil {
+		return 0, 0, err
+	}
+	return who, whom, nil
+}
+
+// Follow is idempotent like the simulator API, following twice is not an error
+func (s *server) Follow(ctx context.Context, req *pb.FollowRequest) (*pb.FollowResponse, error) {
+	database := db.WithContext(s.database, ctx)
+	who, whom, err := s.follows(database, req)
+	if err != nil {
+		return nil, err
+	}
+	err = s.svc.Follow(database, who, whom)
+	if err != nil && !errors.Is(err, service.ErrAlreadyFollowing) {
+		return nil, toStatus(err)
+	}
+	if err == nil {
+		metrics.Follows.WithLabelValues(metrics.SourceGRPC).Inc()
+	}
+	return &pb.FollowResponse{}, nil
+}
+
+// Unfollow is idempotent like the simulator API
+func (s *server) Unfollow(ctx context.Context, req *pb.FollowRequest) (*pb.FollowResponse, error) {
+	database := db.WithContext(s.database, ctx)
+	who, whom, err := s.follows(database, req)
+	if err != nil {
+		return nil, err
+	}
+	err = s.svc.Unfollow(database, who, whom)
+	if err != nil && !errors.Is(err, service.ErrNotFollowing) {
+		return nil, toStatus(err)
+	}
+	if err == nil {
+		metrics.Unfollows.WithLabelValues(metrics.SourceGRPC).Inc()
+	}
+	return &pb.FollowResponse{}, nil
+}
+
+func (s *server) GetTimeline(req *pb.GetTimelineRequest, stream grpc.ServerStreamingServer[pb.Message]) error {
+	page := service.Page{Limit: min(int(req.GetLimit()), maxTimelineLimit)}
+	if page.Limit <= 0 {
+		page.Limit = defaultTimelineLimit
+	}
+
+	database := db.WithContext(s.database, stream.Context())
+	var list *service.MessageList
+	var err error
+	if req.GetUsername() == "" {
+		list, err = service.ListPublicMessages(database, page)
+	} else {
+		id, idErr := userID(database, req.GetUsername())
+		if idErr != nil {
+			return idErr
+		}
+		list, err = s.svc.Timeline(database, id, page)
+	}
+	if err != nil {
+		return toStatus(err)
+	}
+
+	for _, m := range list.Messages {
+		if err := stream.Send(toMessage(m)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *server) GetLatest(ctx context.Context, req *pb.GetLatestRequest) (*pb.GetLatestResponse, error) {
+	latest, err := s.latest.Read()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read latest id", "err", err)
+		return nil, status.Error(codes.Internal, "Failed to read the latest ID.")
+	}
+	return &pb.GetLatestResponse{Latest: int64(latest)}, nil
+}
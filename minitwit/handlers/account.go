@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"minitwit/db"
+	"minitwit/models"
+	"minitwit/service"
+	"minitwit/tracing"
+	"minitwit/utils"
+
+	"gorm.io/gorm"
+)
+
+var (
+	forgotTmpl = template.Must(template.ParseFiles("templates/layout.html", "templates/forgot.html"))
+	resetTmpl  = template.Must(template.ParseFiles("templates/layout.html", "templates/reset.html"))
+)
+
+// VerifyEmailHandler opens the link of the verification email
+func VerifyEmailHandler(database *gorm.DB, svc *service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user, err := svc.VerifyEmail(database, r.URL.Query().Get("token"), time.Now())
+		if errors.Is(err, service.ErrInvalidToken) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to verify email", "err", err)
+			http.Error(w, "Failed to verify your email address", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Email verified", "user_id", user.User_id)
+		utils.AddFlash(w, r, "Your email address is verified")
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+// ResendVerificationHandler mails the logged in user a new verification link
+func ResendVerificationHandler(database *gorm.DB, svc *service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user := sessionUser(w, r, database)
+		if user == nil {
+			return
+		}
+		if !user.Unverified {
+			utils.AddFlash(w, r, "Your email address is already verified")
+		} else if err := svc.SendVerificationEmail(r.Context(), user, time.Now()); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to send verification email", "user_id", user.User_id, "err", err)
+			utils.AddFlash(w, r, "Failed to send the email, try again later")
+		} else {
+			utils.AddFlash(w, r, "We sent you a new link to verify your email address")
+		}
+		http.Redirect(w, r, "/settings", http.StatusFound)
+	}
+}
+
+// resetMailTimeout bounds the background sending of a reset email
+const resetMailTimeout = time.Minute
+
+// ForgotPasswordHandler mails a reset link. The answer is the same for
+// unknown emails, so it does not tell which are used.
+func ForgotPasswordHandler(database *gorm.DB, svc *service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			if err := tracing.Render(r.Context(), forgotTmpl, w, nil); err != nil {
+				http.Error(w, "Failed to render template", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		email := r.FormValue("email")
+		if email == "" {
+			http.Error(w, "You have to enter an email address", http.StatusBadRequest)
+			return
+		}
+		// sending takes long enough to tell known emails apart, so it runs
+		// after the answer
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), resetMailTimeout)
+		go func(now time.Time) {
+			defer cancel()
+			if err := svc.RequestPasswordReset(ctx, db.WithContext(database, ctx), email, now); err != nil {
+				slog.ErrorContext(ctx, "Failed to send password reset email", "err", err)
+			}
+		}(time.Now())
+		utils.AddFlash(w, r, "If an account uses this email address, we sent it a link to reset the password")
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}
+}
+
+// ResetPasswordHandler opens the link of the reset email and sets the new
+// password
+func ResetPasswordHandler(database *gorm.DB, svc *service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		token := r.FormValue("token")
+		if r.Method == "GET" {
+			user, err := svc.CheckResetToken(database, token, time.Now())
+			if errors.Is(err, service.ErrInvalidToken) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, "Failed to check the link", http.StatusInternalServerError)
+				return
+			}
+			// no User, the layout shows the links for logged out users
+			data := struct {
+				User     *models.User
+				Flashes  []interface{}
+				Username string
+				Token    string
+			}{Username: user.Username, Token: token}
+			if err := tracing.Render(r.Context(), resetTmpl, w, data); err != nil {
+				http.Error(w, "Failed to render template", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		password := r.FormValue("password")
+		if password != r.FormValue("password2") {
+			http.Error(w, "Passwords do not match", http.StatusBadRequest)
+			return
+		}
+		user, err := svc.ResetPassword(database, token, password, time.Now())
+		var validationErr *service.ValidationError
+		switch {
+		case errors.Is(err, service.ErrInvalidToken), errors.As(err, &validationErr):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Failed to reset password", "err", err)
+			http.Error(w, "Failed to change your password", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Password reset", "user_id", user.User_id)
+		utils.AddFlash(w, r, "Your password was changed, you can log in now")
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}
+}
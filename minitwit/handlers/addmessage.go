@@ -1,17 +1,22 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
+	"minitwit/db"
+	"minitwit/metrics"
 	"minitwit/models"
+	"minitwit/service"
 	"minitwit/utils"
 
 	"gorm.io/gorm"
 )
 
-func AddMessageHandler(database *gorm.DB) http.HandlerFunc {
+func AddMessageHandler(database *gorm.DB, svc *service.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
 		store, _ := utils.GetSession(r, w)
 		if store.Values["user_id"] == nil {
 			http.Error(w, "You are not logged in", http.StatusBadRequest)
@@ -26,14 +31,24 @@ func AddMessageHandler(database *gorm.DB) http.HandlerFunc {
 			http.Error(w, "Your message cannot be empty", http.StatusBadRequest)
 			return
 		}
+		if err := svc.CheckPostLimit(database, userID, time.Now()); errors.Is(err, service.ErrUnverified) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to insert message", http.StatusInternalServerError)
+			return
+		}
 
 		// Insert message into the database
 		message := models.Message{Author_id: uint(userID), Text: text, Pub_date: time.Now().Unix(), Flagged: 0}
-		result := database.Create(&message)
-		if result.Error != nil {
+		if err := db.CreateMessage(database, &message); err != nil {
 			http.Error(w, "Failed to insert message", http.StatusInternalServerError)
 			return
 		}
+		svc.Timelines.MessagePosted(r.Context(), database, userID)
+		svc.Fanout.MessagePosted(message)
+		svc.Federation.Deliver(message)
+		metrics.MessagesPosted.WithLabelValues(metrics.SourceWeb).Inc()
 
 		// Redirect to timeline
 		utils.AddFlash(w, r, "Your message was recorded")
@@ -1,18 +1,24 @@
 package handlers
 
 import (
+	"log/slog"
 	"net/http"
+	"strings"
 
 	"minitwit/db"
+	"minitwit/federation"
+	"minitwit/metrics"
 	"minitwit/models"
+	"minitwit/service"
 	"minitwit/utils"
 
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
 )
 
-func FollowHandler(database *gorm.DB) http.HandlerFunc {
+func FollowHandler(database *gorm.DB, svc *service.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
 		session, _ := utils.GetSession(r, w)
 		if session.Values["user_id"] == nil {
 			utils.AddFlash(w, r, "You must be logged in to follow users")
@@ -24,6 +30,10 @@ func FollowHandler(database *gorm.DB) http.HandlerFunc {
 		vars := mux.Vars(r)
 		username := vars["username"]
 		user, err := models.GetUserByUsername(database, username)
+		if err != nil && svc.Federation != nil && strings.Contains(username, "@") {
+			// not known yet, look the account up on its own server
+			user, err = resolveRemoteUser(database, svc.Federation, username)
+		}
 		if err != nil {
 			http.Error(w, "User does not exist", http.StatusBadRequest)
 			return
@@ -43,14 +53,35 @@ func FollowHandler(database *gorm.DB) http.HandlerFunc {
 
 		// Insert the follow into the database
 		follower := models.Follower{Who_id: session.Values["user_id"].(int), Whom_id: user.User_id}
-		result := database.Create(&follower)
-		if result.Error != nil {
+		if _, err := db.AddFollow(database, follower.Who_id, follower.Whom_id); err != nil {
 			http.Error(w, "Failed to follow user", http.StatusInternalServerError)
 			return
 		}
+		metrics.Follows.WithLabelValues(metrics.SourceWeb).Inc()
+		svc.Fanout.Followed(database, follower.Who_id, follower.Whom_id)
+		svc.Timelines.FollowsChanged(r.Context(), follower.Who_id)
+		if svc.Federation != nil {
+			if remote, ok := svc.Federation.IsRemote(user.User_id); ok {
+				err := svc.Federation.SendFollow(follower.Who_id, session.Values["username"].(string), remote)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed to send follow", "actor", remote.Actor_uri, "err", err)
+				}
+			}
+		}
 
 		// Redirect to the user's timeline
 		utils.AddFlash(w, r, "You are now following "+username)
-		http.Redirect(w, r, "/"+username, http.StatusFound)
+		http.Redirect(w, r, "/"+user.Username, http.StatusFound)
+	}
+}
+
+// resolveRemoteUser fetches a fediverse account by its user@host handle
+func resolveRemoteUser(database *gorm.DB, fed *federation.Service, handle string) (*models.User, error) {
+	remote, err := fed.ResolveHandle(handle)
+	if err != nil {
+		return nil, err
 	}
+	var user models.User
+	err = database.Where("user_id = ?", remote.User_id).First(&user).Error
+	return &user, err
 }
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/models"
+	"minitwit/service"
+	"minitwit/tracing"
+	"minitwit/utils"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+var usersTmpl = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+	"getGravatar": utils.GetGravatar,
+}).ParseFiles("templates/layout.html", "templates/users.html"))
+
+type userListFunc func(database *gorm.DB, userID int, page service.Page) (*service.UserList, error)
+
+// FollowersHandler lists the users that follow {username}
+func FollowersHandler(database *gorm.DB, cfg *config.Config) http.HandlerFunc {
+	return userListHandler(database, cfg, "followers", service.ListFollowers)
+}
+
+// FollowingHandler lists the users that {username} follows
+func FollowingHandler(database *gorm.DB, cfg *config.Config) http.HandlerFunc {
+	return userListHandler(database, cfg, "following", service.ListFollowing)
+}
+
+// userListHandler shows a page of users, ?cursor= selects the next ones.
+// A logged in viewer sees which of them they follow.
+func userListHandler(database *gorm.DB, cfg *config.Config, pageType string, list userListFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		profileUser, err := models.GetUserByUsername(database, mux.Vars(r)["username"])
+		if err != nil {
+			http.Error(w, "User does not exist", http.StatusBadRequest)
+			return
+		}
+		users, err := list(database, profileUser.User_id, service.Page{Cursor: r.URL.Query().Get("cursor"), Limit: cfg.PerPage})
+		if errors.Is(err, service.ErrInvalidCursor) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to load users", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Users       []models.User
+			NextCursor  string
+			User        *models.User
+			PageType    string
+			ProfileUser models.User
+			Followed    map[int]bool
+			Flashes     []interface{}
+		}{
+			Users:       users.Users,
+			NextCursor:  users.NextCursor,
+			PageType:    pageType,
+			ProfileUser: *profileUser,
+			Flashes:     utils.GetFlashes(w, r),
+		}
+
+		session, _ := utils.GetSession(r, w)
+		if session.Values["user_id"] != nil {
+			userID := session.Values["user_id"].(int)
+			data.User = &models.User{Username: session.Values["username"].(string), User_id: userID}
+			data.Followed, err = service.FollowedBy(database, userID, users.Users)
+			if err != nil {
+				http.Error(w, "Failed to check if user is following", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := tracing.Render(r.Context(), usersTmpl, w, data); err != nil {
+			http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		}
+	}
+}
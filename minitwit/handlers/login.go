@@ -1,25 +1,37 @@
 package handlers
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"errors"
 	"fmt"
+	"html/template"
+	"log/slog"
 	"net/http"
-	"text/template"
+	"time"
 
+	"minitwit/db"
 	"minitwit/models"
+	"minitwit/oidc"
+	"minitwit/ratelimit"
+	"minitwit/service"
+	"minitwit/tracing"
 	"minitwit/utils"
 
 	"github.com/gorilla/sessions"
 	"gorm.io/gorm"
 )
 
-func loginPageGet(w http.ResponseWriter, r *http.Request, store *sessions.Session) {
+func loginPageGet(w http.ResponseWriter, r *http.Request, store *sessions.Session, p *oidc.Provider) {
 	if store.Values["user_id"] != nil {
 		http.Redirect(w, r, "/", http.StatusFound)
 	}
 	loginTmpl := template.Must(template.ParseFiles("templates/layout.html", "templates/login.html"))
-	if err := loginTmpl.Execute(w, nil); err != nil {
+	data := struct {
+		User    *models.User
+		Flashes []interface{}
+		// OIDC is the name of the identity provider, empty without one
+		OIDC string
+	}{OIDC: providerName(p)}
+	if err := tracing.Render(r.Context(), loginTmpl, w, data); err != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 	}
 	//return
@@ -28,26 +40,57 @@ func loginPageGet(w http.ResponseWriter, r *http.Request, store *sessions.Sessio
 func loginUser(w http.ResponseWriter, r *http.Request, store *sessions.Session, database *gorm.DB) {
 	// Get input from form
 	username := r.FormValue("username")
-	password := r.FormValue("password")
+	user, failures, err := service.Login(database, service.LoginAttempt{
+		Username:  username,
+		Password:  r.FormValue("password"),
+		IP:        utils.ClientIP(r),
+		SharedIP:  !utils.ClientIPForwarded(r),
+		UserAgent: r.UserAgent(),
+	}, time.Now())
 
-	// check if user exists
-	user, err := models.GetUserByUsername(database, username)
-	if err != nil {
-		http.Error(w, "Error getting user from db", http.StatusInternalServerError)
-		fmt.Println("Error getting user from db")
+	// unknown users get the same answer as wrong passwords
+	var locked *service.LockedError
+	switch {
+	case errors.As(err, &locked):
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(locked.RetryAfter))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		slog.InfoContext(r.Context(), "Login failed", "username", username, "reason", "locked")
+		return
+	case errors.Is(err, service.ErrInvalidPassword):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.InfoContext(r.Context(), "Login failed", "username", username, "reason", "invalid credentials")
+		return
+	case errors.Is(err, service.ErrUserDisabled):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		slog.InfoContext(r.Context(), "Login failed", "username", username, "reason", "disabled")
+		return
+	case errors.Is(err, service.ErrSecondFactorRequired):
+		askSecondFactor(w, r, store, user)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to check login", "username", username, "err", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
 		return
 	}
-	// compare the given password with the hashed password in the database
-	hash := md5.New()
-	hash.Write([]byte(password))
-	pwHash := hex.EncodeToString(hash.Sum(nil))
+	logIn(w, r, store, user, failures)
+}
 
-	if pwHash != user.PwHash {
-		http.Error(w, "Invalid password", http.StatusBadRequest)
-		fmt.Println("Invalid password")
+// askSecondFactor sends a user with two-factor auth to enter the code, the
+// session gets the user after it
+func askSecondFactor(w http.ResponseWriter, r *http.Request, store *sessions.Session, user *models.User) {
+	delete(store.Values, "user_id")
+	delete(store.Values, "username")
+	store.Values[pendingUserKey] = user.User_id
+	store.Values[pendingSinceKey] = time.Now().Unix()
+	if err := store.Save(r, w); err != nil {
+		http.Error(w, "Failed to save session", http.StatusInternalServerError)
 		return
 	}
+	http.Redirect(w, r, "/login/code", http.StatusFound)
+}
 
+// logIn puts the user in the session and tells about failed logins
+func logIn(w http.ResponseWriter, r *http.Request, store *sessions.Session, user *models.User, failures []models.FailedLogin) {
 	// Set session values
 	store.Values["user_id"] = user.User_id
 	store.Values["username"] = user.Username
@@ -58,15 +101,21 @@ func loginUser(w http.ResponseWriter, r *http.Request, store *sessions.Session,
 
 	// Redirect to timeline
 	utils.AddFlash(w, r, "You were logged in")
+	if len(failures) > 0 {
+		last := failures[0]
+		utils.AddFlash(w, r, fmt.Sprintf("There were %d failed login attempts since your last login, the last one from %s at %s",
+			len(failures), last.IP, time.Unix(last.Created_at, 0).UTC().Format("2006-01-02 15:04 UTC")))
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func LoginHandler(database *gorm.DB) http.HandlerFunc {
+func LoginHandler(database *gorm.DB, p *oidc.Provider) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
 		store, _ := utils.GetSession(r, w)
 
 		if r.Method == "GET" {
-			loginPageGet(w, r, store)
+			loginPageGet(w, r, store, p)
 		}
 
 		if r.Method == "POST" {
@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"minitwit/db"
+	"minitwit/metrics"
+	"minitwit/models"
+	"minitwit/oidc"
+	"minitwit/service"
+	"minitwit/tracing"
+	"minitwit/utils"
+
+	"github.com/gorilla/sessions"
+	"gorm.io/gorm"
+)
+
+// session values of a login at the provider, from the redirect to the
+// callback. A link login adds the identity to the logged in user, a
+// delete login confirms deleting the user instead of the password.
+const (
+	oidcStateKey    = "oidc_state"
+	oidcNonceKey    = "oidc_nonce"
+	oidcVerifierKey = "oidc_verifier"
+	oidcUserKey     = "oidc_user"
+	oidcPurposeKey  = "oidc_purpose"
+	oidcSinceKey    = "oidc_since"
+)
+
+// purposes of a login at the provider by a logged in user
+const (
+	oidcLink   = "link"
+	oidcDelete = "delete"
+)
+
+// session values of an identity without a user, until it signed up
+const (
+	signupSubjectKey  = "signup_subject"
+	signupEmailKey    = "signup_email"
+	signupVerifiedKey = "signup_email_verified"
+	signupUsernameKey = "signup_username"
+	signupNameKey     = "signup_name"
+	signupSinceKey    = "signup_since"
+)
+
+// oidcTimeout is how long the login at the provider and the sign up after
+// it may take
+const oidcTimeout = 10 * time.Minute
+
+var oidcSignupTmpl = template.Must(template.ParseFiles("templates/layout.html", "templates/oidc_signup.html"))
+
+// providerName is the name of the identity provider users can log in
+// with, empty without one
+func providerName(p *oidc.Provider) string {
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
+
+// recent tells if the session value at key was set within oidcTimeout
+func recent(values map[interface{}]interface{}, key string) bool {
+	since, _ := values[key].(int64)
+	return time.Since(time.Unix(since, 0)) <= oidcTimeout
+}
+
+// redirectToProvider starts a login at the provider. A logged in user
+// gives the userID and the purpose, a login 0 and "".
+func redirectToProvider(w http.ResponseWriter, r *http.Request, p *oidc.Provider, store *sessions.Session, userID int, purpose string) {
+	state, nonce, verifier := oidc.RandomString(), oidc.RandomString(), oidc.RandomString()
+	target, err := p.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to reach the identity provider", "err", err)
+		http.Error(w, fmt.Sprintf("Failed to reach your %s, try again later", p.Name), http.StatusBadGateway)
+		return
+	}
+	store.Values[oidcStateKey] = state
+	store.Values[oidcNonceKey] = nonce
+	store.Values[oidcVerifierKey] = verifier
+	store.Values[oidcUserKey] = userID
+	store.Values[oidcPurposeKey] = purpose
+	store.Values[oidcSinceKey] = time.Now().Unix()
+	if err := store.Save(r, w); err != nil {
+		http.Error(w, "Failed to save session", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// OIDCLoginHandler sends the browser to log in at the identity provider
+func OIDCLoginHandler(p *oidc.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		store, _ := utils.GetSession(r, w)
+		redirectToProvider(w, r, p, store, 0, "")
+	}
+}
+
+// OIDCLinkHandler sends the logged in user to the identity provider to
+// link the account there
+func OIDCLinkHandler(database *gorm.DB, p *oidc.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		user := sessionUser(w, r, database)
+		if user == nil {
+			return
+		}
+		store, _ := utils.GetSession(r, w)
+		redirectToProvider(w, r, p, store, user.User_id, oidcLink)
+	}
+}
+
+// OIDCCallbackHandler is where the provider sends the browser back to. It
+// logs in the user of the identity, links it, deletes the user or asks to
+// sign up.
+func OIDCCallbackHandler(database *gorm.DB, svc *service.Service, p *oidc.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		store, _ := utils.GetSession(r, w)
+		state, _ := store.Values[oidcStateKey].(string)
+		nonce, _ := store.Values[oidcNonceKey].(string)
+		verifier, _ := store.Values[oidcVerifierKey].(string)
+		userID, _ := store.Values[oidcUserKey].(int)
+		purpose, _ := store.Values[oidcPurposeKey].(string)
+		fresh := recent(store.Values, oidcSinceKey)
+		// a login at the provider is used once
+		for _, key := range []string{oidcStateKey, oidcNonceKey, oidcVerifierKey, oidcUserKey, oidcPurposeKey, oidcSinceKey} {
+			delete(store.Values, key)
+		}
+		if err := store.Save(r, w); err != nil {
+			http.Error(w, "Failed to save session", http.StatusInternalServerError)
+			return
+		}
+
+		if state == "" || !fresh || subtle.ConstantTimeCompare([]byte(state), []byte(r.FormValue("state"))) != 1 {
+			http.Error(w, "The login expired or was started in another browser, try again", http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("error") != "" {
+			slog.InfoContext(r.Context(), "Login at the identity provider failed", "error", r.FormValue("error"), "description", r.FormValue("error_description"))
+			utils.AddFlash(w, r, fmt.Sprintf("Signing in with your %s failed", p.Name))
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		claims, err := p.Exchange(r.Context(), r.FormValue("code"), verifier, nonce)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to get the ID token", "err", err)
+			http.Error(w, fmt.Sprintf("Failed to sign in with your %s", p.Name), http.StatusBadGateway)
+			return
+		}
+		id := service.ExternalIdentity{
+			Issuer:        claims.Issuer,
+			Subject:       claims.Subject,
+			Email:         claims.Email,
+			EmailVerified: claims.EmailVerified,
+		}
+
+		switch purpose {
+		case oidcLink:
+			linkIdentity(w, r, database, p, userID, id)
+			return
+		case oidcDelete:
+			deleteWithIdentity(w, r, database, svc, p, userID, id)
+			return
+		}
+
+		user, failures, err := service.LoginExternal(database, id)
+		switch {
+		case errors.Is(err, service.ErrNoAccount):
+			store.Values[signupSubjectKey] = claims.Subject
+			store.Values[signupEmailKey] = claims.Email
+			store.Values[signupVerifiedKey] = claims.EmailVerified
+			store.Values[signupUsernameKey] = claims.PreferredUsername
+			store.Values[signupNameKey] = claims.Name
+			store.Values[signupSinceKey] = time.Now().Unix()
+			if err := store.Save(r, w); err != nil {
+				http.Error(w, "Failed to save session", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/login/oidc/signup", http.StatusFound)
+		case errors.Is(err, service.ErrUserDisabled):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			slog.InfoContext(r.Context(), "Login failed", "subject", claims.Subject, "reason", "disabled")
+		case errors.Is(err, service.ErrSecondFactorRequired):
+			askSecondFactor(w, r, store, user)
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Failed to check login", "subject", claims.Subject, "err", err)
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		default:
+			logIn(w, r, store, user, failures)
+		}
+	}
+}
+
+// linkIdentity adds the identity to the user that started the link login,
+// if it is still logged in
+func linkIdentity(w http.ResponseWriter, r *http.Request, database *gorm.DB, p *oidc.Provider, userID int, id service.ExternalIdentity) {
+	if utils.SessionUserID(r) != userID {
+		http.Error(w, "You were logged out, log in and try again", http.StatusBadRequest)
+		return
+	}
+	err := service.LinkIdentity(database, userID, id, time.Now())
+	switch {
+	case errors.Is(err, service.ErrIdentityTaken):
+		utils.AddFlash(w, r, err.Error())
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to link identity", "user_id", userID, "err", err)
+		http.Error(w, "Failed to link the login", http.StatusInternalServerError)
+		return
+	default:
+		slog.InfoContext(r.Context(), "Identity linked", "user_id", userID)
+		utils.AddFlash(w, r, fmt.Sprintf("You can log in with your %s now", p.Name))
+	}
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+// deleteWithIdentity deletes the user that started the delete login, if
+// the identity is linked to it
+func deleteWithIdentity(w http.ResponseWriter, r *http.Request, database *gorm.DB, svc *service.Service, p *oidc.Provider, userID int, id service.ExternalIdentity) {
+	if utils.SessionUserID(r) != userID {
+		http.Error(w, "You were logged out, log in and try again", http.StatusBadRequest)
+		return
+	}
+	user, err := service.IdentityUser(database, id)
+	switch {
+	case errors.Is(err, service.ErrNoAccount) || err == nil && user.User_id != userID:
+		utils.AddFlash(w, r, fmt.Sprintf("Sign in with the %s linked to your account, it was not deleted", p.Name))
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to check login", "user_id", userID, "err", err)
+		http.Error(w, "Failed to delete your account", http.StatusInternalServerError)
+		return
+	}
+	deleteAccount(w, r, database, svc, user)
+}
+
+// OIDCSignupHandler creates the user of an identity that logged in the
+// first time, with a username the user chooses
+func OIDCSignupHandler(database *gorm.DB, svc *service.Service, p *oidc.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		store, _ := utils.GetSession(r, w)
+		subject, _ := store.Values[signupSubjectKey].(string)
+		if p == nil || subject == "" || !recent(store.Values, signupSinceKey) {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		email, _ := store.Values[signupEmailKey].(string)
+		emailVerified, _ := store.Values[signupVerifiedKey].(bool)
+
+		if r.Method == "GET" {
+			username, _ := store.Values[signupUsernameKey].(string)
+			name, _ := store.Values[signupNameKey].(string)
+			data := struct {
+				User     *models.User
+				Flashes  []interface{}
+				Provider string
+				Name     string
+				Username string
+				Email    string
+			}{Provider: p.Name, Name: name, Username: username, Email: email}
+			if err := tracing.Render(r.Context(), oidcSignupTmpl, w, data); err != nil {
+				http.Error(w, "Failed to render template", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		id := service.ExternalIdentity{
+			Issuer:        p.Issuer,
+			Subject:       subject,
+			Email:         email,
+			EmailVerified: emailVerified,
+		}
+		user, err := service.RegisterExternalUser(database, id, r.FormValue("username"), r.FormValue("email"), time.Now())
+		var validationErr *service.ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, service.ErrUsernameTaken):
+			http.Error(w, "User already exists", http.StatusBadRequest)
+			return
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Failed to insert user", "username", r.FormValue("username"), "err", err)
+			http.Error(w, "Failed to register user", http.StatusInternalServerError)
+			return
+		}
+		metrics.UsersRegistered.WithLabelValues(metrics.SourceWeb).Inc()
+		for _, key := range []string{signupSubjectKey, signupEmailKey, signupVerifiedKey, signupUsernameKey, signupNameKey, signupSinceKey} {
+			delete(store.Values, key)
+		}
+
+		if user.Unverified {
+			if err := svc.SendVerificationEmail(r.Context(), user, time.Now()); err != nil {
+				slog.ErrorContext(r.Context(), "Failed to send verification email", "user_id", user.User_id, "err", err)
+			} else {
+				utils.AddFlash(w, r, "We sent you an email to verify your address")
+			}
+		}
+		logIn(w, r, store, user, nil)
+	}
+}
+
+// OIDCUnlinkHandler removes a linked identity of the logged in user
+func OIDCUnlinkHandler(database *gorm.DB, p *oidc.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user := sessionUser(w, r, database)
+		if user == nil {
+			return
+		}
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid login id", http.StatusBadRequest)
+			return
+		}
+		err = service.UnlinkIdentity(database, user.User_id, uint(id))
+		switch {
+		case errors.Is(err, service.ErrIdentityNotFound), errors.Is(err, service.ErrLastLogin):
+			utils.AddFlash(w, r, err.Error())
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Failed to unlink identity", "user_id", user.User_id, "err", err)
+			http.Error(w, "Failed to unlink the login", http.StatusInternalServerError)
+			return
+		default:
+			slog.InfoContext(r.Context(), "Identity unlinked", "user_id", user.User_id)
+			utils.AddFlash(w, r, fmt.Sprintf("Your %s is unlinked", providerName(p)))
+		}
+		http.Redirect(w, r, "/settings", http.StatusFound)
+	}
+}
@@ -3,16 +3,20 @@ package handlers
 import (
 	"net/http"
 
+	"minitwit/config"
 	"minitwit/db"
 	"minitwit/models"
+	"minitwit/service"
+	"minitwit/tracing"
 	"minitwit/utils"
 
 	"gorm.io/gorm"
 )
 
-func PublicTimelineHandler(database *gorm.DB) http.HandlerFunc {
+func PublicTimelineHandler(database *gorm.DB, cfg *config.Config, svc *service.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		messages, err := db.QueryPublicTimeline(database)
+		database := db.WithContext(database, r.Context())
+		messages, err := svc.Timelines.Public(r.Context(), database, cfg.PerPage)
 		if err != nil {
 			http.Error(w, "Failed to load public timeline", http.StatusInternalServerError)
 			return
@@ -40,7 +44,7 @@ func PublicTimelineHandler(database *gorm.DB) http.HandlerFunc {
 			data.User = &models.User{Username: username, User_id: userID}
 		}
 
-		if err := tmpl.Execute(w, data); err != nil {
+		if err := tracing.Render(r.Context(), tmpl, w, data); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		}
 	}
@@ -1,15 +1,16 @@
 package handlers
 
 import (
-	"crypto/md5"
-	"encoding/hex"
-	"log"
+	"errors"
+	"html/template"
+	"log/slog"
 	"net/http"
-	"strings"
-	"text/template"
+	"time"
 
 	"minitwit/db"
-	"minitwit/models"
+	"minitwit/metrics"
+	"minitwit/service"
+	"minitwit/tracing"
 	"minitwit/utils"
 
 	"gorm.io/gorm"
@@ -17,7 +18,7 @@ import (
 
 var registerTmpl = template.Must(template.ParseFiles("templates/layout.html", "templates/register.html"))
 
-func registerUser(w http.ResponseWriter, r *http.Request, database *gorm.DB) {
+func registerUser(w http.ResponseWriter, r *http.Request, database *gorm.DB, svc *service.Service) {
 	username := r.FormValue("username")
 	email := r.FormValue("email")
 	password := r.FormValue("password")
@@ -35,56 +36,43 @@ func registerUser(w http.ResponseWriter, r *http.Request, database *gorm.DB) {
 		return
 	}
 
-	// Validate email format
-	if !isValidEmail(email) {
-		http.Error(w, "You have to enter a valid email address", http.StatusBadRequest)
+	user, err := service.RegisterUser(database, username, email, password)
+	var validationErr *service.ValidationError
+	if errors.As(err, &validationErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	_, err := db.GormGetUserId(database, username)
-	if err == nil {
+	if errors.Is(err, service.ErrUsernameTaken) {
 		http.Error(w, "User already exists", http.StatusBadRequest)
 		return
 	}
-
-	// hash the password
-	hash := md5.New()
-	hash.Write([]byte(password))
-	pwHash := hex.EncodeToString(hash.Sum(nil))
-
-	// insert the user into the database
-	user := models.User{Username: username, Email: email, PwHash: pwHash}
-	result := database.Create(&user)
-	if result.Error != nil {
-		log.Fatalf("Failed to insert in db: %v", err)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to insert user", "username", username, "err", err)
+		http.Error(w, "Failed to register user", http.StatusInternalServerError)
 		return
 	}
+	metrics.UsersRegistered.WithLabelValues(metrics.SourceWeb).Inc()
 
 	// redirect to timeline
 	utils.AddFlash(w, r, "You were successfully registered and can login now")
+	if err := svc.SendVerificationEmail(r.Context(), user, time.Now()); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to send verification email", "user_id", user.User_id, "err", err)
+	} else {
+		utils.AddFlash(w, r, "We sent you an email to verify your address")
+	}
 	http.Redirect(w, r, "/login", http.StatusFound)
 }
 
-func RegisterHandler(database *gorm.DB) http.HandlerFunc {
+func RegisterHandler(database *gorm.DB, svc *service.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
 		if r.Method == "GET" {
-			if err := registerTmpl.Execute(w, nil); err != nil {
+			if err := tracing.Render(r.Context(), registerTmpl, w, nil); err != nil {
 				http.Error(w, "Failed to render template", http.StatusInternalServerError)
 			}
 		}
 		if r.Method == "POST" {
-			registerUser(w, r, database)
+			registerUser(w, r, database, svc)
 		}
 	}
 }
-
-// isValidEmail validates the email format
-func isValidEmail(email string) bool {
-	// Simple email validation - check for @ symbol and a period after it
-	atIndex := strings.Index(email, "@")
-	if atIndex < 1 {
-		return false
-	}
-	dotIndex := strings.LastIndex(email, ".")
-	return dotIndex > atIndex && dotIndex < len(email)-1
-}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+
+	"minitwit/db"
+	"minitwit/models"
+	"minitwit/oidc"
+	"minitwit/service"
+	"minitwit/tracing"
+	"minitwit/utils"
+
+	"gorm.io/gorm"
+)
+
+var settingsTmpl = template.Must(template.ParseFiles("templates/layout.html", "templates/settings.html"))
+
+// sessionUser returns the logged in user, or nil after answering the request
+func sessionUser(w http.ResponseWriter, r *http.Request, database *gorm.DB) *models.User {
+	userID := utils.SessionUserID(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+	var user models.User
+	if err := database.Where("user_id = ?", userID).First(&user).Error; err != nil {
+		http.Error(w, "Error getting user from db", http.StatusInternalServerError)
+		return nil
+	}
+	return &user
+}
+
+func SettingsHandler(database *gorm.DB, p *oidc.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user := sessionUser(w, r, database)
+		if user == nil {
+			return
+		}
+		twoFactor, err := service.TwoFactorEnabled(database, user.User_id)
+		if err != nil {
+			http.Error(w, "Failed to get two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		var codesLeft int64
+		if twoFactor {
+			if codesLeft, err = service.RecoveryCodesLeft(database, user.User_id); err != nil {
+				http.Error(w, "Failed to get two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+		}
+		var identities []models.Identity
+		if p != nil {
+			if identities, err = service.Identities(database, user.User_id); err != nil {
+				http.Error(w, "Failed to get the linked logins", http.StatusInternalServerError)
+				return
+			}
+		}
+		data := struct {
+			User              models.User
+			Flashes           []interface{}
+			TwoFactor         bool
+			RecoveryCodesLeft int64
+			OIDC              string
+			Identities        []models.Identity
+			Password          bool
+		}{
+			User:              *user,
+			Flashes:           utils.GetFlashes(w, r),
+			TwoFactor:         twoFactor,
+			RecoveryCodesLeft: codesLeft,
+			OIDC:              providerName(p),
+			Identities:        identities,
+			Password:          user.PwHash != "",
+		}
+		if err := tracing.Render(r.Context(), settingsTmpl, w, data); err != nil {
+			http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		}
+	}
+}
+
+// ArchiveHandler downloads the data of the logged in user as a zip
+func ArchiveHandler(database *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user := sessionUser(w, r, database)
+		if user == nil {
+			return
+		}
+		data, err := service.ExportUserData(database, user.User_id)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to export user data", "user_id", user.User_id, "err", err)
+			http.Error(w, "Failed to export your data", http.StatusInternalServerError)
+			return
+		}
+		// build the zip first, so a failure is still a 500
+		var buf bytes.Buffer
+		if err := service.WriteArchive(&buf, data); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to write the archive", "user_id", user.User_id, "err", err)
+			http.Error(w, "Failed to export your data", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "minitwit-"+user.Username+".zip"))
+		w.Write(buf.Bytes())
+	}
+}
+
+// DeleteAccountHandler deletes the logged in user after checking the
+// password. Users without a password sign in at the identity provider
+// again instead.
+func DeleteAccountHandler(database *gorm.DB, svc *service.Service, p *oidc.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user := sessionUser(w, r, database)
+		if user == nil {
+			return
+		}
+		if user.PwHash == "" && p != nil {
+			store, _ := utils.GetSession(r, w)
+			redirectToProvider(w, r, p, store, user.User_id, oidcDelete)
+			return
+		}
+		if _, err := service.CheckPassword(database, user.Username, r.FormValue("password")); err != nil {
+			utils.AddFlash(w, r, "Invalid password, your account was not deleted")
+			http.Redirect(w, r, "/settings", http.StatusFound)
+			return
+		}
+		deleteAccount(w, r, database, svc, user)
+	}
+}
+
+// deleteAccount deletes the user after it confirmed it and logs it out
+func deleteAccount(w http.ResponseWriter, r *http.Request, database *gorm.DB, svc *service.Service, user *models.User) {
+	err := svc.DeleteAccount(database, user.User_id)
+	if err != nil && !errors.Is(err, service.ErrUserNotFound) {
+		slog.ErrorContext(r.Context(), "Failed to delete account", "user_id", user.User_id, "err", err)
+		http.Error(w, "Failed to delete your account", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Account deleted", "user_id", user.User_id)
+
+	utils.AddFlash(w, r, "Your account was deleted")
+	if err := utils.ForgetUser(w, r); err != nil {
+		http.Error(w, "Failed to save session", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/public", http.StatusFound)
+}
@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"html/template"
 	"net/http"
-	"text/template"
 
+	"minitwit/config"
 	"minitwit/db"
 	"minitwit/models"
+	"minitwit/service"
+	"minitwit/tracing"
 	"minitwit/utils"
 
 	"gorm.io/gorm"
@@ -15,8 +18,9 @@ var tmpl = template.Must(template.New("layout.html").Funcs(template.FuncMap{
 	"getGravatar": utils.GetGravatar, // Register the getGravatar function with the template - ugly but can't find a better way
 }).ParseFiles("templates/layout.html", "templates/timeline.html"))
 
-func TimelineHandler(database *gorm.DB) http.HandlerFunc {
+func TimelineHandler(database *gorm.DB, cfg *config.Config, svc *service.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
 		session, err := utils.GetSession(r, w)
 		if err != nil {
 			http.Error(w, "Failed to get session", http.StatusInternalServerError)
@@ -31,7 +35,7 @@ func TimelineHandler(database *gorm.DB) http.HandlerFunc {
 		userID := session.Values["user_id"].(int)
 		username := session.Values["username"].(string)
 
-		messages, err := db.QueryTimeline(database, userID)
+		messages, err := svc.Timelines.Home(r.Context(), database, svc.Fanout, userID, cfg.PerPage)
 		if err != nil {
 			http.Error(w, "Failed to load timeline", http.StatusInternalServerError)
 			return
@@ -49,7 +53,7 @@ func TimelineHandler(database *gorm.DB) http.HandlerFunc {
 			Flashes:  utils.GetFlashes(w, r),
 		}
 
-		if err := tmpl.Execute(w, data); err != nil {
+		if err := tracing.Render(r.Context(), tmpl, w, data); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		}
 
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"minitwit/db"
+	"minitwit/models"
+	"minitwit/ratelimit"
+	"minitwit/service"
+	"minitwit/tracing"
+	"minitwit/utils"
+
+	"gorm.io/gorm"
+)
+
+// session values of a login waiting for the second factor
+const (
+	pendingUserKey  = "pending_user_id"
+	pendingSinceKey = "pending_since"
+)
+
+// pendingTimeout is how long the code can be entered after the password
+const pendingTimeout = 5 * time.Minute
+
+var (
+	loginCodeTmpl = template.Must(template.ParseFiles("templates/layout.html", "templates/login_code.html"))
+	twoFactorTmpl = template.Must(template.ParseFiles("templates/layout.html", "templates/twofactor.html"))
+)
+
+// pendingUser returns the user that entered the password, 0 if there is
+// none or it was too long ago
+func pendingUser(values map[interface{}]interface{}) int {
+	userID, _ := values[pendingUserKey].(int)
+	since, _ := values[pendingSinceKey].(int64)
+	if time.Since(time.Unix(since, 0)) > pendingTimeout {
+		return 0
+	}
+	return userID
+}
+
+// LoginCodeHandler is the second step of the login of users with
+// two-factor auth, after LoginHandler checked the password
+func LoginCodeHandler(database *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		store, _ := utils.GetSession(r, w)
+		userID := pendingUser(store.Values)
+		if userID == 0 {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		if r.Method == "GET" {
+			if err := tracing.Render(r.Context(), loginCodeTmpl, w, nil); err != nil {
+				http.Error(w, "Failed to render template", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		user, failures, err := service.LoginSecondFactor(database, userID, r.FormValue("code"), service.LoginAttempt{
+			IP:        utils.ClientIP(r),
+			SharedIP:  !utils.ClientIPForwarded(r),
+			UserAgent: r.UserAgent(),
+		}, time.Now())
+		var locked *service.LockedError
+		switch {
+		case errors.As(err, &locked):
+			w.Header().Set("Retry-After", ratelimit.RetryAfter(locked.RetryAfter))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			slog.InfoContext(r.Context(), "Login failed", "user_id", userID, "reason", "locked")
+			return
+		case errors.Is(err, service.ErrInvalidCode):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			slog.InfoContext(r.Context(), "Login failed", "user_id", userID, "reason", "invalid code")
+			return
+		case errors.Is(err, service.ErrUserDisabled):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Failed to check login code", "user_id", userID, "err", err)
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+
+		delete(store.Values, pendingUserKey)
+		delete(store.Values, pendingSinceKey)
+		logIn(w, r, store, user, failures)
+	}
+}
+
+type twoFactorPage struct {
+	User    models.User
+	Flashes []interface{}
+	Secret  string
+	// otpauth: links are built by totp.URI, html/template filters them otherwise
+	URI   template.URL
+	Codes []string
+}
+
+func renderTwoFactor(w http.ResponseWriter, r *http.Request, data twoFactorPage) {
+	if err := tracing.Render(r.Context(), twoFactorTmpl, w, data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
+
+// TwoFactorHandler shows the secret to enroll with on GET and starts
+// enrolling with a new secret on POST
+func TwoFactorHandler(database *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user := sessionUser(w, r, database)
+		if user == nil {
+			return
+		}
+
+		if r.Method == "POST" {
+			_, _, err := service.EnrollTwoFactor(database, user, time.Now())
+			if errors.Is(err, service.ErrTwoFactorEnabled) {
+				utils.AddFlash(w, r, err.Error())
+				http.Redirect(w, r, "/settings", http.StatusFound)
+				return
+			} else if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to enroll two-factor auth", "user_id", user.User_id, "err", err)
+				http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+			return
+		}
+
+		secret, uri, err := service.PendingTwoFactor(database, user)
+		if errors.Is(err, service.ErrNotEnrolled) {
+			http.Redirect(w, r, "/settings", http.StatusFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		renderTwoFactor(w, r, twoFactorPage{User: *user, Flashes: utils.GetFlashes(w, r), Secret: secret, URI: template.URL(uri)})
+	}
+}
+
+// ConfirmTwoFactorHandler turns two-factor auth on with a code of the app
+// and shows the recovery codes
+func ConfirmTwoFactorHandler(database *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user := sessionUser(w, r, database)
+		if user == nil {
+			return
+		}
+		codes, err := service.ConfirmTwoFactor(database, user.User_id, r.FormValue("code"), time.Now())
+		switch {
+		case errors.Is(err, service.ErrInvalidCode):
+			utils.AddFlash(w, r, "Invalid authentication code, check the clock of your device and try again")
+			http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+			return
+		case errors.Is(err, service.ErrNotEnrolled), errors.Is(err, service.ErrTwoFactorEnabled):
+			utils.AddFlash(w, r, err.Error())
+			http.Redirect(w, r, "/settings", http.StatusFound)
+			return
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Failed to confirm two-factor auth", "user_id", user.User_id, "err", err)
+			http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Two-factor auth enabled", "user_id", user.User_id)
+		renderTwoFactor(w, r, twoFactorPage{User: *user, Codes: codes})
+	}
+}
+
+// DisableTwoFactorHandler turns two-factor auth off after checking the
+// password
+func DisableTwoFactorHandler(database *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
+		user := sessionUser(w, r, database)
+		if user == nil {
+			return
+		}
+		if _, err := service.CheckPassword(database, user.Username, r.FormValue("password")); err != nil {
+			utils.AddFlash(w, r, "Invalid password, two-factor authentication is still on")
+			http.Redirect(w, r, "/settings", http.StatusFound)
+			return
+		}
+		if err := service.DisableTwoFactor(database, user.User_id); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to disable two-factor auth", "user_id", user.User_id, "err", err)
+			http.Error(w, "Failed to turn off two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Two-factor auth disabled", "user_id", user.User_id)
+		utils.AddFlash(w, r, "Two-factor authentication is off")
+		http.Redirect(w, r, "/settings", http.StatusFound)
+	}
+}
@@ -1,17 +1,22 @@
 package handlers
 
 import (
+	"log/slog"
 	"net/http"
 
+	"minitwit/db"
+	"minitwit/metrics"
 	"minitwit/models"
+	"minitwit/service"
 	"minitwit/utils"
 
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
 )
 
-func UnfollowHandler(database *gorm.DB) http.HandlerFunc {
+func UnfollowHandler(database *gorm.DB, svc *service.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
 		session, _ := utils.GetSession(r, w)
 		if session.Values["user_id"] == nil {
 			utils.AddFlash(w, r, "You are not logged in")
@@ -29,11 +34,24 @@ func UnfollowHandler(database *gorm.DB) http.HandlerFunc {
 		}
 
 		// Delete the follow from the database
-		err = database.Where("who_id=? AND whom_id=?", session.Values["user_id"], user.User_id).Delete(&models.Follower{}).Error
+		removed, err := db.RemoveFollow(database, session.Values["user_id"].(int), user.User_id)
 		if err != nil {
 			http.Error(w, "Failed to unfollow user", http.StatusInternalServerError)
 			return
 		}
+		if removed {
+			metrics.Unfollows.WithLabelValues(metrics.SourceWeb).Inc()
+			svc.Fanout.Unfollowed(database, session.Values["user_id"].(int), user.User_id)
+			svc.Timelines.FollowsChanged(r.Context(), session.Values["user_id"].(int))
+		}
+		if svc.Federation != nil {
+			if remote, ok := svc.Federation.IsRemote(user.User_id); ok {
+				err := svc.Federation.SendUnfollow(session.Values["user_id"].(int), session.Values["username"].(string), remote)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed to send unfollow", "actor", remote.Actor_uri, "err", err)
+				}
+			}
+		}
 
 		// Redirect to the user's timeline
 		utils.AddFlash(w, r, "You have unfollowed "+username)
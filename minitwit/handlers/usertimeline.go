@@ -3,16 +3,20 @@ package handlers
 import (
 	"net/http"
 
+	"minitwit/config"
 	"minitwit/db"
 	"minitwit/models"
+	"minitwit/service"
+	"minitwit/tracing"
 	"minitwit/utils"
 
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
 )
 
-func UserTimelineHandler(database *gorm.DB) http.HandlerFunc {
+func UserTimelineHandler(database *gorm.DB, cfg *config.Config, svc *service.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		database := db.WithContext(database, r.Context())
 		vars := mux.Vars(r)
 
 		// For some reason favicon.ico is being passed as a username, it also changes the username to lowercase? - ignore this for now, fix later
@@ -29,7 +33,7 @@ func UserTimelineHandler(database *gorm.DB) http.HandlerFunc {
 		}
 		//profileUser := gorm_models.GormUserToModelUser(user)
 
-		messages, err := db.QueryUserTimeline(database, username)
+		messages, err := svc.Timelines.User(r.Context(), database, profileUser, cfg.PerPage)
 		if err != nil {
 			http.Error(w, "Failed to load user timeline", http.StatusInternalServerError)
 			return
@@ -65,7 +69,7 @@ func UserTimelineHandler(database *gorm.DB) http.HandlerFunc {
 			}
 		}
 
-		if err := tmpl.Execute(w, data); err != nil {
+		if err := tracing.Render(r.Context(), tmpl, w, data); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		}
 	}
@@ -0,0 +1,164 @@
+// Package health serves /healthz, which only says the process is up, and
+// /readyz, which checks the database the instance depends on.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"minitwit/db"
+
+	"gorm.io/gorm"
+)
+
+const (
+	StatusOK        = "ok"
+	StatusFailed    = "failed"
+	StatusSaturated = "saturated"
+)
+
+// Timeout bounds the database checks of a single /readyz request
+var Timeout = 2 * time.Second
+
+// Check is the result of one check. The errors are only logged, /readyz
+// is public and they name hosts and tables.
+type Check struct {
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type PoolCheck struct {
+	Status     string  `json:"status"`
+	Open       int     `json:"open"`
+	InUse      int     `json:"in_use"`
+	Idle       int     `json:"idle"`
+	MaxOpen    int     `json:"max_open"`
+	WaitCount  int64   `json:"wait_count"`
+	Saturation float64 `json:"saturation"`
+}
+
+type Response struct {
+	Status string           `json:"status"`
+	Uptime string           `json:"uptime,omitempty"`
+	Checks map[string]Check `json:"checks,omitempty"`
+	Pool   *PoolCheck       `json:"pool,omitempty"`
+}
+
+var started = time.Now()
+
+func respond(w http.ResponseWriter, code int, response Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Error("Failed to encode health response", "err", err)
+	}
+}
+
+// Liveness answers as long as the process can serve requests
+func Liveness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, Response{Status: StatusOK, Uptime: time.Since(started).Round(time.Second).String()})
+	}
+}
+
+// Readiness pings the database and checks that the migrations are
+// current. It answers 503 if one of them fails, so the instance gets no
+// traffic. A saturated connection pool is reported but doesn't fail the
+// check, the requests are only slower.
+func Readiness(database *gorm.DB) http.HandlerFunc {
+	checker := &checker{database: database}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), Timeout)
+		defer cancel()
+
+		response := Response{Status: StatusOK, Checks: map[string]Check{
+			"database":   run(ctx, "database", func() error { return checker.ping(ctx) }),
+			"migrations": run(ctx, "migrations", func() error { return checker.migrations(ctx) }),
+		}}
+		code := http.StatusOK
+		for _, check := range response.Checks {
+			if check.Status != StatusOK {
+				response.Status = StatusFailed
+				code = http.StatusServiceUnavailable
+			}
+		}
+		response.Pool = checker.pool()
+		respond(w, code, response)
+	}
+}
+
+func run(ctx context.Context, name string, check func() error) Check {
+	start := time.Now()
+	err := check()
+	result := Check{Status: StatusOK, DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		slog.ErrorContext(ctx, "Readiness check failed", "check", name, "err", err)
+		result.Status = StatusFailed
+	}
+	return result
+}
+
+type checker struct {
+	database *gorm.DB
+
+	// migrations don't get undone, so they are only checked until they pass
+	migrated atomic.Bool
+
+	mu        sync.Mutex
+	waitCount int64
+}
+
+func (c *checker) ping(ctx context.Context) error {
+	sqlDB, err := c.database.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+func (c *checker) migrations(ctx context.Context) error {
+	if c.migrated.Load() {
+		return nil
+	}
+	if err := db.CheckMigrations(c.database.WithContext(ctx)); err != nil {
+		return err
+	}
+	c.migrated.Store(true)
+	return nil
+}
+
+// pool is saturated if every connection is in use and requests had to
+// wait for one since the last check
+func (c *checker) pool() *PoolCheck {
+	sqlDB, err := c.database.DB()
+	if err != nil {
+		return nil
+	}
+	stats := sqlDB.Stats()
+	check := &PoolCheck{
+		Status:    StatusOK,
+		Open:      stats.OpenConnections,
+		InUse:     stats.InUse,
+		Idle:      stats.Idle,
+		MaxOpen:   stats.MaxOpenConnections,
+		WaitCount: stats.WaitCount,
+	}
+	if stats.MaxOpenConnections > 0 {
+		check.Saturation = float64(stats.InUse) / float64(stats.MaxOpenConnections)
+	}
+
+	c.mu.Lock()
+	waited := stats.WaitCount > c.waitCount
+	c.waitCount = stats.WaitCount
+	c.mu.Unlock()
+	if check.Saturation >= 1 && waited {
+		check.Status = StatusSaturated
+	}
+	return check
+}
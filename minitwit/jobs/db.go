@@ -0,0 +1,112 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"minitwit/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DBQueue keeps the jobs in the jobs table. On postgres the workers claim
+// jobs with SELECT ... FOR UPDATE SKIP LOCKED, so they never wait for each
+// other and never take the same job.
+type DBQueue struct {
+	db *gorm.DB
+}
+
+func NewDBQueue(database *gorm.DB) *DBQueue {
+	return &DBQueue{db: database}
+}
+
+func (q *DBQueue) Enqueue(ctx context.Context, job *Job) error {
+	row := models.Job{
+		Kind:         job.Kind,
+		Payload:      string(job.Payload),
+		State:        StateQueued,
+		Run_at:       job.RunAt.UnixMilli(),
+		Max_attempts: job.MaxAttempts,
+		Created_at:   time.Now().UnixMilli(),
+	}
+	if job.Unique != "" {
+		row.Unique_key = &job.Unique
+	}
+	if err := q.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+		return err
+	}
+	job.ID = row.ID
+	return nil
+}
+
+func (q *DBQueue) Claim(ctx context.Context, kinds []string, now time.Time, lease time.Duration) (*Job, error) {
+	var job *Job
+	err := q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		query := tx.Where("state = ? AND run_at <= ? AND locked_until <= ? AND kind IN ?", StateQueued, now.UnixMilli(), now.UnixMilli(), kinds)
+		if tx.Dialector.Name() == "postgres" {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+		var rows []models.Job
+		if err := query.Order("run_at, id").Limit(1).Find(&rows).Error; err != nil || len(rows) == 0 {
+			return err
+		}
+		row := rows[0]
+		row.Attempts++
+		err := tx.Model(&models.Job{}).Where("id = ?", row.ID).
+			Updates(map[string]any{"attempts": row.Attempts, "locked_until": now.Add(lease).UnixMilli()}).Error
+		if err != nil {
+			return err
+		}
+		job = &Job{
+			ID:          row.ID,
+			Kind:        row.Kind,
+			Payload:     []byte(row.Payload),
+			RunAt:       time.UnixMilli(row.Run_at),
+			Attempt:     row.Attempts,
+			MaxAttempts: row.Max_attempts,
+		}
+		if row.Unique_key != nil {
+			job.Unique = *row.Unique_key
+		}
+		return nil
+	})
+	return job, err
+}
+
+func (q *DBQueue) Complete(ctx context.Context, job *Job, now time.Time) error {
+	database := q.db.WithContext(ctx)
+	if job.Unique == "" {
+		return database.Where("id = ?", job.ID).Delete(&models.Job{}).Error
+	}
+	return q.update(database, job, map[string]any{"state": StateDone, "finished_at": now.UnixMilli()})
+}
+
+func (q *DBQueue) Retry(ctx context.Context, job *Job, runAt time.Time, cause error) error {
+	return q.update(q.db.WithContext(ctx), job, map[string]any{"run_at": runAt.UnixMilli(), "last_error": cause.Error()})
+}
+
+func (q *DBQueue) Fail(ctx context.Context, job *Job, now time.Time, cause error) error {
+	return q.update(q.db.WithContext(ctx), job, map[string]any{"state": StateDead, "finished_at": now.UnixMilli(), "last_error": cause.Error()})
+}
+
+// update changes a claimed job and gives it back to the queue
+func (q *DBQueue) update(database *gorm.DB, job *Job, values map[string]any) error {
+	values["locked_until"] = 0
+	return database.Model(&models.Job{}).Where("id = ?", job.ID).Updates(values).Error
+}
+
+func (q *DBQueue) Stats(ctx context.Context) ([]Stat, error) {
+	var stats []Stat
+	err := q.db.WithContext(ctx).Model(&models.Job{}).
+		Select("kind, state, COUNT(*) AS count").
+		Where("state IN ?", []string{StateQueued, StateDead}).
+		Group("kind, state").
+		Scan(&stats).Error
+	return stats, err
+}
+
+func (q *DBQueue) Cleanup(ctx context.Context, before time.Time) (int64, error) {
+	result := q.db.WithContext(ctx).Where("state IN ? AND finished_at < ?", []string{StateDone, StateDead}, before.UnixMilli()).Delete(&models.Job{})
+	return result.RowsAffected, result.Error
+}
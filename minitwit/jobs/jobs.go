@@ -0,0 +1,167 @@
+// Package jobs runs work in the background, outside of the requests that
+// cause it. Jobs go into a Queue, in memory for one process or in the jobs
+// table to survive restarts and to share them between the replicas and
+// minitwit worker. A Pool runs them with the handler of their kind:
+//
+//	pool := jobs.NewPool(queue, 4)
+//	pool.Handle("mail.welcome", sendWelcome)
+//	pool.Cron("digest", "0 7 * * *", "mail.digest", nil)
+//	go pool.Run(ctx)
+//
+//	jobs.Enqueue(ctx, queue, "mail.welcome", welcome{UserID: 1})
+//
+// A failed job is retried with exponential backoff until it used its
+// attempts, then it stays in the queue as dead. Jobs run at least once: a
+// worker that dies with a job loses it to another worker after the lease,
+// so handlers have to be safe to repeat.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"minitwit/config"
+
+	"gorm.io/gorm"
+)
+
+// Backends of FromConfig
+const (
+	BackendMemory   = "memory"
+	BackendPostgres = "postgres"
+)
+
+// States of a job
+const (
+	StateQueued = "queued"
+	StateDone   = "done"
+	StateDead   = "dead"
+)
+
+// DefaultMaxAttempts is how often a job runs unless Enqueue says otherwise
+const DefaultMaxAttempts = 5
+
+// Job is one piece of work
+type Job struct {
+	ID      int64
+	Kind    string
+	Payload []byte
+	// Unique, if set, keeps a second job with the same key out of the queue
+	// until the first one is cleaned up
+	Unique string
+	RunAt  time.Time
+	// Attempt is 1 on the first run
+	Attempt     int
+	MaxAttempts int
+}
+
+// Decode reads the JSON payload into v
+func (j *Job) Decode(v any) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// Handler runs a job, an error retries it
+type Handler func(ctx context.Context, job *Job) error
+
+// Queue keeps the jobs
+type Queue interface {
+	// Enqueue adds a job, nothing happens if its Unique key is taken
+	Enqueue(ctx context.Context, job *Job) error
+	// Claim takes the next job of one of kinds that is due at now for
+	// lease, nil if there is none
+	Claim(ctx context.Context, kinds []string, now time.Time, lease time.Duration) (*Job, error)
+	// Complete removes a finished job, unique jobs stay done until Cleanup
+	Complete(ctx context.Context, job *Job, now time.Time) error
+	// Retry runs the job again at runAt
+	Retry(ctx context.Context, job *Job, runAt time.Time, cause error) error
+	// Fail gives up on the job, it stays dead until Cleanup
+	Fail(ctx context.Context, job *Job, now time.Time, cause error) error
+	// Stats counts the queued and dead jobs by kind
+	Stats(ctx context.Context) ([]Stat, error)
+	// Cleanup deletes the done and dead jobs that finished before
+	Cleanup(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Stat is the number of jobs of a kind in a state
+type Stat struct {
+	Kind  string
+	State string
+	Count int64
+}
+
+// FromConfig returns the queue of cfg
+func FromConfig(cfg config.Jobs, database *gorm.DB) (Queue, error) {
+	switch cfg.Backend {
+	case BackendMemory:
+		return NewMemoryQueue(), nil
+	case BackendPostgres:
+		return NewDBQueue(database), nil
+	default:
+		return nil, fmt.Errorf("unknown jobs backend %q, use memory or postgres", cfg.Backend)
+	}
+}
+
+// Option changes a job before Enqueue queues it
+type Option func(*Job)
+
+// At runs the job at t instead of right away
+func At(t time.Time) Option {
+	return func(j *Job) { j.RunAt = t }
+}
+
+// After runs the job d from now
+func After(d time.Duration) Option {
+	return func(j *Job) { j.RunAt = time.Now().Add(d) }
+}
+
+// MaxAttempts sets how often the job runs before it is given up
+func MaxAttempts(n int) Option {
+	return func(j *Job) { j.MaxAttempts = n }
+}
+
+// Unique keeps other jobs with key out of the queue
+func Unique(key string) Option {
+	return func(j *Job) { j.Unique = key }
+}
+
+// Enqueue queues a job of kind with payload as JSON
+func Enqueue(ctx context.Context, q Queue, kind string, payload any, opts ...Option) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	job := &Job{Kind: kind, Payload: data, RunAt: time.Now(), MaxAttempts: DefaultMaxAttempts}
+	for _, opt := range opts {
+		opt(job)
+	}
+	return q.Enqueue(ctx, job)
+}
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error that retrying does not fix, like a payload that
+// does not decode. The job is given up right away.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// Backoff is the wait before the next run of a job that failed its
+// attempt: 10s, 20s, 40s and so on, at most an hour
+func Backoff(attempt int) time.Duration {
+	wait := 10 * time.Second
+	for i := 1; i < attempt && wait < time.Hour; i++ {
+		wait *= 2
+	}
+	return min(wait, time.Hour)
+}
@@ -0,0 +1,135 @@
+package jobs
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+type memoryJob struct {
+	job         Job
+	state       string
+	lockedUntil time.Time
+	finishedAt  time.Time
+	lastError   string
+}
+
+// MemoryQueue keeps the jobs of one process, they are lost on restart
+type MemoryQueue struct {
+	mu     sync.Mutex
+	nextID int64
+	jobs   map[int64]*memoryJob
+	unique map[string]int64
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{jobs: map[int64]*memoryJob{}, unique: map[string]int64{}}
+}
+
+func (q *MemoryQueue) Enqueue(ctx context.Context, job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job.Unique != "" {
+		if _, ok := q.unique[job.Unique]; ok {
+			return nil
+		}
+	}
+	q.nextID++
+	job.ID = q.nextID
+	stored := *job
+	stored.Payload = slices.Clone(job.Payload)
+	q.jobs[job.ID] = &memoryJob{job: stored, state: StateQueued}
+	if job.Unique != "" {
+		q.unique[job.Unique] = job.ID
+	}
+	return nil
+}
+
+func (q *MemoryQueue) Claim(ctx context.Context, kinds []string, now time.Time, lease time.Duration) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next *memoryJob
+	for _, j := range q.jobs {
+		if j.state != StateQueued || j.job.RunAt.After(now) || j.lockedUntil.After(now) || !slices.Contains(kinds, j.job.Kind) {
+			continue
+		}
+		if next == nil || j.job.RunAt.Before(next.job.RunAt) || (j.job.RunAt.Equal(next.job.RunAt) && j.job.ID < next.job.ID) {
+			next = j
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	next.job.Attempt++
+	next.lockedUntil = now.Add(lease)
+	job := next.job
+	job.Payload = slices.Clone(next.job.Payload)
+	return &job, nil
+}
+
+func (q *MemoryQueue) Complete(ctx context.Context, job *Job, now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[job.ID]
+	if !ok {
+		return nil
+	}
+	if j.job.Unique == "" {
+		delete(q.jobs, job.ID)
+		return nil
+	}
+	j.state, j.finishedAt, j.lockedUntil = StateDone, now, time.Time{}
+	return nil
+}
+
+func (q *MemoryQueue) Retry(ctx context.Context, job *Job, runAt time.Time, cause error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j, ok := q.jobs[job.ID]; ok {
+		j.job.RunAt, j.lockedUntil, j.lastError = runAt, time.Time{}, cause.Error()
+	}
+	return nil
+}
+
+func (q *MemoryQueue) Fail(ctx context.Context, job *Job, now time.Time, cause error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j, ok := q.jobs[job.ID]; ok {
+		j.state, j.finishedAt, j.lockedUntil, j.lastError = StateDead, now, time.Time{}, cause.Error()
+	}
+	return nil
+}
+
+func (q *MemoryQueue) Stats(ctx context.Context) ([]Stat, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	counts := map[Stat]int64{}
+	for _, j := range q.jobs {
+		if j.state != StateDone {
+			counts[Stat{Kind: j.job.Kind, State: j.state}]++
+		}
+	}
+	stats := make([]Stat, 0, len(counts))
+	for stat, count := range counts {
+		stat.Count = count
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func (q *MemoryQueue) Cleanup(ctx context.Context, before time.Time) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var deleted int64
+	for id, j := range q.jobs {
+		if j.state != StateQueued && j.finishedAt.Before(before) {
+			delete(q.jobs, id)
+			if j.job.Unique != "" {
+				delete(q.unique, j.job.Unique)
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
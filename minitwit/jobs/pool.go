@@ -0,0 +1,253 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"minitwit/metrics"
+)
+
+// statsInterval is how often a pool counts the jobs for the metrics
+const statsInterval = 15 * time.Second
+
+type cronJob struct {
+	name     string
+	schedule Schedule
+	kind     string
+	payload  any
+	next     time.Time
+}
+
+// Pool runs the jobs of the kinds it has handlers for
+type Pool struct {
+	Queue Queue
+	// Concurrency is the number of jobs that run at once
+	Concurrency int
+	// Poll is how often idle workers look for due jobs
+	Poll time.Duration
+	// Lease is how long a job may run before other workers retry it
+	Lease time.Duration
+	// Drain runs the due jobs when Run stops, for a queue that does not
+	// outlive the process
+	Drain bool
+
+	handlers map[string]Handler
+	crons    []*cronJob
+}
+
+// NewPool returns a pool of concurrency workers, add the handlers before
+// Run
+func NewPool(queue Queue, concurrency int) *Pool {
+	return &Pool{Queue: queue, Concurrency: concurrency, Poll: time.Second, Lease: 5 * time.Minute, handlers: map[string]Handler{}}
+}
+
+// Handle runs the jobs of kind with h
+func (p *Pool) Handle(kind string, h Handler) {
+	p.handlers[kind] = h
+}
+
+// Cron queues a job of kind with payload on schedule (see ParseSchedule).
+// Every pool of the app may run the same cron, each run is queued once.
+func (p *Pool) Cron(name, spec, kind string, payload any) error {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return fmt.Errorf("schedule %q never runs", spec)
+	}
+	p.crons = append(p.crons, &cronJob{name: name, schedule: schedule, kind: kind, payload: payload})
+	return nil
+}
+
+func (p *Pool) kinds() []string {
+	kinds := make([]string, 0, len(p.handlers))
+	for kind := range p.handlers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Run works until ctx is done and the running jobs finished
+func (p *Pool) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < p.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx)
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.schedule(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		p.observe(ctx)
+	}()
+	wg.Wait()
+}
+
+// Start runs the pool in the background, stop ends it and waits for the
+// running jobs
+func (p *Pool) Start() (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (p *Pool) work(ctx context.Context) {
+	// the running job finishes after ctx is done
+	jobCtx := context.WithoutCancel(ctx)
+	for {
+		if p.RunOne(jobCtx) {
+			if ctx.Err() == nil || p.Drain {
+				continue
+			}
+			return
+		}
+		// nothing is due, a drained queue is done
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			if !p.Drain {
+				return
+			}
+		case <-time.After(p.Poll):
+		}
+	}
+}
+
+// RunOne runs the next due job and tells if there was one
+func (p *Pool) RunOne(ctx context.Context) bool {
+	job, err := p.Queue.Claim(ctx, p.kinds(), time.Now(), p.Lease)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to claim a job", "err", err)
+		return false
+	}
+	if job == nil {
+		return false
+	}
+
+	start := time.Now()
+	err = p.run(ctx, job)
+	now := time.Now()
+	result := StateDone
+	switch {
+	case err == nil:
+		err = p.Queue.Complete(ctx, job, now)
+	case job.Attempt >= job.MaxAttempts || isPermanent(err):
+		result = StateDead
+		slog.ErrorContext(ctx, "Job failed for good", "job_id", job.ID, "kind", job.Kind, "attempt", job.Attempt, "err", err)
+		err = p.Queue.Fail(ctx, job, now, err)
+	default:
+		result = "retry"
+		wait := Backoff(job.Attempt)
+		slog.WarnContext(ctx, "Job failed, retrying", "job_id", job.ID, "kind", job.Kind, "attempt", job.Attempt, "retry_in", wait, "err", err)
+		err = p.Queue.Retry(ctx, job, now.Add(wait), err)
+	}
+	if err != nil {
+		// the job runs again after its lease
+		slog.ErrorContext(ctx, "Failed to update a job", "job_id", job.ID, "kind", job.Kind, "err", err)
+	}
+	metrics.JobDuration.WithLabelValues(job.Kind, result).Observe(now.Sub(start).Seconds())
+	return true
+}
+
+// run calls the handler, a panic fails the job instead of the process
+func (p *Pool) run(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return p.handlers[job.Kind](ctx, job)
+}
+
+// schedule queues the cron jobs when they are due
+func (p *Pool) schedule(ctx context.Context) {
+	if len(p.crons) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, c := range p.crons {
+		c.next = c.schedule.Next(now)
+	}
+	for {
+		next := p.crons[0].next
+		for _, c := range p.crons[1:] {
+			if c.next.Before(next) {
+				next = c.next
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		now := time.Now()
+		for _, c := range p.crons {
+			if c.next.After(now) {
+				continue
+			}
+			// the other pools queue the same key, only one job gets in
+			key := "cron:" + c.name + ":" + strconv.FormatInt(c.next.Unix(), 10)
+			if err := Enqueue(ctx, p.Queue, c.kind, c.payload, Unique(key), At(c.next)); err != nil {
+				slog.ErrorContext(ctx, "Failed to queue cron job", "cron", c.name, "err", err)
+			}
+			c.next = c.schedule.Next(now)
+		}
+	}
+}
+
+// observe keeps metrics.Jobs up to date
+func (p *Pool) observe(ctx context.Context) {
+	for {
+		stats, err := p.Queue.Stats(ctx)
+		if err == nil {
+			metrics.Jobs.Reset()
+			for _, s := range stats {
+				metrics.Jobs.WithLabelValues(s.Kind, s.State).Set(float64(s.Count))
+			}
+		} else if ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Failed to count the jobs", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(statsInterval):
+		}
+	}
+}
+
+// CleanupKind is the job that deletes finished jobs, see CleanupHandler
+const CleanupKind = "jobs.cleanup"
+
+// CleanupHandler deletes the jobs that finished more than retention ago
+func CleanupHandler(queue Queue, retention time.Duration) Handler {
+	return func(ctx context.Context, job *Job) error {
+		deleted, err := queue.Cleanup(ctx, time.Now().Add(-retention))
+		if err == nil && deleted > 0 {
+			slog.InfoContext(ctx, "Deleted finished jobs", "jobs", deleted)
+		}
+		return err
+	}
+}
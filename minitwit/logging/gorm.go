@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// GormLogger sends GORM logs to slog. Queries slower than SlowThreshold are
+// logged as warnings with the request id of the query context, so use
+// db.WithContext(r.Context()) in handlers.
+type GormLogger struct {
+	Logger        *slog.Logger
+	Level         logger.LogLevel
+	SlowThreshold time.Duration
+}
+
+// NewGormLogger logs through the default slog logger, queries slower than
+// threshold are logged as warnings
+func NewGormLogger(threshold time.Duration) *GormLogger {
+	return &GormLogger{Logger: slog.Default(), Level: logger.Warn, SlowThreshold: threshold}
+}
+
+func (l *GormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	clone := *l
+	clone.Level = level
+	return &clone
+}
+
+func (l *GormLogger) Info(ctx context.Context, msg string, args ...any) {
+	if l.Level >= logger.Info {
+		l.Logger.InfoContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *GormLogger) Warn(ctx context.Context, msg string, args ...any) {
+	if l.Level >= logger.Warn {
+		l.Logger.WarnContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *GormLogger) Error(ctx context.Context, msg string, args ...any) {
+	if l.Level >= logger.Error {
+		l.Logger.ErrorContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *GormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.Level <= logger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	// not found is handled by the callers
+	case err != nil && l.Level >= logger.Error && !errors.Is(err, gorm.ErrRecordNotFound):
+		sql, rows := fc()
+		l.Logger.ErrorContext(ctx, "Query failed", "sql", sql, "rows", rows, "duration", elapsed, "err", err)
+	case l.SlowThreshold > 0 && elapsed > l.SlowThreshold && l.Level >= logger.Warn:
+		sql, rows := fc()
+		l.Logger.WarnContext(ctx, "Slow query", "sql", sql, "rows", rows, "duration", elapsed, "threshold", l.SlowThreshold)
+	case l.Level >= logger.Info:
+		sql, rows := fc()
+		l.Logger.DebugContext(ctx, "Query", "sql", sql, "rows", rows, "duration", elapsed)
+	}
+}
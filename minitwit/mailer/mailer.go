@@ -0,0 +1,196 @@
+// Package mailer sends the emails of the web app. The log backend is for
+// development on localhost, the file backend writes .eml files for tests and staging and
+// the smtp backend sends them.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"minitwit/config"
+)
+
+// Backends of FromConfig
+const (
+	BackendLog  = "log"
+	BackendFile = "file"
+	BackendSMTP = "smtp"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromConfig returns the mailer of the configured backend
+func FromConfig(cfg config.Mail) (Mailer, error) {
+	switch cfg.Backend {
+	case BackendLog:
+		return Log{}, nil
+	case BackendFile:
+		return &File{Dir: cfg.Dir, From: cfg.From}, nil
+	case BackendSMTP:
+		m := &SMTP{Addr: cfg.SMTPAddr, From: cfg.From}
+		if cfg.SMTPUsername != "" {
+			host, _, _ := strings.Cut(cfg.SMTPAddr, ":")
+			m.Auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unknown mail backend %q, use log, file or smtp", cfg.Backend)
+	}
+}
+
+// Log only logs that an email would be sent. The body is left out, the
+// links in it log in as the recipient.
+type Log struct{}
+
+func (Log) Send(ctx context.Context, msg Message) error {
+	slog.InfoContext(ctx, "Email not sent, mail.backend is log", "to", msg.To, "subject", msg.Subject)
+	return nil
+}
+
+// File writes every email to a file in Dir
+type File struct {
+	Dir  string
+	From string
+}
+
+var fileCount atomic.Int64
+
+func (f *File) Send(ctx context.Context, msg Message) error {
+	data, err := format(f.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%d.eml", time.Now().UnixNano(), fileCount.Add(1))
+	return os.WriteFile(filepath.Join(f.Dir, name), data, 0o644)
+}
+
+// sendTimeout bounds an SMTP conversation if the context has no deadline
+const sendTimeout = 30 * time.Second
+
+// SMTP sends the emails to a server. It uses STARTTLS if the server offers
+// it and net/smtp only sends the password over TLS or to localhost.
+type SMTP struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	data, err := format(s.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	from, _ := mail.ParseAddress(s.From)
+	if err := s.send(ctx, from.Address, msg.To, data); err != nil {
+		return fmt.Errorf("failed to send email to %s: %w", msg.To, err)
+	}
+	return nil
+}
+
+// send is smtp.SendMail on a connection that gives up with ctx, a server
+// that stops answering would block the request otherwise
+func (s *SMTP) send(ctx context.Context, from, to string, data []byte) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sendTimeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	host, _, _ := net.SplitHostPort(s.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(s.Auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// format writes msg as an RFC 5322 message
+func format(from string, msg Message, now time.Time) ([]byte, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %w", from, err)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", msg.To, err)
+	}
+	var b bytes.Buffer
+	header := func(key, value string) { fmt.Fprintf(&b, "%s: %s\r\n", key, value) }
+	header("From", sender.String())
+	header("To", to.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "8bit")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes(), nil
+}
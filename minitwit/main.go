@@ -1,50 +1,174 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"minitwit/admin"
+	"minitwit/backup"
+	"minitwit/cache"
+	"minitwit/config"
 	"minitwit/db"
+	"minitwit/fanout"
+	"minitwit/federation"
 	"minitwit/handlers"
+	"minitwit/health"
+	"minitwit/jobs"
+	"minitwit/logging"
+	"minitwit/mailer"
+	"minitwit/metrics"
 	"minitwit/middleware"
+	"minitwit/oidc"
+	"minitwit/replay"
+	"minitwit/server"
+	"minitwit/service"
+	"minitwit/tracing"
+	"minitwit/utils"
+	"minitwit/worker"
 
 	"github.com/gorilla/mux"
-
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
+	// subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(replay.Main(os.Args[2:], os.Stdout, os.Stderr))
+		case "admin":
+			os.Exit(admin.Main(os.Args[2:], os.Stdout, os.Stderr))
+		case "export":
+			os.Exit(backup.ExportMain(os.Args[2:], os.Stdout, os.Stderr))
+		case "import":
+			os.Exit(backup.ImportMain(os.Args[2:], os.Stdout, os.Stderr))
+		case "worker":
+			os.Exit(worker.Main(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	cfg := config.MustLoad("minitwit", os.Args[1:])
+	logging.Setup(cfg.Log)
+	slog.Info("Configuration loaded", "config", cfg)
+	if cfg.Web.SecretKey == config.DefaultSecretKey {
+		slog.Warn("Sessions are signed with the development secret key, set web.secret_key")
+	}
+	// the login with the company identity provider, nil without one
+	provider := oidc.FromConfig(cfg.OIDC, cfg.Web.BaseURL)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "minitwit")
+	if err != nil {
+		logging.Fatal("Failed to set up tracing", "err", err)
+	}
+
 	// DB abstraction
 	//this MUST be called, otherwise tests fail
 	//seems grom cant read already existing database w/out migration stuff
-	db.AutoMigrateDB()
-	gormDB := db.GormConnectDB()
+	db.AutoMigrateDB(cfg.Database)
+	gormDB := db.GormConnectDB(cfg.Database)
+	if err := metrics.RegisterDB(gormDB); err != nil {
+		slog.Error("Failed to register database metrics", "err", err)
+	}
+
+	rateLimit, err := middleware.RateLimit(gormDB, cfg, nil)
+	if err != nil {
+		logging.Fatal("Invalid rate limit rules", "err", err)
+	}
+	svc := service.New(cfg)
+	svc.Mailer, err = mailer.FromConfig(cfg.Mail)
+	if err != nil {
+		logging.Fatal("Invalid mail settings", "err", err)
+	}
+	svc.Timelines, err = cache.FromConfig(cfg.Cache, gormDB)
+	if err != nil {
+		logging.Fatal("Failed to set up the timeline cache", "err", err)
+	}
+	queue, err := jobs.FromConfig(cfg.Jobs, gormDB)
+	if err != nil {
+		logging.Fatal("Failed to set up the job queue", "err", err)
+	}
+	// fanned out messages drop the cached timelines of the followers
+	svc.Fanout = fanout.FromConfig(gormDB, cfg.Timeline, queue, svc.Timelines.MessagePosted)
+	// ActivityPub, enabled by cfg.Federation, nil without federation.base_url
+	svc.Federation = federation.NewFromConfig(gormDB, cfg.Federation, svc.Timelines, svc.Fanout, queue)
+	stopJobs := func() {}
+	if cfg.Jobs.Embedded {
+		stopJobs = worker.NewPool(cfg.Jobs, queue, svc.Fanout, svc.Federation).Start()
+	}
 
 	// Routes
 	r := mux.NewRouter()
 
 	// Middleware
+	r.Use(middleware.RequestID)
+	r.Use(tracing.Middleware)
 	r.Use(middleware.PrometheusMiddleware)
+	r.Use(utils.TrustProxies(cfg.Server.ClientIPHeader, cfg.Server.TrustedProxies))
+	r.Use(utils.Sessions(cfg.Web.SecretKey))
+	r.Use(rateLimit)
+	r.Use(middleware.ActiveSession(gormDB))
 
 	// expose metrics
-	r.Handle("/metrics", promhttp.Handler())
+	r.Handle("/metrics", middleware.MetricsHandler())
+	r.HandleFunc("/healthz", health.Liveness()).Methods("GET")
+	r.HandleFunc("/readyz", health.Readiness(gormDB)).Methods("GET")
+
+	// ActivityPub routes, before the catch-all "/{username}" ones
+	if svc.Federation != nil {
+		svc.Federation.Register(r)
+	}
 
 	// general routes
-	r.HandleFunc("/", handlers.TimelineHandler(gormDB)).Methods("GET")
-	r.HandleFunc("/public", handlers.PublicTimelineHandler(gormDB)).Methods("GET")
-	r.HandleFunc("/register", handlers.RegisterHandler(gormDB)).Methods("GET", "POST")
-	r.HandleFunc("/login", handlers.LoginHandler(gormDB)).Methods("GET", "POST")
+	r.HandleFunc("/", handlers.TimelineHandler(gormDB, cfg, svc)).Methods("GET")
+	r.HandleFunc("/public", handlers.PublicTimelineHandler(gormDB, cfg, svc)).Methods("GET")
+	r.HandleFunc("/register", handlers.RegisterHandler(gormDB, svc)).Methods("GET", "POST")
+	r.HandleFunc("/login", handlers.LoginHandler(gormDB, provider)).Methods("GET", "POST")
+	r.HandleFunc("/login/code", handlers.LoginCodeHandler(gormDB)).Methods("GET", "POST")
+	r.HandleFunc("/login/oidc", handlers.OIDCLoginHandler(provider)).Methods("GET")
+	r.HandleFunc("/login/oidc/callback", handlers.OIDCCallbackHandler(gormDB, svc, provider)).Methods("GET")
+	r.HandleFunc("/login/oidc/signup", handlers.OIDCSignupHandler(gormDB, svc, provider)).Methods("GET", "POST")
+	r.HandleFunc("/forgot", handlers.ForgotPasswordHandler(gormDB, svc)).Methods("GET", "POST")
+	r.HandleFunc("/reset", handlers.ResetPasswordHandler(gormDB, svc)).Methods("GET", "POST")
+	r.HandleFunc("/verify", handlers.VerifyEmailHandler(gormDB, svc)).Methods("GET")
 	r.HandleFunc("/logout", handlers.LogoutHandler()).Methods("GET")
-	r.HandleFunc("/{username}", handlers.UserTimelineHandler(gormDB)).Methods("GET")
-	r.HandleFunc("/{username}/follow", handlers.FollowHandler(gormDB)).Methods("GET", "POST")
-	r.HandleFunc("/{username}/unfollow", handlers.UnfollowHandler(gormDB)).Methods("GET", "POST")
-	r.HandleFunc("/add_message", handlers.AddMessageHandler(gormDB)).Methods("POST")
+	r.HandleFunc("/settings", handlers.SettingsHandler(gormDB, provider)).Methods("GET")
+	r.HandleFunc("/settings/archive", handlers.ArchiveHandler(gormDB)).Methods("GET")
+	r.HandleFunc("/settings/delete", handlers.DeleteAccountHandler(gormDB, svc, provider)).Methods("POST")
+	r.HandleFunc("/settings/verify", handlers.ResendVerificationHandler(gormDB, svc)).Methods("POST")
+	r.HandleFunc("/settings/oidc", handlers.OIDCLinkHandler(gormDB, provider)).Methods("POST")
+	r.HandleFunc("/settings/oidc/unlink", handlers.OIDCUnlinkHandler(gormDB, provider)).Methods("POST")
+	r.HandleFunc("/settings/2fa", handlers.TwoFactorHandler(gormDB)).Methods("GET", "POST")
+	r.HandleFunc("/settings/2fa/confirm", handlers.ConfirmTwoFactorHandler(gormDB)).Methods("POST")
+	r.HandleFunc("/settings/2fa/disable", handlers.DisableTwoFactorHandler(gormDB)).Methods("POST")
+	r.HandleFunc("/{username}", handlers.UserTimelineHandler(gormDB, cfg, svc)).Methods("GET")
+	r.HandleFunc("/{username}/followers", handlers.FollowersHandler(gormDB, cfg)).Methods("GET")
+	r.HandleFunc("/{username}/following", handlers.FollowingHandler(gormDB, cfg)).Methods("GET")
+	r.HandleFunc("/{username}/follow", handlers.FollowHandler(gormDB, svc)).Methods("GET", "POST")
+	r.HandleFunc("/{username}/unfollow", handlers.UnfollowHandler(gormDB, svc)).Methods("GET", "POST")
+	r.HandleFunc("/add_message", handlers.AddMessageHandler(gormDB, svc)).Methods("POST")
 
 	// Serve static files
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
-	// Start the server
-	fmt.Println("Server is running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+	// Start the server, SIGTERM drains the open requests
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	opts := server.FromConfig(cfg.Web.Addr, cfg.Server)
+	slog.Info("Server is running", "addr", opts.Addr, "tls", opts.TLSCert != "")
+	if err := server.New(r, opts).Run(ctx); err != nil {
+		slog.Error("Server stopped", "err", err)
+	}
+	stopJobs()
+
+	// metrics are scraped, only the buffered spans need flushing
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Failed to flush traces", "err", err)
+	}
+	if err := db.Close(gormDB); err != nil {
+		slog.Error("Failed to close the database pool", "err", err)
+	}
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,234 @@
+// Package metrics holds the business and database metrics. The HTTP request
+// metrics are in package middleware.
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"gorm.io/gorm"
+)
+
+// Sources of writes, used as the source label
+const (
+	SourceWeb   = "web"
+	SourceAPI   = "api"
+	SourceAPIv2 = "apiv2"
+	SourceGRPC  = "grpc"
+)
+
+var (
+	UsersRegistered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "minitwit_users_registered_total",
+			Help: "Total number of registered users",
+		},
+		[]string{"source"},
+	)
+
+	MessagesPosted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "minitwit_messages_posted_total",
+			Help: "Total number of posted messages",
+		},
+		[]string{"source"},
+	)
+
+	Follows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "minitwit_follows_total",
+			Help: "Total number of follows",
+		},
+		[]string{"source"},
+	)
+
+	Unfollows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "minitwit_unfollows_total",
+			Help: "Total number of unfollows",
+		},
+		[]string{"source"},
+	)
+
+	FailedLogins = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "minitwit_failed_logins_total",
+			Help: "Total number of failed logins",
+		},
+		[]string{"reason"},
+	)
+
+	RateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "minitwit_rate_limited_requests_total",
+			Help: "Total number of requests rejected by the rate limiter",
+		},
+		[]string{"path", "key"},
+	)
+
+	TimelineCache = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "minitwit_timeline_cache_requests_total",
+			Help: "Total number of timeline cache lookups by timeline and result",
+		},
+		[]string{"timeline", "result"},
+	)
+
+	FanoutMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "minitwit_fanout_messages_total",
+			Help: "Total number of new messages by how they reach the home timelines: fanned_out, pulled or failed",
+		},
+		[]string{"result"},
+	)
+
+	Jobs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "minitwit_jobs",
+			Help: "Background jobs in the queue by kind and state: queued or dead",
+		},
+		[]string{"kind", "state"},
+	)
+
+	JobDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "minitwit_job_duration_seconds",
+			Help:    "Duration of background jobs by kind and result: done, retry or dead",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"kind", "result"},
+	)
+
+	queryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "minitwit_db_query_duration_seconds",
+			Help:    "Duration of database queries by operation",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"operation"},
+	)
+
+	simulatorLatest = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "minitwit_simulator_latest_id",
+		Help: "Highest latest id received from the simulator",
+	})
+
+	simulatorProcessed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "minitwit_simulator_processed_id",
+		Help: "Highest latest id of a simulator write that has been processed",
+	})
+
+	simulatorLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "minitwit_simulator_latest_lag",
+		Help: "Received minus processed simulator latest id",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(UsersRegistered, MessagesPosted, Follows, Unfollows, FailedLogins, RateLimited, TimelineCache, FanoutMessages, Jobs, JobDuration)
+	prometheus.MustRegister(queryDuration)
+	prometheus.MustRegister(simulatorLatest, simulatorProcessed, simulatorLag)
+}
+
+// ObserveQuery records the duration of a database operation, use it as
+//
+//	defer metrics.ObserveQuery("QueryTimeline")()
+func ObserveQuery(operation string) func() {
+	start := time.Now()
+	return func() {
+		queryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	}
+}
+
+var latest struct {
+	sync.Mutex
+	received, processed int
+}
+
+// SimulatorReceived records the latest id of an incoming simulator request
+func SimulatorReceived(id int) {
+	latest.Lock()
+	defer latest.Unlock()
+	if id > latest.received {
+		latest.received = id
+		simulatorLatest.Set(float64(id))
+		simulatorLag.Set(float64(latest.received - latest.processed))
+	}
+}
+
+// SimulatorProcessed records the latest id of a finished simulator write
+func SimulatorProcessed(id int) {
+	latest.Lock()
+	defer latest.Unlock()
+	if id > latest.processed {
+		latest.processed = id
+		simulatorProcessed.Set(float64(id))
+		simulatorLag.Set(float64(latest.received - latest.processed))
+	}
+}
+
+// RegisterDB exposes the connection pool statistics of sql.DB.Stats() and
+// gauges with the number of users, messages and follows. The counts are
+// cached, so scrapes don't run a full count every few seconds.
+func RegisterDB(database *gorm.DB) error {
+	sqlDB, err := database.DB()
+	if err != nil {
+		return err
+	}
+	if err := prometheus.Register(collectors.NewDBStatsCollector(sqlDB, "minitwit")); err != nil {
+		return err
+	}
+	return prometheus.Register(newTableCollector(database, time.Minute))
+}
+
+type tableCollector struct {
+	database *gorm.DB
+	ttl      time.Duration
+	desc     *prometheus.Desc
+
+	mu      sync.Mutex
+	updated time.Time
+	counts  map[string]int64
+}
+
+var tables = []string{"users", "messages", "followers"}
+
+func newTableCollector(database *gorm.DB, ttl time.Duration) *tableCollector {
+	return &tableCollector{
+		database: database,
+		ttl:      ttl,
+		desc:     prometheus.NewDesc("minitwit_table_rows", "Number of rows per table", []string{"table"}, nil),
+	}
+}
+
+func (c *tableCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *tableCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.updated) > c.ttl {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		counts := map[string]int64{}
+		for _, table := range tables {
+			var n int64
+			if err := c.database.WithContext(ctx).Table(table).Count(&n).Error; err != nil {
+				ch <- prometheus.NewInvalidMetric(c.desc, err)
+				return
+			}
+			counts[table] = n
+		}
+		c.counts = counts
+		c.updated = time.Now()
+	}
+
+	for _, table := range tables {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(c.counts[table]), table)
+	}
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcMethod is the method label of gRPC calls, the path label is the full method name
+const grpcMethod = "GRPC"
+
+// httpStatus maps gRPC codes to the HTTP status used in the status label,
+// so dashboards can treat both APIs the same way
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Canceled:
+		return 499
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func observeGRPC(fullMethod string, start time.Time, err error) {
+	st := status.Convert(err)
+	code := httpStatus(st.Code())
+
+	httpRequestsTotal.WithLabelValues(fullMethod, grpcMethod, strconv.Itoa(code)).Inc()
+	httpRequestDuration.WithLabelValues(fullMethod, grpcMethod).Observe(time.Since(start).Seconds())
+	// the message can contain user input, the code name is bounded
+	if err != nil {
+		RecordResponseMessage(code, st.Code().String())
+	}
+}
+
+// PrometheusUnaryInterceptor records unary calls in the same metric
+// families as PrometheusMiddleware
+func PrometheusUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeGRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+// PrometheusStreamInterceptor records streaming calls in the same metric
+// families as PrometheusMiddleware, the duration covers the whole stream
+func PrometheusStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeGRPC(info.FullMethod, start, err)
+	return err
+}
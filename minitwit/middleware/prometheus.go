@@ -1,12 +1,17 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 	"strconv"
 	"time"
 
+	"minitwit/utils"
+
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -52,7 +57,7 @@ func PrometheusMiddleware(next http.Handler) http.Handler {
 		start := time.Now()
 
 		// wrap response writer
-		ww := &responseWriterWrapper{ResponseWriter: w, statusCode: 200}
+		ww := utils.NewStatusRecorder(w)
 
 		next.ServeHTTP(ww, r)
 
@@ -70,19 +75,27 @@ func PrometheusMiddleware(next http.Handler) http.Handler {
 		}
 
 		duration := time.Since(start).Seconds()
-		statusCode := strconv.Itoa(ww.statusCode)
+		statusCode := strconv.Itoa(ww.Status)
 
 		httpRequestsTotal.WithLabelValues(path, r.Method, statusCode).Inc()
-		httpRequestDuration.WithLabelValues(path, r.Method).Observe(duration)
+		observeWithTraceID(r.Context(), httpRequestDuration.WithLabelValues(path, r.Method), duration)
 	})
 }
 
-type responseWriterWrapper struct {
-	http.ResponseWriter
-	statusCode int
+// observeWithTraceID links the observation to the trace of the request, if
+// it is sampled. Exemplars are only exposed by MetricsHandler.
+func observeWithTraceID(ctx context.Context, observer prometheus.Observer, value float64) {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && spanContext.IsSampled() {
+		exemplarObserver.ObserveWithExemplar(value, prometheus.Labels{"trace_id": spanContext.TraceID().String()})
+		return
+	}
+	observer.Observe(value)
 }
 
-func (rww *responseWriterWrapper) WriteHeader(code int) {
-	rww.statusCode = code
-	rww.ResponseWriter.WriteHeader(code)
+// MetricsHandler serves the metrics in the OpenMetrics format when the
+// scraper asks for it, which is needed for exemplars
+func MetricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
 }
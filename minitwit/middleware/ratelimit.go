@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"minitwit/config"
+	"minitwit/ratelimit"
+	"minitwit/utils"
+
+	"gorm.io/gorm"
+)
+
+// RateLimit builds the rate limiter of the config. Users are identified by
+// their session, API clients are limited by IP, see utils.ClientIP. reject writes the 429
+// response, nil for plain text. The ip rules are left out without
+// server.client_ip_header, behind a load balancer all clients would share
+// its address and one bucket.
+func RateLimit(database *gorm.DB, cfg *config.Config, reject func(w http.ResponseWriter, r *http.Request)) (func(http.Handler) http.Handler, error) {
+	if !cfg.RateLimit.Enabled {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	rules, err := ratelimit.ParseRules(cfg.RateLimit.Rules)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Server.ClientIPHeader == "" {
+		rules = withoutIPRules(rules)
+	}
+	store, err := ratelimit.NewStore(cfg.RateLimit.Backend, database)
+	if err != nil {
+		return nil, err
+	}
+
+	simulator := cfg.Simulator.Authorization()
+	return ratelimit.Middleware(store, ratelimit.Options{
+		Rules:    rules,
+		ClientIP: utils.ClientIP,
+		User: func(r *http.Request) string {
+			if id := utils.SessionUserID(r); id != 0 {
+				return strconv.Itoa(id)
+			}
+			return ""
+		},
+		Exempt: func(r *http.Request) bool {
+			return cfg.RateLimit.ExemptSimulator && r.Header.Get("Authorization") == simulator
+		},
+		Reject: reject,
+	}), nil
+}
+
+func withoutIPRules(rules []ratelimit.Rule) []ratelimit.Rule {
+	var kept []ratelimit.Rule
+	var dropped []string
+	for _, rule := range rules {
+		if rule.Key == ratelimit.KeyIP {
+			dropped = append(dropped, rule.String())
+			continue
+		}
+		kept = append(kept, rule)
+	}
+	if len(dropped) > 0 {
+		slog.Warn("Per-IP rate limits are off until server.client_ip_header is set", "rules", dropped)
+	}
+	return kept
+}
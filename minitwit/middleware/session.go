@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"minitwit/db"
+	"minitwit/models"
+	"minitwit/utils"
+
+	"gorm.io/gorm"
+)
+
+// ActiveSession logs out sessions of users that were deleted or disabled
+// after they logged in. The session cookie stays valid until it expires,
+// so the user is looked up on every request that carries one.
+func ActiveSession(database *gorm.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if userID := utils.SessionUserID(r); userID != 0 {
+				var user models.User
+				err := db.WithContext(database, r.Context()).Select("user_id, disabled").Where("user_id = ?", userID).First(&user).Error
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound), err == nil && user.Disabled:
+					if err := utils.ForgetUser(w, r); err != nil {
+						slog.ErrorContext(r.Context(), "Failed to end the session", "user_id", userID, "err", err)
+					}
+				case err != nil:
+					slog.ErrorContext(r.Context(), "Failed to check the session user", "user_id", userID, "err", err)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
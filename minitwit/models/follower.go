@@ -1,6 +1,8 @@
 package models
 
+// the unique index keeps retried follow requests from adding duplicate rows,
+// idx_followers_whom finds the followers of a user
 type Follower struct {
-	Who_id  int
-	Whom_id int
+	Who_id  int `gorm:"uniqueIndex:idx_followers_who_whom"`
+	Whom_id int `gorm:"uniqueIndex:idx_followers_who_whom;index:idx_followers_whom"`
 }
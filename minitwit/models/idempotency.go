@@ -0,0 +1,13 @@
+package models
+
+// Stored response of a write to the simulator API, replayed when the same
+// request is retried. Status is 0 while the first request is still running.
+type IdempotencyKey struct {
+	Key          string `gorm:"primaryKey"`
+	Fingerprint  string
+	Status       int
+	Content_type string
+	Body         []byte
+	Created_at   int64
+	Expires_at   int64 `gorm:"index"`
+}
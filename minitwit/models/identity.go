@@ -0,0 +1,13 @@
+package models
+
+// External identity linked to a user, the account at an OpenID Connect
+// provider. Issuer and Subject identify it, the email may change at the
+// provider and is only kept to show it.
+type Identity struct {
+	ID         uint   `gorm:"primaryKey"`
+	Issuer     string `gorm:"not null;uniqueIndex:idx_identities_issuer_subject"`
+	Subject    string `gorm:"not null;uniqueIndex:idx_identities_issuer_subject"`
+	User_id    int    `gorm:"not null;index"`
+	Email      string
+	Created_at int64
+}
@@ -0,0 +1,20 @@
+package models
+
+// Job of the background queue, see package jobs. Times are unix
+// milliseconds. A worker owns a queued job until Locked_until, after that
+// another one may run it again. Unique_key keeps a job from being queued
+// twice, e.g. a cron tick by several workers.
+type Job struct {
+	ID           int64   `gorm:"primaryKey"`
+	Kind         string  `gorm:"not null"`
+	Payload      string  `gorm:"not null"`
+	Unique_key   *string `gorm:"uniqueIndex"`
+	State        string  `gorm:"not null;index:idx_jobs_ready,priority:1"`
+	Run_at       int64   `gorm:"index:idx_jobs_ready,priority:2"`
+	Locked_until int64
+	Attempts     int
+	Max_attempts int
+	Last_error   string
+	Created_at   int64
+	Finished_at  int64
+}
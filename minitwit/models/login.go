@@ -0,0 +1,15 @@
+package models
+
+// Failed login, kept for the lockout and for admins. Username is what was
+// typed and User_id is 0 if there is no such user. Failures are cleared by
+// the next successful login of the account.
+type FailedLogin struct {
+	ID         uint   `gorm:"primaryKey"`
+	Username   string `gorm:"index"`
+	User_id    int    `gorm:"index"`
+	IP         string `gorm:"index"`
+	User_agent string
+	Reason     string
+	Created_at int64 `gorm:"index"`
+	Cleared    bool  `gorm:"not null;default:false"`
+}
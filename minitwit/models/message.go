@@ -1,12 +1,12 @@
 package models
 
 type Message struct {
-	Message_id int `gorm:"primaryKey"`
-	Author_id  uint
+	Message_id int    `gorm:"primaryKey"`
+	Author_id  uint   `gorm:"index:idx_messages_author_date,priority:1"`
 	Author     string `gorm:"-"` // ignore this field when write and read to db
 	Email      string `gorm:"-"`
 	Text       string
-	Pub_date   int64
+	Pub_date   int64  `gorm:"index:idx_messages_author_date,priority:2"`
 	PubDate    string `gorm:"-"`
 	Flagged    int
 }
@@ -0,0 +1,10 @@
+package models
+
+// Token bucket of the rate limiter, shared by the replicas. Times are unix
+// milliseconds, full buckets are deleted after Full_at.
+type RateLimitBucket struct {
+	Key        string `gorm:"primaryKey"`
+	Tokens     float64
+	Updated_at int64
+	Full_at    int64 `gorm:"index"`
+}
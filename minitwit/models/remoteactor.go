@@ -0,0 +1,25 @@
+package models
+
+// Remote (fediverse) accounts are stored as a normal User row so that their
+// notes show up in the timeline queries. RemoteActor holds the ActivityPub
+// specific data for such a user.
+type RemoteActor struct {
+	User_id    int    `gorm:"primaryKey;autoIncrement:false"`
+	Actor_uri  string `gorm:"uniqueIndex"`
+	Inbox      string
+	Public_key string
+}
+
+// Key pair used to sign outgoing activities on behalf of a local user
+type ActorKey struct {
+	User_id     int `gorm:"primaryKey;autoIncrement:false"`
+	Private_key string
+	Public_key  string
+}
+
+// Maps a message received from a remote server to its note id,
+// so the same note isn't stored twice
+type RemoteNote struct {
+	Message_id int    `gorm:"primaryKey;autoIncrement:false"`
+	Note_uri   string `gorm:"uniqueIndex"`
+}
@@ -0,0 +1,17 @@
+package models
+
+// Cached timeline, shared by the replicas. Data is the JSON of the
+// messages, the row is ignored after Expires_at (unix milliseconds) and
+// deleted later.
+type TimelineCache struct {
+	Key        string `gorm:"primaryKey"`
+	Data       string
+	Expires_at int64 `gorm:"index"`
+}
+
+// Generation of the shared timeline cache, a single row bumped by every
+// invalidation. A replica does not cache a timeline it queried across one.
+type TimelineCacheGeneration struct {
+	ID         int `gorm:"primaryKey"`
+	Generation uint64
+}
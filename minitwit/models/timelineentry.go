@@ -0,0 +1,17 @@
+package models
+
+// TimelineEntry puts a message into the home timeline of User_id when
+// timelines are fanned out. Author_id and Pub_date are copied from the
+// message, to prune on unfollow and to read the timeline in order.
+type TimelineEntry struct {
+	User_id    int   `gorm:"primaryKey;autoIncrement:false;index:idx_timeline_entries_user_date,priority:1"`
+	Message_id int   `gorm:"primaryKey;autoIncrement:false;index:idx_timeline_entries_user_date,priority:3"`
+	Author_id  int   `gorm:"index"`
+	Pub_date   int64 `gorm:"index:idx_timeline_entries_user_date,priority:2"`
+}
+
+// PopularAuthor has too many followers to fan out to, the timelines of
+// the followers read their messages at request time
+type PopularAuthor struct {
+	User_id int `gorm:"primaryKey;autoIncrement:false"`
+}
@@ -0,0 +1,21 @@
+package models
+
+// Two-factor auth of a user. The secret is kept from enrolling on, Enabled
+// is set once the user confirmed a code. Last_step is the TOTP step of the
+// last accepted code, older codes are rejected.
+type TwoFactor struct {
+	User_id    int `gorm:"primaryKey;autoIncrement:false"`
+	Secret     string
+	Enabled    bool `gorm:"not null;default:false"`
+	Last_step  int64
+	Created_at int64
+}
+
+// One-time code to log in without the authenticator, hashed like
+// passwords. Used_at is 0 until it is used.
+type RecoveryCode struct {
+	ID      uint `gorm:"primaryKey"`
+	User_id int  `gorm:"index"`
+	Hash    string
+	Used_at int64
+}
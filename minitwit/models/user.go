@@ -1,7 +1,7 @@
 package models
 
 import (
-	"fmt"
+	"minitwit/metrics"
 
 	"gorm.io/gorm"
 )
@@ -12,6 +12,16 @@ type User struct {
 	Email    string
 	Pwd      string `gorm:"-"` //for register API
 	PwHash   string
+	// disabled users cannot log in, set with minitwit admin
+	Disabled bool `gorm:"not null;default:false"`
+	// users that signed up on the web until they open the link of the
+	// verification email, they can post less
+	Unverified bool `gorm:"not null;default:false"`
+	// counts of the followers table and the unflagged messages, changed in
+	// the transactions that change those, see db.FixCounters
+	Follower_count  int64 `gorm:"not null;default:0"`
+	Following_count int64 `gorm:"not null;default:0"`
+	Message_count   int64 `gorm:"not null;default:0"`
 	//'Has many' relationship - message
 	Messages []Message `gorm:"foreignKey:Author_id;references:User_id"`
 	//Self-referential 'Many to Many' relationship - follow
@@ -21,11 +31,10 @@ type User struct {
 }
 
 func GetUserByUsername(database *gorm.DB, username string) (*User, error) {
+	defer metrics.ObserveQuery("GetUserByUsername")()
 	var user User
 	err := database.Table("users").Where("username = ?", username).First(&user).Error
 	if err != nil {
-		fmt.Println("got error:")
-		fmt.Println(err)
 		return nil, err
 	}
 	return &user, nil
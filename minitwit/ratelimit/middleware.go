@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"minitwit/metrics"
+
+	"github.com/gorilla/mux"
+)
+
+// Options of Middleware
+type Options struct {
+	Rules []Rule
+	// ClientIP returns the address of the client, the remote address by
+	// default
+	ClientIP func(r *http.Request) string
+	// User returns the logged in user of a request, or "" if there is
+	// none. Requests without a user are limited by IP by user rules.
+	User func(r *http.Request) string
+	// Exempt requests are not limited
+	Exempt func(r *http.Request) bool
+	// Reject answers a limited request, after Retry-After is set. The
+	// default is a plain text 429.
+	Reject func(w http.ResponseWriter, r *http.Request)
+	// Now is the clock, time.Now by default
+	Now func() time.Time
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Middleware takes a token from the bucket of every rule that matches the
+// route of the request and answers 429 if one of them is empty. Rules match
+// the route template, so it is used with Router.Use. Store errors let the
+// request through.
+func Middleware(store Store, opts Options) func(http.Handler) http.Handler {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.ClientIP == nil {
+		opts.ClientIP = remoteHost
+	}
+	if opts.Reject == nil {
+		opts.Reject = func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(opts.Rules) == 0 || (opts.Exempt != nil && opts.Exempt(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// the label is bounded by the routes, paths are not
+			path, label := r.URL.Path, "unknown"
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					path, label = template, template
+				}
+			}
+
+			now := opts.Now()
+			var wait time.Duration
+			var limitedBy *Rule
+			for i, rule := range opts.Rules {
+				if !rule.matches(r.Method, path) {
+					continue
+				}
+				key := "ip:" + opts.ClientIP(r)
+				if rule.Key == KeyUser && opts.User != nil {
+					if user := opts.User(r); user != "" {
+						key = "user:" + user
+					}
+				}
+				allowed, ruleWait, err := store.Take(r.Context(), strconv.Itoa(i)+":"+key, rule.Limit, now)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed to check the rate limit", "rule", rule.String(), "err", err)
+					continue
+				}
+				if !allowed && ruleWait > wait {
+					wait, limitedBy = ruleWait, &opts.Rules[i]
+				}
+			}
+			if limitedBy == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			metrics.RateLimited.WithLabelValues(label, limitedBy.Key).Inc()
+			slog.InfoContext(r.Context(), "Request rate limited", "rule", limitedBy.String(), "retry_after", wait)
+			w.Header().Set("Retry-After", RetryAfter(wait))
+			opts.Reject(w, r)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Package ratelimit limits requests per client IP or per user with token
+// buckets. Rules pick the routes and the limits, for example
+//
+//	POST /login ip 10/m; POST /add_message user 30/m burst 10; * /api/v2/* ip 300/m
+//
+// allows 10 login attempts per minute and IP. The buckets live in a Store,
+// in memory for a single replica or in the database to share the limits
+// between replicas.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys of the buckets of a rule
+const (
+	KeyIP   = "ip"
+	KeyUser = "user"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second up to Burst
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// fullAt is when a bucket with tokens left at now is full again
+func (l Limit) fullAt(tokens float64, now time.Time) time.Time {
+	return now.Add(time.Duration((float64(l.Burst) - tokens) / l.Rate * float64(time.Second)))
+}
+
+// take refills the bucket for the time since updated and removes a token.
+// It returns how long to wait for the next token if the bucket is empty.
+func (l Limit) take(tokens float64, updated, now time.Time) (float64, bool, time.Duration) {
+	if elapsed := now.Sub(updated).Seconds(); elapsed > 0 {
+		tokens = min(float64(l.Burst), tokens+elapsed*l.Rate)
+	}
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	return tokens, false, time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+}
+
+// Rule limits the requests of the routes it matches
+type Rule struct {
+	// Method is the HTTP method or * for all
+	Method string
+	// Path is a mux path template like /msgs/{username}, a trailing *
+	// matches every path with that prefix
+	Path string
+	// Key is KeyIP or KeyUser
+	Key string
+	Limit
+}
+
+func (r Rule) matches(method, path string) bool {
+	if r.Method != "*" && r.Method != method {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(r.Path, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return r.Path == path
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%s %s %s", r.Method, r.Path, r.Key)
+}
+
+var units = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+// ParseRules parses rules separated by semicolons. A rule is
+// "METHOD PATH KEY COUNT/UNIT", optionally followed by "burst N". The unit
+// is s, m or h and the burst defaults to the count.
+func ParseRules(spec string) ([]Rule, error) {
+	var rules []Rule
+	var errs []error
+	for _, raw := range strings.Split(spec, ";") {
+		fields := strings.Fields(raw)
+		if len(fields) == 0 {
+			continue
+		}
+		rule, err := parseRule(fields)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rate limit rule %q: %w", strings.TrimSpace(raw), err))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, errors.Join(errs...)
+}
+
+func parseRule(fields []string) (Rule, error) {
+	if len(fields) != 4 && !(len(fields) == 6 && fields[4] == "burst") {
+		return Rule{}, errors.New(`want "METHOD PATH KEY COUNT/UNIT [burst N]"`)
+	}
+	rule := Rule{Method: strings.ToUpper(fields[0]), Path: fields[1], Key: fields[2]}
+	if !strings.HasPrefix(rule.Path, "/") {
+		return rule, fmt.Errorf("path %q does not start with /", rule.Path)
+	}
+	if rule.Key != KeyIP && rule.Key != KeyUser {
+		return rule, fmt.Errorf("key %q is not ip or user", rule.Key)
+	}
+
+	count, unit, _ := strings.Cut(fields[3], "/")
+	n, err := strconv.Atoi(count)
+	per, ok := units[unit]
+	if err != nil || n < 1 || !ok {
+		return rule, fmt.Errorf("rate %q is not like 10/m", fields[3])
+	}
+	rule.Rate = float64(n) / per.Seconds()
+	rule.Burst = n
+	if len(fields) == 6 {
+		rule.Burst, err = strconv.Atoi(fields[5])
+		if err != nil || rule.Burst < 1 {
+			return rule, fmt.Errorf("burst %q is not a positive number", fields[5])
+		}
+	}
+	return rule, nil
+}
+
+// RetryAfter formats a wait as the whole seconds of a Retry-After header
+func RetryAfter(wait time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"minitwit/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Backends of NewStore
+const (
+	BackendMemory   = "memory"
+	BackendPostgres = "postgres"
+)
+
+// sweepInterval is how often full buckets are dropped, a full bucket is
+// the same as no bucket
+const sweepInterval = time.Minute
+
+// Store keeps the token buckets
+type Store interface {
+	// Take removes a token from the bucket of key. If the bucket is empty
+	// it returns false and how long until the next token.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error)
+}
+
+// NewStore returns the store of a backend, the postgres store keeps the
+// buckets in database
+func NewStore(backend string, database *gorm.DB) (Store, error) {
+	switch backend {
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	case BackendPostgres:
+		return NewDBStore(database), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit backend %q, use memory or postgres", backend)
+	}
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// MemoryStore keeps the buckets of one process
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	tokens, allowed, wait := limit.take(b.tokens, b.updated, now)
+	b.tokens, b.updated = tokens, now
+	b.full = limit.fullAt(tokens, now)
+	return allowed, wait, nil
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if !b.full.After(now) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// Len is the number of buckets that are not full
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
+
+// DBStore keeps the buckets in the rate_limit_buckets table, so all
+// replicas share them. On postgres the row is locked while a token is
+// taken.
+type DBStore struct {
+	db *gorm.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewDBStore(database *gorm.DB) *DBStore {
+	return &DBStore{db: database}
+}
+
+func (s *DBStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	database := s.db.WithContext(ctx)
+	if err := s.sweep(database, now); err != nil {
+		return false, 0, err
+	}
+
+	var allowed bool
+	var wait time.Duration
+	err := database.Transaction(func(tx *gorm.DB) error {
+		// a new bucket starts full, a concurrent insert of another replica wins
+		fresh := models.RateLimitBucket{Key: key, Tokens: float64(limit.Burst), Updated_at: now.UnixMilli(), Full_at: now.UnixMilli()}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&fresh).Error; err != nil {
+			return err
+		}
+
+		var b models.RateLimitBucket
+		query := tx
+		if tx.Dialector.Name() == "postgres" {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		if err := query.Where("key = ?", key).Take(&b).Error; err != nil {
+			return err
+		}
+
+		var tokens float64
+		tokens, allowed, wait = limit.take(b.Tokens, time.UnixMilli(b.Updated_at), now)
+		return tx.Model(&b).Updates(map[string]any{"tokens": tokens, "updated_at": now.UnixMilli(), "full_at": limit.fullAt(tokens, now).UnixMilli()}).Error
+	})
+	return allowed, wait, err
+}
+
+// sweep deletes the full buckets, at most once a minute per replica
+func (s *DBStore) sweep(database *gorm.DB, now time.Time) error {
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) < sweepInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.lastSweep = now
+	s.mu.Unlock()
+	return database.Where("full_at <= ?", now.UnixMilli()).Delete(&models.RateLimitBucket{}).Error
+}
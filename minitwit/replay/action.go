@@ -0,0 +1,124 @@
+// Package replay sends a recorded log of simulator actions to a MiniTwit
+// server or straight to the database, to load-test the system locally.
+//
+// The log is JSONL, one action per line:
+//
+//	{"latest": 1, "action": "register", "username": "a", "email": "a@a.a", "pwd": "a"}
+//	{"latest": 2, "action": "tweet", "username": "a", "content": "Hello"}
+//	{"latest": 3, "action": "follow", "username": "a", "target": "b"}
+//	{"latest": 4, "action": "unfollow", "username": "a", "target": "b"}
+//	{"latest": 5, "action": "msgs", "no": 20}
+//	{"latest": 6, "action": "user_msgs", "username": "a", "no": 20}
+//	{"latest": 7, "action": "fllws", "username": "a", "no": 20}
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	Register = "register"
+	Tweet    = "tweet"
+	Follow   = "follow"
+	Unfollow = "unfollow"
+	Msgs     = "msgs"
+	UserMsgs = "user_msgs"
+	Fllws    = "fllws"
+)
+
+// Action is one simulator request
+type Action struct {
+	Latest   int    `json:"latest"`
+	Action   string `json:"action"`
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Pwd      string `json:"pwd,omitempty"`
+	Content  string `json:"content,omitempty"`
+	Target   string `json:"target,omitempty"`
+	No       int    `json:"no,omitempty"`
+}
+
+// Endpoint is the simulator API route of the action, used to group the report
+func (a Action) Endpoint() string {
+	switch a.Action {
+	case Register:
+		return "POST /register"
+	case Tweet:
+		return "POST /msgs/{username}"
+	case Follow, Unfollow:
+		return "POST /fllws/{username}"
+	case Msgs:
+		return "GET /msgs"
+	case UserMsgs:
+		return "GET /msgs/{username}"
+	case Fllws:
+		return "GET /fllws/{username}"
+	}
+	return "unknown"
+}
+
+func (a Action) validate() error {
+	switch a.Action {
+	case Register, Tweet, UserMsgs, Fllws:
+		if a.Username == "" {
+			return fmt.Errorf("%s needs a username", a.Action)
+		}
+	case Follow, Unfollow:
+		if a.Username == "" || a.Target == "" {
+			return fmt.Errorf("%s needs a username and a target", a.Action)
+		}
+	case Msgs:
+	default:
+		return fmt.Errorf("unknown action %q", a.Action)
+	}
+	return nil
+}
+
+// LineError is an invalid line in the log, decoding can continue after it
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Decoder reads actions from a JSONL log
+type Decoder struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &Decoder{scanner: scanner}
+}
+
+// Next returns the next action, or io.EOF at the end of the log. Blank
+// lines are skipped.
+func (d *Decoder) Next() (Action, error) {
+	for d.scanner.Scan() {
+		d.line++
+		raw := d.scanner.Bytes()
+		if len(raw) == 0 {
+			continue
+		}
+		var a Action
+		if err := json.Unmarshal(raw, &a); err != nil {
+			return a, &LineError{d.line, err}
+		}
+		if err := a.validate(); err != nil {
+			return a, &LineError{d.line, err}
+		}
+		return a, nil
+	}
+	if err := d.scanner.Err(); err != nil {
+		return Action{}, err
+	}
+	return Action{}, io.EOF
+}
@@ -0,0 +1,90 @@
+package replay
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"minitwit/api"
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/service"
+)
+
+const usage = `usage: minitwit replay [flags] <log.jsonl>
+
+Replays a JSONL log of simulator actions, use - to read from stdin.
+
+`
+
+// Main runs the replay command and returns the exit code
+func Main(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", "http://localhost:8081", "base URL of the simulator API")
+	store := fs.Bool("store", false, "run the actions directly on the database configured by the DB_* variables")
+	concurrency := fs.Int("concurrency", 4, "number of actions in flight")
+	rate := fs.Float64("rate", 0, "actions per second, 0 for no limit")
+	dryRun := fs.Bool("dry-run", false, "only read and validate the log")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	in := os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var target Target
+	if !*dryRun {
+		// the database settings and simulator credentials come from the
+		// config file and environment
+		cfg, err := config.Load("replay", nil)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if *store {
+			target = &StoreTarget{
+				DB:         db.GormConnectDB(cfg.Database),
+				Service:    service.New(cfg),
+				LatestFile: api.LatestFile(cfg.API.LatestFile),
+			}
+		} else {
+			target = NewHTTPTarget(*server, cfg.Simulator.Authorization())
+		}
+	}
+
+	// stop sending on ctrl-c but still print what was done
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := Run(ctx, NewDecoder(in), target, Options{Concurrency: *concurrency, Rate: *rate, DryRun: *dryRun})
+	if report != nil {
+		if werr := report.Write(stdout); werr != nil {
+			fmt.Fprintln(stderr, werr)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,235 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Options control how a log is replayed
+type Options struct {
+	// number of actions in flight, at least 1
+	Concurrency int
+	// actions per second, 0 means as fast as possible
+	Rate float64
+	// only read and validate the log
+	DryRun bool
+}
+
+// EndpointStats are the results for one simulator endpoint
+type EndpointStats struct {
+	Endpoint  string
+	Count     int
+	Errors    map[string]int
+	latencies []time.Duration
+}
+
+// Percentile returns the latency below which p percent of the requests finished
+func (s *EndpointStats) Percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	i := int(float64(len(s.latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(s.latencies) {
+		i = len(s.latencies) - 1
+	}
+	return s.latencies[i]
+}
+
+// ErrorCount is the number of failed requests
+func (s *EndpointStats) ErrorCount() int {
+	n := 0
+	for _, c := range s.Errors {
+		n += c
+	}
+	return n
+}
+
+// Report summarizes a replay
+type Report struct {
+	Endpoints map[string]*EndpointStats
+	// lines of the log that could not be parsed
+	InvalidLines int
+	// highest latest id sent, and the one stored by the target afterwards
+	SentLatest   int
+	TargetLatest int
+	Duration     time.Duration
+	DryRun       bool
+}
+
+func (r *Report) record(a Action, latency time.Duration, err error) {
+	stats, ok := r.Endpoints[a.Endpoint()]
+	if !ok {
+		stats = &EndpointStats{Endpoint: a.Endpoint(), Errors: map[string]int{}}
+		r.Endpoints[a.Endpoint()] = stats
+	}
+	stats.Count++
+	stats.latencies = append(stats.latencies, latency)
+	if err != nil {
+		stats.Errors[err.Error()]++
+	}
+	if a.Latest > r.SentLatest {
+		r.SentLatest = a.Latest
+	}
+}
+
+// Run replays the log on the target. Actions of the same user are sent by
+// the same worker and stay in order. Other actions wait for the
+// registrations before them, so a user is registered before it tweets or
+// is followed.
+func Run(ctx context.Context, dec *Decoder, target Target, opts Options) (*Report, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	report := &Report{Endpoints: map[string]*EndpointStats{}, DryRun: opts.DryRun}
+	start := time.Now()
+
+	var mu sync.Mutex
+	var wg, registering sync.WaitGroup
+	queues := make([]chan Action, opts.Concurrency)
+	for i := range queues {
+		queues[i] = make(chan Action, 16)
+		wg.Add(1)
+		go func(queue chan Action) {
+			defer wg.Done()
+			for a := range queue {
+				begin := time.Now()
+				var err error
+				if !opts.DryRun {
+					err = target.Do(ctx, a)
+				}
+				latency := time.Since(begin)
+				mu.Lock()
+				report.record(a, latency, err)
+				mu.Unlock()
+				if a.Action == Register {
+					registering.Done()
+				}
+			}
+		}(queues[i])
+	}
+
+	var tick <-chan time.Time
+	if opts.Rate > 0 && !opts.DryRun {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	err := func() error {
+		for {
+			a, err := dec.Next()
+			var lineErr *LineError
+			if errors.As(err, &lineErr) {
+				report.InvalidLines++
+				continue
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			if a.Action == Register {
+				registering.Add(1)
+			} else {
+				registering.Wait()
+			}
+			select {
+			case queues[worker(a, len(queues))] <- a:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}()
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	report.Duration = time.Since(start)
+	if err != nil {
+		return report, err
+	}
+
+	if !opts.DryRun {
+		latest, err := target.Latest(ctx)
+		if err != nil {
+			return report, fmt.Errorf("reading latest: %w", err)
+		}
+		report.TargetLatest = latest
+	}
+	return report, nil
+}
+
+func worker(a Action, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(a.Username))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Write prints the report as a table
+func (r *Report) Write(w io.Writer) error {
+	endpoints := make([]string, 0, len(r.Endpoints))
+	total := 0
+	for endpoint, stats := range r.Endpoints {
+		endpoints = append(endpoints, endpoint)
+		total += stats.Count
+	}
+	sort.Strings(endpoints)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT\tREQUESTS\tERRORS\tP50\tP90\tP99")
+	for _, endpoint := range endpoints {
+		s := r.Endpoints[endpoint]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\n", endpoint, s.Count, s.ErrorCount(),
+			s.Percentile(50).Round(time.Microsecond), s.Percentile(90).Round(time.Microsecond), s.Percentile(99).Round(time.Microsecond))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		s := r.Endpoints[endpoint]
+		reasons := make([]string, 0, len(s.Errors))
+		for reason := range s.Errors {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "%s: %d x %s\n", endpoint, s.Errors[reason], reason)
+		}
+	}
+
+	fmt.Fprintf(w, "%d actions in %s", total, r.Duration.Round(time.Millisecond))
+	if seconds := r.Duration.Seconds(); seconds > 0 {
+		fmt.Fprintf(w, " (%.1f/s)", float64(total)/seconds)
+	}
+	fmt.Fprintln(w)
+	if r.InvalidLines > 0 {
+		fmt.Fprintf(w, "%d invalid lines skipped\n", r.InvalidLines)
+	}
+	if r.DryRun {
+		fmt.Fprintf(w, "latest: %d\n", r.SentLatest)
+	} else {
+		fmt.Fprintf(w, "latest sent: %d, latest stored: %d\n", r.SentLatest, r.TargetLatest)
+	}
+	return nil
+}
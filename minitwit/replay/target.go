@@ -0,0 +1,213 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"minitwit/api"
+	"minitwit/db"
+	"minitwit/service"
+
+	"gorm.io/gorm"
+)
+
+// Target executes actions
+type Target interface {
+	Do(ctx context.Context, a Action) error
+	// Latest returns the latest action id stored by the target
+	Latest(ctx context.Context) (int, error)
+}
+
+// HTTPTarget sends actions to the simulator API of a running server
+type HTTPTarget struct {
+	BaseURL       string
+	Authorization string
+	Client        *http.Client
+}
+
+// NewHTTPTarget sends the Authorization header of the simulator, see
+// config.Simulator.Authorization
+func NewHTTPTarget(baseURL, authorization string) *HTTPTarget {
+	return &HTTPTarget{
+		BaseURL:       baseURL,
+		Authorization: authorization,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (t *HTTPTarget) Do(ctx context.Context, a Action) error {
+	var method, path string
+	var body any
+	switch a.Action {
+	case Register:
+		method, path = "POST", "/register"
+		body = api.RegisterRequest{Username: a.Username, Email: a.Email, Pwd: a.Pwd}
+	case Tweet:
+		method, path = "POST", "/msgs/"+url.PathEscape(a.Username)
+		body = api.MessageRequest{Content: a.Content}
+	case Follow:
+		method, path = "POST", "/fllws/"+url.PathEscape(a.Username)
+		body = api.FollowRequest{Follow: a.Target}
+	case Unfollow:
+		method, path = "POST", "/fllws/"+url.PathEscape(a.Username)
+		body = api.FollowRequest{Unfollow: a.Target}
+	case Msgs:
+		method, path = "GET", "/msgs"
+	case UserMsgs:
+		method, path = "GET", "/msgs/"+url.PathEscape(a.Username)
+	case Fllws:
+		method, path = "GET", "/fllws/"+url.PathEscape(a.Username)
+	}
+
+	query := url.Values{"latest": {strconv.Itoa(a.Latest)}}
+	if a.No > 0 {
+		query.Set("no", strconv.Itoa(a.No))
+	}
+
+	var payload io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, t.BaseURL+path+"?"+query.Encode(), payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", t.Authorization)
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// read the body so the connection can be reused
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return &StatusError{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+func (t *HTTPTarget) Latest(ctx context.Context) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", t.BaseURL+"/latest", nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, &StatusError{Code: resp.StatusCode}
+	}
+	var latest api.LatestResponse
+	if err := json.NewDecoder(resp.Body).Decode(&latest); err != nil {
+		return 0, err
+	}
+	return latest.Latest, nil
+}
+
+// StatusError is an error response of the server
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("HTTP %d", e.Code)
+}
+
+// StoreTarget runs actions directly on the database through the service
+// layer, with the same semantics as the simulator API
+type StoreTarget struct {
+	DB         *gorm.DB
+	Service    *service.Service
+	LatestFile api.LatestFile
+
+	// latest is the highest id stored, the workers finish out of order
+	mu     sync.Mutex
+	latest int
+}
+
+func (t *StoreTarget) Do(ctx context.Context, a Action) error {
+	database := t.DB.WithContext(ctx)
+	if err := t.setLatest(a.Latest); err != nil {
+		return err
+	}
+
+	limit := a.No
+	if limit <= 0 {
+		limit = 100
+	}
+
+	if a.Action == Register {
+		_, err := service.RegisterSimulatorUser(database, a.Username, a.Email, a.Pwd)
+		return err
+	}
+	if a.Action == Msgs {
+		_, err := service.ListPublicMessages(database, service.Page{Limit: limit})
+		return err
+	}
+
+	userID, err := db.GormGetUserId(database, a.Username)
+	if err != nil {
+		return service.ErrUserNotFound
+	}
+	switch a.Action {
+	case Tweet:
+		_, err = t.Service.PostMessage(database, userID, a.Content)
+	case Follow, Unfollow:
+		var targetID int
+		targetID, err = db.GormGetUserId(database, a.Target)
+		if err != nil {
+			return service.ErrUserNotFound
+		}
+		if a.Action == Follow {
+			if err = t.Service.Follow(database, userID, targetID); errors.Is(err, service.ErrAlreadyFollowing) {
+				err = nil
+			}
+		} else {
+			if err = t.Service.Unfollow(database, userID, targetID); errors.Is(err, service.ErrNotFollowing) {
+				err = nil
+			}
+		}
+	case UserMsgs:
+		_, err = service.ListUserMessages(database, userID, service.Page{Limit: limit})
+	case Fllws:
+		_, err = service.ListFollowing(database, userID, service.Page{Limit: limit})
+	}
+	return err
+}
+
+// setLatest stores id unless a higher one is stored already
+func (t *StoreTarget) setLatest(id int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if id <= t.latest {
+		return nil
+	}
+	if err := t.LatestFile.Set(strconv.Itoa(id)); err != nil {
+		return err
+	}
+	t.latest = id
+	return nil
+}
+
+func (t *StoreTarget) Latest(ctx context.Context) (int, error) {
+	return t.LatestFile.Read()
+}
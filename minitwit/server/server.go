@@ -0,0 +1,112 @@
+// Package server runs the HTTP servers of the web app and the API with
+// timeouts, optional TLS and a graceful shutdown on SIGTERM.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"minitwit/config"
+)
+
+// Options configure a server, the zero values of the timeouts disable them
+type Options struct {
+	Addr              string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish
+	ShutdownTimeout time.Duration
+	// TLSCert and TLSKey are PEM files, TLS is used if both are set
+	TLSCert string
+	TLSKey  string
+}
+
+// DefaultOptions have the default timeouts of package config
+var DefaultOptions = FromConfig("", config.Default().Server)
+
+// FromConfig returns the options for a server listening on addr
+func FromConfig(addr string, cfg config.Server) Options {
+	return Options{
+		Addr:              addr,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ShutdownTimeout:   cfg.ShutdownTimeout,
+		TLSCert:           cfg.TLSCert,
+		TLSKey:            cfg.TLSKey,
+	}
+}
+
+type Server struct {
+	http *http.Server
+	opts Options
+}
+
+func New(handler http.Handler, opts Options) *Server {
+	return &Server{
+		opts: opts,
+		http: &http.Server{
+			Addr:              opts.Addr,
+			Handler:           handler,
+			ReadHeaderTimeout: opts.ReadHeaderTimeout,
+			ReadTimeout:       opts.ReadTimeout,
+			WriteTimeout:      opts.WriteTimeout,
+			IdleTimeout:       opts.IdleTimeout,
+			ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		},
+	}
+}
+
+// Run listens on the configured address and serves until ctx is done
+func (s *Server) Run(ctx context.Context) error {
+	lis, err := net.Listen("tcp", s.opts.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, lis)
+}
+
+// Serve serves on lis until ctx is done. It then stops accepting
+// connections and waits up to ShutdownTimeout for in-flight requests.
+func (s *Server) Serve(ctx context.Context, lis net.Listener) error {
+	if s.opts.TLSCert != "" && s.opts.TLSKey != "" {
+		certs, err := NewCertReloader(s.opts.TLSCert, s.opts.TLSKey)
+		if err != nil {
+			lis.Close()
+			return err
+		}
+		s.http.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.GetCertificate}
+		lis = tls.NewListener(lis, s.http.TLSConfig)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.http.Serve(lis)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, waiting for in-flight requests", "addr", lis.Addr().String(), "timeout", s.opts.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+	defer cancel()
+	if err := s.http.Shutdown(shutdownCtx); err != nil {
+		s.http.Close()
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"archive/zip"
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"io"
+	"time"
+
+	"minitwit/db"
+	"minitwit/models"
+	"minitwit/utils"
+
+	"gorm.io/gorm"
+)
+
+// UserData is everything stored about a user, for the data export
+type UserData struct {
+	Profile    Profile       `json:"profile"`
+	Messages   []DataMessage `json:"messages"`
+	Following  []DataUser    `json:"following"`
+	Followers  []DataUser    `json:"followers"`
+	ExportedAt time.Time     `json:"exported_at"`
+}
+
+type Profile struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Gravatar string `json:"gravatar"`
+	Disabled bool   `json:"disabled"`
+}
+
+type DataMessage struct {
+	ID      int       `json:"id"`
+	Text    string    `json:"text"`
+	PubDate time.Time `json:"pub_date"`
+	Flagged bool      `json:"flagged"`
+}
+
+type DataUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+func toDataUsers(users []models.User) []DataUser {
+	out := make([]DataUser, len(users))
+	for i, u := range users {
+		out[i] = DataUser{u.User_id, u.Username}
+	}
+	return out
+}
+
+// ExportUserData collects the profile, all messages, flagged ones included,
+// and the follows of a user. It reads in one transaction so the parts match.
+func ExportUserData(database *gorm.DB, userID int) (*UserData, error) {
+	data := &UserData{ExportedAt: time.Now().UTC()}
+	err := database.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Where("user_id = ?", userID).First(&user).Error; err != nil {
+			return ErrUserNotFound
+		}
+		data.Profile = Profile{user.User_id, user.Username, user.Email, utils.GetGravatar(user.Email, 80), user.Disabled}
+
+		messages, err := db.QueryMessagesForReview(tx, user.Username, false, -1)
+		if err != nil {
+			return err
+		}
+		data.Messages = make([]DataMessage, len(messages))
+		for i, m := range messages {
+			data.Messages[i] = DataMessage{m.Message_id, m.Text, time.Unix(m.Pub_date, 0).UTC(), m.Flagged != 0}
+		}
+
+		following, err := db.QueryFollowing(tx, userID, 0, -1)
+		if err != nil {
+			return err
+		}
+		followers, err := db.QueryFollowers(tx, userID, 0, -1)
+		if err != nil {
+			return err
+		}
+		data.Following = toDataUsers(following)
+		data.Followers = toDataUsers(followers)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//go:embed archive.html
+var archiveHTML string
+
+var archiveTmpl = template.Must(template.New("archive").Funcs(template.FuncMap{
+	"date": func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+}).Parse(archiveHTML))
+
+// WriteArchive writes the data as a zip of JSON files with an index.html
+// to read them in a browser
+func WriteArchive(w io.Writer, data *UserData) error {
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name string
+		v    any
+	}{
+		{"profile.json", data.Profile},
+		{"messages.json", data.Messages},
+		{"following.json", data.Following},
+		{"followers.json", data.Followers},
+	}
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.v); err != nil {
+			return err
+		}
+	}
+
+	f, err := zw.Create("index.html")
+	if err != nil {
+		return err
+	}
+	if err := archiveTmpl.Execute(f, data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// DeleteAccount removes a user with their messages and the follows in
+// both directions, in one transaction. Sessions of the user end on their
+// next request, see middleware.ActiveSession.
+func (s *Service) DeleteAccount(database *gorm.DB, userID int) error {
+	err := database.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.User{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrUserNotFound
+		}
+		_, err := db.DeleteUser(tx, userID)
+		return err
+	})
+	if err == nil {
+		// the messages are gone from the timelines of the followers too
+		s.Timelines.Clear(database.Statement.Context)
+	}
+	return err
+}
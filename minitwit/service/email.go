@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"minitwit/mailer"
+	"minitwit/models"
+
+	"gorm.io/gorm"
+)
+
+// Purposes of the signed tokens in email links
+const (
+	PurposeVerify = "verify"
+	PurposeReset  = "reset"
+)
+
+// How long the email links work
+const (
+	VerifyTokenTTL = 7 * 24 * time.Hour
+	ResetTokenTTL  = time.Hour
+)
+
+// tokenKey derives the key of the email tokens from the secret key, so a
+// token cannot be used as a session cookie or the other way around
+func tokenKey(secretKey string) []byte {
+	mac := hmac.New(sha256.New, []byte(secretKey))
+	mac.Write([]byte("minitwit email tokens"))
+	return mac.Sum(nil)
+}
+
+type tokenClaims struct {
+	Purpose string `json:"p"`
+	UserID  int    `json:"u"`
+	Expires int64  `json:"e"`
+	// Bind is a fingerprint of what the token is for, the email to verify
+	// or the password hash to replace. Changing it voids the token, so a
+	// reset link works once.
+	Bind string `json:"b"`
+}
+
+func fingerprint(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *Service) signToken(claims tokenClaims) string {
+	payload, _ := json.Marshal(claims)
+	mac := hmac.New(sha256.New, s.tokenKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseToken checks the signature, the purpose and the expiry of a token
+func (s *Service) parseToken(token, purpose string, now time.Time) (*tokenClaims, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	mac := hmac.New(sha256.New, s.tokenKey)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrInvalidToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Purpose != purpose || now.Unix() > claims.Expires {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
+
+// tokenUser returns the user of a valid token
+func (s *Service) tokenUser(database *gorm.DB, token, purpose string, now time.Time, bind func(*models.User) string) (*models.User, error) {
+	claims, err := s.parseToken(token, purpose, now)
+	if err != nil {
+		return nil, err
+	}
+	var user models.User
+	err = database.Where("user_id = ?", claims.UserID).Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(claims.Bind), []byte(fingerprint(bind(&user)))) || user.Disabled {
+		return nil, ErrInvalidToken
+	}
+	return &user, nil
+}
+
+func link(baseURL, path, token string) string {
+	return strings.TrimSuffix(baseURL, "/") + path + "?" + url.Values{"token": {token}}.Encode()
+}
+
+// ValidEmail accepts a bare address with a dot in the domain, like
+// alice@example.com
+func ValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return false
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	dot := strings.LastIndex(domain, ".")
+	return dot > 0 && dot < len(domain)-1
+}
+
+// SendVerificationEmail mails the user a link to verify the email address
+func (s *Service) SendVerificationEmail(ctx context.Context, user *models.User, now time.Time) error {
+	token := s.signToken(tokenClaims{PurposeVerify, user.User_id, now.Add(VerifyTokenTTL).Unix(), fingerprint(user.Email)})
+	return s.Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address for MiniTwit",
+		Body: fmt.Sprintf("Hi %s,\n\nopen this link to verify your email address:\n\n%s\n\n"+
+			"The link works for %d days. If you did not sign up for MiniTwit, ignore this email.\n",
+			user.Username, link(s.BaseURL, "/verify", token), int(VerifyTokenTTL.Hours()/24)),
+	})
+}
+
+// VerifyEmail marks the email of the user of a verify token as verified
+func (s *Service) VerifyEmail(database *gorm.DB, token string, now time.Time) (*models.User, error) {
+	user, err := s.tokenUser(database, token, PurposeVerify, now, func(u *models.User) string { return u.Email })
+	if err != nil {
+		return nil, err
+	}
+	if err := database.Model(&models.User{}).Where("user_id = ?", user.User_id).Update("unverified", false).Error; err != nil {
+		return nil, err
+	}
+	user.Unverified = false
+	return user, nil
+}
+
+// RequestPasswordReset mails a reset link to every account with the email.
+// Unknown emails are no error, the caller must not tell which exist.
+func (s *Service) RequestPasswordReset(ctx context.Context, database *gorm.DB, email string, now time.Time) error {
+	var users []models.User
+	if err := database.Where("LOWER(email) = LOWER(?) AND disabled = ?", strings.TrimSpace(email), false).Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		token := s.signToken(tokenClaims{PurposeReset, user.User_id, now.Add(ResetTokenTTL).Unix(), fingerprint(user.PwHash)})
+		err := s.Mailer.Send(ctx, mailer.Message{
+			To:      user.Email,
+			Subject: "Reset your MiniTwit password",
+			Body: fmt.Sprintf("Hi %s,\n\nopen this link to choose a new password:\n\n%s\n\n"+
+				"The link works once within %d minutes. If you did not ask for it, ignore this email.\n",
+				user.Username, link(s.BaseURL, "/reset", token), int(ResetTokenTTL.Minutes())),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckResetToken returns the user of a reset token that can still be used
+func (s *Service) CheckResetToken(database *gorm.DB, token string, now time.Time) (*models.User, error) {
+	return s.tokenUser(database, token, PurposeReset, now, func(u *models.User) string { return u.PwHash })
+}
+
+// ResetPassword sets the password of the user of a reset token. The link
+// proved the email works, so it is verified, and the lockout is lifted.
+func (s *Service) ResetPassword(database *gorm.DB, token, password string, now time.Time) (*models.User, error) {
+	user, err := s.CheckResetToken(database, token, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := SetPassword(database, user.User_id, password); err != nil {
+		return nil, err
+	}
+	if err := database.Model(&models.User{}).Where("user_id = ?", user.User_id).Update("unverified", false).Error; err != nil {
+		return nil, err
+	}
+	if _, err := ClearFailedLogins(database, user.Username); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// checkPostLimit keeps unverified users to UnverifiedPostLimit messages in
+// 24 hours
+func (s *Service) checkPostLimit(database *gorm.DB, author *models.User, now time.Time) error {
+	if !author.Unverified || s.UnverifiedPostLimit < 0 {
+		return nil
+	}
+	var count int64
+	if err := database.Model(&models.Message{}).
+		Where("author_id = ? AND pub_date > ?", author.User_id, now.Add(-24*time.Hour).Unix()).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count >= int64(s.UnverifiedPostLimit) {
+		return ErrUnverified
+	}
+	return nil
+}
+
+// CheckPostLimit returns ErrUnverified if the user cannot post before
+// verifying the email
+func (s *Service) CheckPostLimit(database *gorm.DB, userID int, now time.Time) error {
+	var author models.User
+	if err := database.Select("user_id, unverified").Where("user_id = ?", userID).Take(&author).Error; err != nil {
+		return err
+	}
+	return s.checkPostLimit(database, &author, now)
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"minitwit/db"
+	"minitwit/models"
+
+	"gorm.io/gorm"
+)
+
+// UserList is one page of users
+type UserList struct {
+	Users      []models.User
+	NextCursor string
+}
+
+// Follow makes whoID follow whomID
+func (s *Service) Follow(database *gorm.DB, whoID, whomID int) error {
+	if whoID == whomID {
+		return ErrFollowSelf
+	}
+	// the unique index on followers also catches concurrent retries
+	added, err := db.AddFollow(database, whoID, whomID)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return ErrAlreadyFollowing
+	}
+	s.Fanout.Followed(database, whoID, whomID)
+	s.Timelines.FollowsChanged(database.Statement.Context, whoID)
+	return nil
+}
+
+// Unfollow removes the follow from whoID to whomID
+func (s *Service) Unfollow(database *gorm.DB, whoID, whomID int) error {
+	removed, err := db.RemoveFollow(database, whoID, whomID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return ErrNotFollowing
+	}
+	s.Fanout.Unfollowed(database, whoID, whomID)
+	s.Timelines.FollowsChanged(database.Statement.Context, whoID)
+	return nil
+}
+
+type followQuery func(db *gorm.DB, userID int, afterID int, limit int) ([]models.User, error)
+
+func listUsers(database *gorm.DB, query followQuery, userID int, page Page) (*UserList, error) {
+	afterID, err := userCursor(page.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	users, err := query(database, userID, afterID, page.limit()+1)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &UserList{Users: users}
+	if len(users) > page.limit() {
+		list.Users = users[:page.limit()]
+		list.NextCursor = nextUserCursor(list.Users[len(list.Users)-1].User_id)
+	}
+	return list, nil
+}
+
+// ListFollowing returns the users that userID follows
+func ListFollowing(database *gorm.DB, userID int, page Page) (*UserList, error) {
+	return listUsers(database, db.QueryFollowing, userID, page)
+}
+
+// ListFollowers returns the users that follow userID
+func ListFollowers(database *gorm.DB, userID int, page Page) (*UserList, error) {
+	return listUsers(database, db.QueryFollowers, userID, page)
+}
+
+// FollowedBy tells which of users viewerID follows
+func FollowedBy(database *gorm.DB, viewerID int, users []models.User) (map[int]bool, error) {
+	ids := make([]int, len(users))
+	for i, u := range users {
+		ids[i] = u.User_id
+	}
+	followed, err := db.QueryFollowedAmong(database, viewerID, ids)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[int]bool, len(followed))
+	for _, id := range followed {
+		set[id] = true
+	}
+	return set, nil
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"minitwit/db"
+	"minitwit/models"
+
+	"gorm.io/gorm"
+)
+
+// ExternalIdentity is who an OpenID Connect provider logged in
+type ExternalIdentity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// LoginExternal logs in the user linked to the identity like Login, the
+// provider checked the credentials. Identities without a user return
+// ErrNoAccount, users with two-factor auth ErrSecondFactorRequired.
+func LoginExternal(database *gorm.DB, id ExternalIdentity) (*models.User, []models.FailedLogin, error) {
+	user, err := IdentityUser(database, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Disabled {
+		return nil, nil, ErrUserDisabled
+	}
+
+	enabled, err := TwoFactorEnabled(database, user.User_id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if enabled {
+		return user, nil, ErrSecondFactorRequired
+	}
+	failures, err := ClearFailedLogins(database, user.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, failures, nil
+}
+
+// IdentityUser is the user linked to the identity, ErrNoAccount without one
+func IdentityUser(database *gorm.DB, id ExternalIdentity) (*models.User, error) {
+	var user models.User
+	err := database.Joins("JOIN identities ON identities.user_id = users.user_id").
+		Where("identities.issuer = ? AND identities.subject = ?", id.Issuer, id.Subject).
+		Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNoAccount
+	} else if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// RegisterExternalUser creates a user without a password for the identity.
+// The email is verified if the provider verified it.
+func RegisterExternalUser(database *gorm.DB, id ExternalIdentity, username, email string, now time.Time) (*models.User, error) {
+	if username == "" {
+		return nil, &ValidationError{"You have to enter a username"}
+	} else if !ValidEmail(email) {
+		return nil, &ValidationError{"You have to enter a valid email address"}
+	} else if _, err := db.GormGetUserId(database, username); err == nil {
+		return nil, ErrUsernameTaken
+	}
+
+	user := models.User{
+		Username:   username,
+		Email:      email,
+		Unverified: !id.EmailVerified || !strings.EqualFold(email, id.Email),
+	}
+	err := database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return linkIdentity(tx, user.User_id, id, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// LinkIdentity lets the user log in with the identity too
+func LinkIdentity(database *gorm.DB, userID int, id ExternalIdentity, now time.Time) error {
+	return database.Transaction(func(tx *gorm.DB) error {
+		return linkIdentity(tx, userID, id, now)
+	})
+}
+
+func linkIdentity(tx *gorm.DB, userID int, id ExternalIdentity, now time.Time) error {
+	var linked models.Identity
+	err := tx.Where("issuer = ? AND subject = ?", id.Issuer, id.Subject).Take(&linked).Error
+	switch {
+	case err == nil && linked.User_id == userID:
+		return tx.Model(&linked).Update("email", id.Email).Error
+	case err == nil:
+		return ErrIdentityTaken
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	}
+	return tx.Create(&models.Identity{
+		Issuer:     id.Issuer,
+		Subject:    id.Subject,
+		User_id:    userID,
+		Email:      id.Email,
+		Created_at: now.Unix(),
+	}).Error
+}
+
+// Identities lists the identities linked to the user, the oldest first
+func Identities(database *gorm.DB, userID int) ([]models.Identity, error) {
+	var identities []models.Identity
+	err := database.Where("user_id = ?", userID).Order("id").Find(&identities).Error
+	return identities, err
+}
+
+// UnlinkIdentity removes an identity of the user. Users without a password
+// keep at least one, or they could not log in anymore.
+func UnlinkIdentity(database *gorm.DB, userID int, identityID uint) error {
+	return database.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Select("user_id, pw_hash").Where("user_id = ?", userID).Take(&user).Error; err != nil {
+			return err
+		}
+		var count int64
+		if err := tx.Model(&models.Identity{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+			return err
+		}
+		result := tx.Where("id = ? AND user_id = ?", identityID, userID).Delete(&models.Identity{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrIdentityNotFound
+		}
+		if user.PwHash == "" && count <= 1 {
+			// rolls the delete back
+			return ErrLastLogin
+		}
+		return nil
+	})
+}
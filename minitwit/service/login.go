@@ -0,0 +1,201 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"minitwit/metrics"
+	"minitwit/models"
+
+	"gorm.io/gorm"
+)
+
+// Reasons of failed logins, also the reason label of metrics.FailedLogins
+const (
+	ReasonUnknownUser     = "unknown_user"
+	ReasonInvalidPassword = "invalid_password"
+	ReasonDisabled        = "disabled"
+	ReasonLocked          = "locked"
+	ReasonInvalidCode     = "invalid_code"
+)
+
+// LockoutPolicy delays logins after repeated failures. From Free failures
+// within Window on, the next attempt has to wait BaseDelay, doubled for
+// every further failure up to Window. From LockAfter failures on it waits
+// Window.
+type LockoutPolicy struct {
+	Window    time.Duration
+	Free      int64
+	BaseDelay time.Duration
+	LockAfter int64
+}
+
+// The account policy counts failures for a username until its next login,
+// the IP policy all failures from an address, which many users may share
+var (
+	AccountLockout = LockoutPolicy{Window: 15 * time.Minute, Free: 3, BaseDelay: 2 * time.Second, LockAfter: 10}
+	IPLockout      = LockoutPolicy{Window: 15 * time.Minute, Free: 20, BaseDelay: 2 * time.Second, LockAfter: 100}
+)
+
+// wait is how long the next attempt has to wait after failures, the
+// last of them at last
+func (p LockoutPolicy) wait(failures int64, last, now time.Time) time.Duration {
+	var delay time.Duration
+	switch {
+	case failures >= p.LockAfter:
+		delay = p.Window
+	case failures >= p.Free:
+		// stop doubling at Window, before the shift overflows
+		delay = p.Window
+		if shift := failures - p.Free; shift < 63 && p.BaseDelay <= p.Window>>shift {
+			delay = p.BaseDelay << shift
+		}
+	default:
+		return 0
+	}
+	return max(0, last.Add(delay).Sub(now))
+}
+
+// LockedError is returned while logins are delayed after failures
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("Too many failed logins, try again in %d seconds.", int(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// LoginAttempt holds the credentials and the client they came from
+type LoginAttempt struct {
+	Username  string
+	Password  string
+	IP        string
+	UserAgent string
+	// SharedIP is set if IP may be the address of a proxy, then only the
+	// account policy applies
+	SharedIP bool
+}
+
+// Login checks the credentials like CheckPassword, but records failures and
+// delays further attempts for the username or from the IP with a
+// LockedError. Unknown usernames are answered like wrong passwords. It
+// returns the failures since the last login of the user and clears them.
+// Users with two-factor auth are returned with ErrSecondFactorRequired,
+// their failures stay until LoginSecondFactor.
+func Login(database *gorm.DB, attempt LoginAttempt, now time.Time) (*models.User, []models.FailedLogin, error) {
+	user, err := Authenticate(database, attempt, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enabled, err := TwoFactorEnabled(database, user.User_id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if enabled {
+		return user, nil, ErrSecondFactorRequired
+	}
+	failures, err := ClearFailedLogins(database, user.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, failures, nil
+}
+
+// Authenticate checks the credentials with the delays of Login, for API
+// clients that send them with every request. The failures are left for the
+// next login to tell about, and the second factor is up to the caller.
+func Authenticate(database *gorm.DB, attempt LoginAttempt, now time.Time) (*models.User, error) {
+	wait, err := lockedFor(database, attempt, now)
+	if err != nil {
+		return nil, err
+	}
+	if wait > 0 {
+		if err := recordFailure(database, attempt, 0, ReasonLocked, now); err != nil {
+			return nil, err
+		}
+		return nil, &LockedError{wait}
+	}
+
+	user, err := models.GetUserByUsername(database, attempt.Username)
+	var reason string
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		reason, err = ReasonUnknownUser, ErrInvalidPassword
+	case err != nil:
+		return nil, err
+	case user.PwHash != hashPassword(attempt.Password):
+		reason, err = ReasonInvalidPassword, ErrInvalidPassword
+	case user.Disabled:
+		reason, err = ReasonDisabled, ErrUserDisabled
+	}
+	if reason != "" {
+		var userID int
+		if user != nil {
+			userID = user.User_id
+		}
+		if recordErr := recordFailure(database, attempt, userID, reason, now); recordErr != nil {
+			return nil, recordErr
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// lockedFor is the longer wait of the account and the IP policy
+func lockedFor(database *gorm.DB, attempt LoginAttempt, now time.Time) (time.Duration, error) {
+	var account, ip struct {
+		Count int64
+		Last  int64
+	}
+	recent := database.Model(&models.FailedLogin{}).Select("COUNT(*) AS count, COALESCE(MAX(created_at), 0) AS last")
+	if err := recent.Session(&gorm.Session{}).
+		Where("username = ? AND cleared = ? AND reason <> ? AND created_at > ?", attempt.Username, false, ReasonLocked, now.Add(-AccountLockout.Window).Unix()).
+		Scan(&account).Error; err != nil {
+		return 0, err
+	}
+	wait := AccountLockout.wait(account.Count, time.Unix(account.Last, 0), now)
+	if attempt.IP == "" || attempt.SharedIP {
+		return wait, nil
+	}
+	if err := recent.Session(&gorm.Session{}).
+		Where("ip = ? AND reason <> ? AND created_at > ?", attempt.IP, ReasonLocked, now.Add(-IPLockout.Window).Unix()).
+		Scan(&ip).Error; err != nil {
+		return 0, err
+	}
+	return max(wait, IPLockout.wait(ip.Count, time.Unix(ip.Last, 0), now)), nil
+}
+
+func recordFailure(database *gorm.DB, attempt LoginAttempt, userID int, reason string, now time.Time) error {
+	metrics.FailedLogins.WithLabelValues(reason).Inc()
+	return database.Create(&models.FailedLogin{
+		Username:   attempt.Username,
+		User_id:    userID,
+		IP:         attempt.IP,
+		User_agent: attempt.UserAgent,
+		Reason:     reason,
+		Created_at: now.Unix(),
+	}).Error
+}
+
+// ClearFailedLogins ends the delays of an account and returns the failures
+// it cleared, the newest first
+func ClearFailedLogins(database *gorm.DB, username string) ([]models.FailedLogin, error) {
+	var failures []models.FailedLogin
+	if err := database.Where("username = ? AND cleared = ?", username, false).Order("created_at DESC, id DESC").Find(&failures).Error; err != nil {
+		return nil, err
+	}
+	if len(failures) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint, len(failures))
+	for i, f := range failures {
+		ids[i] = f.ID
+	}
+	if err := database.Model(&models.FailedLogin{}).Where("id IN ?", ids).Update("cleared", true).Error; err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
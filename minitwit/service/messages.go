@@ -0,0 +1,106 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"minitwit/db"
+	"minitwit/models"
+	"minitwit/utils"
+
+	"gorm.io/gorm"
+)
+
+// MessageList is one page of messages
+type MessageList struct {
+	Messages   []models.Message
+	NextCursor string
+}
+
+// PostMessage stores a new message and hands it to federation
+func (s *Service) PostMessage(database *gorm.DB, authorID int, text string) (*models.Message, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, &ValidationError{"Your message cannot be empty"}
+	}
+
+	now := time.Now()
+	var author models.User
+	authorErr := database.Select("user_id, username, email, unverified").Where("user_id = ?", authorID).First(&author).Error
+	if authorErr == nil {
+		if err := s.checkPostLimit(database, &author, now); err != nil {
+			return nil, err
+		}
+	}
+
+	message := models.Message{Author_id: uint(authorID), Text: text, Pub_date: now.Unix(), Flagged: 0}
+	if err := db.CreateMessage(database, &message); err != nil {
+		return nil, err
+	}
+	s.Timelines.MessagePosted(database.Statement.Context, database, authorID)
+	s.Fanout.MessagePosted(message)
+	s.Federation.Deliver(message)
+
+	if authorErr == nil {
+		message.Author = author.Username
+		message.Email = author.Email
+	}
+	message.PubDate = utils.FormatTime(message.Pub_date)
+	return &message, nil
+}
+
+// GetMessage returns a single unflagged message
+func GetMessage(database *gorm.DB, messageID int) (*models.Message, error) {
+	messages, err := db.QueryMessagesPage(database, nil, 1, "messages.flagged = 0 AND messages.message_id = ?", messageID)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, ErrMessageNotFound
+	}
+	return &messages[0], nil
+}
+
+func listMessages(database *gorm.DB, page Page, whereClause string, args ...interface{}) (*MessageList, error) {
+	return pageMessages(page, func(cursor *db.MessageCursor, limit int) ([]models.Message, error) {
+		return db.QueryMessagesPage(database, cursor, limit, whereClause, args...)
+	})
+}
+
+// pageMessages returns the page of a timeline that query reads
+func pageMessages(page Page, query func(cursor *db.MessageCursor, limit int) ([]models.Message, error)) (*MessageList, error) {
+	cursor, err := messageCursor(page.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	// fetch one extra row to know if there is a next page
+	messages, err := query(cursor, page.limit()+1)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &MessageList{Messages: messages}
+	if len(messages) > page.limit() {
+		list.Messages = messages[:page.limit()]
+		last := list.Messages[len(list.Messages)-1]
+		list.NextCursor = nextMessageCursor(last.Pub_date, last.Message_id)
+	}
+	return list, nil
+}
+
+// ListPublicMessages returns the public timeline, newest first
+func ListPublicMessages(database *gorm.DB, page Page) (*MessageList, error) {
+	return listMessages(database, page, "messages.flagged = 0")
+}
+
+// ListUserMessages returns the messages written by userID, newest first
+func ListUserMessages(database *gorm.DB, userID int, page Page) (*MessageList, error) {
+	return listMessages(database, page, "messages.flagged = 0 AND messages.author_id = ?", userID)
+}
+
+// Timeline returns the home timeline of userID: their own messages and
+// those of the users they follow
+func (s *Service) Timeline(database *gorm.DB, userID int, page Page) (*MessageList, error) {
+	return pageMessages(page, func(cursor *db.MessageCursor, limit int) ([]models.Message, error) {
+		return s.Fanout.Home(database, userID, cursor, limit)
+	})
+}
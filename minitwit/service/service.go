@@ -0,0 +1,149 @@
+// Package service holds the operations shared by the simulator API and API v2.
+// Handlers decode requests and encode responses, the logic lives here.
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"minitwit/cache"
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/fanout"
+	"minitwit/federation"
+	"minitwit/mailer"
+)
+
+// Service runs the operations that other parts of the process hear about,
+// posting and following reach the timeline cache, the fan out and
+// federation. Nil collaborators are turned off.
+type Service struct {
+	Timelines  *cache.Timelines
+	Fanout     *fanout.Fanout
+	Federation *federation.Service
+	// UnverifiedPostLimit is how many messages a day users with an
+	// unverified email can post, -1 for no limit
+	UnverifiedPostLimit int
+	// Mailer sends the verification and reset emails, their links point
+	// to BaseURL
+	Mailer  mailer.Mailer
+	BaseURL string
+
+	// tokenKey signs the links in the emails
+	tokenKey []byte
+}
+
+// New returns the service of cfg, without cache, fan out and federation.
+// The emails are only logged until Mailer is set.
+func New(cfg *config.Config) *Service {
+	return &Service{
+		UnverifiedPostLimit: cfg.Web.UnverifiedPostLimit,
+		Mailer:              mailer.Log{},
+		BaseURL:             cfg.Web.BaseURL,
+		tokenKey:            tokenKey(cfg.Web.SecretKey),
+	}
+}
+
+var (
+	ErrUserNotFound     = errors.New("User not found.")
+	ErrMessageNotFound  = errors.New("Message not found.")
+	ErrUsernameTaken    = errors.New("The username is already taken")
+	ErrAlreadyFollowing = errors.New("Already following this user.")
+	ErrNotFollowing     = errors.New("Not following this user.")
+	ErrFollowSelf       = errors.New("Users cannot follow themselves.")
+	ErrInvalidCursor    = errors.New("Invalid cursor.")
+	ErrInvalidPassword  = errors.New("Invalid username or password.")
+	ErrUserDisabled     = errors.New("This account is disabled.")
+	// ErrSecondFactorRequired is returned by Login with the user, the login
+	// is completed by LoginSecondFactor
+	ErrSecondFactorRequired = errors.New("Enter the code of your authenticator app.")
+	ErrInvalidCode          = errors.New("Invalid authentication code.")
+	ErrNotEnrolled          = errors.New("Two-factor authentication was not set up.")
+	ErrTwoFactorEnabled     = errors.New("Two-factor authentication is already on.")
+	ErrInvalidToken         = errors.New("This link is invalid or has expired.")
+	ErrUnverified           = errors.New("Verify your email address to post more messages, we sent you a link.")
+	// ErrNoAccount is returned by LoginExternal for identities that are not
+	// linked to a user yet
+	ErrNoAccount        = errors.New("No account is linked to this login yet.")
+	ErrIdentityNotFound = errors.New("Linked login not found.")
+	ErrIdentityTaken    = errors.New("This login is already linked to another account.")
+	ErrLastLogin        = errors.New("Choose a password with \"Forgot your password?\" before removing the only way to log in.")
+)
+
+// ValidationError is returned for invalid user input, the message can be shown as is
+type ValidationError struct {
+	Msg string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Msg
+}
+
+// Page selects a slice of a list. Cursor is the NextCursor of the previous page.
+type Page struct {
+	Cursor string
+	Limit  int
+}
+
+func (p Page) limit() int {
+	if p.Limit <= 0 {
+		return db.PER_PAGE
+	}
+	return p.Limit
+}
+
+func encodeCursor(parts ...string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(parts, ":")))
+}
+
+func decodeCursor(cursor string, n int) ([]int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != n {
+		return nil, ErrInvalidCursor
+	}
+	values := make([]int64, n)
+	for i, part := range parts {
+		values[i], err = strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+	return values, nil
+}
+
+func messageCursor(cursor string) (*db.MessageCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	values, err := decodeCursor(cursor, 2)
+	if err != nil {
+		return nil, err
+	}
+	return &db.MessageCursor{PubDate: values[0], MessageID: int(values[1])}, nil
+}
+
+func userCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	values, err := decodeCursor(cursor, 1)
+	if err != nil {
+		return 0, err
+	}
+	return int(values[0]), nil
+}
+
+func nextMessageCursor(pubDate int64, messageID int) string {
+	return encodeCursor(fmt.Sprint(pubDate), strconv.Itoa(messageID))
+}
+
+func nextUserCursor(userID int) string {
+	return encodeCursor(strconv.Itoa(userID))
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"minitwit/models"
+	"minitwit/totp"
+
+	"gorm.io/gorm"
+)
+
+// TOTPIssuer is the name authenticator apps show next to the username
+const TOTPIssuer = "MiniTwit"
+
+// RecoveryCodeCount is how many recovery codes a user gets
+const RecoveryCodeCount = 10
+
+// TwoFactorEnabled tells if the user has to enter a code to log in
+func TwoFactorEnabled(database *gorm.DB, userID int) (bool, error) {
+	var count int64
+	err := database.Model(&models.TwoFactor{}).Where("user_id = ? AND enabled = ?", userID, true).Count(&count).Error
+	return count > 0, err
+}
+
+// EnrollTwoFactor starts enrolling a user with a new secret and returns it
+// with the otpauth URI for the authenticator app. Two-factor auth is
+// enabled by ConfirmTwoFactor.
+func EnrollTwoFactor(database *gorm.DB, user *models.User, now time.Time) (secret, uri string, err error) {
+	enabled, err := TwoFactorEnabled(database, user.User_id)
+	if err != nil {
+		return "", "", err
+	}
+	if enabled {
+		return "", "", ErrTwoFactorEnabled
+	}
+	secret, err = totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := database.Save(&models.TwoFactor{User_id: user.User_id, Secret: secret, Created_at: now.Unix()}).Error; err != nil {
+		return "", "", err
+	}
+	return secret, totp.URI(TOTPIssuer, user.Username, secret), nil
+}
+
+// PendingTwoFactor returns the secret and URI of an enrollment that was
+// not confirmed yet, or ErrNotEnrolled
+func PendingTwoFactor(database *gorm.DB, user *models.User) (secret, uri string, err error) {
+	var tf models.TwoFactor
+	err = database.Where("user_id = ? AND enabled = ?", user.User_id, false).Take(&tf).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", "", ErrNotEnrolled
+	} else if err != nil {
+		return "", "", err
+	}
+	return tf.Secret, totp.URI(TOTPIssuer, user.Username, tf.Secret), nil
+}
+
+// ConfirmTwoFactor enables two-factor auth if code matches the secret of
+// EnrollTwoFactor. It returns the recovery codes, they are only stored
+// hashed so this is the only time they can be shown.
+func ConfirmTwoFactor(database *gorm.DB, userID int, code string, now time.Time) ([]string, error) {
+	var codes []string
+	err := database.Transaction(func(tx *gorm.DB) error {
+		var tf models.TwoFactor
+		err := tx.Where("user_id = ?", userID).Take(&tf).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotEnrolled
+		} else if err != nil {
+			return err
+		}
+		if tf.Enabled {
+			return ErrTwoFactorEnabled
+		}
+		step, ok := totp.Validate(tf.Secret, code, now, 0)
+		if !ok {
+			return ErrInvalidCode
+		}
+		if err := tx.Model(&tf).Updates(map[string]any{"enabled": true, "last_step": step}).Error; err != nil {
+			return err
+		}
+		codes, err = newRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// DisableTwoFactor turns two-factor auth off and drops the recovery codes
+func DisableTwoFactor(database *gorm.DB, userID int) error {
+	return database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.TwoFactor{}).Error
+	})
+}
+
+// RecoveryCodesLeft counts the unused recovery codes of a user
+func RecoveryCodesLeft(database *gorm.DB, userID int) (int64, error) {
+	var count int64
+	err := database.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at = 0", userID).Count(&count).Error
+	return count, err
+}
+
+// newRecoveryCodes replaces the recovery codes of a user
+func newRecoveryCodes(tx *gorm.DB, userID int) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, RecoveryCodeCount)
+	rows := make([]models.RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		rows[i] = models.RecoveryCode{User_id: userID, Hash: hashRecoveryCode(codes[i])}
+	}
+	return codes, tx.Create(&rows).Error
+}
+
+// hashRecoveryCode ignores case, spaces and dashes. The codes are random,
+// so a plain hash is enough.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecondFactor accepts a TOTP code once, or an unused recovery code
+func checkSecondFactor(database *gorm.DB, userID int, code string, now time.Time) (bool, error) {
+	var tf models.TwoFactor
+	if err := database.Where("user_id = ? AND enabled = ?", userID, true).Take(&tf).Error; err != nil {
+		return false, err
+	}
+	if step, ok := totp.Validate(tf.Secret, code, now, tf.Last_step); ok {
+		// a concurrent login with the same code loses
+		result := database.Model(&models.TwoFactor{}).Where("user_id = ? AND last_step < ?", userID, step).Update("last_step", step)
+		return result.RowsAffected == 1, result.Error
+	}
+
+	var recovery models.RecoveryCode
+	err := database.Where("user_id = ? AND hash = ? AND used_at = 0", userID, hashRecoveryCode(code)).Take(&recovery).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	result := database.Model(&models.RecoveryCode{}).Where("id = ? AND used_at = 0", recovery.ID).Update("used_at", now.Unix())
+	return result.RowsAffected == 1, result.Error
+}
+
+// LoginSecondFactor completes the Login of a user with two-factor auth
+// with a TOTP or recovery code. Wrong codes count as failed logins of the
+// account, so they are delayed and locked like passwords. Like Login it
+// returns the failures since the last login and clears them.
+func LoginSecondFactor(database *gorm.DB, userID int, code string, attempt LoginAttempt, now time.Time) (*models.User, []models.FailedLogin, error) {
+	user, err := AuthenticateSecondFactor(database, userID, code, attempt, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	failures, err := ClearFailedLogins(database, user.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, failures, nil
+}
+
+// AuthenticateSecondFactor checks the code like LoginSecondFactor, for API
+// clients that send one with their requests. The failures are left for the
+// next login to tell about.
+func AuthenticateSecondFactor(database *gorm.DB, userID int, code string, attempt LoginAttempt, now time.Time) (*models.User, error) {
+	var user models.User
+	if err := database.Where("user_id = ?", userID).Take(&user).Error; err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	attempt.Username = user.Username
+
+	wait, err := lockedFor(database, attempt, now)
+	if err != nil {
+		return nil, err
+	}
+	if wait > 0 {
+		if err := recordFailure(database, attempt, userID, ReasonLocked, now); err != nil {
+			return nil, err
+		}
+		return nil, &LockedError{wait}
+	}
+
+	ok, err := checkSecondFactor(database, userID, code, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err := recordFailure(database, attempt, userID, ReasonInvalidCode, now); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCode
+	}
+	return &user, nil
+}
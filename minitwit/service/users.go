@@ -0,0 +1,99 @@
+package service
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"minitwit/db"
+	"minitwit/models"
+
+	"gorm.io/gorm"
+)
+
+func hashPassword(password string) string {
+	hash := md5.New()
+	hash.Write([]byte(password))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// RegisterUser validates the input and creates a new user, who posts
+// within Service.UnverifiedPostLimit until the email address is verified
+func RegisterUser(database *gorm.DB, username, email, password string) (*models.User, error) {
+	return createUser(database, username, email, password, ValidEmail, true)
+}
+
+// RegisterVerifiedUser creates a user like RegisterUser whose email address
+// is trusted, for accounts made by an admin
+func RegisterVerifiedUser(database *gorm.DB, username, email, password string) (*models.User, error) {
+	return createUser(database, username, email, password, ValidEmail, false)
+}
+
+// RegisterSimulatorUser creates a verified user for the simulator, which
+// only requires an @ in the email and has no mailbox to verify it. Only the
+// transports behind the simulator credentials use it.
+func RegisterSimulatorUser(database *gorm.DB, username, email, password string) (*models.User, error) {
+	return createUser(database, username, email, password, func(email string) bool {
+		return strings.Contains(email, "@")
+	}, false)
+}
+
+func createUser(database *gorm.DB, username, email, password string, validEmail func(string) bool, unverified bool) (*models.User, error) {
+	if username == "" {
+		return nil, &ValidationError{"You have to enter a username"}
+	} else if email == "" || !validEmail(email) {
+		return nil, &ValidationError{"You have to enter a valid email address"}
+	} else if password == "" {
+		return nil, &ValidationError{"You have to enter a password"}
+	} else if _, err := db.GormGetUserId(database, username); err == nil {
+		return nil, ErrUsernameTaken
+	}
+
+	user := models.User{Username: username, Email: email, PwHash: hashPassword(password), Unverified: unverified}
+	if err := database.Create(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUser finds a user by numeric id or by username
+func GetUser(database *gorm.DB, ref string) (*models.User, error) {
+	var user models.User
+	query := database.Where("username = ?", ref)
+	if id, err := strconv.Atoi(ref); err == nil {
+		query = database.Where("user_id = ?", id)
+	}
+	err := query.First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CheckPassword returns the user if the credentials are valid
+func CheckPassword(database *gorm.DB, username, password string) (*models.User, error) {
+	user, err := models.GetUserByUsername(database, username)
+	if err != nil {
+		return nil, ErrInvalidPassword
+	}
+	if user.PwHash != hashPassword(password) {
+		return nil, ErrInvalidPassword
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	return user, nil
+}
+
+// SetPassword replaces the password of userID
+func SetPassword(database *gorm.DB, userID int, password string) error {
+	if password == "" {
+		return &ValidationError{"You have to enter a password"}
+	}
+	return database.Model(&models.User{}).Where("user_id = ?", userID).Update("pw_hash", hashPassword(password)).Error
+}
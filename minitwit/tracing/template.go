@@ -0,0 +1,28 @@
+package tracing
+
+import (
+	"context"
+	"io"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Template is implemented by both html/template and text/template
+type Template interface {
+	Name() string
+	Execute(w io.Writer, data any) error
+}
+
+// Render executes the template in a span
+func Render(ctx context.Context, tmpl Template, w io.Writer, data any) error {
+	_, span := Tracer().Start(ctx, "template "+tmpl.Name(), trace.WithAttributes(attribute.String("template.name", tmpl.Name())))
+	defer span.End()
+	err := tmpl.Execute(w, data)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
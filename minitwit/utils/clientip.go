@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// TrustProxies makes ClientIP read header for the client address, use it
+// when the app runs behind proxies. Each of the proxies appends the
+// address it got the request from.
+func TrustProxies(header string, proxies int) func(http.Handler) http.Handler {
+	proxies = max(1, proxies)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ip := forwardedFor(r, header, proxies)
+			if ip == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+		})
+	}
+}
+
+// forwardedFor is the address the outermost of the trusted proxies
+// appended to the header. Entries left of it come from the client and can
+// be anything.
+func forwardedFor(r *http.Request, header string, proxies int) string {
+	values := r.Header.Values(header)
+	if len(values) == 0 {
+		return ""
+	}
+	entries := strings.Split(strings.Join(values, ","), ",")
+	return strings.TrimSpace(entries[max(0, len(entries)-proxies)])
+}
+
+// ClientIP is the client address found by TrustProxies, or the remote
+// address of the connection
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// ClientIPForwarded tells if ClientIP is the address a trusted proxy
+// forwarded. Otherwise it is the remote address, which behind a load
+// balancer is the same for all clients.
+func ClientIPForwarded(r *http.Request) bool {
+	_, ok := r.Context().Value(clientIPKey{}).(string)
+	return ok
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// StatusRecorder remembers the status of a response for middlewares, and
+// a copy of the body if Body is set. Flush and the http.ResponseController
+// reach the wrapped writer.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status      int
+	Body        *bytes.Buffer
+	wroteHeader bool
+}
+
+// NewStatusRecorder wraps w, the status is 200 until the handler sets one
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (sr *StatusRecorder) WriteHeader(code int) {
+	if !sr.wroteHeader {
+		sr.Status = code
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *StatusRecorder) Write(b []byte) (int, error) {
+	sr.wroteHeader = true
+	if sr.Body != nil {
+		sr.Body.Write(b)
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *StatusRecorder) Flush() {
+	sr.wroteHeader = true
+	http.NewResponseController(sr.ResponseWriter).Flush()
+}
+
+func (sr *StatusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
@@ -1,21 +1,25 @@
 package utils
 
 import (
+	"context"
 	"net/http"
 
+	"minitwit/config"
+
 	"github.com/gorilla/sessions"
 )
 
-const SECRET_KEY = "development key"
-
 var sessionSaveError = "Failed to save session"
 var sessionGetError = "Failed to get session"
 
-var store *sessions.CookieStore
+type storeKey struct{}
 
-func init() {
+// devStore signs the sessions of requests that did not pass Sessions with
+// the development key
+var devStore = newStore(config.DefaultSecretKey)
 
-	store = sessions.NewCookieStore([]byte(SECRET_KEY))
+func newStore(secretKey string) *sessions.CookieStore {
+	store := sessions.NewCookieStore([]byte(secretKey))
 
 	store.Options = &sessions.Options{
 		Path:     "/",
@@ -23,6 +27,25 @@ func init() {
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 	}
+	return store
+}
+
+// Sessions signs the session cookies of the requests it passes with
+// secretKey
+func Sessions(secretKey string) func(http.Handler) http.Handler {
+	store := newStore(secretKey)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), storeKey{}, store)))
+		})
+	}
+}
+
+func sessionStore(r *http.Request) *sessions.CookieStore {
+	if store, ok := r.Context().Value(storeKey{}).(*sessions.CookieStore); ok {
+		return store
+	}
+	return devStore
 }
 
 // Flash messages
@@ -54,7 +77,7 @@ func GetFlashes(w http.ResponseWriter, r *http.Request) []interface{} {
 
 // Get session
 func GetSession(r *http.Request, w http.ResponseWriter) (*sessions.Session, error) {
-	session, err := store.Get(r, "minitwit-session")
+	session, err := sessionStore(r).Get(r, "minitwit-session")
 	if err != nil {
 		// Handle invalid cookie case
 		session.Options.MaxAge = -1
@@ -65,3 +88,24 @@ func GetSession(r *http.Request, w http.ResponseWriter) (*sessions.Session, erro
 	}
 	return session, err
 }
+
+// SessionUserID returns the id of the logged in user, 0 if there is none
+func SessionUserID(r *http.Request) int {
+	session, err := sessionStore(r).Get(r, "minitwit-session")
+	if err != nil {
+		return 0
+	}
+	id, _ := session.Values["user_id"].(int)
+	return id
+}
+
+// ForgetUser logs the session out but keeps its flashes
+func ForgetUser(w http.ResponseWriter, r *http.Request) error {
+	session, err := sessionStore(r).Get(r, "minitwit-session")
+	if err != nil {
+		return err
+	}
+	delete(session.Values, "user_id")
+	delete(session.Values, "username")
+	return session.Save(r, w)
+}
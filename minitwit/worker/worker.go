@@ -0,0 +1,126 @@
+// Package worker runs the background jobs. The web app and the API embed a
+// pool unless jobs.embedded is false, then minitwit worker runs them:
+//
+//	MINITWIT_JOBS_BACKEND=postgres MINITWIT_JOBS_EMBEDDED=false minitwit worker
+package worker
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"minitwit/cache"
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/fanout"
+	"minitwit/federation"
+	"minitwit/health"
+	"minitwit/jobs"
+	"minitwit/logging"
+	"minitwit/metrics"
+	"minitwit/middleware"
+	"minitwit/server"
+	"minitwit/tracing"
+
+	"github.com/gorilla/mux"
+)
+
+// Retention is how long finished jobs stay in the queue
+const Retention = 7 * 24 * time.Hour
+
+// NewPool returns a pool of cfg with the handlers of the app, f and fed
+// may be nil
+func NewPool(cfg config.Jobs, queue jobs.Queue, f *fanout.Fanout, fed *federation.Service) *jobs.Pool {
+	pool := jobs.NewPool(queue, cfg.Workers)
+	pool.Poll = cfg.Poll
+	pool.Lease = cfg.Lease
+	// queued jobs of the memory backend are lost once the process stops
+	pool.Drain = cfg.Backend == jobs.BackendMemory
+
+	f.Register(pool)
+	fed.RegisterJobs(pool)
+	pool.Handle(jobs.CleanupKind, jobs.CleanupHandler(queue, Retention))
+	if err := pool.Cron("cleanup", "@hourly", jobs.CleanupKind, nil); err != nil {
+		panic(err)
+	}
+	return pool
+}
+
+// Main runs the jobs until SIGTERM, args are the config flags
+func Main(args []string, stdout, stderr io.Writer) int {
+	cfg, err := config.Load("worker", args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err == nil && cfg.Jobs.Backend != jobs.BackendPostgres {
+		err = fmt.Errorf("jobs.backend must be postgres, the worker cannot see the jobs of other processes in memory")
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "worker: invalid configuration:\n%v\n", err)
+		return 2
+	}
+	logging.Setup(cfg.Log)
+	slog.Info("Configuration loaded", "config", cfg)
+	shutdownTracing, err := tracing.Setup(context.Background(), "minitwit-worker")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	db.AutoMigrateDB(cfg.Database)
+	database := db.GormConnectDB(cfg.Database)
+	defer db.Close(database)
+	if err := metrics.RegisterDB(database); err != nil {
+		slog.Error("Failed to register database metrics", "err", err)
+	}
+	// only a shared cache sees the timelines the jobs change
+	var timelines *cache.Timelines
+	if cfg.Cache.Enabled && cfg.Cache.Backend == cache.BackendPostgres {
+		timelines, err = cache.FromConfig(cfg.Cache, database)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+	queue, err := jobs.FromConfig(cfg.Jobs, database)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	f := fanout.FromConfig(database, cfg.Timeline, queue, timelines.MessagePosted)
+	pool := NewPool(cfg.Jobs, queue, f, federation.NewFromConfig(database, cfg.Federation, timelines, f, queue))
+
+	r := mux.NewRouter()
+	r.Handle("/metrics", middleware.MetricsHandler())
+	r.HandleFunc("/healthz", health.Liveness()).Methods("GET")
+	r.HandleFunc("/readyz", health.Readiness(database)).Methods("GET")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopPool := pool.Start()
+	opts := server.FromConfig(cfg.Jobs.Addr, cfg.Server)
+	slog.Info("Worker is running", "addr", opts.Addr, "workers", cfg.Jobs.Workers)
+	code := 0
+	if err := server.New(r, opts).Run(ctx); err != nil {
+		slog.Error("Server stopped", "err", err)
+		code = 1
+	}
+	// the running jobs finish, the queued ones wait for the next worker
+	stopPool()
+
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Failed to flush traces", "err", err)
+	}
+	slog.Info("Worker stopped")
+	return code
+}
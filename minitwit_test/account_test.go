@@ -0,0 +1,325 @@
+package account_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"minitwit/apiv2"
+	"minitwit/config"
+	"minitwit/handlers"
+	"minitwit/middleware"
+	"minitwit/models"
+	"minitwit/service"
+	"minitwit/totp"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var svc = service.New(config.Default())
+
+func setupDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}, &models.RemoteActor{}, &models.ActorKey{}, &models.RemoteNote{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}, &models.Identity{}, &models.TimelineEntry{}, &models.PopularAuthor{}))
+	return database
+}
+
+// seed registers alice, bob and carol. alice and bob follow each other,
+// carol follows alice.
+func seed(t *testing.T, database *gorm.DB) (alice, bob, carol *models.User) {
+	var users []*models.User
+	for _, name := range []string{"alice", "bob", "carol"} {
+		user, err := service.RegisterUser(database, name, name+"@example.com", "secret")
+		require.NoError(t, err)
+		users = append(users, user)
+	}
+	alice, bob, carol = users[0], users[1], users[2]
+	_, err := svc.PostMessage(database, alice.User_id, "hello <b>world</b>")
+	require.NoError(t, err)
+	_, err = svc.PostMessage(database, alice.User_id, "hidden")
+	require.NoError(t, err)
+	require.NoError(t, database.Model(&models.Message{}).Where("text = ?", "hidden").Update("flagged", 1).Error)
+	_, err = svc.PostMessage(database, bob.User_id, "from bob")
+	require.NoError(t, err)
+	require.NoError(t, database.Create(&[]models.Follower{
+		{Who_id: alice.User_id, Whom_id: bob.User_id},
+		{Who_id: bob.User_id, Whom_id: alice.User_id},
+		{Who_id: carol.User_id, Whom_id: alice.User_id},
+	}).Error)
+	return alice, bob, carol
+}
+
+func unzip(t *testing.T, data []byte) map[string][]byte {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		rc.Close()
+		files[f.Name] = content
+	}
+	return files
+}
+
+func TestExportUserData(t *testing.T) {
+	database := setupDB(t)
+	alice, bob, carol := seed(t, database)
+
+	data, err := service.ExportUserData(database, alice.User_id)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", data.Profile.Username)
+	assert.Equal(t, "alice@example.com", data.Profile.Email)
+	require.Len(t, data.Messages, 2, "flagged messages are part of the export")
+	var texts []string
+	for _, m := range data.Messages {
+		texts = append(texts, m.Text)
+	}
+	assert.ElementsMatch(t, []string{"hello <b>world</b>", "hidden"}, texts)
+	assert.Equal(t, []service.DataUser{{ID: bob.User_id, Username: "bob"}}, data.Following)
+	assert.ElementsMatch(t, []service.DataUser{{ID: bob.User_id, Username: "bob"}, {ID: carol.User_id, Username: "carol"}}, data.Followers)
+
+	var buf bytes.Buffer
+	require.NoError(t, service.WriteArchive(&buf, data))
+	files := unzip(t, buf.Bytes())
+	for _, name := range []string{"profile.json", "messages.json", "following.json", "followers.json", "index.html"} {
+		assert.Contains(t, files, name)
+	}
+	var messages []service.DataMessage
+	require.NoError(t, json.Unmarshal(files["messages.json"], &messages))
+	assert.Len(t, messages, 2)
+	index := string(files["index.html"])
+	assert.Contains(t, index, "hello &lt;b&gt;world&lt;/b&gt;", "the index escapes messages")
+	assert.Contains(t, index, "carol")
+
+	_, err = service.ExportUserData(database, 999)
+	assert.ErrorIs(t, err, service.ErrUserNotFound)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	database := setupDB(t)
+	alice, bob, carol := seed(t, database)
+
+	require.NoError(t, svc.DeleteAccount(database, alice.User_id))
+
+	var count int64
+	database.Model(&models.User{}).Where("user_id = ?", alice.User_id).Count(&count)
+	assert.Zero(t, count)
+	database.Model(&models.Message{}).Where("author_id = ?", alice.User_id).Count(&count)
+	assert.Zero(t, count)
+	database.Model(&models.Follower{}).Where("who_id = ? OR whom_id = ?", alice.User_id, alice.User_id).Count(&count)
+	assert.Zero(t, count, "follows in both directions are removed")
+
+	// the others keep their data
+	database.Model(&models.Message{}).Where("author_id = ?", bob.User_id).Count(&count)
+	assert.Equal(t, int64(1), count)
+	database.Model(&models.User{}).Where("user_id = ?", carol.User_id).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	assert.ErrorIs(t, svc.DeleteAccount(database, alice.User_id), service.ErrUserNotFound)
+}
+
+// web is the part of the router the settings page needs
+func web(database *gorm.DB) *mux.Router {
+	r := mux.NewRouter()
+	r.Use(middleware.ActiveSession(database))
+	r.HandleFunc("/login", handlers.LoginHandler(database, nil)).Methods("GET", "POST")
+	r.HandleFunc("/settings", handlers.SettingsHandler(database, nil)).Methods("GET")
+	r.HandleFunc("/settings/archive", handlers.ArchiveHandler(database)).Methods("GET")
+	r.HandleFunc("/settings/delete", handlers.DeleteAccountHandler(database, svc, nil)).Methods("POST")
+	return r
+}
+
+// client keeps the session cookie between requests
+type client struct {
+	r       *mux.Router
+	cookies []*http.Cookie
+}
+
+func (c *client) do(method, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c.r.ServeHTTP(rec, req)
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		c.cookies = cookies
+	}
+	return rec
+}
+
+func login(t *testing.T, r *mux.Router, username string) *client {
+	c := &client{r: r}
+	rec := c.do("POST", "/login", url.Values{"username": {username}, "password": {"secret"}})
+	require.Equal(t, http.StatusFound, rec.Code)
+	require.Equal(t, "/", rec.Header().Get("Location"))
+	return c
+}
+
+func TestSettingsPage(t *testing.T) {
+	database := setupDB(t)
+	seed(t, database)
+	r := web(database)
+
+	anonymous := &client{r: r}
+	rec := anonymous.do("GET", "/settings", nil)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/login", rec.Header().Get("Location"))
+
+	alice := login(t, r, "alice")
+	rec = alice.do("GET", "/settings", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "/settings/archive")
+
+	rec = alice.do("GET", "/settings/archive", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/zip", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), "minitwit-alice.zip")
+	var profile service.Profile
+	require.NoError(t, json.Unmarshal(unzip(t, rec.Body.Bytes())["profile.json"], &profile))
+	assert.Equal(t, "alice", profile.Username)
+}
+
+func TestDeleteAccountFromSettings(t *testing.T) {
+	database := setupDB(t)
+	alice, _, _ := seed(t, database)
+	r := web(database)
+
+	browser := login(t, r, "alice")
+	phone := login(t, r, "alice")
+
+	rec := browser.do("POST", "/settings/delete", url.Values{"password": {"wrong"}})
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/settings", rec.Header().Get("Location"))
+	var count int64
+	database.Model(&models.User{}).Where("user_id = ?", alice.User_id).Count(&count)
+	assert.Equal(t, int64(1), count, "a wrong password keeps the account")
+
+	rec = browser.do("POST", "/settings/delete", url.Values{"password": {"secret"}})
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/public", rec.Header().Get("Location"))
+	database.Model(&models.User{}).Where("user_id = ?", alice.User_id).Count(&count)
+	assert.Zero(t, count)
+
+	// both sessions are logged out
+	for name, c := range map[string]*client{"browser": browser, "phone": phone} {
+		rec = c.do("GET", "/settings", nil)
+		assert.Equal(t, http.StatusFound, rec.Code, name)
+		assert.Equal(t, "/login", rec.Header().Get("Location"), name)
+	}
+}
+
+func apiRequest(t *testing.T, r *mux.Router, method, path, username string, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.SetBasicAuth(username, "secret")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIArchiveAndDelete(t *testing.T) {
+	database := setupDB(t)
+	alice, bob, _ := seed(t, database)
+	r := mux.NewRouter()
+	apiv2.Register(r, database, svc)
+	path := fmt.Sprintf("/api/v2/users/%d", alice.User_id)
+
+	rec := apiRequest(t, r, "GET", path+"/archive", "alice", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/zip", rec.Header().Get("Content-Type"))
+	assert.Contains(t, unzip(t, rec.Body.Bytes()), "index.html")
+
+	rec = apiRequest(t, r, "GET", path+"/archive", "alice", "application/json")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var data service.UserData
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&data))
+	assert.Len(t, data.Messages, 2)
+
+	rec = apiRequest(t, r, "GET", path+"/archive", "bob", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = apiRequest(t, r, "DELETE", path, "bob", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = apiRequest(t, r, "DELETE", path, "alice", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = apiRequest(t, r, "GET", path, "bob", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	var following int64
+	database.Model(&models.Follower{}).Where("who_id = ?", bob.User_id).Count(&following)
+	assert.Zero(t, following)
+}
+
+func TestAPIWritesNeedSecondFactor(t *testing.T) {
+	database := setupDB(t)
+	alice, _, carol := seed(t, database)
+	now := time.Now()
+	secret, _, err := service.EnrollTwoFactor(database, alice, now)
+	require.NoError(t, err)
+	code, err := totp.Code(secret, totp.Step(now))
+	require.NoError(t, err)
+	codes, err := service.ConfirmTwoFactor(database, alice.User_id, code, now)
+	require.NoError(t, err)
+	r := mux.NewRouter()
+	apiv2.Register(r, database, svc)
+	path := fmt.Sprintf("/api/v2/users/%d", alice.User_id)
+
+	withCode := func(method, path, code string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth("alice", "secret")
+		if code != "" {
+			req.Header.Set(apiv2.OTPHeader, code)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the password is enough to read
+	assert.Equal(t, http.StatusOK, apiRequest(t, r, "GET", path+"/timeline", "alice", "").Code)
+	rec := apiRequest(t, r, "GET", path+"/archive", "alice", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), apiv2.OTPHeader)
+	assert.Equal(t, http.StatusUnauthorized, apiRequest(t, r, "DELETE", path, "alice", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, withCode("GET", path+"/archive", "000000", nil).Code)
+
+	// every change needs a new code
+	message := apiv2.CreateMessageRequest{Text: "hi"}
+	follow := apiv2.CreateFollowRequest{User: "carol"}
+	assert.Equal(t, http.StatusUnauthorized, withCode("POST", "/api/v2/messages", "", message).Code)
+	assert.Equal(t, http.StatusCreated, withCode("POST", "/api/v2/messages", codes[0], message).Code)
+	assert.Equal(t, http.StatusUnauthorized, withCode("POST", "/api/v2/messages", codes[0], message).Code)
+	assert.Equal(t, http.StatusUnauthorized, withCode("POST", path+"/following", "", follow).Code)
+	assert.Equal(t, http.StatusCreated, withCode("POST", path+"/following", codes[1], follow).Code)
+	unfollow := fmt.Sprintf("%s/following/%d", path, carol.User_id)
+	assert.Equal(t, http.StatusUnauthorized, withCode("DELETE", unfollow, "", nil).Code)
+	assert.Equal(t, http.StatusNoContent, withCode("DELETE", unfollow, codes[2], nil).Code)
+
+	assert.Equal(t, http.StatusOK, withCode("GET", path+"/archive", codes[3], nil).Code)
+	var failures int64
+	database.Model(&models.FailedLogin{}).Where("username = ? AND cleared = ?", "alice", false).Count(&failures)
+	assert.Equal(t, int64(2), failures, "the wrong and the reused code wait for the next login")
+	assert.Equal(t, http.StatusNoContent, withCode("DELETE", path, codes[4], nil).Code)
+}
@@ -0,0 +1,255 @@
+package admin_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"minitwit/admin"
+	"minitwit/apiv2"
+	"minitwit/config"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var svc = service.New(config.Default())
+
+func setupDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}, &models.RemoteActor{}, &models.ActorKey{}, &models.RemoteNote{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}, &models.Identity{}, &models.TimelineEntry{}, &models.PopularAuthor{}))
+	return database
+}
+
+// run runs an admin command and returns its output
+func run(t *testing.T, database *gorm.DB, args ...string) string {
+	var out bytes.Buffer
+	require.NoError(t, admin.Run(database, nil, args, &out))
+	return out.String()
+}
+
+func runJSON(t *testing.T, database *gorm.DB, v any, args ...string) {
+	out := run(t, database, append([]string{"-json"}, args...)...)
+	require.NoError(t, json.Unmarshal([]byte(out), v), out)
+}
+
+func addUser(t *testing.T, database *gorm.DB, name string) *models.User {
+	user, err := service.RegisterUser(database, name, name+"@example.com", "secret")
+	require.NoError(t, err)
+	return user
+}
+
+func TestCreateAndListUsers(t *testing.T) {
+	database := setupDB(t)
+
+	var created []struct{ Username, Password string }
+	runJSON(t, database, &created, "users", "create", "alice", "alice@example.com")
+	require.Len(t, created, 1)
+	assert.NotEmpty(t, created[0].Password, "a generated password is printed once")
+	_, err := service.CheckPassword(database, "alice", created[0].Password)
+	assert.NoError(t, err)
+
+	out := run(t, database, "users", "create", "-password", "hunter2", "bob", "bob@example.com")
+	assert.NotContains(t, out, "PASSWORD", "a given password is not printed")
+	_, err = service.CheckPassword(database, "bob", "hunter2")
+	assert.NoError(t, err)
+
+	out = run(t, database, "users", "list")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, []string{"ID", "USERNAME", "EMAIL", "DISABLED"}, strings.Fields(lines[0]))
+	assert.Equal(t, []string{"1", "alice", "alice@example.com", "false"}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"2", "bob", "bob@example.com", "false"}, strings.Fields(lines[2]))
+
+	// the service validation applies
+	err = admin.Run(database, nil, []string{"users", "create", "alice", "other@example.com"}, &bytes.Buffer{})
+	assert.ErrorIs(t, err, service.ErrUsernameTaken)
+}
+
+func TestDisableUser(t *testing.T) {
+	database := setupDB(t)
+	addUser(t, database, "alice")
+
+	run(t, database, "users", "disable", "alice")
+	_, err := service.CheckPassword(database, "alice", "secret")
+	assert.ErrorIs(t, err, service.ErrUserDisabled)
+
+	// API v2 answers 403 for disabled accounts
+	req := httptest.NewRequest("POST", "/api/v2/messages", strings.NewReader(`{"text":"hi"}`))
+	req.SetBasicAuth("alice", "secret")
+	r := mux.NewRouter()
+	apiv2.Register(r, database, svc)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	var users []struct{ Username string }
+	runJSON(t, database, &users, "users", "list", "-disabled")
+	assert.Equal(t, "alice", users[0].Username)
+
+	run(t, database, "users", "enable", "alice")
+	_, err = service.CheckPassword(database, "alice", "secret")
+	assert.NoError(t, err)
+	runJSON(t, database, &users, "users", "list", "-disabled")
+	assert.Empty(t, users)
+}
+
+func TestDeleteUser(t *testing.T) {
+	database := setupDB(t)
+	alice := addUser(t, database, "alice")
+	bob := addUser(t, database, "bob")
+	_, err := svc.PostMessage(database, alice.User_id, "hello")
+	require.NoError(t, err)
+	_, err = svc.PostMessage(database, bob.User_id, "hi")
+	require.NoError(t, err)
+	require.NoError(t, database.Create(&models.Follower{Who_id: alice.User_id, Whom_id: bob.User_id}).Error)
+	require.NoError(t, database.Create(&models.Follower{Who_id: bob.User_id, Whom_id: alice.User_id}).Error)
+
+	var deleted struct {
+		Username string
+		Messages int64 `json:"deleted_messages"`
+		Follows  int64 `json:"deleted_follows"`
+	}
+	runJSON(t, database, &deleted, "users", "delete", "alice")
+	assert.Equal(t, "alice", deleted.Username)
+	assert.Equal(t, int64(1), deleted.Messages)
+	assert.Equal(t, int64(2), deleted.Follows)
+
+	_, err = service.GetUser(database, "alice")
+	assert.ErrorIs(t, err, service.ErrUserNotFound)
+	var messages, follows int64
+	database.Model(&models.Message{}).Count(&messages)
+	database.Model(&models.Follower{}).Count(&follows)
+	assert.Equal(t, int64(1), messages)
+	assert.Equal(t, int64(0), follows)
+
+	err = admin.Run(database, nil, []string{"users", "delete", "alice"}, &bytes.Buffer{})
+	assert.ErrorIs(t, err, service.ErrUserNotFound)
+}
+
+func TestRenameAndResetPassword(t *testing.T) {
+	database := setupDB(t)
+	addUser(t, database, "alice")
+	addUser(t, database, "bob")
+
+	err := admin.Run(database, nil, []string{"users", "rename", "alice", "bob"}, &bytes.Buffer{})
+	assert.ErrorIs(t, err, service.ErrUsernameTaken)
+
+	run(t, database, "users", "rename", "alice", "alicia")
+	_, err = service.CheckPassword(database, "alicia", "secret")
+	assert.NoError(t, err)
+
+	run(t, database, "users", "reset-password", "-password", "new-secret", "alicia")
+	_, err = service.CheckPassword(database, "alicia", "secret")
+	assert.ErrorIs(t, err, service.ErrInvalidPassword)
+	_, err = service.CheckPassword(database, "alicia", "new-secret")
+	assert.NoError(t, err)
+
+	var users []struct{ Password string }
+	runJSON(t, database, &users, "users", "reset-password", "bob")
+	require.NotEmpty(t, users[0].Password)
+	_, err = service.CheckPassword(database, "bob", users[0].Password)
+	assert.NoError(t, err)
+}
+
+func TestFlagMessages(t *testing.T) {
+	database := setupDB(t)
+	alice := addUser(t, database, "alice")
+	first, err := svc.PostMessage(database, alice.User_id, "first")
+	require.NoError(t, err)
+	_, err = svc.PostMessage(database, alice.User_id, "second")
+	require.NoError(t, err)
+
+	run(t, database, "messages", "flag", fmt.Sprint(first.Message_id))
+	_, err = service.GetMessage(database, first.Message_id)
+	assert.ErrorIs(t, err, service.ErrMessageNotFound, "flagged messages are hidden")
+
+	var messages []struct {
+		ID      int
+		Author  string
+		Flagged bool
+		Text    string
+	}
+	runJSON(t, database, &messages, "messages", "list", "-flagged")
+	require.Len(t, messages, 1)
+	assert.Equal(t, "first", messages[0].Text)
+	assert.Equal(t, "alice", messages[0].Author)
+
+	runJSON(t, database, &messages, "messages", "list", "-user", "alice")
+	assert.Len(t, messages, 2)
+
+	run(t, database, "messages", "unflag", fmt.Sprint(first.Message_id))
+	_, err = service.GetMessage(database, first.Message_id)
+	assert.NoError(t, err)
+
+	err = admin.Run(database, nil, []string{"messages", "flag", "999"}, &bytes.Buffer{})
+	assert.ErrorIs(t, err, service.ErrMessageNotFound)
+}
+
+func TestRecountFollowers(t *testing.T) {
+	database := setupDB(t)
+	alice := addUser(t, database, "alice")
+	bob := addUser(t, database, "bob")
+	carol := addUser(t, database, "carol")
+	for _, f := range []models.Follower{
+		{Who_id: alice.User_id, Whom_id: bob.User_id},
+		{Who_id: carol.User_id, Whom_id: bob.User_id},
+		{Who_id: bob.User_id, Whom_id: alice.User_id},
+		// a follow of a user deleted with raw SQL
+		{Who_id: alice.User_id, Whom_id: 42},
+	} {
+		require.NoError(t, database.Create(&f).Error)
+	}
+
+	out := run(t, database, "followers", "recount")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Equal(t, []string{"2", "bob", "2", "1"}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"1", "alice", "1", "2"}, strings.Fields(lines[2]))
+	assert.Contains(t, out, "1 follows of deleted users, rerun with -fix")
+
+	var result struct {
+		Users []struct {
+			Username  string
+			Followers int64
+			Following int64
+		}
+		Dangling int64 `json:"dangling_follows"`
+		Removed  bool  `json:"dangling_removed"`
+	}
+	runJSON(t, database, &result, "followers", "recount", "-fix")
+	assert.Equal(t, int64(1), result.Dangling)
+	assert.True(t, result.Removed)
+	assert.Equal(t, int64(1), result.Users[1].Following, "the dangling follow is gone")
+
+	assert.NotContains(t, run(t, database, "followers", "recount"), "deleted users")
+}
+
+// invalid arguments are found before Main connects to the database
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"users"},
+		{"users", "explode"},
+		{"users", "disable"},
+		{"users", "rename", "alice"},
+		{"messages", "flag", "abc"},
+	} {
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 2, admin.Main(args, &stdout, &stderr), args)
+		assert.Contains(t, stderr.String(), "usage: minitwit admin", args)
+	}
+
+	var stderr bytes.Buffer
+	assert.Equal(t, 0, admin.Main([]string{"-h"}, &bytes.Buffer{}, &stderr))
+	assert.Contains(t, stderr.String(), "users reset-password")
+}
@@ -0,0 +1,339 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"minitwit/api"
+	"minitwit/config"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const simulatorAuth = "Basic c2ltdWxhdG9yOnN1cGVyX3NhZmUh"
+
+// apiClient sends requests through the router and checks every response
+// against the OpenAPI document
+type apiClient struct {
+	t      *testing.T
+	router *mux.Router
+	doc    *openapi3.T
+	db     *gorm.DB
+}
+
+func setupAPI(t *testing.T) *apiClient {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.IdempotencyKey{}))
+
+	cfg := config.Default()
+	cfg.API.LatestFile = filepath.Join(t.TempDir(), "latest_processed_sim_action_id.txt")
+	require.NoError(t, os.WriteFile(cfg.API.LatestFile, []byte("0"), 0644))
+
+	doc, err := api.LoadSpec()
+	require.NoError(t, err)
+	return &apiClient{t: t, router: api.NewRouter(database, cfg, service.New(cfg)), doc: doc, db: database}
+}
+
+func (c *apiClient) do(method, path string, body any, auth bool) *httptest.ResponseRecorder {
+	header := http.Header{}
+	if auth {
+		header.Set("Authorization", simulatorAuth)
+	}
+	return c.send(method, path, body, header)
+}
+
+func (c *apiClient) send(method, path string, body any, header http.Header) *httptest.ResponseRecorder {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		require.NoError(c.t, err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	c.router.ServeHTTP(rec, req)
+
+	// the response must be described by the spec
+	specRouter, err := gorillamux.NewRouter(c.doc)
+	require.NoError(c.t, err)
+	route, pathParams, err := specRouter.FindRoute(req)
+	require.NoError(c.t, err, "%s %s is not in the spec", method, path)
+	input := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{Request: req, PathParams: pathParams, Route: route},
+		Status:                 rec.Code,
+		Header:                 rec.Header(),
+		Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+	}
+	input.SetBodyBytes(rec.Body.Bytes())
+	assert.NoError(c.t, openapi3filter.ValidateResponse(context.Background(), input), "%s %s", method, path)
+	return rec
+}
+
+func TestOpenAPIDocumentMatchesRoutes(t *testing.T) {
+	c := setupAPI(t)
+
+	rec := c.do("GET", "/openapi.json", nil, false)
+	require.Equal(t, http.StatusOK, rec.Code)
+	served, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	_, err = openapi3.NewLoader().LoadFromData(served)
+	require.NoError(t, err)
+
+	// every route except /metrics is documented, with the same methods
+	err = c.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, _ := route.GetPathTemplate()
+		if path == "/metrics" {
+			return nil
+		}
+		pathItem := c.doc.Paths.Value(path)
+		if !assert.NotNil(t, pathItem, "route %s is not documented", path) {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			assert.NotNil(t, pathItem.GetOperation(method), "%s %s is not documented", method, path)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestSimulatorAPIConformsToSpec(t *testing.T) {
+	c := setupAPI(t)
+
+	rec := c.do("POST", "/register?latest=1", api.RegisterRequest{Username: "a", Email: "a@a.a", Pwd: "a"}, true)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	rec = c.do("POST", "/register?latest=2", api.RegisterRequest{Username: "b", Email: "b@b.b", Pwd: "b"}, true)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = c.do("POST", "/msgs/a?latest=3", api.MessageRequest{Content: "Blub!"}, true)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = c.do("GET", "/msgs/a?no=20", nil, true)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var msgs []api.MessageResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&msgs))
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "Blub!", msgs[0].Content)
+	assert.Equal(t, "a", msgs[0].User)
+
+	rec = c.do("GET", "/msgs?no=20", nil, true)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = c.do("POST", "/fllws/a?latest=4", api.FollowRequest{Follow: "b"}, true)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = c.do("GET", "/fllws/a", nil, true)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var follows api.FollowsResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&follows))
+	assert.Equal(t, []string{"b"}, follows.Follows)
+
+	rec = c.do("POST", "/fllws/a?latest=5", api.FollowRequest{Unfollow: "b"}, true)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	// following oneself is answered like before, but nothing is stored
+	rec = c.do("POST", "/fllws/a", api.FollowRequest{Follow: "a"}, true)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	// empty lists are arrays, not null
+	rec = c.do("GET", "/fllws/a", nil, true)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"follows":[]}`, rec.Body.String())
+	rec = c.do("GET", "/msgs/b", nil, true)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+
+	rec = c.do("GET", "/latest", nil, false)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var latest api.LatestResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&latest))
+	assert.Equal(t, 5, latest.Latest)
+}
+
+func TestHealthEndpointsConformToSpec(t *testing.T) {
+	c := setupAPI(t)
+
+	assert.Equal(t, http.StatusOK, c.do("GET", "/healthz", nil, false).Code)
+	// only part of the tables are migrated here
+	assert.Equal(t, http.StatusServiceUnavailable, c.do("GET", "/readyz", nil, false).Code)
+}
+
+func TestSimulatorAPIRejectsInvalidRequests(t *testing.T) {
+	c := setupAPI(t)
+	rec := c.do("POST", "/register", api.RegisterRequest{Username: "a", Email: "a@a.a", Pwd: "a"}, true)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	decodeError := func(rec *httptest.ResponseRecorder) api.ErrorResponse {
+		var body api.ErrorResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		return body
+	}
+
+	// used to panic on content.(string)
+	rec = c.do("POST", "/msgs/a", map[string]any{}, true)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	body := decodeError(rec)
+	assert.Equal(t, http.StatusBadRequest, body.Status)
+	assert.Contains(t, body.ErrorMsg, "content")
+
+	rec = c.do("POST", "/msgs/a", map[string]any{"content": 42}, true)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = c.do("POST", "/fllws/a", map[string]any{}, true)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = c.do("POST", "/register", map[string]any{"username": "c"}, true)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = c.do("GET", "/msgs?no=lots", nil, true)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, decodeError(rec).ErrorMsg, `"no"`)
+
+	rec = c.do("GET", "/msgs", nil, false)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = c.do("GET", "/msgs/nobody", nil, true)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestSimulatorAPIChecksCredentialsBeforeBodies(t *testing.T) {
+	c := setupAPI(t)
+	latest := func() int {
+		var body api.LatestResponse
+		require.NoError(t, json.NewDecoder(c.do("GET", "/latest", nil, false).Body).Decode(&body))
+		return body.Latest
+	}
+
+	// invalid bodies without credentials are forbidden, not bad requests
+	for _, path := range []string{"/msgs/a?latest=9", "/fllws/a?latest=9"} {
+		rec := c.do("POST", path, map[string]any{"content": 42, "follow": 42}, false)
+		assert.Equal(t, http.StatusForbidden, rec.Code, path)
+	}
+	assert.Equal(t, http.StatusForbidden, c.do("GET", "/msgs?no=lots", nil, false).Code)
+	assert.Equal(t, 0, latest(), "only the simulator moves latest")
+
+	// invalid requests of the simulator still count as processed
+	rec := c.do("POST", "/msgs/a?latest=7", map[string]any{"content": 42}, true)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, 7, latest())
+}
+
+func TestSimulatorRetriesAreIdempotent(t *testing.T) {
+	c := setupAPI(t)
+	require.Equal(t, http.StatusCreated, c.do("POST", "/register?latest=1", api.RegisterRequest{Username: "a", Email: "a@a.a", Pwd: "a"}, true).Code)
+	require.Equal(t, http.StatusCreated, c.do("POST", "/register?latest=2", api.RegisterRequest{Username: "b", Email: "b@b.b", Pwd: "b"}, true).Code)
+
+	// a retry after a timeout repeats the latest action id
+	for i := 0; i < 2; i++ {
+		rec := c.do("POST", "/msgs/a?latest=3", api.MessageRequest{Content: "Blub!"}, true)
+		require.Equal(t, http.StatusNoContent, rec.Code)
+		assert.Equal(t, i == 1, rec.Header().Get("Idempotent-Replayed") == "true")
+	}
+	rec := c.do("GET", "/msgs/a", nil, true)
+	var msgs []api.MessageResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&msgs))
+	assert.Len(t, msgs, 1)
+
+	// the simulator counter restarts on every run, different requests are not replayed
+	rec = c.do("POST", "/msgs/a?latest=3", api.MessageRequest{Content: "Another run"}, true)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, http.StatusNoContent, c.do("POST", "/fllws/a?latest=4", api.FollowRequest{Follow: "b"}, true).Code)
+	}
+
+	// errors are not stored, the retry runs again
+	header := http.Header{"Authorization": {simulatorAuth}, "Idempotency-Key": {"retry-1"}}
+	rec = c.send("POST", "/fllws/a", api.FollowRequest{Follow: "nobody"}, header)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, http.StatusCreated, c.do("POST", "/register", api.RegisterRequest{Username: "nobody", Email: "n@n.n", Pwd: "n"}, true).Code)
+	rec = c.send("POST", "/fllws/a", api.FollowRequest{Follow: "nobody"}, header)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+	rec = c.send("POST", "/fllws/a", api.FollowRequest{Follow: "nobody"}, header)
+	assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+
+	rec = c.send("POST", "/fllws/a", api.FollowRequest{Follow: "b"}, header)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = c.do("GET", "/fllws/a", nil, true)
+	assert.JSONEq(t, `{"follows":["b","nobody"]}`, rec.Body.String())
+
+	// keys made of the latest id only cover the retries of one run
+	var keys []models.IdempotencyKey
+	require.NoError(t, c.db.Where("key LIKE ?", "latest:%").Find(&keys).Error)
+	require.NotEmpty(t, keys)
+	for _, key := range keys {
+		assert.Equal(t, int64(config.Default().API.LatestRetryTTL.Seconds()), key.Expires_at-key.Created_at)
+	}
+}
+
+func TestAbandonedReservationsAreTakenOver(t *testing.T) {
+	c := setupAPI(t)
+	require.Equal(t, http.StatusCreated, c.do("POST", "/register?latest=1", api.RegisterRequest{Username: "a", Email: "a@a.a", Pwd: "a"}, true).Code)
+	header := http.Header{"Authorization": {simulatorAuth}, "Idempotency-Key": {"k"}}
+	send := func() *httptest.ResponseRecorder {
+		return c.send("POST", "/msgs/a", api.MessageRequest{Content: "hi"}, header)
+	}
+	var reservation models.IdempotencyKey
+	require.Equal(t, http.StatusNoContent, send().Code)
+	require.NoError(t, c.db.Where("key LIKE ?", "key:%").Take(&reservation).Error)
+
+	// a request still running holds the key
+	now := time.Now()
+	require.NoError(t, c.db.Model(&reservation).Updates(map[string]any{"status": 0, "created_at": now.Unix()}).Error)
+	assert.Equal(t, http.StatusConflict, send().Code)
+
+	// one that never finished gives it up after the lease
+	require.NoError(t, c.db.Model(&reservation).Update("created_at", now.Add(-2*time.Minute).Unix()).Error)
+	rec := send()
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, "true", send().Header().Get("Idempotent-Replayed"))
+}
+
+func TestIdempotencyKeysBelongToTheCredentials(t *testing.T) {
+	c := setupAPI(t)
+	register := func(name string, header http.Header) *httptest.ResponseRecorder {
+		return c.send("POST", "/register?latest=1", api.RegisterRequest{Username: name, Email: name + "@a.a", Pwd: "a"}, header)
+	}
+	// a client without credentials cannot answer the simulator's retries
+	anonymous := http.Header{"Idempotency-Key": {"k"}}
+	simulator := http.Header{"Idempotency-Key": {"k"}, "Authorization": {simulatorAuth}}
+	require.Equal(t, http.StatusCreated, register("a", anonymous).Code)
+	rec := register("a", simulator)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "the username is taken, nothing was replayed")
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+
+	// forbidden requests never reach the store
+	forbidden := http.Header{"Authorization": {"Basic bm9ib2R5Om5vcGU="}}
+	assert.Equal(t, http.StatusForbidden, c.send("POST", "/msgs/a?latest=2", api.MessageRequest{Content: "hi"}, forbidden).Code)
+	rec = c.do("POST", "/msgs/a?latest=2", api.MessageRequest{Content: "hi"}, true)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+}
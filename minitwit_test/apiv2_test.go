@@ -0,0 +1,195 @@
+package apiv2_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"minitwit/apiv2"
+	"minitwit/config"
+	"minitwit/middleware"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var svc = service.New(config.Default())
+
+type credentials struct {
+	username, password string
+}
+
+func setupRouter(t *testing.T) *mux.Router {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}))
+
+	r := mux.NewRouter()
+	r.Use(middleware.PrometheusMiddleware)
+	apiv2.Register(r, database, svc)
+	return r
+}
+
+func request(t *testing.T, r *mux.Router, method, path string, body any, auth *credentials) *httptest.ResponseRecorder {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		require.NoError(t, err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if auth != nil {
+		req.SetBasicAuth(auth.username, auth.password)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	var v T
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&v))
+	return v
+}
+
+func createUser(t *testing.T, r *mux.Router, username string) (apiv2.User, *credentials) {
+	rec := request(t, r, "POST", "/api/v2/users", apiv2.CreateUserRequest{Username: username, Email: username + "@example.com", Password: "secret"}, nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	user := decode[apiv2.User](t, rec)
+	assert.Equal(t, fmt.Sprintf("/api/v2/users/%d", user.ID), rec.Header().Get("Location"))
+	return user, &credentials{username, "secret"}
+}
+
+// verifyEmail marks the email of username as verified in the database of
+// the test
+func verifyEmail(t *testing.T, username string) {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, database.Model(&models.User{}).Where("username = ?", username).Update("unverified", false).Error)
+}
+
+func assertProblem(t *testing.T, rec *httptest.ResponseRecorder, status int) apiv2.Problem {
+	require.Equal(t, status, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	problem := decode[apiv2.Problem](t, rec)
+	assert.Equal(t, status, problem.Status)
+	assert.Equal(t, http.StatusText(status), problem.Title)
+	return problem
+}
+
+func TestUsersByIdAndName(t *testing.T) {
+	r := setupRouter(t)
+	alice, _ := createUser(t, r, "alice")
+
+	byID := decode[apiv2.User](t, request(t, r, "GET", fmt.Sprintf("/api/v2/users/%d", alice.ID), nil, nil))
+	byName := decode[apiv2.User](t, request(t, r, "GET", "/api/v2/users/alice", nil, nil))
+	assert.Equal(t, alice, byID)
+	assert.Equal(t, alice, byName)
+
+	assertProblem(t, request(t, r, "GET", "/api/v2/users/nobody", nil, nil), http.StatusNotFound)
+
+	rec := request(t, r, "POST", "/api/v2/users", apiv2.CreateUserRequest{Username: "alice", Email: "a@example.com", Password: "x"}, nil)
+	assertProblem(t, rec, http.StatusConflict)
+
+	rec = request(t, r, "POST", "/api/v2/users", apiv2.CreateUserRequest{Username: "bob", Email: "not-an-email", Password: "x"}, nil)
+	problem := assertProblem(t, rec, http.StatusBadRequest)
+	assert.Equal(t, "You have to enter a valid email address", problem.Detail)
+}
+
+func TestMessagesArePaginatedWithCursor(t *testing.T) {
+	r := setupRouter(t)
+	_, alice := createUser(t, r, "alice")
+
+	assertProblem(t, request(t, r, "POST", "/api/v2/messages", apiv2.CreateMessageRequest{Text: "hi"}, nil), http.StatusUnauthorized)
+	assertProblem(t, request(t, r, "POST", "/api/v2/messages", apiv2.CreateMessageRequest{Text: "hi"}, &credentials{"alice", "wrong"}), http.StatusUnauthorized)
+
+	for i := 1; i <= 5; i++ {
+		if i == 4 {
+			// new accounts post a few messages before verifying their email
+			assertProblem(t, request(t, r, "POST", "/api/v2/messages", apiv2.CreateMessageRequest{Text: "too early"}, alice), http.StatusForbidden)
+			verifyEmail(t, "alice")
+		}
+		rec := request(t, r, "POST", "/api/v2/messages", apiv2.CreateMessageRequest{Text: fmt.Sprintf("message %d", i)}, alice)
+		require.Equal(t, http.StatusCreated, rec.Code)
+		message := decode[apiv2.Message](t, rec)
+		assert.Equal(t, fmt.Sprintf("message %d", i), message.Text)
+		assert.Equal(t, "alice", message.Author.Username)
+		assert.Equal(t, fmt.Sprintf("/api/v2/messages/%d", message.ID), rec.Header().Get("Location"))
+	}
+
+	// walk all pages, newest first
+	var texts []string
+	path := "/api/v2/users/alice/messages?limit=2"
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3)
+		page := decode[apiv2.List[apiv2.Message]](t, request(t, r, "GET", path, nil, nil))
+		for _, m := range page.Items {
+			texts = append(texts, m.Text)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		path = "/api/v2/users/alice/messages?limit=2&cursor=" + page.NextCursor
+	}
+	assert.Equal(t, []string{"message 5", "message 4", "message 3", "message 2", "message 1"}, texts)
+
+	public := decode[apiv2.List[apiv2.Message]](t, request(t, r, "GET", "/api/v2/messages", nil, nil))
+	assert.Len(t, public.Items, 5)
+	single := decode[apiv2.Message](t, request(t, r, "GET", fmt.Sprintf("/api/v2/messages/%d", public.Items[0].ID), nil, nil))
+	assert.Equal(t, public.Items[0], single)
+
+	assertProblem(t, request(t, r, "GET", "/api/v2/messages?cursor=garbage", nil, nil), http.StatusBadRequest)
+	assertProblem(t, request(t, r, "GET", "/api/v2/messages?limit=1000", nil, nil), http.StatusBadRequest)
+	assertProblem(t, request(t, r, "GET", "/api/v2/messages/999", nil, nil), http.StatusNotFound)
+}
+
+func TestFollowsAndTimeline(t *testing.T) {
+	r := setupRouter(t)
+	alice, aliceAuth := createUser(t, r, "alice")
+	bob, bobAuth := createUser(t, r, "bob")
+
+	rec := request(t, r, "POST", "/api/v2/messages", apiv2.CreateMessageRequest{Text: "from bob"}, bobAuth)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	// only alice can change who alice follows
+	rec = request(t, r, "POST", "/api/v2/users/alice/following", apiv2.CreateFollowRequest{User: "bob"}, bobAuth)
+	assertProblem(t, rec, http.StatusForbidden)
+
+	rec = request(t, r, "POST", "/api/v2/users/alice/following", apiv2.CreateFollowRequest{User: fmt.Sprint(bob.ID)}, aliceAuth)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	follow := decode[apiv2.Follow](t, rec)
+	// the users carry their counters after the follow
+	alice.Counts = &apiv2.UserCounts{Following: 1}
+	bob.Counts = &apiv2.UserCounts{Followers: 1, Messages: 1}
+	assert.Equal(t, apiv2.Follow{Follower: alice, Followee: bob}, follow)
+	assert.Equal(t, bob, decode[apiv2.User](t, request(t, r, "GET", "/api/v2/users/bob", nil, nil)))
+
+	rec = request(t, r, "POST", "/api/v2/users/alice/following", apiv2.CreateFollowRequest{User: "bob"}, aliceAuth)
+	assertProblem(t, rec, http.StatusConflict)
+
+	following := decode[apiv2.List[apiv2.User]](t, request(t, r, "GET", "/api/v2/users/alice/following", nil, nil))
+	assert.Equal(t, []apiv2.User{bob}, following.Items)
+	followers := decode[apiv2.List[apiv2.User]](t, request(t, r, "GET", "/api/v2/users/bob/followers", nil, nil))
+	assert.Equal(t, []apiv2.User{alice}, followers.Items)
+
+	assertProblem(t, request(t, r, "GET", "/api/v2/users/alice/timeline", nil, nil), http.StatusUnauthorized)
+	timeline := decode[apiv2.List[apiv2.Message]](t, request(t, r, "GET", "/api/v2/users/alice/timeline", nil, aliceAuth))
+	require.Len(t, timeline.Items, 1)
+	assert.Equal(t, "from bob", timeline.Items[0].Text)
+
+	rec = request(t, r, "DELETE", "/api/v2/users/alice/following/bob", nil, aliceAuth)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assertProblem(t, request(t, r, "DELETE", "/api/v2/users/alice/following/bob", nil, aliceAuth), http.StatusNotFound)
+
+	timeline = decode[apiv2.List[apiv2.Message]](t, request(t, r, "GET", "/api/v2/users/alice/timeline", nil, aliceAuth))
+	assert.Empty(t, timeline.Items)
+}
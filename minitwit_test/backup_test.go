@@ -0,0 +1,248 @@
+package backup_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"minitwit/backup"
+	"minitwit/config"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var svc = service.New(config.Default())
+
+func openDB(t *testing.T, name string) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s_%s?mode=memory&cache=shared", t.Name(), name)), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	return database
+}
+
+// source is an instance with a gap in the user ids
+func source(t *testing.T) *gorm.DB {
+	database := openDB(t, "source")
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}))
+	var users []*models.User
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		user, err := service.RegisterUser(database, name, name+"@example.com", "secret")
+		require.NoError(t, err)
+		users = append(users, user)
+	}
+	require.NoError(t, database.Delete(&models.User{}, users[1].User_id).Error)
+	for _, user := range []*models.User{users[0], users[2], users[3]} {
+		_, err := svc.PostMessage(database, user.User_id, "hello from "+user.Username)
+		require.NoError(t, err)
+	}
+	require.NoError(t, database.Model(&models.Message{}).Where("message_id = 2").Update("flagged", 1).Error)
+	require.NoError(t, database.Model(&models.User{}).Where("user_id = ?", users[3].User_id).Update("disabled", true).Error)
+	require.NoError(t, database.Create(&[]models.Follower{{Who_id: 1, Whom_id: 3}, {Who_id: 3, Whom_id: 1}, {Who_id: 4, Whom_id: 1}}).Error)
+	return database
+}
+
+func export(t *testing.T, database *gorm.DB, latest *int) string {
+	path := filepath.Join(t.TempDir(), "export.ndjson.gz")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = backup.Export(database, f, latest)
+	require.NoError(t, err)
+	return path
+}
+
+func opener(path string) func() (backup.Source, error) {
+	return func() (backup.Source, error) { return backup.Open(path) }
+}
+
+type row struct {
+	ID       int
+	Username string
+	Disabled bool
+}
+
+func users(t *testing.T, database *gorm.DB) []row {
+	var rows []row
+	require.NoError(t, database.Raw("SELECT user_id AS id, username, disabled FROM users ORDER BY user_id").Scan(&rows).Error)
+	return rows
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := source(t)
+	latest := 1234
+	path := export(t, src, &latest)
+
+	target := openDB(t, "target")
+	latestFile := filepath.Join(t.TempDir(), "latest.txt")
+	report, err := backup.Import(target, opener(path), backup.Options{LatestFile: latestFile})
+	require.NoError(t, err)
+	assert.Equal(t, backup.Counts{Users: 3, Messages: 3, Followers: 3}, report.Imported)
+	assert.Equal(t, backup.Counts{}, report.Skipped)
+
+	// the ids, the gap and the flags are kept
+	assert.Equal(t, []row{{1, "alice", false}, {3, "carol", false}, {4, "dave", true}}, users(t, target))
+	var flagged []int
+	target.Model(&models.Message{}).Where("flagged = 1").Pluck("message_id", &flagged)
+	assert.Equal(t, []int{2}, flagged)
+	_, err = service.CheckPassword(target, "alice", "secret")
+	assert.NoError(t, err)
+	var follows []models.Follower
+	target.Order("who_id, whom_id").Find(&follows)
+	assert.Equal(t, []models.Follower{{Who_id: 1, Whom_id: 3}, {Who_id: 3, Whom_id: 1}, {Who_id: 4, Whom_id: 1}}, follows)
+
+	content, err := os.ReadFile(latestFile)
+	require.NoError(t, err)
+	assert.Equal(t, "1234", string(content))
+
+	// new rows get ids after the imported ones
+	user, err := service.RegisterUser(target, "erin", "erin@example.com", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, 5, user.User_id)
+}
+
+func TestImportResume(t *testing.T) {
+	path := export(t, source(t), nil)
+
+	target := openDB(t, "target")
+	require.NoError(t, target.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}))
+	// an earlier import stopped after the first user and message
+	require.NoError(t, target.Create(&models.User{User_id: 1, Username: "alice", Email: "alice@example.com"}).Error)
+	require.NoError(t, target.Create(&models.Message{Message_id: 1, Author_id: 1, Text: "hello from alice"}).Error)
+
+	_, err := backup.Import(target, opener(path), backup.Options{})
+	assert.ErrorIs(t, err, backup.ErrNotEmpty)
+
+	report, err := backup.Import(target, opener(path), backup.Options{Resume: true, BatchSize: 2})
+	require.NoError(t, err)
+	assert.Equal(t, backup.Counts{Users: 2, Messages: 2, Followers: 3}, report.Imported)
+	assert.Equal(t, backup.Counts{Users: 1, Messages: 1}, report.Skipped)
+	assert.Len(t, users(t, target), 3)
+
+	// resuming a finished import changes nothing
+	report, err = backup.Import(target, opener(path), backup.Options{Resume: true})
+	require.NoError(t, err)
+	assert.Equal(t, backup.Counts{}, report.Imported)
+}
+
+// writeExport writes records as an export file
+func writeExport(t *testing.T, records ...string) string {
+	path := filepath.Join(t.TempDir(), "export.ndjson.gz")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(strings.Join(records, "\n") + "\n"))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+	return path
+}
+
+const header = `{"kind":"header","header":{"version":1,"created":"2025-01-01T00:00:00Z"}}`
+
+func TestImportReferentialIntegrity(t *testing.T) {
+	path := writeExport(t, header,
+		`{"kind":"user","user":{"id":1,"username":"alice","email":"a@a","pw_hash":"x"}}`,
+		`{"kind":"message","message":{"id":1,"author_id":1,"text":"ok","pub_date":1}}`,
+		`{"kind":"message","message":{"id":2,"author_id":7,"text":"orphan","pub_date":2}}`,
+		`{"kind":"follower","follower":{"who_id":1,"whom_id":9}}`,
+		`{"kind":"end","counts":{"users":1,"messages":2,"followers":1}}`,
+	)
+
+	target := openDB(t, "target")
+	_, err := backup.Import(target, opener(path), backup.Options{})
+	var integrityErr *backup.IntegrityError
+	require.ErrorAs(t, err, &integrityErr)
+	assert.Equal(t, backup.Counts{Messages: 1, Followers: 1}, integrityErr.Invalid)
+	assert.Contains(t, err.Error(), "message 2 by missing user 7")
+	var count int64
+	target.Model(&models.User{}).Count(&count)
+	assert.Zero(t, count, "nothing is written when validation fails")
+
+	report, err := backup.Import(target, opener(path), backup.Options{SkipInvalid: true})
+	require.NoError(t, err)
+	assert.Equal(t, backup.Counts{Users: 1, Messages: 1}, report.Imported)
+	assert.Equal(t, backup.Counts{Messages: 1, Followers: 1}, report.Invalid)
+}
+
+func TestImportRejectsBrokenFiles(t *testing.T) {
+	user := `{"kind":"user","user":{"id":1,"username":"alice","email":"a@a","pw_hash":"x"}}`
+	cases := map[string]struct {
+		path string
+		want string
+	}{
+		"newer version": {writeExport(t, `{"kind":"header","header":{"version":2}}`, user), "unsupported export version 2"},
+		"no header":     {writeExport(t, user), "not the header"},
+		"truncated":     {writeExport(t, header, user), "end record is missing"},
+		"wrong counts":  {writeExport(t, header, user, `{"kind":"end","counts":{"users":2,"messages":0,"followers":0}}`), "corrupt"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := backup.Import(nil, opener(c.path), backup.Options{DryRun: true})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), c.want)
+		})
+	}
+
+	// an export cut off in the middle of the gzip stream
+	full, err := os.ReadFile(export(t, source(t), nil))
+	require.NoError(t, err)
+	cut := filepath.Join(t.TempDir(), "cut.ndjson.gz")
+	require.NoError(t, os.WriteFile(cut, full[:len(full)-20], 0644))
+	_, err = backup.Import(nil, opener(cut), backup.Options{DryRun: true})
+	assert.Error(t, err)
+}
+
+func TestExportFormat(t *testing.T) {
+	path := export(t, source(t), nil)
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+
+	var kinds []string
+	dec := json.NewDecoder(gz)
+	for dec.More() {
+		var rec backup.Record
+		require.NoError(t, dec.Decode(&rec))
+		kinds = append(kinds, rec.Kind)
+	}
+	assert.Equal(t, []string{"header", "user", "user", "user", "message", "message", "message", "follower", "follower", "follower", "end"}, kinds)
+}
+
+func TestImportLegacySchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "minitwit.db")
+	legacy, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	schema, err := os.ReadFile("../minitwit/schema.sql")
+	require.NoError(t, err)
+	require.NoError(t, legacy.Exec(string(schema)).Error)
+	require.NoError(t, legacy.Exec(`INSERT INTO user VALUES (1, 'alice', 'a@a', 'pbkdf2:sha256:x'), (2, 'bob', 'b@b', 'pbkdf2:sha256:y');
+		INSERT INTO message VALUES (10, 1, 'hi', 1233065594, 0), (11, 2, 'flagged', NULL, 1);
+		INSERT INTO follower VALUES (1, 2), (1, 2), (2, 1), (2, 99)`).Error)
+	sqlDB, _ := legacy.DB()
+	sqlDB.Close()
+
+	target := openDB(t, "target")
+	_, err = backup.Import(target, opener(path), backup.Options{})
+	require.ErrorAs(t, err, new(*backup.IntegrityError))
+
+	report, err := backup.Import(target, opener(path), backup.Options{SkipInvalid: true})
+	require.NoError(t, err)
+	// the duplicate follow is read once
+	assert.Equal(t, backup.Counts{Users: 2, Messages: 2, Followers: 2}, report.Imported)
+	assert.Equal(t, backup.Counts{Followers: 1}, report.Invalid)
+	assert.Equal(t, []row{{1, "alice", false}, {2, "bob", false}}, users(t, target))
+	var ids []int
+	target.Model(&models.Message{}).Order("message_id").Pluck("message_id", &ids)
+	assert.Equal(t, []int{10, 11}, ids)
+}
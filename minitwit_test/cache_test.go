@@ -0,0 +1,376 @@
+package cache_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"minitwit/cache"
+	"minitwit/config"
+	"minitwit/handlers"
+	"minitwit/metrics"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func setupDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}, &models.RemoteActor{}, &models.ActorKey{}, &models.RemoteNote{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}, &models.Identity{}, &models.TimelineCache{}, &models.TimelineCacheGeneration{}, &models.TimelineEntry{}, &models.PopularAuthor{}))
+	return database
+}
+
+// withCache returns a service that drops the changed timelines of
+// timelines, a nil one does not cache
+func withCache(timelines *cache.Timelines) *service.Service {
+	svc := service.New(config.Default())
+	svc.Timelines = timelines
+	return svc
+}
+
+func entry(texts ...string) *cache.Entry {
+	e := &cache.Entry{Limit: 10}
+	for _, text := range texts {
+		e.Messages = append(e.Messages, models.Message{Text: text})
+	}
+	return e
+}
+
+// testCache checks the behaviour every Cache shares
+func testCache(t *testing.T, c cache.Cache) {
+	ctx := context.Background()
+	_, ok, err := c.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, c.Set(ctx, "a", entry("one"), time.Minute, 0))
+	got, ok, err := c.Get(ctx, "a")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, 10, got.Limit)
+	assert.Equal(t, "one", got.Messages[0].Text)
+
+	// Set replaces
+	require.NoError(t, c.Set(ctx, "a", entry("two"), time.Minute, 0))
+	got, _, err = c.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "two", got.Messages[0].Text)
+
+	require.NoError(t, c.Set(ctx, "b", entry("b"), time.Minute, 0))
+	require.NoError(t, c.Set(ctx, "c", entry("c"), time.Minute, 0))
+	require.NoError(t, c.Delete(ctx, "a", "missing"))
+	_, ok, _ = c.Get(ctx, "a")
+	assert.False(t, ok)
+	_, ok, _ = c.Get(ctx, "b")
+	assert.True(t, ok)
+
+	require.NoError(t, c.Clear(ctx))
+	for _, key := range []string{"b", "c"} {
+		_, ok, _ = c.Get(ctx, key)
+		assert.False(t, ok, key)
+	}
+
+	// a timeline queried before an invalidation is not stored
+	generation, err := c.Generation(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), generation, "one Delete and one Clear")
+	require.NoError(t, c.Delete(ctx, "d"))
+	require.NoError(t, c.Set(ctx, "d", entry("old"), time.Minute, generation))
+	_, ok, _ = c.Get(ctx, "d")
+	assert.False(t, ok)
+
+	// entries expire after their TTL
+	generation, err = c.Generation(ctx)
+	require.NoError(t, err)
+	require.NoError(t, c.Set(ctx, "short", entry("x"), 20*time.Millisecond, generation))
+	time.Sleep(30 * time.Millisecond)
+	_, ok, err = c.Get(ctx, "short")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestLRU(t *testing.T) {
+	testCache(t, cache.NewLRU(10))
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewLRU(2)
+	require.NoError(t, c.Set(ctx, "a", entry("a"), time.Minute, 0))
+	require.NoError(t, c.Set(ctx, "b", entry("b"), time.Minute, 0))
+	_, ok, _ := c.Get(ctx, "a")
+	require.True(t, ok)
+	require.NoError(t, c.Set(ctx, "c", entry("c"), time.Minute, 0))
+
+	assert.Equal(t, 2, c.Len())
+	_, ok, _ = c.Get(ctx, "b")
+	assert.False(t, ok, "b was used least recently")
+	for _, key := range []string{"a", "c"} {
+		_, ok, _ = c.Get(ctx, key)
+		assert.True(t, ok, key)
+	}
+
+	// callers cannot change the cached messages
+	got, _, _ := c.Get(ctx, "a")
+	got.Messages[0].Text = "changed"
+	got, _, _ = c.Get(ctx, "a")
+	assert.Equal(t, "a", got.Messages[0].Text)
+}
+
+func TestDBCache(t *testing.T) {
+	testCache(t, cache.NewDBCache(setupDB(t)))
+}
+
+func TestDBCacheIsShared(t *testing.T) {
+	database := setupDB(t)
+	ctx := context.Background()
+	require.NoError(t, cache.NewDBCache(database).Set(ctx, "a", entry("a"), time.Minute, 0))
+	_, ok, err := cache.NewDBCache(database).Get(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// an invalidation of another replica keeps an old timeline out
+	first, second := cache.NewDBCache(database), cache.NewDBCache(database)
+	generation, err := first.Generation(ctx)
+	require.NoError(t, err)
+	require.NoError(t, second.Delete(ctx, "b"))
+	require.NoError(t, first.Set(ctx, "b", entry("old"), time.Minute, generation))
+	_, ok, err = second.Get(ctx, "b")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestFromConfig(t *testing.T) {
+	// the default is shared with the API
+	cfg := config.Default().Cache
+	timelines, err := cache.FromConfig(cfg, setupDB(t))
+	require.NoError(t, err)
+	assert.IsType(t, &cache.DBCache{}, timelines.Cache)
+	assert.Equal(t, 10*time.Second, timelines.TTL)
+
+	cfg.Backend = cache.BackendMemory
+	timelines, err = cache.FromConfig(cfg, nil)
+	require.NoError(t, err)
+	assert.IsType(t, &cache.LRU{}, timelines.Cache)
+
+	cfg.Backend = "redis"
+	_, err = cache.FromConfig(cfg, nil)
+	assert.Error(t, err)
+
+	cfg.Enabled = false
+	timelines, err = cache.FromConfig(cfg, nil)
+	require.NoError(t, err)
+	assert.Nil(t, timelines)
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database = config.Database{Host: "db", User: "u", Name: "n", ConnectTimeout: time.Second}
+	require.NoError(t, cfg.Validate())
+	cfg.Cache.Backend = "redis"
+	assert.ErrorContains(t, cfg.Validate(), "cache.backend")
+	cfg.Cache.Backend = cache.BackendMemory
+	cfg.Cache.TTL = 0
+	assert.ErrorContains(t, cfg.Validate(), "cache.ttl")
+}
+
+func count(timeline, result string) float64 {
+	return testutil.ToFloat64(metrics.TimelineCache.WithLabelValues(timeline, result))
+}
+
+func TestTimelinesHitsAndLimits(t *testing.T) {
+	database := setupDB(t)
+	ctx := context.Background()
+	alice, err := service.RegisterUser(database, "alice", "alice@example.com", "secret")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := withCache(nil).PostMessage(database, alice.User_id, fmt.Sprintf("message %d", i))
+		require.NoError(t, err)
+	}
+	timelines := &cache.Timelines{Cache: cache.NewLRU(10), TTL: time.Minute}
+	hits, misses := count(cache.TimelinePublic, "hit"), count(cache.TimelinePublic, "miss")
+
+	messages, err := timelines.Public(ctx, database, 2)
+	require.NoError(t, err)
+	assert.Len(t, messages, 2)
+	assert.Equal(t, misses+1, count(cache.TimelinePublic, "miss"))
+
+	// a smaller page comes from the cache, a bigger one needs the query
+	messages, err = timelines.Public(ctx, database, 1)
+	require.NoError(t, err)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, hits+1, count(cache.TimelinePublic, "hit"))
+	messages, err = timelines.Public(ctx, database, 30)
+	require.NoError(t, err)
+	assert.Len(t, messages, 3)
+	assert.Equal(t, misses+2, count(cache.TimelinePublic, "miss"))
+
+	// the whole timeline answers every limit
+	messages, err = timelines.Public(ctx, database, 100)
+	require.NoError(t, err)
+	assert.Len(t, messages, 3)
+	assert.Equal(t, hits+2, count(cache.TimelinePublic, "hit"))
+
+	// the cache keeps serving until it is told about the change
+	require.NoError(t, database.Create(&models.Message{Author_id: uint(alice.User_id), Text: "behind the cache", Pub_date: time.Now().Unix() + 10}).Error)
+	messages, _ = timelines.Public(ctx, database, 30)
+	assert.Len(t, messages, 3)
+	timelines.MessagePosted(ctx, database, alice.User_id)
+	messages, _ = timelines.Public(ctx, database, 30)
+	assert.Len(t, messages, 4)
+
+	// a nil cache always queries
+	var off *cache.Timelines
+	messages, err = off.User(ctx, database, alice, 30)
+	require.NoError(t, err)
+	assert.Len(t, messages, 4)
+	off.MessagePosted(ctx, database, alice.User_id)
+	off.FollowsChanged(ctx, alice.User_id)
+	off.Clear(ctx)
+}
+
+func TestTimelinesSkipQueriesThatRacedAPost(t *testing.T) {
+	database := setupDB(t)
+	ctx := context.Background()
+	alice, err := service.RegisterUser(database, "alice", "alice@example.com", "secret")
+	require.NoError(t, err)
+	timelines := &cache.Timelines{Cache: cache.NewLRU(10), TTL: time.Minute}
+
+	// alice posts after the timeline was read but before it is cached
+	posted := false
+	require.NoError(t, database.Callback().Query().After("gorm:query").Register("test:post", func(*gorm.DB) {
+		if posted {
+			return
+		}
+		posted = true
+		_, err := withCache(timelines).PostMessage(database, alice.User_id, "hello")
+		require.NoError(t, err)
+	}))
+	messages, err := timelines.Public(ctx, database, 30)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+	_, ok, err := timelines.Cache.Get(ctx, "public")
+	require.NoError(t, err)
+	assert.False(t, ok, "the old timeline is not cached")
+
+	messages, err = timelines.Public(ctx, database, 30)
+	require.NoError(t, err)
+	assert.Len(t, messages, 1)
+}
+
+func TestServicesInvalidate(t *testing.T) {
+	database := setupDB(t)
+	ctx := context.Background()
+	svc := withCache(&cache.Timelines{Cache: cache.NewDBCache(database), TTL: time.Minute})
+	var users []*models.User
+	for _, name := range []string{"alice", "bob", "carol"} {
+		user, err := service.RegisterUser(database, name, name+"@example.com", "secret")
+		require.NoError(t, err)
+		users = append(users, user)
+	}
+	alice, bob, carol := users[0], users[1], users[2]
+	require.NoError(t, svc.Follow(database, bob.User_id, alice.User_id))
+
+	home := func(user *models.User) int {
+		messages, err := svc.Timelines.Home(ctx, database, nil, user.User_id, 30)
+		require.NoError(t, err)
+		return len(messages)
+	}
+	assert.Equal(t, 0, home(bob))
+	assert.Equal(t, 0, home(carol))
+
+	// posting reaches the followers
+	_, err := svc.PostMessage(database, alice.User_id, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, 1, home(bob))
+
+	// following and unfollowing change the home timeline
+	require.NoError(t, svc.Follow(database, carol.User_id, alice.User_id))
+	assert.Equal(t, 1, home(carol))
+	require.NoError(t, svc.Unfollow(database, carol.User_id, alice.User_id))
+	assert.Equal(t, 0, home(carol))
+
+	// deleting alice removes her messages from bob's timeline
+	require.NoError(t, svc.DeleteAccount(database, alice.User_id))
+	assert.Equal(t, 0, home(bob))
+}
+
+// web is the part of the router the timelines need
+func web(database *gorm.DB, svc *service.Service) *mux.Router {
+	cfg := config.Default()
+	r := mux.NewRouter()
+	r.HandleFunc("/", handlers.TimelineHandler(database, cfg, svc)).Methods("GET")
+	r.HandleFunc("/public", handlers.PublicTimelineHandler(database, cfg, svc)).Methods("GET")
+	r.HandleFunc("/login", handlers.LoginHandler(database, nil)).Methods("GET", "POST")
+	r.HandleFunc("/add_message", handlers.AddMessageHandler(database, svc)).Methods("POST")
+	r.HandleFunc("/{username}", handlers.UserTimelineHandler(database, cfg, svc)).Methods("GET")
+	r.HandleFunc("/{username}/follow", handlers.FollowHandler(database, svc)).Methods("GET", "POST")
+	r.HandleFunc("/{username}/unfollow", handlers.UnfollowHandler(database, svc)).Methods("GET", "POST")
+	return r
+}
+
+// client keeps the session cookie between requests
+type client struct {
+	r       *mux.Router
+	cookies []*http.Cookie
+}
+
+func (c *client) do(method, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c.r.ServeHTTP(rec, req)
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		c.cookies = cookies
+	}
+	return rec
+}
+
+func login(t *testing.T, r *mux.Router, username string) *client {
+	c := &client{r: r}
+	rec := c.do("POST", "/login", url.Values{"username": {username}, "password": {"secret"}})
+	require.Equal(t, http.StatusFound, rec.Code)
+	return c
+}
+
+func TestHandlersInvalidate(t *testing.T) {
+	database := setupDB(t)
+	svc := withCache(&cache.Timelines{Cache: cache.NewLRU(100), TTL: time.Minute})
+	for _, name := range []string{"alice", "bob"} {
+		_, err := service.RegisterUser(database, name, name+"@example.com", "secret")
+		require.NoError(t, err)
+	}
+	r := web(database, svc)
+	alice, bob := login(t, r, "alice"), login(t, r, "bob")
+
+	// fill the cache
+	for _, path := range []string{"/", "/public", "/alice"} {
+		assert.NotContains(t, bob.do("GET", path, nil).Body.String(), "first post", path)
+	}
+	assert.Equal(t, http.StatusFound, bob.do("POST", "/alice/follow", nil).Code)
+	assert.Equal(t, http.StatusFound, alice.do("POST", "/add_message", url.Values{"text": {"first post"}}).Code)
+	for _, path := range []string{"/", "/public", "/alice"} {
+		assert.Contains(t, bob.do("GET", path, nil).Body.String(), "first post", path)
+	}
+
+	assert.Equal(t, http.StatusFound, bob.do("POST", "/alice/unfollow", nil).Code)
+	assert.NotContains(t, bob.do("GET", "/", nil).Body.String(), "first post")
+	assert.Equal(t, http.StatusFound, bob.do("POST", "/alice/follow", nil).Code)
+	assert.Contains(t, bob.do("GET", "/", nil).Body.String(), "first post")
+}
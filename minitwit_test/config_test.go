@@ -0,0 +1,170 @@
+package config_test
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"minitwit/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestDefaults(t *testing.T) {
+	cfg, err := config.Load("test", nil)
+	require.NoError(t, err)
+	assert.Equal(t, config.Default(), cfg)
+	assert.Equal(t, "Basic c2ltdWxhdG9yOnN1cGVyX3NhZmUh", cfg.Simulator.Authorization())
+
+	// only the database has no usable default
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "database.host must be set")
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, "minitwit.yaml", `
+per_page: 50
+web:
+  addr: ":9000"
+database:
+  host: from-file
+  user: minitwit
+  name: minitwit
+  slow_query: 1s
+`)
+	t.Setenv("MINITWIT_CONFIG", path)
+	t.Setenv("DB_HOST", "from-env")
+	t.Setenv("DB_PORT", "")
+
+	cfg, err := config.Load("test", []string{"-database-slow-query", "2s", "-web-addr=:9001"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+
+	assert.Equal(t, 50, cfg.PerPage)                           // file
+	assert.Equal(t, "from-env", cfg.Database.Host)             // env over file
+	assert.Equal(t, "5432", cfg.Database.Port)                 // empty env is unset
+	assert.Equal(t, 2*time.Second, cfg.Database.SlowQuery)     // flag over file
+	assert.Equal(t, ":9001", cfg.Web.Addr)                     // flag over file
+	assert.Equal(t, config.Default().API.Addr, cfg.API.Addr)   // default
+	assert.Equal(t, "minitwit", cfg.Database.User)             // file
+	assert.Equal(t, config.Default().Log.Level, cfg.Log.Level) // default
+
+	t.Setenv("MINITWIT_PER_PAGE", "10")
+	cfg, err = config.Load("test", []string{"-per-page", "20"})
+	require.NoError(t, err)
+	assert.Equal(t, 20, cfg.PerPage)
+}
+
+func TestBoolSettings(t *testing.T) {
+	path := writeFile(t, "minitwit.yaml", `
+rate_limit:
+  exempt_simulator: false
+`)
+	cfg, err := config.Load("test", []string{"-config", path, "-rate-limit-enabled=false"})
+	require.NoError(t, err)
+	assert.False(t, cfg.RateLimit.ExemptSimulator)
+	assert.False(t, cfg.RateLimit.Enabled)
+
+	t.Setenv("MINITWIT_RATE_LIMIT_ENABLED", "false")
+	cfg, err = config.Load("test", []string{"-rate-limit-enabled"})
+	require.NoError(t, err)
+	assert.True(t, cfg.RateLimit.Enabled, "a bool flag without a value is true")
+
+	t.Setenv("MINITWIT_RATE_LIMIT_ENABLED", "maybe")
+	_, err = config.Load("test", nil)
+	assert.ErrorContains(t, err, "not true or false")
+}
+
+func TestTOMLFile(t *testing.T) {
+	path := writeFile(t, "minitwit.toml", `
+per_page = 40
+
+[database]
+host = "db"
+user = "minitwit"
+name = "minitwit"
+connect_timeout = "5s"
+
+[simulator]
+password = "secret"
+`)
+	cfg, err := config.Load("test", []string{"-config", path})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, 40, cfg.PerPage)
+	assert.Equal(t, "db", cfg.Database.Host)
+	assert.Equal(t, 5*time.Second, cfg.Database.ConnectTimeout)
+	assert.Equal(t, "host=db user=minitwit password= dbname=minitwit port=5432 sslmode=disable TimeZone=UTC", cfg.Database.DSN())
+	assert.Equal(t, "secret", cfg.Simulator.Password)
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := config.Load("test", []string{"-config", writeFile(t, "c.yaml", "database:\n  hots: db\n")})
+	assert.ErrorContains(t, err, "unknown setting database.hots")
+
+	_, err = config.Load("test", []string{"-config", writeFile(t, "c.json", "{}")})
+	assert.ErrorContains(t, err, "unknown config format")
+
+	_, err = config.Load("test", []string{"-per-page", "many"})
+	assert.ErrorContains(t, err, `per_page: "many" is not a number`)
+
+	t.Setenv("MINITWIT_SHUTDOWN_TIMEOUT", "20")
+	_, err = config.Load("test", nil)
+	assert.ErrorContains(t, err, "MINITWIT_SHUTDOWN_TIMEOUT")
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database.Host, cfg.Database.User, cfg.Database.Name = "db", "minitwit", "minitwit"
+	require.NoError(t, cfg.Validate())
+
+	cfg.PerPage = 0
+	cfg.Web.Addr = "8080"
+	cfg.Log.Format = "xml"
+	cfg.Server.TLSCert = "cert.pem"
+	cfg.Federation.BaseURL = "minitwit.example"
+	err := cfg.Validate()
+	require.Error(t, err)
+	for _, msg := range []string{
+		"per_page must be between 1 and 1000",
+		`web.addr "8080" is not a host:port address`,
+		`log.format "xml" is not json or text`,
+		"server.tls_cert and server.tls_key must be set together",
+		"federation.base_url",
+	} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
+
+func TestLogRedactsSecrets(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database.Password = "hunter2"
+	cfg.Web.SecretKey = "cookie-secret"
+
+	var buf strings.Builder
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("Configuration loaded", "config", cfg)
+	out := buf.String()
+	assert.Contains(t, out, "config.database.password=[redacted]")
+	assert.Contains(t, out, "config.per_page=30")
+	assert.Contains(t, out, "config.server.shutdown_timeout=20s")
+	for _, secret := range []string{"hunter2", "cookie-secret", "super_safe!"} {
+		assert.NotContains(t, out, secret)
+	}
+}
+
+func TestExampleConfigIsValid(t *testing.T) {
+	cfg, err := config.Load("test", []string{"-config", "../minitwit/minitwit.example.yaml"})
+	require.NoError(t, err)
+	assert.NoError(t, cfg.Validate())
+}
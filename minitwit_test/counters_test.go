@@ -0,0 +1,195 @@
+package counters_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"minitwit/admin"
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/handlers"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var svc = service.New(config.Default())
+
+func setupDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}, &models.RemoteActor{}, &models.ActorKey{}, &models.RemoteNote{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}, &models.Identity{}, &models.TimelineEntry{}, &models.PopularAuthor{}))
+	return database
+}
+
+func register(t *testing.T, database *gorm.DB, names ...string) []int {
+	var ids []int
+	for _, name := range names {
+		user, err := service.RegisterUser(database, name, name+"@example.com", "secret")
+		require.NoError(t, err)
+		ids = append(ids, user.User_id)
+	}
+	return ids
+}
+
+// counts returns the followers, following and messages counters of userID
+func counts(t *testing.T, database *gorm.DB, userID int) [3]int64 {
+	var user models.User
+	require.NoError(t, database.First(&user, userID).Error)
+	return [3]int64{user.Follower_count, user.Following_count, user.Message_count}
+}
+
+func TestCountersFollowAndPost(t *testing.T) {
+	database := setupDB(t)
+	ids := register(t, database, "alice", "bob", "carol")
+	alice, bob, carol := ids[0], ids[1], ids[2]
+
+	require.NoError(t, svc.Follow(database, bob, alice))
+	require.NoError(t, svc.Follow(database, carol, alice))
+	require.NoError(t, svc.Follow(database, alice, bob))
+	assert.ErrorIs(t, svc.Follow(database, bob, alice), service.ErrAlreadyFollowing)
+	for _, text := range []string{"one", "two", "three"} {
+		_, err := svc.PostMessage(database, alice, text)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, [3]int64{2, 1, 3}, counts(t, database, alice))
+	assert.Equal(t, [3]int64{1, 1, 0}, counts(t, database, bob))
+	assert.Equal(t, [3]int64{0, 1, 0}, counts(t, database, carol))
+
+	require.NoError(t, svc.Unfollow(database, carol, alice))
+	assert.ErrorIs(t, svc.Unfollow(database, carol, alice), service.ErrNotFollowing)
+	assert.Equal(t, [3]int64{1, 1, 3}, counts(t, database, alice))
+	assert.Equal(t, [3]int64{0, 0, 0}, counts(t, database, carol))
+
+	// flagged messages do not count
+	var first models.Message
+	require.NoError(t, database.Where("author_id = ?", alice).Order("message_id").First(&first).Error)
+	_, err := db.SetMessagesFlagged(database, []int{first.Message_id}, true)
+	require.NoError(t, err)
+	assert.Equal(t, [3]int64{1, 1, 2}, counts(t, database, alice))
+	_, err = db.SetMessagesFlagged(database, []int{first.Message_id}, false)
+	require.NoError(t, err)
+	assert.Equal(t, [3]int64{1, 1, 3}, counts(t, database, alice))
+
+	// deleting alice takes her follows off the others
+	require.NoError(t, svc.DeleteAccount(database, alice))
+	assert.Equal(t, [3]int64{0, 0, 0}, counts(t, database, bob))
+	drift, err := db.QueryCounterDrift(database, 10)
+	require.NoError(t, err)
+	assert.Empty(t, drift)
+}
+
+// web is the part of the router that changes and shows the counters
+func web(database *gorm.DB) *mux.Router {
+	cfg := config.Default()
+	r := mux.NewRouter()
+	r.HandleFunc("/login", handlers.LoginHandler(database, nil)).Methods("GET", "POST")
+	r.HandleFunc("/add_message", handlers.AddMessageHandler(database, svc)).Methods("POST")
+	r.HandleFunc("/{username}", handlers.UserTimelineHandler(database, cfg, svc)).Methods("GET")
+	r.HandleFunc("/{username}/follow", handlers.FollowHandler(database, svc)).Methods("GET", "POST")
+	r.HandleFunc("/{username}/unfollow", handlers.UnfollowHandler(database, svc)).Methods("GET", "POST")
+	return r
+}
+
+// client keeps the session cookie between requests
+type client struct {
+	r       *mux.Router
+	cookies []*http.Cookie
+}
+
+func (c *client) do(method, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c.r.ServeHTTP(rec, req)
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		c.cookies = cookies
+	}
+	return rec
+}
+
+func login(t *testing.T, r *mux.Router, username string) *client {
+	c := &client{r: r}
+	rec := c.do("POST", "/login", url.Values{"username": {username}, "password": {"secret"}})
+	require.Equal(t, http.StatusFound, rec.Code)
+	return c
+}
+
+func TestCountersOnProfile(t *testing.T) {
+	database := setupDB(t)
+	ids := register(t, database, "alice", "bob")
+	r := web(database)
+	alice, bob := login(t, r, "alice"), login(t, r, "bob")
+
+	assert.Equal(t, http.StatusFound, bob.do("POST", "/alice/follow", nil).Code)
+	assert.Equal(t, http.StatusFound, bob.do("POST", "/alice/follow", nil).Code)
+	assert.Equal(t, http.StatusFound, alice.do("POST", "/add_message", url.Values{"text": {"hello"}}).Code)
+	assert.Equal(t, [3]int64{1, 0, 1}, counts(t, database, ids[0]))
+
+	profile := bob.do("GET", "/alice", nil).Body.String()
+	assert.Contains(t, profile, "<strong>1</strong> messages")
+	assert.Contains(t, profile, "<strong>1</strong> followers")
+	assert.Contains(t, profile, "<strong>0</strong> following")
+
+	assert.Equal(t, http.StatusFound, bob.do("POST", "/alice/unfollow", nil).Code)
+	assert.Equal(t, http.StatusFound, bob.do("POST", "/alice/unfollow", nil).Code)
+	assert.Contains(t, bob.do("GET", "/alice", nil).Body.String(), "<strong>0</strong> followers")
+	assert.Equal(t, [3]int64{0, 0, 0}, counts(t, database, ids[1]))
+}
+
+func TestRecountUsers(t *testing.T) {
+	database := setupDB(t)
+	ids := register(t, database, "alice", "bob", "carol")
+	require.NoError(t, svc.Follow(database, ids[1], ids[0]))
+	_, err := svc.PostMessage(database, ids[0], "hello")
+	require.NoError(t, err)
+
+	// rows written around the counters
+	require.NoError(t, database.Create(&models.Follower{Who_id: ids[2], Whom_id: ids[0]}).Error)
+	require.NoError(t, database.Model(&models.User{}).Where("user_id = ?", ids[1]).Update("message_count", 7).Error)
+
+	recount := func(args ...string) (drift []db.CounterDrift, fixed int64) {
+		var out bytes.Buffer
+		require.NoError(t, admin.Run(database, nil, append([]string{"-json", "users", "recount"}, args...), &out))
+		var result struct {
+			Users []db.CounterDrift `json:"users"`
+			Fixed int64             `json:"fixed"`
+		}
+		require.NoError(t, json.Unmarshal(out.Bytes(), &result))
+		return result.Users, result.Fixed
+	}
+	drift, fixed := recount()
+	assert.Equal(t, int64(0), fixed)
+	require.Len(t, drift, 3)
+	assert.Equal(t, db.CounterDrift{UserID: ids[0], Username: "alice", Follower_count: 1, Message_count: 1, Followers: 2, Messages: 1}, drift[0])
+	assert.Equal(t, db.CounterDrift{UserID: ids[1], Username: "bob", Following_count: 1, Message_count: 7, Following: 1}, drift[1])
+	assert.Equal(t, db.CounterDrift{UserID: ids[2], Username: "carol", Following: 1}, drift[2])
+	assert.Equal(t, [3]int64{1, 0, 1}, counts(t, database, ids[0]))
+
+	_, fixed = recount("-fix")
+	assert.Equal(t, int64(3), fixed)
+	assert.Equal(t, [3]int64{2, 0, 1}, counts(t, database, ids[0]))
+	assert.Equal(t, [3]int64{0, 1, 0}, counts(t, database, ids[1]))
+	assert.Equal(t, [3]int64{0, 1, 0}, counts(t, database, ids[2]))
+	drift, _ = recount()
+	assert.Empty(t, drift)
+
+	var out bytes.Buffer
+	require.NoError(t, admin.Run(database, nil, []string{"users", "recount"}, &out))
+	assert.Equal(t, "the counters of all users are right\n", out.String())
+}
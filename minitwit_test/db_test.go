@@ -6,11 +6,13 @@ import (
 	"time"
 
 	"minitwit/db"
+	"minitwit/models"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
@@ -203,3 +205,22 @@ func TestQueryUserTimeline(t *testing.T) {
 
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
+
+// Test MigrateFollowers on a followers table without constraints, like the one from schema.sql
+func TestMigrateFollowersRemovesDuplicates(t *testing.T) {
+	gormDB, err := gorm.Open(sqlite.Open("file:migrate_followers?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, gormDB.Exec("CREATE TABLE followers (who_id integer, whom_id integer)").Error)
+	require.NoError(t, gormDB.Exec("INSERT INTO followers VALUES (1, 2), (1, 2), (1, 3), (2, 1), (1, 2)").Error)
+
+	require.NoError(t, db.MigrateFollowers(gormDB))
+	// running it again is a no-op
+	require.NoError(t, db.MigrateFollowers(gormDB))
+
+	var count int64
+	require.NoError(t, gormDB.Model(&models.Follower{}).Count(&count).Error)
+	assert.Equal(t, int64(3), count)
+
+	err = gormDB.Create(&models.Follower{Who_id: 1, Whom_id: 2}).Error
+	assert.ErrorContains(t, err, "UNIQUE constraint failed")
+}
@@ -0,0 +1,533 @@
+package email_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"minitwit/config"
+	"minitwit/handlers"
+	"minitwit/mailer"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var svc = service.New(config.Default())
+
+// fakeSMTP is an SMTP server that accepts every email and keeps it
+type fakeSMTP struct {
+	addr string
+
+	mu     sync.Mutex
+	auth   string
+	from   string
+	rcpt   []string
+	data   string
+	reject bool
+}
+
+func startSMTP(t *testing.T) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	s := &fakeSMTP{addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 localhost ESMTP fake")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		s.mu.Lock()
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			_, encoded, _ := strings.Cut(arg, " ")
+			decoded, _ := base64.StdEncoding.DecodeString(encoded)
+			s.auth = string(decoded)
+			reply("235 ok")
+		case "MAIL":
+			s.from = arg
+			reply("250 ok")
+		case "RCPT":
+			if s.reject {
+				reply("550 no such user")
+				break
+			}
+			s.rcpt = append(s.rcpt, arg)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.data = data.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			s.mu.Unlock()
+			return
+		default:
+			reply("250 ok")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestSMTP(t *testing.T) {
+	server := startSMTP(t)
+	cfg := config.Mail{Backend: mailer.BackendSMTP, From: "MiniTwit <noreply@example.com>", SMTPAddr: server.addr, SMTPUsername: "mt", SMTPPassword: "pw"}
+	m, err := mailer.FromConfig(cfg)
+	require.NoError(t, err)
+
+	require.NoError(t, m.Send(context.Background(), mailer.Message{To: "alice@example.com", Subject: "Grüße", Body: "line 1\nline 2\n"}))
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Equal(t, "\x00mt\x00pw", server.auth)
+	assert.Equal(t, "FROM:<noreply@example.com>", server.from)
+	assert.Equal(t, []string{"TO:<alice@example.com>"}, server.rcpt)
+
+	msg, err := mail.ReadMessage(strings.NewReader(server.data))
+	require.NoError(t, err)
+	assert.Equal(t, `"MiniTwit" <noreply@example.com>`, msg.Header.Get("From"))
+	assert.Equal(t, "<alice@example.com>", msg.Header.Get("To"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Grüße", subject)
+	body, _ := io.ReadAll(msg.Body)
+	assert.Equal(t, "line 1\r\nline 2\r\n", string(body))
+}
+
+func TestSMTPErrors(t *testing.T) {
+	server := startSMTP(t)
+	server.reject = true
+	m := &mailer.SMTP{Addr: server.addr, From: "noreply@example.com"}
+	err := m.Send(context.Background(), mailer.Message{To: "nobody@example.com", Subject: "hi", Body: "hi"})
+	assert.ErrorContains(t, err, "550")
+
+	err = m.Send(context.Background(), mailer.Message{To: "not an address", Subject: "hi", Body: "hi"})
+	assert.ErrorContains(t, err, "invalid recipient")
+
+	_, err = mailer.FromConfig(config.Mail{Backend: "pigeon"})
+	assert.ErrorContains(t, err, `unknown mail backend "pigeon"`)
+}
+
+func TestSMTPGivesUpWithTheContext(t *testing.T) {
+	// a server that accepts the connection and never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	m := &mailer.SMTP{Addr: l.Addr().String(), From: "noreply@example.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = m.Send(ctx, mailer.Message{To: "alice@example.com", Subject: "hi", Body: "hi"})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m, err := mailer.FromConfig(config.Mail{Backend: mailer.BackendFile, Dir: dir, From: "noreply@example.com"})
+	require.NoError(t, err)
+	for _, to := range []string{"alice@example.com", "bob@example.com"} {
+		require.NoError(t, m.Send(context.Background(), mailer.Message{To: to, Subject: "Hello", Body: "Hi " + to}))
+	}
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	f, err := os.Open(filepath.Join(dir, files[0].Name()))
+	require.NoError(t, err)
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", msg.Header.Get("Subject"))
+	assert.Equal(t, "text/plain; charset=utf-8", msg.Header.Get("Content-Type"))
+	_, err = msg.Header.Date()
+	assert.NoError(t, err)
+}
+
+func TestMailConfig(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database = config.Database{Host: "db", User: "u", Name: "n", ConnectTimeout: time.Second}
+	require.NoError(t, cfg.Validate())
+
+	cfg.Web.BaseURL = "minitwit.example.com"
+	cfg.Web.UnverifiedPostLimit = -2
+	cfg.Mail = config.Mail{Backend: "smtp", From: "nobody", SMTPAddr: "smtp.example.com"}
+	err := cfg.Validate()
+	for _, want := range []string{"web.base_url", "web.unverified_post_limit", "mail.from", "mail.smtp_addr"} {
+		assert.ErrorContains(t, err, want)
+	}
+	cfg.Mail = config.Mail{Backend: "pigeon", From: "noreply@example.com"}
+	assert.ErrorContains(t, cfg.Validate(), `mail.backend "pigeon"`)
+
+	// the log backend drops the emails, only localhost may use it
+	cfg = config.Default()
+	cfg.Database = config.Database{Host: "db", User: "u", Name: "n", ConnectTimeout: time.Second}
+	cfg.Web.BaseURL = "http://127.0.0.1:8080"
+	require.NoError(t, cfg.Validate())
+	cfg.Web.BaseURL = "https://minitwit.example.com"
+	assert.ErrorContains(t, cfg.Validate(), "mail.backend log")
+	cfg.Mail.Backend = "smtp"
+	cfg.Mail.SMTPAddr = "smtp.example.com:587"
+	require.NoError(t, cfg.Validate())
+}
+
+func TestLogMailerHidesBody(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	require.NoError(t, mailer.Log{}.Send(context.Background(), mailer.Message{To: "alice@example.com", Subject: "Reset your password", Body: "https://minitwit.example.com/reset?token=secret"}))
+	assert.Contains(t, buf.String(), "alice@example.com")
+	assert.NotContains(t, buf.String(), "token=secret")
+}
+
+func TestValidEmail(t *testing.T) {
+	for email, valid := range map[string]bool{
+		"alice@example.com":       true,
+		"alice.smith+mt@mail.dk":  true,
+		"alice@localhost":         false,
+		"alice@example.":          false,
+		"alice.example.com":       false,
+		"@example.com":            false,
+		"Alice <alice@example.c>": false,
+		"alice@exa mple.com":      false,
+		" alice@example.com":      false,
+	} {
+		assert.Equal(t, valid, service.ValidEmail(email), email)
+	}
+}
+
+// outbox keeps the emails instead of sending them
+type outbox struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (o *outbox) Send(ctx context.Context, msg mailer.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sent = append(o.sent, msg)
+	return nil
+}
+
+// wait waits until n emails were sent from the background
+func (o *outbox) wait(t *testing.T, n int) {
+	require.Eventually(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return len(o.sent) >= n
+	}, 5*time.Second, 10*time.Millisecond)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	require.Len(t, o.sent, n)
+}
+
+var tokenRe = regexp.MustCompile(`https?://\S+\?token=(\S+)`)
+
+// lastToken returns the token of the link in the last email
+func (o *outbox) lastToken(t *testing.T) (string, string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	require.NotEmpty(t, o.sent)
+	match := tokenRe.FindStringSubmatch(o.sent[len(o.sent)-1].Body)
+	require.NotNil(t, match, "no link in %q", o.sent[len(o.sent)-1].Body)
+	token, err := url.QueryUnescape(match[1])
+	require.NoError(t, err)
+	return match[0], token
+}
+
+func setupDB(t *testing.T) (*gorm.DB, *models.User) {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}))
+	user, err := service.RegisterUser(database, "alice", "alice@example.com", "secret")
+	require.NoError(t, err)
+	require.True(t, user.Unverified)
+	return database, user
+}
+
+func TestRegisterChecksEmails(t *testing.T) {
+	database, _ := setupDB(t)
+	_, err := service.RegisterUser(database, "bob", "bob@localhost", "secret")
+	assert.ErrorAs(t, err, new(*service.ValidationError))
+	_, err = service.RegisterVerifiedUser(database, "bob", "bob@", "secret")
+	assert.ErrorAs(t, err, new(*service.ValidationError))
+
+	admin, err := service.RegisterVerifiedUser(database, "bob", "bob@example.com", "secret")
+	require.NoError(t, err)
+	assert.False(t, admin.Unverified)
+
+	// the simulator keeps its own rules, its users have no mailbox
+	simulated, err := service.RegisterSimulatorUser(database, "carol", "carol@sim", "secret")
+	require.NoError(t, err)
+	assert.False(t, simulated.Unverified)
+	_, err = service.RegisterSimulatorUser(database, "dave", "dave", "secret")
+	assert.ErrorAs(t, err, new(*service.ValidationError))
+}
+
+// withMail returns a service that sends its emails to box, with links to
+// baseURL
+func withMail(box *outbox, baseURL string) *service.Service {
+	svc := service.New(config.Default())
+	svc.Mailer, svc.BaseURL = box, baseURL
+	return svc
+}
+
+func TestVerifyToken(t *testing.T) {
+	database, user := setupDB(t)
+	now := time.Unix(1700000000, 0)
+	box := &outbox{}
+	svc := withMail(box, "https://mt.example.com/")
+
+	require.NoError(t, svc.SendVerificationEmail(context.Background(), user, now))
+	assert.Equal(t, "alice@example.com", box.sent[0].To)
+	link, token := box.lastToken(t)
+	assert.True(t, strings.HasPrefix(link, "https://mt.example.com/verify?token="), link)
+
+	_, err := svc.VerifyEmail(database, token, now.Add(service.VerifyTokenTTL+time.Second))
+	assert.ErrorIs(t, err, service.ErrInvalidToken, "expired")
+	_, err = svc.VerifyEmail(database, token[:len(token)-2]+"xx", now)
+	assert.ErrorIs(t, err, service.ErrInvalidToken, "tampered")
+	_, err = svc.CheckResetToken(database, token, now)
+	assert.ErrorIs(t, err, service.ErrInvalidToken, "verify tokens do not reset passwords")
+
+	cfg := config.Default()
+	cfg.Web.SecretKey = "another key"
+	_, err = service.New(cfg).VerifyEmail(database, token, now)
+	assert.ErrorIs(t, err, service.ErrInvalidToken, "signed with another key")
+
+	verified, err := svc.VerifyEmail(database, token, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.False(t, verified.Unverified)
+	var stored models.User
+	database.Take(&stored, user.User_id)
+	assert.False(t, stored.Unverified)
+
+	// a link for an old address does not verify the new one
+	require.NoError(t, svc.SendVerificationEmail(context.Background(), user, now))
+	_, token = box.lastToken(t)
+	database.Model(user).Update("email", "alice@example.org")
+	_, err = svc.VerifyEmail(database, token, now)
+	assert.ErrorIs(t, err, service.ErrInvalidToken)
+}
+
+func TestResetToken(t *testing.T) {
+	database, user := setupDB(t)
+	now := time.Unix(1700000000, 0)
+	box := &outbox{}
+	svc := withMail(box, "https://mt.example.com")
+
+	require.NoError(t, svc.RequestPasswordReset(context.Background(), database, "nobody@example.com", now))
+	assert.Empty(t, box.sent, "unknown emails get no mail and no error")
+	require.NoError(t, svc.RequestPasswordReset(context.Background(), database, " Alice@Example.com", now))
+	require.Len(t, box.sent, 1)
+	_, token := box.lastToken(t)
+
+	_, err := svc.ResetPassword(database, token, "new", now.Add(service.ResetTokenTTL+time.Second))
+	assert.ErrorIs(t, err, service.ErrInvalidToken, "expired")
+	_, err = svc.ResetPassword(database, token, "", now)
+	assert.Error(t, err)
+
+	_, _, err = service.Login(database, service.LoginAttempt{Username: "alice", Password: "wrong"}, now)
+	require.Error(t, err)
+	reset, err := svc.ResetPassword(database, token, "new", now)
+	require.NoError(t, err)
+	assert.Equal(t, user.User_id, reset.User_id)
+	_, err = service.CheckPassword(database, "alice", "new")
+	assert.NoError(t, err)
+	var stored models.User
+	database.Take(&stored, user.User_id)
+	assert.False(t, stored.Unverified, "the link proved the address")
+	var failures int64
+	database.Model(&models.FailedLogin{}).Where("cleared = ?", false).Count(&failures)
+	assert.Zero(t, failures)
+
+	_, err = svc.ResetPassword(database, token, "newer", now)
+	assert.ErrorIs(t, err, service.ErrInvalidToken, "a reset link works once")
+}
+
+func TestUnverifiedPostLimit(t *testing.T) {
+	database, user := setupDB(t)
+	for i := 0; i < svc.UnverifiedPostLimit; i++ {
+		_, err := svc.PostMessage(database, user.User_id, fmt.Sprintf("message %d", i))
+		require.NoError(t, err)
+	}
+	_, err := svc.PostMessage(database, user.User_id, "one too many")
+	assert.ErrorIs(t, err, service.ErrUnverified)
+
+	// older messages do not count
+	database.Model(&models.Message{}).Where("author_id = ?", user.User_id).Update("pub_date", time.Now().Add(-25*time.Hour).Unix())
+	_, err = svc.PostMessage(database, user.User_id, "a day later")
+	assert.NoError(t, err)
+
+	limited := &service.Service{UnverifiedPostLimit: 0}
+	assert.ErrorIs(t, limited.CheckPostLimit(database, user.User_id, time.Now()), service.ErrUnverified)
+	unlimited := &service.Service{UnverifiedPostLimit: -1}
+	assert.NoError(t, unlimited.CheckPostLimit(database, user.User_id, time.Now()))
+	database.Model(user).Update("unverified", false)
+	assert.NoError(t, limited.CheckPostLimit(database, user.User_id, time.Now()), "verified users have no limit")
+}
+
+// client keeps the session cookie between requests, like a browser the
+// last one a response sets
+type client struct {
+	r       http.Handler
+	cookies []*http.Cookie
+}
+
+func (c *client) do(method, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c.r.ServeHTTP(rec, req)
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		c.cookies = cookies[len(cookies)-1:]
+	}
+	return rec
+}
+
+func web(t *testing.T, database *gorm.DB) (*client, *outbox) {
+	box := &outbox{}
+	svc := withMail(box, "http://mt.test")
+	r := mux.NewRouter()
+	r.HandleFunc("/register", handlers.RegisterHandler(database, svc)).Methods("GET", "POST")
+	r.HandleFunc("/login", handlers.LoginHandler(database, nil)).Methods("GET", "POST")
+	r.HandleFunc("/forgot", handlers.ForgotPasswordHandler(database, svc)).Methods("GET", "POST")
+	r.HandleFunc("/reset", handlers.ResetPasswordHandler(database, svc)).Methods("GET", "POST")
+	r.HandleFunc("/verify", handlers.VerifyEmailHandler(database, svc)).Methods("GET")
+	r.HandleFunc("/settings", handlers.SettingsHandler(database, nil)).Methods("GET")
+	r.HandleFunc("/settings/verify", handlers.ResendVerificationHandler(database, svc)).Methods("POST")
+	r.HandleFunc("/add_message", handlers.AddMessageHandler(database, svc)).Methods("POST")
+	return &client{r: r}, box
+}
+
+func TestRegisterAndVerify(t *testing.T) {
+	database, _ := setupDB(t)
+	c, box := web(t, database)
+
+	form := url.Values{"username": {"bob"}, "email": {"bob@example"}, "password": {"pw"}, "password2": {"pw"}}
+	assert.Equal(t, http.StatusBadRequest, c.do("POST", "/register", form).Code)
+	form.Set("email", "bob@example.com")
+	require.Equal(t, http.StatusFound, c.do("POST", "/register", form).Code)
+	var bob models.User
+	require.NoError(t, database.Where("username = ?", "bob").Take(&bob).Error)
+	assert.True(t, bob.Unverified)
+	require.Len(t, box.sent, 1)
+	assert.Equal(t, "bob@example.com", box.sent[0].To)
+
+	require.Equal(t, http.StatusFound, c.do("POST", "/login", url.Values{"username": {"bob"}, "password": {"pw"}}).Code)
+	assert.Contains(t, c.do("GET", "/settings", nil).Body.String(), "is not verified yet")
+	for i := 0; i < svc.UnverifiedPostLimit; i++ {
+		assert.Equal(t, http.StatusFound, c.do("POST", "/add_message", url.Values{"text": {"hi"}}).Code)
+	}
+	rec := c.do("POST", "/add_message", url.Values{"text": {"hi"}})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Verify your email address")
+
+	require.Equal(t, "/settings", c.do("POST", "/settings/verify", nil).Header().Get("Location"))
+	require.Len(t, box.sent, 2)
+	link, _ := box.lastToken(t)
+	require.True(t, strings.HasPrefix(link, "http://mt.test/verify?token="))
+
+	assert.Equal(t, http.StatusBadRequest, c.do("GET", "/verify?token=nonsense", nil).Code)
+	rec = c.do("GET", strings.TrimPrefix(link, "http://mt.test"), nil)
+	require.Equal(t, http.StatusFound, rec.Code)
+	assert.Contains(t, c.do("GET", "/settings", nil).Body.String(), "Your email address is verified")
+	assert.Equal(t, http.StatusFound, c.do("POST", "/add_message", url.Values{"text": {"verified"}}).Code)
+}
+
+func TestForgotAndReset(t *testing.T) {
+	database, _ := setupDB(t)
+	c, box := web(t, database)
+
+	assert.Contains(t, c.do("GET", "/login", nil).Body.String(), `href="/forgot"`)
+	unknown := c.do("POST", "/forgot", url.Values{"email": {"nobody@example.com"}})
+	known := c.do("POST", "/forgot", url.Values{"email": {"alice@example.com"}})
+	assert.Equal(t, unknown.Code, known.Code)
+	assert.Equal(t, unknown.Header().Get("Location"), known.Header().Get("Location"))
+	box.wait(t, 1)
+	link, token := box.lastToken(t)
+	path := strings.TrimPrefix(link, "http://mt.test")
+
+	rec := c.do("GET", path, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Choose a new password for alice")
+	assert.Contains(t, rec.Body.String(), token)
+
+	rec = c.do("POST", "/reset", url.Values{"token": {token}, "password": {"new"}, "password2": {"other"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = c.do("POST", "/reset", url.Values{"token": {token}, "password": {"new"}, "password2": {"new"}})
+	require.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/login", rec.Header().Get("Location"))
+	assert.Equal(t, http.StatusFound, c.do("POST", "/login", url.Values{"username": {"alice"}, "password": {"new"}}).Code)
+
+	rec = c.do("GET", path, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid or has expired")
+}
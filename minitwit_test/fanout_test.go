@@ -0,0 +1,339 @@
+package fanout_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"minitwit/admin"
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/fanout"
+	"minitwit/jobs"
+	"minitwit/metrics"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func setupDB(t testing.TB) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}, &models.RemoteActor{}, &models.ActorKey{}, &models.RemoteNote{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}, &models.Identity{}, &models.TimelineEntry{}, &models.PopularAuthor{}))
+	return database
+}
+
+// startFanout returns a service that fans out through queue with cfg for
+// the test, a pool runs the jobs
+func startFanout(t *testing.T, database *gorm.DB, cfg config.Timeline, queue jobs.Queue) *service.Service {
+	f := fanout.New(database, cfg, queue, nil)
+	pool := jobs.NewPool(queue, 2)
+	pool.Poll = 10 * time.Millisecond
+	f.Register(pool)
+	t.Cleanup(pool.Start())
+	svc := service.New(config.Default())
+	svc.Fanout = f
+	return svc
+}
+
+func testConfig() config.Timeline {
+	cfg := config.Default().Timeline
+	cfg.Mode = fanout.ModeFanout
+	cfg.MaxFollowers = 2
+	cfg.Backfill = 2
+	return cfg
+}
+
+func register(t *testing.T, database *gorm.DB, names ...string) []*models.User {
+	var users []*models.User
+	for _, name := range names {
+		user, err := service.RegisterUser(database, name, name+"@example.com", "secret")
+		require.NoError(t, err)
+		users = append(users, user)
+	}
+	return users
+}
+
+// post writes messages a second apart, so the timelines have a fixed order
+func post(t *testing.T, svc *service.Service, database *gorm.DB, author *models.User, texts ...string) {
+	for _, text := range texts {
+		var last models.Message
+		database.Order("pub_date DESC").Limit(1).Find(&last)
+		message := models.Message{Author_id: uint(author.User_id), Text: text, Pub_date: max(last.Pub_date+1, time.Now().Unix())}
+		require.NoError(t, database.Create(&message).Error)
+		svc.Fanout.MessagePosted(message)
+	}
+}
+
+func home(t *testing.T, svc *service.Service, database *gorm.DB, user *models.User) []string {
+	messages, err := svc.Fanout.Home(database, user.User_id, nil, 30)
+	require.NoError(t, err)
+	texts := make([]string, len(messages))
+	for i, m := range messages {
+		texts[i] = m.Text
+	}
+	return texts
+}
+
+// entries counts the fanned out messages in the timeline of user
+func entries(t *testing.T, database *gorm.DB, user *models.User) int64 {
+	var count int64
+	require.NoError(t, database.Model(&models.TimelineEntry{}).Where("user_id = ?", user.User_id).Count(&count).Error)
+	return count
+}
+
+func TestFanoutFollowAndPost(t *testing.T) {
+	database := setupDB(t)
+	users := register(t, database, "alice", "bob")
+	alice, bob := users[0], users[1]
+	svc := service.New(config.Default())
+	post(t, svc, database, alice, "a1", "a2", "a3")
+	post(t, svc, database, bob, "b1")
+	svc = startFanout(t, database, testConfig(), jobs.NewMemoryQueue())
+
+	// following copies the newest Backfill messages
+	require.NoError(t, svc.Follow(database, bob.User_id, alice.User_id))
+	assert.Equal(t, int64(2), entries(t, database, bob))
+	assert.Equal(t, []string{"b1", "a3", "a2"}, home(t, svc, database, bob))
+
+	// new messages reach the followers in the background, the own ones are
+	// read at request time
+	post(t, svc, database, alice, "a4")
+	post(t, svc, database, bob, "b2")
+	require.Eventually(t, func() bool { return entries(t, database, bob) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"b2", "a4", "b1", "a3", "a2"}, home(t, svc, database, bob))
+	assert.Equal(t, []string{"a4", "a3", "a2", "a1"}, home(t, svc, database, alice))
+
+	// flagged messages stay hidden
+	require.NoError(t, database.Model(&models.Message{}).Where("text = ?", "a4").Update("flagged", 1).Error)
+	assert.Equal(t, []string{"b2", "b1", "a3", "a2"}, home(t, svc, database, bob))
+
+	// unfollowing prunes
+	require.NoError(t, svc.Unfollow(database, bob.User_id, alice.User_id))
+	assert.Equal(t, int64(0), entries(t, database, bob))
+	assert.Equal(t, []string{"b2", "b1"}, home(t, svc, database, bob))
+}
+
+func TestFanoutPopularAuthorsArePulled(t *testing.T) {
+	database := setupDB(t)
+	svc := startFanout(t, database, testConfig(), jobs.NewMemoryQueue())
+	users := register(t, database, "star", "bob", "carol", "dave")
+	star, bob := users[0], users[1]
+	for _, follower := range users[1:] {
+		require.NoError(t, svc.Follow(database, follower.User_id, star.User_id))
+	}
+	pulled := testutil.ToFloat64(metrics.FanoutMessages.WithLabelValues("pulled"))
+
+	// three followers are more than MaxFollowers
+	post(t, svc, database, star, "s1")
+	require.Eventually(t, func() bool {
+		popular, err := db.IsPopularAuthor(database, star.User_id)
+		return err == nil && popular
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, pulled+1, testutil.ToFloat64(metrics.FanoutMessages.WithLabelValues("pulled")))
+	assert.Equal(t, int64(0), entries(t, database, bob))
+	assert.Equal(t, []string{"s1"}, home(t, svc, database, bob))
+
+	// following a popular author copies nothing, their messages are pulled
+	erin := register(t, database, "erin")[0]
+	require.NoError(t, svc.Follow(database, erin.User_id, star.User_id))
+	assert.Equal(t, int64(0), entries(t, database, erin))
+	assert.Equal(t, []string{"s1"}, home(t, svc, database, erin))
+	require.NoError(t, svc.Unfollow(database, erin.User_id, star.User_id))
+	assert.Empty(t, home(t, svc, database, erin))
+}
+
+// readAll pages through the home timeline of user with the API service
+func readAll(t *testing.T, svc *service.Service, database *gorm.DB, user *models.User) []int {
+	var ids []int
+	page := service.Page{Limit: 2}
+	for {
+		list, err := svc.Timeline(database, user.User_id, page)
+		require.NoError(t, err)
+		for _, m := range list.Messages {
+			ids = append(ids, m.Message_id)
+		}
+		if list.NextCursor == "" {
+			return ids
+		}
+		page.Cursor = list.NextCursor
+	}
+}
+
+func TestFanoutMatchesPull(t *testing.T) {
+	database := setupDB(t)
+	users := register(t, database, "star", "alice", "bob", "carol", "dave")
+	star, alice, bob := users[0], users[1], users[2]
+	svc := service.New(config.Default())
+	for _, follower := range users[1:] {
+		require.NoError(t, svc.Follow(database, follower.User_id, star.User_id))
+	}
+	require.NoError(t, svc.Follow(database, bob.User_id, alice.User_id))
+	require.NoError(t, svc.Follow(database, alice.User_id, bob.User_id))
+	for i := 0; i < 4; i++ {
+		for _, author := range users[:3] {
+			post(t, svc, database, author, fmt.Sprintf("%s %d", author.Username, i))
+		}
+	}
+
+	// pull mode reads everything at request time
+	want := map[int][]int{}
+	for _, user := range users {
+		want[user.User_id] = readAll(t, svc, database, user)
+	}
+	assert.Len(t, want[bob.User_id], 12)
+
+	// the rebuild makes star popular and copies the rest
+	var out bytes.Buffer
+	require.NoError(t, admin.Run(database, nil, []string{"-json", "timelines", "rebuild", "-max-followers", "2", "-backfill", "100"}, &out))
+	assert.JSONEq(t, `{"entries": 8}`, out.String())
+	svc = startFanout(t, database, testConfig(), jobs.NewMemoryQueue())
+	popular, err := db.IsPopularAuthor(database, star.User_id)
+	require.NoError(t, err)
+	assert.True(t, popular)
+	for _, user := range users {
+		assert.Equal(t, want[user.User_id], readAll(t, svc, database, user), user.Username)
+	}
+
+	// deleting a user removes their timeline and their messages from others
+	require.NoError(t, svc.DeleteAccount(database, alice.User_id))
+	var count int64
+	require.NoError(t, database.Model(&models.TimelineEntry{}).Where("user_id = ? OR author_id = ?", alice.User_id, alice.User_id).Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+}
+
+// brokenQueue refuses every job
+type brokenQueue struct{ *jobs.MemoryQueue }
+
+func (brokenQueue) Enqueue(ctx context.Context, job *jobs.Job) error {
+	return errors.New("queue is down")
+}
+
+func TestFanoutQueueFails(t *testing.T) {
+	database := setupDB(t)
+	svc := startFanout(t, database, testConfig(), brokenQueue{jobs.NewMemoryQueue()})
+	users := register(t, database, "alice", "bob")
+	require.NoError(t, svc.Follow(database, users[1].User_id, users[0].User_id))
+
+	// without a queue the messages are fanned out right away
+	for i := 0; i < 10; i++ {
+		post(t, svc, database, users[0], fmt.Sprint(i))
+	}
+	assert.Equal(t, int64(10), entries(t, database, users[1]))
+}
+
+func TestFanoutJobRetries(t *testing.T) {
+	database := setupDB(t)
+	queue := jobs.NewMemoryQueue()
+	f := fanout.New(database, testConfig(), queue, nil)
+	pool := jobs.NewPool(queue, 1)
+	f.Register(pool)
+	svc := service.New(config.Default())
+	svc.Fanout = f
+	users := register(t, database, "alice", "bob")
+	require.NoError(t, svc.Follow(database, users[1].User_id, users[0].User_id))
+	post(t, svc, database, users[0], "a1")
+
+	// a failed fan out stays queued for a retry
+	require.NoError(t, database.Migrator().DropTable(&models.TimelineEntry{}))
+	assert.True(t, pool.RunOne(context.Background()))
+	stats, err := queue.Stats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []jobs.Stat{{Kind: fanout.JobKind, State: jobs.StateQueued, Count: 1}}, stats)
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database = config.Database{Host: "db", User: "u", Name: "n", ConnectTimeout: time.Second}
+	cfg.Timeline.Mode = "push"
+	assert.ErrorContains(t, cfg.Validate(), "timeline.mode")
+	cfg.Timeline.Mode = fanout.ModeFanout
+	require.NoError(t, cfg.Validate())
+	cfg.Jobs.Embedded = false
+	assert.ErrorContains(t, cfg.Validate(), "jobs.embedded")
+	cfg.Jobs.Backend = "postgres"
+	require.NoError(t, cfg.Validate())
+	cfg.Jobs.Backend = "redis"
+	cfg.Jobs.Workers = 0
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "jobs.backend")
+	assert.ErrorContains(t, err, "jobs.workers")
+
+	assert.Nil(t, fanout.FromConfig(nil, config.Default().Timeline, nil, nil))
+}
+
+// generate makes users that each follow follows others and post messages,
+// the first user is followed by everybody
+func generate(b *testing.B, database *gorm.DB, users, follows, messages int) {
+	rng := rand.New(rand.NewSource(1))
+	var rows []models.User
+	for i := 1; i <= users; i++ {
+		rows = append(rows, models.User{User_id: i, Username: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@example.com", i), PwHash: "x"})
+	}
+	require.NoError(b, database.CreateInBatches(rows, 500).Error)
+
+	var followers []models.Follower
+	for who := 1; who <= users; who++ {
+		seen := map[int]bool{who: true}
+		if who != 1 {
+			seen[1] = true
+			followers = append(followers, models.Follower{Who_id: who, Whom_id: 1})
+		}
+		for len(seen) <= follows {
+			whom := rng.Intn(users) + 1
+			if !seen[whom] {
+				seen[whom] = true
+				followers = append(followers, models.Follower{Who_id: who, Whom_id: whom})
+			}
+		}
+	}
+	require.NoError(b, database.CreateInBatches(followers, 500).Error)
+
+	var rowsMessages []models.Message
+	for i := 0; i < users*messages; i++ {
+		rowsMessages = append(rowsMessages, models.Message{Author_id: uint(rng.Intn(users) + 1), Text: "generated", Pub_date: int64(1700000000 + i)})
+	}
+	require.NoError(b, database.CreateInBatches(rowsMessages, 500).Error)
+}
+
+// BenchmarkHomeTimeline compares reading the first page of home timelines
+// at request time with reading the fanned out ones:
+//
+//	go test -run NONE -bench HomeTimeline ./fanout_test.go
+func BenchmarkHomeTimeline(b *testing.B) {
+	database, err := gorm.Open(sqlite.Open(b.TempDir()+"/bench.db"), &gorm.Config{Logger: logger.Discard})
+	require.NoError(b, err)
+	require.NoError(b, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}, &models.TimelineEntry{}, &models.PopularAuthor{}))
+	const users = 2000
+	generate(b, database, users, 200, 20)
+
+	cfg := config.Default().Timeline
+	cfg.Mode = fanout.ModeFanout
+	cfg.MaxFollowers = users / 2
+	_, err = fanout.Rebuild(database, cfg)
+	require.NoError(b, err)
+
+	for _, mode := range []string{fanout.ModePull, fanout.ModeFanout} {
+		b.Run(mode, func(b *testing.B) {
+			cfg.Mode = mode
+			f := fanout.FromConfig(database, cfg, nil, nil)
+			rng := rand.New(rand.NewSource(2))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Home(database, rng.Intn(users)+1, nil, 30); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
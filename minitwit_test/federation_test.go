@@ -0,0 +1,385 @@
+package federation_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/federation"
+	"minitwit/handlers"
+	"minitwit/jobs"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// instance is one MiniTwit server with its own database
+type instance struct {
+	db     *gorm.DB
+	fed    *federation.Service
+	server *httptest.Server
+}
+
+func newInstance(t *testing.T, name string) *instance {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", name)), &gorm.Config{})
+	require.NoError(t, err)
+	err = database.AutoMigrate(&models.User{}, &models.Message{}, &models.RemoteActor{}, &models.ActorKey{}, &models.RemoteNote{})
+	require.NoError(t, err)
+
+	inst := &instance{db: database}
+	r := mux.NewRouter()
+	inst.server = httptest.NewServer(r)
+	t.Cleanup(inst.server.Close)
+
+	// the test servers listen on loopback
+	inst.fed = federation.NewFromConfig(database, config.Federation{BaseURL: inst.server.URL, Scheme: "http", AllowPrivate: true}, nil, nil, nil)
+	inst.fed.Register(r)
+	return inst
+}
+
+func (inst *instance) host() string {
+	u, _ := url.Parse(inst.server.URL)
+	return u.Host
+}
+
+func (inst *instance) createUser(t *testing.T, username string) models.User {
+	user := models.User{Username: username, Email: username + "@example.com", PwHash: "x"}
+	require.NoError(t, inst.db.Create(&user).Error)
+	return user
+}
+
+func TestWebFingerAndActor(t *testing.T) {
+	a := newInstance(t, "webfinger")
+	a.createUser(t, "alice")
+
+	resp, err := http.Get(a.server.URL + "/.well-known/webfinger?resource=acct:alice@" + a.host())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var wf struct {
+		Subject string
+		Links   []struct{ Rel, Type, Href string }
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&wf))
+	assert.Equal(t, "acct:alice@"+a.host(), wf.Subject)
+	require.NotEmpty(t, wf.Links)
+	assert.Equal(t, a.server.URL+"/ap/users/alice", wf.Links[0].Href)
+
+	req, _ := http.NewRequest("GET", wf.Links[0].Href, nil)
+	req.Header.Set("Accept", "application/activity+json")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var actor federation.Actor
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&actor))
+	assert.Equal(t, "Person", actor.Type)
+	assert.Equal(t, "alice", actor.PreferredUsername)
+	assert.Equal(t, actor.ID+"/inbox", actor.Inbox)
+	assert.Contains(t, actor.PublicKey.PublicKeyPem, "BEGIN PUBLIC KEY")
+
+	resp, err = http.Get(a.server.URL + "/.well-known/webfinger?resource=acct:nobody@" + a.host())
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestInboxRejectsBadSignatures(t *testing.T) {
+	a := newInstance(t, "badsignatures")
+	b := newInstance(t, "badsignaturesB")
+	a.createUser(t, "alice")
+	b.createUser(t, "bob")
+	inbox := a.server.URL + "/ap/users/alice/inbox"
+
+	// unsigned
+	body := `{"type":"Follow","actor":"` + b.server.URL + `/ap/users/bob","object":"` + a.server.URL + `/ap/users/alice"}`
+	resp, err := http.Post(inbox, "application/activity+json", strings.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// signature from a real actor that doesn't match the request
+	req, _ := http.NewRequest("POST", inbox, strings.NewReader(body))
+	req.Header.Set("Signature", `keyId="`+b.server.URL+`/ap/users/bob#main-key",headers="(request-target) host date digest",signature="AAAA"`)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestSignatureMustCoverTargetHostAndDate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	body := []byte(`{"type":"Follow"}`)
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("POST", "https://a.example/ap/users/alice/inbox", strings.NewReader(string(body)))
+		require.NoError(t, federation.SignRequest(req, body, "https://b.example/ap/users/bob#main-key", key))
+		return req
+	}
+	require.NoError(t, federation.VerifyRequest(newRequest(), body, &key.PublicKey))
+
+	// a valid signature of only some of the headers could be sent to
+	// any inbox
+	for _, headers := range []string{"date", "date digest", "host date digest", "(request-target) date digest", "(request-target) host date"} {
+		req := newRequest()
+		var lines []string
+		for _, h := range strings.Fields(headers) {
+			value := req.Header.Get(h)
+			switch h {
+			case "(request-target)":
+				value = "post /ap/users/alice/inbox"
+			case "host":
+				value = req.Host
+			}
+			lines = append(lines, h+": "+value)
+		}
+		hashed := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+		require.NoError(t, err)
+		req.Header.Set("Signature", fmt.Sprintf(`keyId="https://b.example/ap/users/bob#main-key",headers="%s",signature="%s"`, headers, base64.StdEncoding.EncodeToString(sig)))
+		assert.Error(t, federation.VerifyRequest(req, body, &key.PublicKey), headers)
+	}
+}
+
+// Two local instances: bob on B follows alice on A, alice posts and the
+// note ends up in bob's home timeline on B.
+func TestFederationBetweenInstances(t *testing.T) {
+	a := newInstance(t, "instanceA")
+	b := newInstance(t, "instanceB")
+	alice := a.createUser(t, "alice")
+	bob := b.createUser(t, "bob")
+
+	// B resolves alice and stores her as a remote user
+	remote, err := b.fed.ResolveHandle("alice@" + a.host())
+	require.NoError(t, err)
+	assert.Equal(t, a.server.URL+"/ap/users/alice", remote.Actor_uri)
+
+	// bob follows alice, the follower row is written like for local follows
+	require.NoError(t, b.db.Create(&models.Follower{Who_id: bob.User_id, Whom_id: remote.User_id}).Error)
+	require.NoError(t, b.fed.SendFollow(bob.User_id, bob.Username, remote))
+
+	// A now knows bob as a remote follower of alice
+	var followers []int
+	a.db.Table("followers").Where("whom_id = ?", alice.User_id).Pluck("who_id", &followers)
+	require.Len(t, followers, 1)
+	bobOnA, isRemote := a.fed.IsRemote(followers[0])
+	require.True(t, isRemote)
+	assert.Equal(t, b.server.URL+"/ap/users/bob", bobOnA.Actor_uri)
+
+	// alice posts, the note is delivered to B
+	message := models.Message{Author_id: uint(alice.User_id), Text: "Hello fediverse", Pub_date: time.Now().Unix()}
+	require.NoError(t, a.db.Create(&message).Error)
+	require.NoError(t, a.fed.DeliverNote(message))
+
+	timeline, err := db.QueryTimeline(b.db, bob.User_id)
+	require.NoError(t, err)
+	require.Len(t, timeline, 1)
+	assert.Equal(t, "Hello fediverse", timeline[0].Text)
+	assert.Equal(t, "alice@"+a.host(), timeline[0].Author)
+
+	// a second delivery of the same note is ignored
+	require.NoError(t, a.fed.DeliverNote(message))
+	timeline, err = db.QueryTimeline(b.db, bob.User_id)
+	require.NoError(t, err)
+	assert.Len(t, timeline, 1)
+
+	// outbox lists alice's note
+	resp, err := http.Get(a.server.URL + "/ap/users/alice/outbox")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var outbox federation.OrderedCollection
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&outbox))
+	require.Equal(t, 1, outbox.TotalItems)
+	assert.Equal(t, "Create", outbox.OrderedItems[0].Type)
+
+	// bob unfollows, A removes the follower row
+	require.NoError(t, b.fed.SendUnfollow(bob.User_id, bob.Username, remote))
+	var count int64
+	a.db.Table("followers").Where("whom_id = ?", alice.User_id).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+// With a queue the Accept and the notes are sent by jobs, a failed
+// delivery stays queued for a retry.
+func TestDeliveriesAreQueued(t *testing.T) {
+	a := newInstance(t, "queuedA")
+	b := newInstance(t, "queuedB")
+	alice := a.createUser(t, "alice")
+	bob := b.createUser(t, "bob")
+	queue := jobs.NewMemoryQueue()
+	a.fed.Queue = queue
+	pool := jobs.NewPool(queue, 1)
+	a.fed.RegisterJobs(pool)
+	queued := func() []jobs.Stat {
+		stats, err := queue.Stats(context.Background())
+		require.NoError(t, err)
+		return stats
+	}
+
+	remote, err := b.fed.ResolveHandle("alice@" + a.host())
+	require.NoError(t, err)
+	require.NoError(t, b.db.Create(&models.Follower{Who_id: bob.User_id, Whom_id: remote.User_id}).Error)
+	require.NoError(t, b.fed.SendFollow(bob.User_id, bob.Username, remote))
+	assert.Equal(t, []jobs.Stat{{Kind: federation.DeliveryJobKind, State: jobs.StateQueued, Count: 1}}, queued())
+	require.True(t, pool.RunOne(context.Background()))
+	assert.Empty(t, queued())
+
+	// the note job queues a delivery for every inbox
+	message := models.Message{Author_id: uint(alice.User_id), Text: "Hello fediverse", Pub_date: time.Now().Unix()}
+	require.NoError(t, a.db.Create(&message).Error)
+	a.fed.Deliver(message)
+	assert.Equal(t, []jobs.Stat{{Kind: federation.NoteJobKind, State: jobs.StateQueued, Count: 1}}, queued())
+	require.True(t, pool.RunOne(context.Background()))
+	assert.Equal(t, []jobs.Stat{{Kind: federation.DeliveryJobKind, State: jobs.StateQueued, Count: 1}}, queued())
+	require.True(t, pool.RunOne(context.Background()))
+	timeline, err := db.QueryTimeline(b.db, bob.User_id)
+	require.NoError(t, err)
+	require.Len(t, timeline, 1)
+	assert.Equal(t, "Hello fediverse", timeline[0].Text)
+
+	// B is down, the delivery is retried later
+	b.server.Close()
+	message = models.Message{Author_id: uint(alice.User_id), Text: "Anyone there?", Pub_date: time.Now().Unix()}
+	require.NoError(t, a.db.Create(&message).Error)
+	a.fed.Deliver(message)
+	require.True(t, pool.RunOne(context.Background()))
+	require.True(t, pool.RunOne(context.Background()))
+	assert.Equal(t, []jobs.Stat{{Kind: federation.DeliveryJobKind, State: jobs.StateQueued, Count: 1}}, queued())
+}
+
+// fakeActor serves the actor document of a server we hold the key of
+type fakeActor struct {
+	uri string
+	key *rsa.PrivateKey
+}
+
+func newFakeActor(t *testing.T) *fakeActor {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pubPem := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	actor := &fakeActor{key: key}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/activity+json")
+		json.NewEncoder(w).Encode(federation.Actor{
+			ID:                actor.uri,
+			Type:              "Person",
+			PreferredUsername: "mallory",
+			Inbox:             actor.uri + "/inbox",
+			PublicKey:         federation.PublicKey{ID: actor.uri + "#main-key", Owner: actor.uri, PublicKeyPem: pubPem},
+		})
+	}))
+	t.Cleanup(server.Close)
+	actor.uri = server.URL + "/ap/users/mallory"
+	return actor
+}
+
+// post signs activity with key and sends it to inbox
+func (f *fakeActor) post(t *testing.T, inbox string, activity federation.Activity, key *rsa.PrivateKey) int {
+	body, err := json.Marshal(activity)
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", inbox, strings.NewReader(string(body)))
+	require.NoError(t, err)
+	require.NoError(t, federation.SignRequest(req, body, f.uri+"#main-key", key))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (f *fakeActor) note(id, content string) federation.Activity {
+	return federation.Activity{
+		Type:   "Create",
+		Actor:  f.uri,
+		Object: federation.Activity{ID: f.uri + "/notes/" + id, Type: "Note", AttributedTo: f.uri, Content: content},
+	}
+}
+
+func TestInboxOnlyFetchesPublicAddresses(t *testing.T) {
+	a := newInstance(t, "privateaddresses")
+	a.createUser(t, "alice")
+	// a real instance, the inbox must not reach the loopback servers
+	a.fed.Client = federation.New(a.db, a.server.URL).Client
+
+	var fetched int
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+	}))
+	defer internal.Close()
+	mallory := newFakeActor(t)
+	mallory.uri = internal.URL + "/admin"
+	assert.Equal(t, http.StatusUnauthorized, mallory.post(t, a.server.URL+"/ap/users/alice/inbox", mallory.note("1", "hi"), mallory.key))
+	assert.Zero(t, fetched)
+
+	for _, uri := range []string{"file:///etc/passwd", "gopher://example.com/x", "http://169.254.169.254/latest/meta-data"} {
+		mallory.uri = uri
+		assert.Equal(t, http.StatusUnauthorized, mallory.post(t, a.server.URL+"/ap/users/alice/inbox", mallory.note("1", "hi"), mallory.key), uri)
+	}
+	var users int64
+	a.db.Model(&models.User{}).Count(&users)
+	assert.Equal(t, int64(1), users)
+}
+
+func TestInboxStoresOnlyVerifiedActors(t *testing.T) {
+	a := newInstance(t, "verifiedactors")
+	alice := a.createUser(t, "alice")
+	inbox := a.server.URL + "/ap/users/alice/inbox"
+	mallory := newFakeActor(t)
+	remoteUsers := func() int64 {
+		var count int64
+		a.db.Model(&models.RemoteActor{}).Count(&count)
+		return count
+	}
+
+	// signed with a key that is not in the actor document
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, mallory.post(t, inbox, mallory.note("1", "hi"), other))
+	assert.Zero(t, remoteUsers())
+
+	// a valid signature stores the actor, but nobody follows it yet
+	assert.Equal(t, http.StatusForbidden, mallory.post(t, inbox, mallory.note("1", "hi"), mallory.key))
+	require.Equal(t, int64(1), remoteUsers())
+	var messages int64
+	a.db.Model(&models.Message{}).Count(&messages)
+	assert.Zero(t, messages)
+
+	var remote models.RemoteActor
+	require.NoError(t, a.db.Where("actor_uri = ?", mallory.uri).First(&remote).Error)
+	require.NoError(t, a.db.Create(&models.Follower{Who_id: alice.User_id, Whom_id: remote.User_id}).Error)
+	assert.Equal(t, http.StatusAccepted, mallory.post(t, inbox, mallory.note("2", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>"), mallory.key))
+
+	// the note is stored as text and escaped when it is shown
+	var message models.Message
+	require.NoError(t, a.db.Where("author_id = ?", remote.User_id).First(&message).Error)
+	assert.Equal(t, "<script>alert(1)</script>", message.Text)
+	rec := httptest.NewRecorder()
+	handlers.PublicTimelineHandler(a.db, config.Default(), service.New(config.Default()))(rec, httptest.NewRequest("GET", "/public", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "<script>")
+	assert.Contains(t, rec.Body.String(), "&lt;script&gt;alert(1)&lt;/script&gt;")
+}
@@ -0,0 +1,215 @@
+package follows_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"minitwit/apiv2"
+	"minitwit/config"
+	"minitwit/handlers"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var svc = service.New(config.Default())
+
+func setupDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}, &models.TimelineEntry{}, &models.PopularAuthor{}))
+	return database
+}
+
+func register(t *testing.T, database *gorm.DB, names ...string) map[string]int {
+	ids := make(map[string]int)
+	for _, name := range names {
+		user, err := service.RegisterUser(database, name, name+"@example.com", "secret")
+		require.NoError(t, err)
+		ids[name] = user.User_id
+	}
+	return ids
+}
+
+// router has the follow lists of the web app and of API v2
+func router(database *gorm.DB, perPage int) *mux.Router {
+	cfg := config.Default()
+	cfg.PerPage = perPage
+	r := mux.NewRouter()
+	apiv2.Register(r, database, svc)
+	r.HandleFunc("/login", handlers.LoginHandler(database, nil)).Methods("GET", "POST")
+	r.HandleFunc("/{username}", handlers.UserTimelineHandler(database, cfg, svc)).Methods("GET")
+	r.HandleFunc("/{username}/followers", handlers.FollowersHandler(database, cfg)).Methods("GET")
+	r.HandleFunc("/{username}/following", handlers.FollowingHandler(database, cfg)).Methods("GET")
+	r.HandleFunc("/{username}/follow", handlers.FollowHandler(database, svc)).Methods("GET", "POST")
+	r.HandleFunc("/{username}/unfollow", handlers.UnfollowHandler(database, svc)).Methods("GET", "POST")
+	return r
+}
+
+// client keeps the session cookie between requests
+type client struct {
+	r       *mux.Router
+	cookies []*http.Cookie
+}
+
+func (c *client) get(path string) *httptest.ResponseRecorder {
+	return c.do("GET", path, nil)
+}
+
+func (c *client) do(method, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c.r.ServeHTTP(rec, req)
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		c.cookies = cookies
+	}
+	return rec
+}
+
+func login(t *testing.T, r *mux.Router, username string) *client {
+	c := &client{r: r}
+	rec := c.do("POST", "/login", url.Values{"username": {username}, "password": {"secret"}})
+	require.Equal(t, http.StatusFound, rec.Code)
+	return c
+}
+
+var (
+	listedUser = regexp.MustCompile(`<strong><a href="/(\w+)">`)
+	nextPage   = regexp.MustCompile(`href="(/\w+/\w+\?cursor=[^"]+)"`)
+)
+
+// listed returns the users of a list page and the link to the next one
+func listed(t *testing.T, rec *httptest.ResponseRecorder) ([]string, string) {
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	var names []string
+	for _, m := range listedUser.FindAllStringSubmatch(body, -1) {
+		names = append(names, m[1])
+	}
+	next := ""
+	if m := nextPage.FindStringSubmatch(body); m != nil {
+		next = m[1]
+	}
+	return names, next
+}
+
+func TestFollowListPages(t *testing.T) {
+	database := setupDB(t)
+	ids := register(t, database, "alice", "bob", "carol", "dave")
+	for _, name := range []string{"bob", "carol", "dave"} {
+		require.NoError(t, svc.Follow(database, ids[name], ids["alice"]))
+	}
+	require.NoError(t, svc.Follow(database, ids["alice"], ids["carol"]))
+	register(t, database, "erin")
+	r := router(database, 2)
+	anonymous := &client{r: r}
+
+	// ordered by user id, two per page
+	names, next := listed(t, anonymous.get("/alice/followers"))
+	assert.Equal(t, []string{"bob", "carol"}, names)
+	require.NotEmpty(t, next)
+	names, next = listed(t, anonymous.get(next))
+	assert.Equal(t, []string{"dave"}, names)
+	assert.Empty(t, next)
+
+	names, _ = listed(t, anonymous.get("/alice/following"))
+	assert.Equal(t, []string{"carol"}, names)
+	assert.Contains(t, anonymous.get("/bob/followers").Body.String(), "Nobody follows bob yet")
+	assert.Contains(t, anonymous.get("/erin/following").Body.String(), "erin does not follow anybody yet")
+	assert.NotContains(t, anonymous.get("/alice/followers").Body.String(), "/follow\"")
+
+	assert.Equal(t, http.StatusBadRequest, anonymous.get("/nobody/followers").Code)
+	assert.Equal(t, http.StatusBadRequest, anonymous.get("/alice/followers?cursor=nonsense").Code)
+
+	profile := anonymous.get("/alice").Body.String()
+	assert.Contains(t, profile, `<a href="/alice/followers"><strong>3</strong> followers</a>`)
+	assert.Contains(t, profile, `<a href="/alice/following"><strong>1</strong> following</a>`)
+}
+
+func TestFollowListPagesShowViewerFollows(t *testing.T) {
+	database := setupDB(t)
+	ids := register(t, database, "alice", "bob", "carol")
+	require.NoError(t, svc.Follow(database, ids["bob"], ids["alice"]))
+	require.NoError(t, svc.Follow(database, ids["carol"], ids["alice"]))
+	r := router(database, 10)
+	bob := login(t, r, "bob")
+
+	page := bob.get("/alice/followers").Body.String()
+	assert.Contains(t, page, "This is you!")
+	assert.Contains(t, page, `<a class="follow" href="/carol/follow">Follow</a>`)
+	assert.NotContains(t, page, `href="/bob/follow"`)
+
+	assert.Equal(t, http.StatusFound, bob.do("POST", "/carol/follow", nil).Code)
+	page = bob.get("/alice/followers").Body.String()
+	assert.Contains(t, page, `<a class="unfollow" href="/carol/unfollow">Unfollow</a>`)
+
+	page = bob.get("/bob/following").Body.String()
+	assert.Contains(t, page, `<a class="unfollow" href="/alice/unfollow">Unfollow</a>`)
+	assert.Contains(t, page, `<a class="unfollow" href="/carol/unfollow">Unfollow</a>`)
+}
+
+func apiList(t *testing.T, r *mux.Router, path string, username string) (int, apiv2.List[apiv2.User]) {
+	req := httptest.NewRequest("GET", path, nil)
+	if username != "" {
+		req.SetBasicAuth(username, "secret")
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	var list apiv2.List[apiv2.User]
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&list))
+	}
+	return rec.Code, list
+}
+
+func TestFollowListsAPIShowViewerFollows(t *testing.T) {
+	database := setupDB(t)
+	ids := register(t, database, "alice", "bob", "carol")
+	require.NoError(t, svc.Follow(database, ids["bob"], ids["alice"]))
+	require.NoError(t, svc.Follow(database, ids["carol"], ids["alice"]))
+	require.NoError(t, svc.Follow(database, ids["bob"], ids["carol"]))
+	r := router(database, 10)
+
+	// without credentials nobody is followed or not
+	code, list := apiList(t, r, "/api/v2/users/alice/followers", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, list.Items, 2)
+	for _, user := range list.Items {
+		assert.Nil(t, user.Followed)
+	}
+
+	followed := func(list apiv2.List[apiv2.User]) map[string]bool {
+		m := make(map[string]bool)
+		for _, user := range list.Items {
+			require.NotNil(t, user.Followed, user.Username)
+			m[user.Username] = *user.Followed
+		}
+		return m
+	}
+	code, list = apiList(t, r, "/api/v2/users/alice/followers", "bob")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]bool{"bob": false, "carol": true}, followed(list))
+
+	code, list = apiList(t, r, "/api/v2/users/bob/following", "alice")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]bool{"alice": false, "carol": false}, followed(list))
+
+	code, _ = apiList(t, r, "/api/v2/users/alice/followers", "nobody")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
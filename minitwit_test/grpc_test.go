@@ -0,0 +1,205 @@
+package grpc_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"minitwit/api"
+	"minitwit/config"
+	"minitwit/grpcapi"
+	pb "minitwit/grpcapi/minitwitv1"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const simulatorAuth = "Basic c2ltdWxhdG9yOnN1cGVyX3NhZmUh"
+
+// setupClient returns a client of a new server and the file of its latest
+// id
+func setupClient(t *testing.T) (pb.MiniTwitClient, api.LatestFile) {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}))
+
+	cfg := config.Default()
+	cfg.API.LatestFile = filepath.Join(t.TempDir(), "latest_processed_sim_action_id.txt")
+	require.NoError(t, os.WriteFile(cfg.API.LatestFile, []byte("0"), 0644))
+
+	lis := bufconn.Listen(1024 * 1024)
+	server := grpcapi.NewServer(database, cfg, service.New(cfg))
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewMiniTwitClient(conn), api.LatestFile(cfg.API.LatestFile)
+}
+
+func simulatorContext() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", simulatorAuth)
+}
+
+func readTimeline(t *testing.T, client pb.MiniTwitClient, req *pb.GetTimelineRequest) []string {
+	stream, err := client.GetTimeline(simulatorContext(), req)
+	require.NoError(t, err)
+	var contents []string
+	for {
+		m, err := stream.Recv()
+		if err == io.EOF {
+			return contents
+		}
+		require.NoError(t, err)
+		contents = append(contents, m.GetUsername()+": "+m.GetContent())
+	}
+}
+
+func TestGRPCSimulatorFlow(t *testing.T) {
+	client, latestFile := setupClient(t)
+	ctx := simulatorContext()
+
+	alice, err := client.RegisterUser(ctx, &pb.RegisterUserRequest{Username: "alice", Email: "alice@example.com", Password: "secret", Latest: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "alice", alice.GetUsername())
+	_, err = client.RegisterUser(ctx, &pb.RegisterUserRequest{Username: "bob", Email: "bob@example.com", Password: "secret", Latest: 2})
+	require.NoError(t, err)
+	_, err = client.RegisterUser(ctx, &pb.RegisterUserRequest{Username: "carol", Email: "carol@example.com", Password: "secret"})
+	require.NoError(t, err)
+
+	_, err = client.PostMessage(ctx, &pb.PostMessageRequest{Username: "bob", Content: "hello from bob", Latest: 3})
+	require.NoError(t, err)
+	message, err := client.PostMessage(ctx, &pb.PostMessageRequest{Username: "carol", Content: "hello from carol"})
+	require.NoError(t, err)
+	assert.Equal(t, "carol", message.GetUsername())
+
+	_, err = client.Follow(ctx, &pb.FollowRequest{Username: "alice", Target: "bob", Latest: 4})
+	require.NoError(t, err)
+	// following twice is fine, like in the simulator API
+	_, err = client.Follow(ctx, &pb.FollowRequest{Username: "alice", Target: "bob"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"bob: hello from bob"}, readTimeline(t, client, &pb.GetTimelineRequest{Username: "alice"}))
+	assert.Equal(t, []string{"carol: hello from carol", "bob: hello from bob"}, readTimeline(t, client, &pb.GetTimelineRequest{}))
+	assert.Len(t, readTimeline(t, client, &pb.GetTimelineRequest{Limit: 1}), 1)
+
+	_, err = client.Unfollow(ctx, &pb.FollowRequest{Username: "alice", Target: "bob", Latest: 5})
+	require.NoError(t, err)
+	assert.Empty(t, readTimeline(t, client, &pb.GetTimelineRequest{Username: "alice"}))
+
+	latest, err := client.GetLatest(ctx, &pb.GetLatestRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), latest.GetLatest())
+	// the simulator API sees the same value
+	apiLatest, err := latestFile.Read()
+	require.NoError(t, err)
+	assert.Equal(t, 5, apiLatest)
+}
+
+func TestGRPCTimelineLimit(t *testing.T) {
+	client, _ := setupClient(t)
+	ctx := simulatorContext()
+	_, err := client.RegisterUser(ctx, &pb.RegisterUserRequest{Username: "alice", Email: "alice@example.com", Password: "secret"})
+	require.NoError(t, err)
+	for i := 0; i < 101; i++ {
+		_, err := client.PostMessage(ctx, &pb.PostMessageRequest{Username: "alice", Content: fmt.Sprint(i)})
+		require.NoError(t, err)
+	}
+
+	// larger limits are capped like in API v2
+	assert.Len(t, readTimeline(t, client, &pb.GetTimelineRequest{Limit: 1000000}), 100)
+	assert.Len(t, readTimeline(t, client, &pb.GetTimelineRequest{}), 100)
+}
+
+func TestGRPCErrors(t *testing.T) {
+	client, _ := setupClient(t)
+	ctx := simulatorContext()
+
+	_, err := client.GetLatest(context.Background(), &pb.GetLatestRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.RegisterUser(ctx, &pb.RegisterUserRequest{Username: "alice", Email: "invalid", Password: "secret"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "You have to enter a valid email address", status.Convert(err).Message())
+
+	_, err = client.RegisterUser(ctx, &pb.RegisterUserRequest{Username: "alice", Email: "alice@example.com", Password: "secret"})
+	require.NoError(t, err)
+	_, err = client.RegisterUser(ctx, &pb.RegisterUserRequest{Username: "alice", Email: "alice@example.com", Password: "secret"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	_, err = client.PostMessage(ctx, &pb.PostMessageRequest{Username: "nobody", Content: "hi"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Follow(ctx, &pb.FollowRequest{Username: "alice", Target: "nobody"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	stream, err := client.GetTimeline(ctx, &pb.GetTimelineRequest{Username: "nobody"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGRPCMetrics(t *testing.T) {
+	client, _ := setupClient(t)
+	ctx := simulatorContext()
+
+	counter := func(method, code string) float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() != "http_requests_total" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				labels := map[string]string{}
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				if labels["path"] == method && labels["method"] == "GRPC" && labels["status"] == code {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+		return 0
+	}
+
+	// the registry is shared with the other tests, compare against the counts before
+	registered := counter(pb.MiniTwit_RegisterUser_FullMethodName, "200")
+	notFound := counter(pb.MiniTwit_PostMessage_FullMethodName, "404")
+	streamed := counter(pb.MiniTwit_GetTimeline_FullMethodName, "200")
+
+	_, err := client.RegisterUser(ctx, &pb.RegisterUserRequest{Username: "alice", Email: "alice@example.com", Password: "secret"})
+	require.NoError(t, err)
+	_, err = client.PostMessage(ctx, &pb.PostMessageRequest{Username: "nobody", Content: "hi"})
+	require.Error(t, err)
+	readTimeline(t, client, &pb.GetTimelineRequest{})
+
+	assert.Equal(t, registered+1, counter(pb.MiniTwit_RegisterUser_FullMethodName, "200"))
+	assert.Equal(t, notFound+1, counter(pb.MiniTwit_PostMessage_FullMethodName, "404"))
+	assert.Equal(t, streamed+1, counter(pb.MiniTwit_GetTimeline_FullMethodName, "200"))
+
+	count, err := testutil.GatherAndCount(prometheus.DefaultGatherer, "http_request_duration_seconds", "http_response_messages_total")
+	require.NoError(t, err)
+	assert.Positive(t, count)
+}
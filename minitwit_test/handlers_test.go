@@ -10,13 +10,17 @@ import (
 	"strings"
 	"testing"
 
+	"minitwit/config"
 	"minitwit/handlers"
 	"minitwit/models"
+	"minitwit/service"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 )
 
+var svc = service.New(config.Default())
+
 const (
 	testEmail    = "test@example.com"
 	testUsername = "testuser"
@@ -58,7 +62,7 @@ func TestAddMessageHandlerNotLoggedIn(t *testing.T) {
 	req := createFormRequest("POST", "/add_message", formValues)
 	rec := httptest.NewRecorder()
 
-	handlers.AddMessageHandler(nil)(rec, req)
+	handlers.AddMessageHandler(nil, svc)(rec, req)
 
 	assert.Equal(t, http.StatusBadRequest, rec.Code)
 }
@@ -75,7 +79,7 @@ func TestRegisterHandlerValidationErrors(t *testing.T) {
 		req := createFormRequest("POST", "/register", formValues)
 		rec := httptest.NewRecorder()
 
-		handlers.RegisterHandler(nil)(rec, req)
+		handlers.RegisterHandler(nil, svc)(rec, req)
 
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
 	})
@@ -91,7 +95,7 @@ func TestRegisterHandlerValidationErrors(t *testing.T) {
 		req := createFormRequest("POST", "/register", formValues)
 		rec := httptest.NewRecorder()
 
-		handlers.RegisterHandler(nil)(rec, req)
+		handlers.RegisterHandler(nil, svc)(rec, req)
 
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
 	})
@@ -107,7 +111,7 @@ func TestRegisterHandlerValidationErrors(t *testing.T) {
 		req := createFormRequest("POST", "/register", formValues)
 		rec := httptest.NewRecorder()
 
-		handlers.RegisterHandler(nil)(rec, req)
+		handlers.RegisterHandler(nil, svc)(rec, req)
 
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
 	})
@@ -119,7 +123,7 @@ func TestFollowHandlerNotLoggedIn(t *testing.T) {
 	req = addRouteParams(req, map[string]string{"username": "user"})
 	rec := httptest.NewRecorder()
 
-	handlers.FollowHandler(nil)(rec, req)
+	handlers.FollowHandler(nil, svc)(rec, req)
 
 	assert.Equal(t, http.StatusFound, rec.Code)
 	assert.Equal(t, "/login", rec.Header().Get("Location"))
@@ -131,7 +135,7 @@ func TestUnfollowHandlerNotLoggedIn(t *testing.T) {
 	req = addRouteParams(req, map[string]string{"username": "user"})
 	rec := httptest.NewRecorder()
 
-	handlers.UnfollowHandler(nil)(rec, req)
+	handlers.UnfollowHandler(nil, svc)(rec, req)
 
 	assert.Equal(t, http.StatusFound, rec.Code)
 	assert.Equal(t, "/login", rec.Header().Get("Location"))
@@ -142,7 +146,7 @@ func TestTimelineHandlerNotLoggedIn(t *testing.T) {
 	req := httptest.NewRequest("GET", "/", nil)
 	rec := httptest.NewRecorder()
 
-	handlers.TimelineHandler(nil)(rec, req)
+	handlers.TimelineHandler(nil, config.Default(), svc)(rec, req)
 
 	assert.Equal(t, http.StatusFound, rec.Code)
 	assert.Equal(t, "/public", rec.Header().Get("Location"))
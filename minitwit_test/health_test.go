@@ -0,0 +1,124 @@
+package health_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"minitwit/db"
+	"minitwit/health"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func openDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	require.NoError(t, err)
+	return database
+}
+
+func migrate(t *testing.T, database *gorm.DB) {
+	require.NoError(t, database.AutoMigrate(db.Models...))
+	require.NoError(t, db.MigrateFollowers(database))
+}
+
+// captureLogs sends the default logger to the returned buffer for the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func get(t *testing.T, handler http.HandlerFunc) (int, health.Response) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.NotContains(t, rec.Body.String(), "error", "errors are only logged")
+	var response health.Response
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	return rec.Code, response
+}
+
+func TestLiveness(t *testing.T) {
+	code, response := get(t, health.Liveness())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOK, response.Status)
+	assert.NotEmpty(t, response.Uptime)
+}
+
+func TestReadiness(t *testing.T) {
+	database := openDB(t)
+	migrate(t, database)
+
+	code, response := get(t, health.Readiness(database))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOK, response.Status)
+	assert.Equal(t, health.StatusOK, response.Checks["database"].Status)
+	assert.Equal(t, health.StatusOK, response.Checks["migrations"].Status)
+	require.NotNil(t, response.Pool)
+	assert.Equal(t, health.StatusOK, response.Pool.Status)
+}
+
+func TestReadinessFailsWithoutMigrations(t *testing.T) {
+	database := openDB(t)
+	logs := captureLogs(t)
+
+	code, response := get(t, health.Readiness(database))
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, health.StatusFailed, response.Status)
+	assert.Equal(t, health.StatusOK, response.Checks["database"].Status)
+	assert.Equal(t, health.StatusFailed, response.Checks["migrations"].Status)
+	assert.Contains(t, logs.String(), "is missing")
+
+	// passes once the tables exist
+	migrate(t, database)
+	code, _ = get(t, health.Readiness(database))
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestReadinessFailsWhenDatabaseIsDown(t *testing.T) {
+	database := openDB(t)
+	migrate(t, database)
+	readiness := health.Readiness(database)
+	logs := captureLogs(t)
+
+	sqlDB, err := database.DB()
+	require.NoError(t, err)
+	require.NoError(t, sqlDB.Close())
+
+	code, response := get(t, readiness)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, health.StatusFailed, response.Checks["database"].Status)
+	assert.Contains(t, logs.String(), "check=database")
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	attempts := 0
+	database, err := db.ConnectWithRetry(func() (*gorm.DB, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return openDB(t), nil
+	}, time.Minute)
+	require.NoError(t, err)
+	assert.NotNil(t, database)
+	assert.Equal(t, 3, attempts)
+
+	// gives up with the last error after the timeout
+	_, err = db.ConnectWithRetry(func() (*gorm.DB, error) {
+		return nil, errors.New("connection refused")
+	}, time.Second)
+	assert.EqualError(t, err, "connection refused")
+}
@@ -0,0 +1,324 @@
+package jobs_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"minitwit/config"
+	"minitwit/jobs"
+	"minitwit/metrics"
+	"minitwit/models"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var ctx = context.Background()
+
+func setupDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.Job{}))
+	return database
+}
+
+// queues runs test with both backends
+func queues(t *testing.T, test func(t *testing.T, queue jobs.Queue)) {
+	t.Run("memory", func(t *testing.T) { test(t, jobs.NewMemoryQueue()) })
+	t.Run("postgres", func(t *testing.T) { test(t, jobs.NewDBQueue(setupDB(t))) })
+}
+
+func claim(t *testing.T, queue jobs.Queue, now time.Time) *jobs.Job {
+	job, err := queue.Claim(ctx, []string{"a", "b"}, now, time.Minute)
+	require.NoError(t, err)
+	return job
+}
+
+func stats(t *testing.T, queue jobs.Queue) map[string]int64 {
+	list, err := queue.Stats(ctx)
+	require.NoError(t, err)
+	counts := map[string]int64{}
+	for _, s := range list {
+		counts[s.Kind+" "+s.State] = s.Count
+	}
+	return counts
+}
+
+func TestQueueClaim(t *testing.T) {
+	queues(t, func(t *testing.T, queue jobs.Queue) {
+		now := time.Now()
+		require.NoError(t, jobs.Enqueue(ctx, queue, "a", map[string]int{"n": 1}, jobs.At(now.Add(time.Second))))
+		require.NoError(t, jobs.Enqueue(ctx, queue, "b", map[string]int{"n": 2}, jobs.At(now)))
+		require.NoError(t, jobs.Enqueue(ctx, queue, "c", nil, jobs.At(now)))
+		require.NoError(t, jobs.Enqueue(ctx, queue, "a", map[string]int{"n": 3}, jobs.After(time.Hour)))
+
+		// the due jobs of the claimed kinds, the oldest first
+		job := claim(t, queue, now)
+		require.NotNil(t, job)
+		assert.Equal(t, "b", job.Kind)
+		assert.Equal(t, 1, job.Attempt)
+		assert.Equal(t, jobs.DefaultMaxAttempts, job.MaxAttempts)
+		var payload struct{ N int }
+		require.NoError(t, job.Decode(&payload))
+		assert.Equal(t, 2, payload.N)
+		assert.Nil(t, claim(t, queue, now))
+
+		first := claim(t, queue, now.Add(time.Second))
+		require.NotNil(t, first)
+		require.NoError(t, first.Decode(&payload))
+		assert.Equal(t, 1, payload.N)
+		require.NoError(t, queue.Complete(ctx, first, now))
+		assert.Nil(t, claim(t, queue, now.Add(time.Second)))
+
+		// a job whose worker died runs again after its lease
+		again := claim(t, queue, now.Add(2*time.Minute))
+		require.NotNil(t, again)
+		assert.Equal(t, job.ID, again.ID)
+		assert.Equal(t, 2, again.Attempt)
+		require.NoError(t, queue.Complete(ctx, again, now))
+
+		assert.Equal(t, map[string]int64{"a queued": 1, "c queued": 1}, stats(t, queue))
+	})
+}
+
+func TestQueueUnique(t *testing.T) {
+	queues(t, func(t *testing.T, queue jobs.Queue) {
+		now := time.Now()
+		for i := 0; i < 3; i++ {
+			require.NoError(t, jobs.Enqueue(ctx, queue, "a", i, jobs.Unique("once"), jobs.At(now)))
+		}
+		job := claim(t, queue, now)
+		require.NotNil(t, job)
+		assert.Equal(t, "once", job.Unique)
+		assert.Equal(t, []byte("0"), job.Payload)
+		require.NoError(t, queue.Complete(ctx, job, now))
+		assert.Nil(t, claim(t, queue, now))
+
+		// a done unique job keeps its key until it is cleaned up
+		require.NoError(t, jobs.Enqueue(ctx, queue, "a", 3, jobs.Unique("once"), jobs.At(now)))
+		assert.Nil(t, claim(t, queue, now))
+		deleted, err := queue.Cleanup(ctx, now)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), deleted)
+		deleted, err = queue.Cleanup(ctx, now.Add(time.Millisecond))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), deleted)
+		require.NoError(t, jobs.Enqueue(ctx, queue, "a", 4, jobs.Unique("once"), jobs.At(now)))
+		assert.NotNil(t, claim(t, queue, now))
+	})
+}
+
+func TestQueueRetryAndFail(t *testing.T) {
+	queues(t, func(t *testing.T, queue jobs.Queue) {
+		now := time.Now()
+		require.NoError(t, jobs.Enqueue(ctx, queue, "a", nil, jobs.At(now), jobs.MaxAttempts(2)))
+		job := claim(t, queue, now)
+		require.NotNil(t, job)
+		require.NoError(t, queue.Retry(ctx, job, now.Add(time.Second), errors.New("boom")))
+		assert.Nil(t, claim(t, queue, now))
+
+		job = claim(t, queue, now.Add(time.Second))
+		require.NotNil(t, job)
+		assert.Equal(t, 2, job.Attempt)
+		require.NoError(t, queue.Fail(ctx, job, now, errors.New("boom")))
+		assert.Nil(t, claim(t, queue, now.Add(time.Hour)))
+		assert.Equal(t, map[string]int64{"a dead": 1}, stats(t, queue))
+
+		deleted, err := queue.Cleanup(ctx, now.Add(time.Millisecond))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), deleted)
+		assert.Empty(t, stats(t, queue))
+	})
+}
+
+func TestDBQueueKeepsErrors(t *testing.T) {
+	database := setupDB(t)
+	queue := jobs.NewDBQueue(database)
+	now := time.Now()
+	require.NoError(t, jobs.Enqueue(ctx, queue, "a", nil, jobs.At(now)))
+	job := claim(t, queue, now)
+	require.NoError(t, queue.Fail(ctx, job, now, errors.New("boom")))
+
+	var row models.Job
+	require.NoError(t, database.First(&row, job.ID).Error)
+	assert.Equal(t, jobs.StateDead, row.State)
+	assert.Equal(t, "boom", row.Last_error)
+	assert.Equal(t, int64(0), row.Locked_until)
+	assert.Equal(t, now.UnixMilli(), row.Finished_at)
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 10*time.Second, jobs.Backoff(1))
+	assert.Equal(t, 20*time.Second, jobs.Backoff(2))
+	assert.Equal(t, 80*time.Second, jobs.Backoff(4))
+	assert.Equal(t, time.Hour, jobs.Backoff(10))
+	assert.Equal(t, time.Hour, jobs.Backoff(100))
+}
+
+func TestParseSchedule(t *testing.T) {
+	from := time.Date(2024, 1, 31, 10, 17, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 10, 30, 0, 0, time.UTC)},
+		{"5,20 * * * *", time.Date(2024, 1, 31, 10, 20, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 9-17/4 * * *", time.Date(2024, 1, 31, 13, 30, 0, 0, time.UTC)},
+		{"0 7 * * 1-5", time.Date(2024, 2, 1, 7, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)},
+		// restricted day of month and day of week match either
+		{"0 0 15 * 5", time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{"@every 10m", time.Date(2024, 1, 31, 10, 20, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		schedule, err := jobs.ParseSchedule(test.spec)
+		require.NoError(t, err, test.spec)
+		assert.Equal(t, test.want, schedule.Next(from), test.spec)
+	}
+
+	never, err := jobs.ParseSchedule("0 0 31 2 *")
+	require.NoError(t, err)
+	assert.True(t, never.Next(from).IsZero())
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@every 1ms", "@yearly"} {
+		_, err := jobs.ParseSchedule(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestPoolRunOne(t *testing.T) {
+	queue := jobs.NewMemoryQueue()
+	pool := jobs.NewPool(queue, 1)
+	var runs []string
+	handler := func(err error) jobs.Handler {
+		return func(ctx context.Context, job *jobs.Job) error {
+			runs = append(runs, job.Kind)
+			return err
+		}
+	}
+	pool.Handle("ok", handler(nil))
+	pool.Handle("flaky", handler(errors.New("try again")))
+	pool.Handle("last", handler(errors.New("try again")))
+	pool.Handle("bad", handler(jobs.Permanent(errors.New("invalid payload"))))
+	pool.Handle("panics", func(ctx context.Context, job *jobs.Job) error {
+		runs = append(runs, job.Kind)
+		panic("oops")
+	})
+	observed := testutil.CollectAndCount(metrics.JobDuration)
+	for _, kind := range []string{"ok", "flaky", "bad", "panics"} {
+		require.NoError(t, jobs.Enqueue(ctx, queue, kind, nil, jobs.MaxAttempts(2)))
+	}
+	require.NoError(t, jobs.Enqueue(ctx, queue, "last", nil, jobs.MaxAttempts(1)))
+	require.NoError(t, jobs.Enqueue(ctx, queue, "unhandled", nil))
+
+	for pool.RunOne(ctx) {
+	}
+	assert.Equal(t, []string{"ok", "flaky", "bad", "panics", "last"}, runs)
+	// the failed jobs wait for their backoff until they used their attempts
+	assert.Equal(t, map[string]int64{"flaky queued": 1, "bad dead": 1, "panics queued": 1, "last dead": 1, "unhandled queued": 1}, stats(t, queue))
+	job, err := queue.Claim(ctx, []string{"flaky"}, time.Now().Add(jobs.Backoff(1)), time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, job)
+	assert.Equal(t, 2, job.Attempt)
+
+	// ok done, flaky and panics retry, bad and last dead
+	assert.Equal(t, observed+5, testutil.CollectAndCount(metrics.JobDuration))
+}
+
+func TestPoolCron(t *testing.T) {
+	queue := jobs.NewMemoryQueue()
+	var mu sync.Mutex
+	runs := 0
+	newPool := func() *jobs.Pool {
+		pool := jobs.NewPool(queue, 1)
+		pool.Poll = 10 * time.Millisecond
+		pool.Handle("tick", func(ctx context.Context, job *jobs.Job) error {
+			mu.Lock()
+			defer mu.Unlock()
+			runs++
+			return nil
+		})
+		require.NoError(t, pool.Cron("tick", "@every 1s", "tick", nil))
+		return pool
+	}
+	assert.ErrorContains(t, newPool().Cron("never", "0 0 30 2 *", "tick", nil), "never runs")
+
+	// two pools queue each tick once
+	stopA, stopB := newPool().Start(), newPool().Start()
+	time.Sleep(2500 * time.Millisecond)
+	stopA()
+	stopB()
+	mu.Lock()
+	defer mu.Unlock()
+	assert.GreaterOrEqual(t, runs, 2)
+	assert.LessOrEqual(t, runs, 3)
+}
+
+func TestPoolDrain(t *testing.T) {
+	queue := jobs.NewMemoryQueue()
+	pool := jobs.NewPool(queue, 2)
+	pool.Poll = time.Hour
+	pool.Drain = true
+	var mu sync.Mutex
+	runs := 0
+	pool.Handle("a", func(ctx context.Context, job *jobs.Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		runs++
+		return nil
+	})
+	stop := pool.Start()
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, jobs.Enqueue(ctx, queue, "a", i))
+	}
+
+	// the idle workers only wake up to stop, then run the queued jobs
+	stop()
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 20, runs)
+	assert.Empty(t, stats(t, queue))
+}
+
+func TestCleanupHandler(t *testing.T) {
+	queue := jobs.NewMemoryQueue()
+	old := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, jobs.Enqueue(ctx, queue, "a", nil, jobs.At(old), jobs.Unique("old")))
+	job := claim(t, queue, old)
+	require.NoError(t, queue.Complete(ctx, job, old))
+	require.NoError(t, jobs.Enqueue(ctx, queue, "a", nil, jobs.Unique("new")))
+	job = claim(t, queue, time.Now())
+	require.NoError(t, queue.Fail(ctx, job, time.Now(), errors.New("boom")))
+
+	cleanup := jobs.CleanupHandler(queue, 24*time.Hour)
+	require.NoError(t, cleanup(ctx, &jobs.Job{Kind: jobs.CleanupKind}))
+	assert.Equal(t, map[string]int64{"a dead": 1}, stats(t, queue))
+}
+
+func TestFromConfig(t *testing.T) {
+	cfg := config.Default().Jobs
+	queue, err := jobs.FromConfig(cfg, nil)
+	require.NoError(t, err)
+	assert.IsType(t, &jobs.MemoryQueue{}, queue)
+	cfg.Backend = jobs.BackendPostgres
+	queue, err = jobs.FromConfig(cfg, setupDB(t))
+	require.NoError(t, err)
+	assert.IsType(t, &jobs.DBQueue{}, queue)
+	cfg.Backend = "redis"
+	_, err = jobs.FromConfig(cfg, nil)
+	assert.Error(t, err)
+}
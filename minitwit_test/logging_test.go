@@ -0,0 +1,110 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"minitwit/logging"
+	"minitwit/middleware"
+	"minitwit/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func jsonLogger(t *testing.T, buf *bytes.Buffer) *slog.Logger {
+	handler, err := logging.NewHandler(buf, "json", slog.LevelDebug)
+	require.NoError(t, err)
+	return slog.New(handler)
+}
+
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &record), line)
+		out = append(out, record)
+	}
+	return out
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := jsonLogger(t, &buf)
+	handler := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.InfoContext(r.Context(), "handled")
+	}))
+
+	// a new id is created
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	generated := rec.Header().Get("X-Request-ID")
+	assert.Len(t, generated, 32)
+
+	// the id of a proxy is kept
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "from-proxy-1")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "from-proxy-1", rec.Header().Get("X-Request-ID"))
+
+	// ids that can't be logged as they are get replaced
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "bad id\twith spaces")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Len(t, rec.Header().Get("X-Request-ID"), 32)
+
+	logged := records(t, &buf)
+	require.Len(t, logged, 3)
+	assert.Equal(t, generated, logged[0]["request_id"])
+	assert.Equal(t, "from-proxy-1", logged[1]["request_id"])
+	assert.Equal(t, "handled", logged[1]["msg"])
+}
+
+func TestGormLoggerLogsSlowQueriesWithRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	gormLogger := &logging.GormLogger{Logger: jsonLogger(t, &buf), Level: logger.Warn, SlowThreshold: time.Nanosecond}
+
+	database, err := gorm.Open(sqlite.Open("file:gorm_logger?mode=memory&cache=shared"), &gorm.Config{Logger: gormLogger})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}))
+	buf.Reset()
+
+	ctx := logging.WithRequestID(context.Background(), "req-42")
+	var users []models.User
+	require.NoError(t, database.WithContext(ctx).Where("username = ?", "alice").Find(&users).Error)
+	// not found is not an error worth logging
+	database.WithContext(ctx).Session(&gorm.Session{Logger: gormLogger.LogMode(logger.Error)}).First(&models.User{})
+
+	logged := records(t, &buf)
+	require.Len(t, logged, 1)
+	assert.Equal(t, "Slow query", logged[0]["msg"])
+	assert.Equal(t, "WARN", logged[0]["level"])
+	assert.Equal(t, "req-42", logged[0]["request_id"])
+	assert.Contains(t, logged[0]["sql"], "alice")
+}
+
+func TestLogFormats(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := logging.NewHandler(&buf, "text", slog.LevelWarn)
+	require.NoError(t, err)
+	logger := slog.New(handler)
+	logger.Info("dropped")
+	logger.WarnContext(logging.WithRequestID(context.Background(), "abc"), "kept")
+	assert.NotContains(t, buf.String(), "dropped")
+	assert.Contains(t, buf.String(), "msg=kept request_id=abc")
+
+	_, err = logging.NewHandler(&buf, "xml", slog.LevelInfo)
+	assert.Error(t, err)
+}
@@ -0,0 +1,312 @@
+package login_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"minitwit/admin"
+	"minitwit/apiv2"
+	"minitwit/config"
+	"minitwit/handlers"
+	"minitwit/metrics"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var svc = service.New(config.Default())
+
+func setupDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}))
+	_, err = service.RegisterUser(database, "alice", "alice@example.com", "secret")
+	require.NoError(t, err)
+	return database
+}
+
+func attempt(username, password, ip string) service.LoginAttempt {
+	return service.LoginAttempt{Username: username, Password: password, IP: ip, UserAgent: "test"}
+}
+
+func TestUnknownUsersLookLikeWrongPasswords(t *testing.T) {
+	database := setupDB(t)
+	now := time.Unix(1700000000, 0)
+	unknown := testutil.ToFloat64(metrics.FailedLogins.WithLabelValues(service.ReasonUnknownUser))
+
+	_, _, wrongPassword := service.Login(database, attempt("alice", "wrong", "10.0.0.1"), now)
+	_, _, unknownUser := service.Login(database, attempt("mallory", "wrong", "10.0.0.1"), now)
+	assert.ErrorIs(t, wrongPassword, service.ErrInvalidPassword)
+	assert.Equal(t, wrongPassword, unknownUser)
+	assert.Equal(t, unknown+1, testutil.ToFloat64(metrics.FailedLogins.WithLabelValues(service.ReasonUnknownUser)))
+
+	var failures []models.FailedLogin
+	require.NoError(t, database.Order("id").Find(&failures).Error)
+	require.Len(t, failures, 2)
+	assert.Equal(t, models.FailedLogin{ID: 1, Username: "alice", User_id: 1, IP: "10.0.0.1", User_agent: "test", Reason: service.ReasonInvalidPassword, Created_at: now.Unix()}, failures[0])
+	assert.Equal(t, service.ReasonUnknownUser, failures[1].Reason)
+	assert.Zero(t, failures[1].User_id)
+}
+
+func TestProgressiveDelays(t *testing.T) {
+	for _, username := range []string{"alice", "nobody"} {
+		t.Run(username, func(t *testing.T) {
+			database := setupDB(t)
+			now := time.Unix(1700000000, 0)
+			// every attempt comes from another address, only the account counts
+			try := func(password string) error {
+				now = now.Add(time.Millisecond)
+				_, _, err := service.Login(database, attempt(username, password, fmt.Sprintf("10.0.0.%d", now.Nanosecond()/1e6)), now)
+				return err
+			}
+
+			for i := 0; i < 3; i++ {
+				assert.ErrorIs(t, try("wrong"), service.ErrInvalidPassword)
+			}
+			// the third failure delays the next attempt, even with the right password
+			var locked *service.LockedError
+			require.ErrorAs(t, try("secret"), &locked)
+			assert.Equal(t, "Too many failed logins, try again in 2 seconds.", locked.Error())
+
+			// each further failure doubles the delay
+			for _, delay := range []time.Duration{2, 4, 8, 16, 32, 64} {
+				now = now.Add(delay * time.Second)
+				assert.ErrorIs(t, try("wrong"), service.ErrInvalidPassword)
+				require.ErrorAs(t, try("wrong"), &locked)
+				assert.InDelta(t, (2 * delay * time.Second).Seconds(), locked.RetryAfter.Seconds(), 1)
+			}
+			// attempts while locked do not count
+			now = now.Add(128 * time.Second)
+			assert.ErrorIs(t, try("wrong"), service.ErrInvalidPassword)
+			require.ErrorAs(t, try("wrong"), &locked)
+			assert.InDelta(t, service.AccountLockout.Window.Seconds(), locked.RetryAfter.Seconds(), 1, "ten failures lock the account")
+
+			now = now.Add(service.AccountLockout.Window)
+			err := try("secret")
+			if username == "alice" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, service.ErrInvalidPassword)
+			}
+		})
+	}
+}
+
+func TestIPLockout(t *testing.T) {
+	database := setupDB(t)
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < int(service.IPLockout.Free); i++ {
+		_, _, err := service.Login(database, attempt(fmt.Sprintf("user%d", i), "guess", "10.0.0.1"), now)
+		assert.ErrorIs(t, err, service.ErrInvalidPassword)
+	}
+	_, _, err := service.Login(database, attempt("alice", "secret", "10.0.0.1"), now)
+	assert.ErrorAs(t, err, new(*service.LockedError), "guessing many usernames delays the address")
+	_, _, err = service.Login(database, attempt("alice", "secret", "10.0.0.2"), now)
+	assert.NoError(t, err)
+
+	// the address of a load balancer is shared by everybody
+	shared := attempt("bob", "secret", "10.0.0.1")
+	shared.SharedIP = true
+	_, _, err = service.Login(database, shared, now)
+	assert.ErrorIs(t, err, service.ErrInvalidPassword, "only the account policy applies")
+}
+
+func TestAuthenticateKeepsFailures(t *testing.T) {
+	database := setupDB(t)
+	now := time.Unix(1700000000, 0)
+	_, _, err := service.Login(database, attempt("alice", "wrong", "10.0.0.1"), now)
+	require.Error(t, err)
+
+	// API clients send the password with every request
+	user, err := service.Authenticate(database, attempt("alice", "secret", "10.0.0.2"), now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user.Username)
+	_, err = service.Authenticate(database, attempt("alice", "wrong", "10.0.0.2"), now.Add(2*time.Second))
+	assert.ErrorIs(t, err, service.ErrInvalidPassword)
+
+	_, failures, err := service.Login(database, attempt("alice", "secret", "10.0.0.3"), now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Len(t, failures, 2, "the next login tells about all of them")
+}
+
+func TestLockoutDelayIsCapped(t *testing.T) {
+	database := setupDB(t)
+	now := time.Unix(1700000000, 0)
+	// past the free failures the doubled delay outgrows the window, and
+	// from 33 more on it would overflow
+	for _, extra := range []int64{10, 33, 40} {
+		failures := service.IPLockout.Free + extra
+		require.NoError(t, database.Where("1 = 1").Delete(&models.FailedLogin{}).Error)
+		for i := int64(0); i < failures; i++ {
+			require.NoError(t, database.Create(&models.FailedLogin{Username: fmt.Sprintf("user%d", i), IP: "10.0.0.1", Reason: service.ReasonUnknownUser, Created_at: now.Unix()}).Error)
+		}
+		_, _, err := service.Login(database, attempt("alice", "secret", "10.0.0.1"), now)
+		var locked *service.LockedError
+		require.ErrorAs(t, err, &locked, "%d failures", failures)
+		assert.Equal(t, service.IPLockout.Window, locked.RetryAfter, "%d failures", failures)
+	}
+}
+
+func TestLoginClearsFailures(t *testing.T) {
+	database := setupDB(t)
+	now := time.Unix(1700000000, 0)
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		_, _, err := service.Login(database, attempt("alice", "wrong", ip), now.Add(time.Duration(i)*time.Second))
+		require.Error(t, err)
+	}
+
+	user, failures, err := service.Login(database, attempt("alice", "secret", "10.0.0.3"), now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user.Username)
+	require.Len(t, failures, 2)
+	assert.Equal(t, "10.0.0.2", failures[0].IP, "newest first")
+
+	_, failures, err = service.Login(database, attempt("alice", "secret", "10.0.0.3"), now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, failures, "failures are reported once")
+}
+
+// client keeps the session cookie between requests, like a browser the
+// last one a response sets
+type client struct {
+	r       *mux.Router
+	cookies []*http.Cookie
+}
+
+func (c *client) do(method, path, ip string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "test")
+	req.RemoteAddr = ip + ":1234"
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c.r.ServeHTTP(rec, req)
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		c.cookies = cookies[len(cookies)-1:]
+	}
+	return rec
+}
+
+func (c *client) login(username, password, ip string) *httptest.ResponseRecorder {
+	return c.do("POST", "/login", ip, url.Values{"username": {username}, "password": {password}})
+}
+
+func web(database *gorm.DB) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/login", handlers.LoginHandler(database, nil)).Methods("GET", "POST")
+	r.HandleFunc("/settings", handlers.SettingsHandler(database, nil)).Methods("GET")
+	return r
+}
+
+func TestWebLogin(t *testing.T) {
+	database := setupDB(t)
+	c := &client{r: web(database)}
+
+	wrong := c.login("alice", "wrong", "10.0.0.1")
+	unknown := c.login("nobody", "wrong", "10.0.0.1")
+	assert.Equal(t, http.StatusBadRequest, wrong.Code)
+	assert.Equal(t, wrong.Body.String(), unknown.Body.String())
+	assert.Contains(t, wrong.Body.String(), "Invalid username or password")
+
+	// the next login tells about the failures
+	c.login("alice", "wrong", "10.0.0.2")
+	require.Equal(t, http.StatusFound, c.login("alice", "secret", "10.0.0.3").Code)
+	rec := c.do("GET", "/settings", "10.0.0.3", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "There were 2 failed login attempts since your last login, the last one from 10.0.0.2")
+	rec = c.do("GET", "/settings", "10.0.0.3", nil)
+	assert.NotContains(t, rec.Body.String(), "failed login attempts")
+}
+
+func TestWebLoginLocked(t *testing.T) {
+	database := setupDB(t)
+	c := &client{r: web(database)}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusBadRequest, c.login("alice", "wrong", "10.0.0.1").Code)
+	}
+	rec := c.login("alice", "secret", "10.0.0.2")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), "Too many failed logins")
+
+	var failures []models.FailedLogin
+	require.NoError(t, database.Where("username = ?", "alice").Order("id").Find(&failures).Error)
+	require.Len(t, failures, 4)
+	assert.Equal(t, service.ReasonLocked, failures[3].Reason)
+	assert.Equal(t, "10.0.0.2", failures[3].IP)
+	assert.Equal(t, "test", failures[3].User_agent)
+}
+
+func TestAPIv2Lockout(t *testing.T) {
+	database := setupDB(t)
+	r := mux.NewRouter()
+	apiv2.Register(r, database, svc)
+
+	get := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/api/v2/users/alice/following/bob", nil)
+		req.SetBasicAuth("alice", password)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, get("wrong").Code)
+	}
+	rec := get("secret")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	var problem apiv2.Problem
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&problem))
+	assert.Contains(t, problem.Detail, "Too many failed logins")
+}
+
+func TestAdminLogins(t *testing.T) {
+	database := setupDB(t)
+	now := time.Now()
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		service.Login(database, attempt("alice", "wrong", ip), now)
+	}
+	service.Login(database, attempt("bob", "wrong", "10.0.0.9"), now)
+
+	var out bytes.Buffer
+	require.NoError(t, admin.Run(database, nil, []string{"-json", "logins", "list", "-user", "alice"}, &out))
+	var rows []struct {
+		Username string
+		IP       string
+		Reason   string
+		Cleared  bool
+	}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &rows))
+	require.Len(t, rows, 3)
+	assert.Equal(t, "10.0.0.3", rows[0].IP)
+	assert.Equal(t, service.ReasonInvalidPassword, rows[0].Reason)
+
+	out.Reset()
+	require.NoError(t, admin.Run(database, nil, []string{"logins", "list", "-ip", "10.0.0.9"}, &out))
+	assert.Contains(t, out.String(), "bob")
+	assert.NotContains(t, out.String(), "alice")
+
+	_, _, err := service.Login(database, attempt("alice", "secret", "10.0.0.4"), now)
+	require.ErrorAs(t, err, new(*service.LockedError))
+	out.Reset()
+	require.NoError(t, admin.Run(database, nil, []string{"logins", "unlock", "alice"}, &out))
+	assert.Contains(t, out.String(), "4")
+	_, _, err = service.Login(database, attempt("alice", "secret", "10.0.0.4"), now)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,154 @@
+package metrics_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"minitwit/api"
+	"minitwit/config"
+	"minitwit/metrics"
+	"minitwit/models"
+	"minitwit/service"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const simulatorAuth = "Basic c2ltdWxhdG9yOnN1cGVyX3NhZmUh"
+
+func setup(t *testing.T) (*gorm.DB, http.Handler) {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}, &models.IdempotencyKey{}))
+
+	cfg := config.Default()
+	cfg.API.LatestFile = filepath.Join(t.TempDir(), "latest_processed_sim_action_id.txt")
+	require.NoError(t, os.WriteFile(cfg.API.LatestFile, []byte("0"), 0644))
+	return database, api.NewRouter(database, cfg, service.New(cfg))
+}
+
+func post(t *testing.T, r http.Handler, path string, body any) int {
+	payload, err := json.Marshal(body)
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", simulatorAuth)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// gathered returns the metric family from the default registry
+func gathered(t *testing.T, name string) *dto.MetricFamily {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			return family
+		}
+	}
+	return nil
+}
+
+func labelValues(family *dto.MetricFamily, label string) []string {
+	var values []string
+	for _, m := range family.GetMetric() {
+		for _, pair := range m.GetLabel() {
+			if pair.GetName() == label {
+				values = append(values, pair.GetValue())
+			}
+		}
+	}
+	return values
+}
+
+func TestAPIWritesAreCountedBySource(t *testing.T) {
+	_, r := setup(t)
+
+	registered := testutil.ToFloat64(metrics.UsersRegistered.WithLabelValues(metrics.SourceAPI))
+	posted := testutil.ToFloat64(metrics.MessagesPosted.WithLabelValues(metrics.SourceAPI))
+	follows := testutil.ToFloat64(metrics.Follows.WithLabelValues(metrics.SourceAPI))
+	unfollows := testutil.ToFloat64(metrics.Unfollows.WithLabelValues(metrics.SourceAPI))
+	web := testutil.ToFloat64(metrics.MessagesPosted.WithLabelValues(metrics.SourceWeb))
+
+	require.Equal(t, http.StatusCreated, post(t, r, "/register", map[string]string{"username": "a", "email": "a@a", "pwd": "a"}))
+	require.Equal(t, http.StatusCreated, post(t, r, "/register", map[string]string{"username": "b", "email": "b@b", "pwd": "b"}))
+	require.Equal(t, http.StatusNoContent, post(t, r, "/msgs/a", map[string]string{"content": "hello"}))
+	require.Equal(t, http.StatusNoContent, post(t, r, "/fllws/a", map[string]string{"follow": "b"}))
+	require.Equal(t, http.StatusNoContent, post(t, r, "/fllws/a", map[string]string{"unfollow": "b"}))
+
+	assert.Equal(t, registered+2, testutil.ToFloat64(metrics.UsersRegistered.WithLabelValues(metrics.SourceAPI)))
+	assert.Equal(t, posted+1, testutil.ToFloat64(metrics.MessagesPosted.WithLabelValues(metrics.SourceAPI)))
+	assert.Equal(t, follows+1, testutil.ToFloat64(metrics.Follows.WithLabelValues(metrics.SourceAPI)))
+	assert.Equal(t, unfollows+1, testutil.ToFloat64(metrics.Unfollows.WithLabelValues(metrics.SourceAPI)))
+	assert.Equal(t, web, testutil.ToFloat64(metrics.MessagesPosted.WithLabelValues(metrics.SourceWeb)))
+
+	// the timeline queries are timed by operation
+	req := httptest.NewRequest("GET", "/msgs", nil)
+	req.Header.Set("Authorization", simulatorAuth)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	family := gathered(t, "minitwit_db_query_duration_seconds")
+	require.NotNil(t, family)
+	assert.Contains(t, labelValues(family, "operation"), "QueryMessagesPage")
+}
+
+func TestErrorMessageLabelsAreBounded(t *testing.T) {
+	_, r := setup(t)
+
+	req := httptest.NewRequest("GET", "/msgs", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	require.Equal(t, http.StatusNotFound, post(t, r, "/msgs/nobody", map[string]string{"content": "hello"}))
+
+	family := gathered(t, "http_response_messages_total")
+	require.NotNil(t, family)
+	types := labelValues(family, "message_type")
+	assert.Contains(t, types, "not_authorized")
+	assert.Contains(t, types, "user_not_found")
+	for _, value := range types {
+		assert.NotContains(t, value, " ", "message_type %q looks like a raw error message", value)
+	}
+}
+
+func TestSimulatorLag(t *testing.T) {
+	_, r := setup(t)
+
+	require.Equal(t, http.StatusCreated, post(t, r, "/register?latest=100", map[string]string{"username": "a", "email": "a@a", "pwd": "a"}))
+	assert.Equal(t, 100.0, gathered(t, "minitwit_simulator_processed_id").GetMetric()[0].GetGauge().GetValue())
+
+	// a read only moves the received id
+	req := httptest.NewRequest("GET", "/msgs?latest=105", nil)
+	req.Header.Set("Authorization", simulatorAuth)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, 105.0, gathered(t, "minitwit_simulator_latest_id").GetMetric()[0].GetGauge().GetValue())
+	assert.Equal(t, 5.0, gathered(t, "minitwit_simulator_latest_lag").GetMetric()[0].GetGauge().GetValue())
+
+	require.Equal(t, http.StatusNoContent, post(t, r, "/msgs/a?latest=106", map[string]string{"content": "hello"}))
+	assert.Equal(t, 0.0, gathered(t, "minitwit_simulator_latest_lag").GetMetric()[0].GetGauge().GetValue())
+}
+
+func TestRegisterDB(t *testing.T) {
+	database, r := setup(t)
+	require.Equal(t, http.StatusCreated, post(t, r, "/register", map[string]string{"username": "a", "email": "a@a", "pwd": "a"}))
+	require.NoError(t, metrics.RegisterDB(database))
+
+	family := gathered(t, "minitwit_table_rows")
+	require.NotNil(t, family)
+	rows := map[string]float64{}
+	for _, m := range family.GetMetric() {
+		rows[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"users": 1, "messages": 0, "followers": 0}, rows)
+
+	assert.NotNil(t, gathered(t, "go_sql_open_connections"))
+}
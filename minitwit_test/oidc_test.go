@@ -0,0 +1,476 @@
+package oidc_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"minitwit/config"
+	"minitwit/handlers"
+	"minitwit/models"
+	"minitwit/oidc"
+	"minitwit/oidc/oidctest"
+	"minitwit/service"
+	"minitwit/totp"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const baseURL = "http://mt.test"
+
+var carol = oidctest.User{
+	Subject:           "0f3c-carol",
+	Email:             "carol@corp.example.com",
+	EmailVerified:     true,
+	PreferredUsername: "carol",
+	Name:              "Carol Example",
+}
+
+func idp(t *testing.T, secret string) (*oidctest.Server, *oidc.Provider) {
+	idp := oidctest.NewServer("minitwit", secret)
+	t.Cleanup(idp.Close)
+	p := oidc.FromConfig(config.OIDC{Issuer: idp.URL, ClientID: "minitwit", ClientSecret: secret}, baseURL+"/")
+	return idp, p
+}
+
+func TestChallenge(t *testing.T) {
+	// RFC 7636 appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", oidc.Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+	assert.Len(t, oidc.RandomString(), 43)
+	assert.NotEqual(t, oidc.RandomString(), oidc.RandomString())
+}
+
+func TestFromConfig(t *testing.T) {
+	assert.Nil(t, oidc.FromConfig(config.OIDC{}, baseURL))
+	p := oidc.FromConfig(config.OIDC{Issuer: "https://login.example.com", ClientID: "minitwit"}, baseURL+"/")
+	assert.Equal(t, baseURL+"/login/oidc/callback", p.RedirectURL)
+
+	cfg := config.Default()
+	cfg.Database.Host, cfg.Database.User, cfg.Database.Name = "db", "minitwit", "minitwit"
+	cfg.OIDC.Issuer = "login.example.com"
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "oidc.issuer")
+	assert.Contains(t, err.Error(), "oidc.client_id")
+	cfg.OIDC.Issuer, cfg.OIDC.ClientID = "https://login.example.com", "minitwit"
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	_, p := idp(t, "")
+	target, err := p.AuthCodeURL(context.Background(), "the-state", "the-nonce", "the-verifier")
+	require.NoError(t, err)
+	u, err := url.Parse(target)
+	require.NoError(t, err)
+	q := u.Query()
+	assert.Equal(t, "/authorize", u.Path)
+	assert.Equal(t, "code", q.Get("response_type"))
+	assert.Equal(t, "minitwit", q.Get("client_id"))
+	assert.Equal(t, baseURL+"/login/oidc/callback", q.Get("redirect_uri"))
+	assert.Equal(t, "openid email profile", q.Get("scope"))
+	assert.Equal(t, "the-state", q.Get("state"))
+	assert.Equal(t, "the-nonce", q.Get("nonce"))
+	assert.Equal(t, oidc.Challenge("the-verifier"), q.Get("code_challenge"))
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+}
+
+func TestDiscoveryErrors(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	p := &oidc.Provider{Issuer: down.URL, ClientID: "minitwit"}
+	_, err := p.AuthCodeURL(context.Background(), "s", "n", "v")
+	assert.Error(t, err)
+
+	// the document must be about the configured issuer
+	server, _ := idp(t, "")
+	p = &oidc.Provider{Issuer: server.URL + "/", ClientID: "minitwit"}
+	_, err = p.AuthCodeURL(context.Background(), "s", "n", "v")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "issuer")
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	server, p := idp(t, "")
+	ctx := context.Background()
+	now := time.Now()
+
+	claims, err := p.VerifyIDToken(ctx, server.Sign(server.Claims(carol, "n", now)), "n", now)
+	require.NoError(t, err)
+	assert.Equal(t, carol.Subject, claims.Subject)
+	assert.Equal(t, carol.Email, claims.Email)
+	assert.True(t, claims.EmailVerified)
+	assert.Equal(t, "carol", claims.PreferredUsername)
+
+	invalid := map[string]func(map[string]any){
+		"issuer":          func(c map[string]any) { c["iss"] = "https://evil.example.com" },
+		"audience":        func(c map[string]any) { c["aud"] = "other" },
+		"azp":             func(c map[string]any) { c["aud"] = []string{"minitwit", "other"} },
+		"expired":         func(c map[string]any) { c["exp"] = now.Add(-2 * time.Minute).Unix() },
+		"future":          func(c map[string]any) { c["iat"] = now.Add(10 * time.Minute).Unix() },
+		"nonce":           func(c map[string]any) { c["nonce"] = "replayed" },
+		"missing subject": func(c map[string]any) { delete(c, "sub") },
+	}
+	for name, tamper := range invalid {
+		c := server.Claims(carol, "n", now)
+		tamper(c)
+		_, err := p.VerifyIDToken(ctx, server.Sign(c), "n", now)
+		assert.ErrorIs(t, err, oidc.ErrInvalidIDToken, name)
+	}
+	c := server.Claims(carol, "n", now)
+	c["aud"], c["azp"] = []string{"minitwit", "other"}, "minitwit"
+	_, err = p.VerifyIDToken(ctx, server.Sign(c), "n", now)
+	assert.NoError(t, err, "several audiences with minitwit as authorized party")
+
+	token := server.Sign(server.Claims(carol, "n", now))
+	parts := strings.Split(token, ".")
+	other := strings.Split(server.Sign(server.Claims(oidctest.User{Subject: "admin"}, "n", now)), ".")
+	_, err = p.VerifyIDToken(ctx, parts[0]+"."+other[1]+"."+parts[2], "n", now)
+	assert.ErrorIs(t, err, oidc.ErrInvalidIDToken, "claims of another token")
+	_, err = p.VerifyIDToken(ctx, "eyJhbGciOiJub25lIn0."+parts[1]+".", "n", now)
+	assert.ErrorIs(t, err, oidc.ErrInvalidIDToken, "alg none")
+	_, err = p.VerifyIDToken(ctx, "not a token", "n", now)
+	assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+}
+
+func TestKeyRotation(t *testing.T) {
+	server, p := idp(t, "")
+	ctx := context.Background()
+	now := time.Now()
+	_, err := p.VerifyIDToken(ctx, server.Sign(server.Claims(carol, "n", now)), "n", now)
+	require.NoError(t, err)
+
+	server.RotateKey()
+	_, err = p.VerifyIDToken(ctx, server.Sign(server.Claims(carol, "n", now)), "n", now)
+	assert.ErrorIs(t, err, oidc.ErrInvalidIDToken, "the keys were just fetched")
+
+	oidc.KeysRefresh = 0
+	t.Cleanup(func() { oidc.KeysRefresh = time.Minute })
+	_, err = p.VerifyIDToken(ctx, server.Sign(server.Claims(carol, "n", now)), "n", now)
+	assert.NoError(t, err)
+}
+
+// noRedirect is a browser at the provider, the redirects are checked by
+// the tests
+var noRedirect = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+// authorize logs in at the provider and returns where it sends the browser
+func authorize(t *testing.T, target string) string {
+	resp, err := noRedirect.Get(target)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	return resp.Header.Get("Location")
+}
+
+func TestExchange(t *testing.T) {
+	for _, secret := range []string{"", "s3cret:&%"} {
+		server, p := idp(t, secret)
+		server.SetUser(carol)
+		ctx := context.Background()
+
+		target, err := p.AuthCodeURL(ctx, "s", "n", "verifier")
+		require.NoError(t, err)
+		back, err := url.Parse(authorize(t, target))
+		require.NoError(t, err)
+		code := back.Query().Get("code")
+		_, err = p.Exchange(ctx, code, "wrong verifier", "n")
+		assert.Error(t, err, "the verifier must match the challenge")
+
+		target, _ = p.AuthCodeURL(ctx, "s", "n", "verifier")
+		back, _ = url.Parse(authorize(t, target))
+		code = back.Query().Get("code")
+		claims, err := p.Exchange(ctx, code, "verifier", "n")
+		require.NoError(t, err, "secret %q", secret)
+		assert.Equal(t, carol.Subject, claims.Subject)
+		_, err = p.Exchange(ctx, code, "verifier", "n")
+		assert.Error(t, err, "codes work once")
+	}
+
+	_, p := idp(t, "right")
+	p.ClientSecret = "wrong"
+	target, _ := p.AuthCodeURL(context.Background(), "s", "n", "verifier")
+	back, _ := url.Parse(authorize(t, target))
+	_, err := p.Exchange(context.Background(), back.Query().Get("code"), "verifier", "n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid_client")
+}
+
+func setupDB(t *testing.T) (*gorm.DB, *models.User) {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}, &models.RemoteActor{}, &models.ActorKey{}, &models.RemoteNote{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}, &models.Identity{}, &models.TimelineEntry{}, &models.PopularAuthor{}))
+	user, err := service.RegisterUser(database, "alice", "alice@example.com", "secret")
+	require.NoError(t, err)
+	return database, user
+}
+
+func TestRegisterExternalUser(t *testing.T) {
+	database, alice := setupDB(t)
+	now := time.Now()
+	id := service.ExternalIdentity{Issuer: "https://idp", Subject: "c1", Email: "carol@corp.example.com", EmailVerified: true}
+
+	_, _, err := service.LoginExternal(database, id)
+	assert.ErrorIs(t, err, service.ErrNoAccount)
+	_, err = service.RegisterExternalUser(database, id, "alice", id.Email, now)
+	assert.ErrorIs(t, err, service.ErrUsernameTaken)
+	_, err = service.RegisterExternalUser(database, id, "carol", "carol", now)
+	assert.ErrorAs(t, err, new(*service.ValidationError))
+
+	carol, err := service.RegisterExternalUser(database, id, "carol", "Carol@corp.example.com", now)
+	require.NoError(t, err)
+	assert.False(t, carol.Unverified, "the provider verified the email")
+	assert.Empty(t, carol.PwHash)
+	_, err = service.CheckPassword(database, "carol", "")
+	assert.ErrorIs(t, err, service.ErrInvalidPassword, "no password to log in with")
+
+	user, _, err := service.LoginExternal(database, id)
+	require.NoError(t, err)
+	assert.Equal(t, carol.User_id, user.User_id)
+	assert.ErrorIs(t, service.LinkIdentity(database, alice.User_id, id, now), service.ErrIdentityTaken)
+
+	dave, err := service.RegisterExternalUser(database, service.ExternalIdentity{Issuer: "https://idp", Subject: "d1", Email: "dave@corp.example.com"}, "dave", "dave@corp.example.com", now)
+	require.NoError(t, err)
+	assert.True(t, dave.Unverified, "the provider did not verify the email")
+
+	identities, err := service.Identities(database, carol.User_id)
+	require.NoError(t, err)
+	require.Len(t, identities, 1)
+	assert.ErrorIs(t, service.UnlinkIdentity(database, carol.User_id, identities[0].ID), service.ErrLastLogin)
+	assert.ErrorIs(t, service.UnlinkIdentity(database, alice.User_id, identities[0].ID), service.ErrIdentityNotFound)
+	identities, _ = service.Identities(database, carol.User_id)
+	assert.Len(t, identities, 1, "the last login is kept")
+
+	database.Model(carol).Update("disabled", true)
+	_, _, err = service.LoginExternal(database, id)
+	assert.ErrorIs(t, err, service.ErrUserDisabled)
+}
+
+// client keeps the session cookie between requests, like a browser the
+// last one a response sets
+type client struct {
+	t       *testing.T
+	r       http.Handler
+	cookies []*http.Cookie
+}
+
+func (c *client) do(method, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c.r.ServeHTTP(rec, req)
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		c.cookies = cookies[len(cookies)-1:]
+	}
+	return rec
+}
+
+// viaProvider follows the redirect of start through the provider and
+// returns the answer of the callback
+func (c *client) viaProvider(start *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	require.Equal(c.t, http.StatusFound, start.Code, start.Body.String())
+	back := authorize(c.t, start.Header().Get("Location"))
+	require.True(c.t, strings.HasPrefix(back, baseURL+oidc.CallbackPath+"?"), back)
+	return c.do("GET", strings.TrimPrefix(back, baseURL), nil)
+}
+
+func web(t *testing.T, database *gorm.DB) (*client, *oidctest.Server) {
+	server, p := idp(t, "secret")
+	p.Name = "Example Corp account"
+	svc := service.New(config.Default())
+	svc.BaseURL = baseURL
+	r := mux.NewRouter()
+	r.HandleFunc("/login", handlers.LoginHandler(database, p)).Methods("GET", "POST")
+	r.HandleFunc("/login/code", handlers.LoginCodeHandler(database)).Methods("GET", "POST")
+	r.HandleFunc("/login/oidc", handlers.OIDCLoginHandler(p)).Methods("GET")
+	r.HandleFunc("/login/oidc/callback", handlers.OIDCCallbackHandler(database, svc, p)).Methods("GET")
+	r.HandleFunc("/login/oidc/signup", handlers.OIDCSignupHandler(database, svc, p)).Methods("GET", "POST")
+	r.HandleFunc("/logout", handlers.LogoutHandler()).Methods("GET")
+	r.HandleFunc("/settings", handlers.SettingsHandler(database, p)).Methods("GET")
+	r.HandleFunc("/settings/oidc", handlers.OIDCLinkHandler(database, p)).Methods("POST")
+	r.HandleFunc("/settings/oidc/unlink", handlers.OIDCUnlinkHandler(database, p)).Methods("POST")
+	r.HandleFunc("/settings/delete", handlers.DeleteAccountHandler(database, svc, p)).Methods("POST")
+	return &client{t: t, r: r}, server
+}
+
+func TestLoginPage(t *testing.T) {
+	database, _ := setupDB(t)
+	c := &client{t: t, r: handlers.LoginHandler(database, nil)}
+	assert.NotContains(t, c.do("GET", "/login", nil).Body.String(), "/login/oidc")
+	rec := httptest.NewRecorder()
+	handlers.OIDCLoginHandler(nil)(rec, httptest.NewRequest("GET", "/login/oidc", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	c, _ = web(t, database)
+	assert.Contains(t, c.do("GET", "/login", nil).Body.String(), `<a href="/login/oidc">Sign in with your Example Corp account</a>`)
+}
+
+func TestSignupOnFirstLogin(t *testing.T) {
+	database, _ := setupDB(t)
+	c, server := web(t, database)
+	server.SetUser(carol)
+
+	assert.Equal(t, "/login", c.do("GET", "/login/oidc/signup", nil).Header().Get("Location"), "nothing to sign up")
+	rec := c.viaProvider(c.do("GET", "/login/oidc", nil))
+	require.Equal(t, http.StatusFound, rec.Code, rec.Body.String())
+	require.Equal(t, "/login/oidc/signup", rec.Header().Get("Location"))
+
+	rec = c.do("GET", "/login/oidc/signup", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "as Carol Example")
+	assert.Contains(t, rec.Body.String(), `name=username size=30 value="carol"`)
+	assert.Contains(t, rec.Body.String(), `value="carol@corp.example.com"`)
+
+	rec = c.do("POST", "/login/oidc/signup", url.Values{"username": {"alice"}, "email": {carol.Email}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "User already exists")
+	rec = c.do("POST", "/login/oidc/signup", url.Values{"username": {"carol.e"}, "email": {carol.Email}})
+	require.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/", rec.Header().Get("Location"))
+
+	var user models.User
+	require.NoError(t, database.Where("username = ?", "carol.e").Take(&user).Error)
+	assert.False(t, user.Unverified)
+	var identity models.Identity
+	require.NoError(t, database.Where("user_id = ?", user.User_id).Take(&identity).Error)
+	assert.Equal(t, server.URL, identity.Issuer)
+	assert.Equal(t, carol.Subject, identity.Subject)
+	rec = c.do("GET", "/settings", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Linked to carol@corp.example.com")
+	assert.Equal(t, "/login", c.do("GET", "/login/oidc/signup", nil).Header().Get("Location"), "signed up once")
+
+	// the next time the identity logs in directly
+	c.do("GET", "/logout", nil)
+	rec = c.viaProvider(c.do("GET", "/login/oidc", nil))
+	require.Equal(t, "/", rec.Header().Get("Location"))
+	assert.Contains(t, c.do("GET", "/settings", nil).Body.String(), "sign out [carol.e]")
+
+	rec = c.do("POST", "/settings/oidc/unlink", url.Values{"id": {fmt.Sprint(identity.ID)}})
+	assert.Equal(t, "/settings", rec.Header().Get("Location"))
+	assert.Contains(t, c.do("GET", "/settings", nil).Body.String(), "Forgot your password?")
+
+	database.Model(&user).Update("disabled", true)
+	c.do("GET", "/logout", nil)
+	assert.Equal(t, http.StatusForbidden, c.viaProvider(c.do("GET", "/login/oidc", nil)).Code)
+}
+
+func TestLinkAndUnlink(t *testing.T) {
+	database, alice := setupDB(t)
+	c, server := web(t, database)
+	server.SetUser(carol)
+
+	assert.Equal(t, "/login", c.do("POST", "/settings/oidc", nil).Header().Get("Location"), "only logged in users link")
+	require.Equal(t, http.StatusFound, c.do("POST", "/login", url.Values{"username": {"alice"}, "password": {"secret"}}).Code)
+	assert.Contains(t, c.do("GET", "/settings", nil).Body.String(), "Log in with your Example Corp account instead of the password")
+
+	rec := c.viaProvider(c.do("POST", "/settings/oidc", nil))
+	require.Equal(t, "/settings", rec.Header().Get("Location"))
+	rec = c.do("GET", "/settings", nil)
+	assert.Contains(t, rec.Body.String(), "You can log in with your Example Corp account now")
+	assert.Contains(t, rec.Body.String(), "Linked to carol@corp.example.com")
+	identities, err := service.Identities(database, alice.User_id)
+	require.NoError(t, err)
+	require.Len(t, identities, 1)
+
+	c.do("GET", "/logout", nil)
+	rec = c.viaProvider(c.do("GET", "/login/oidc", nil))
+	require.Equal(t, "/", rec.Header().Get("Location"))
+	assert.Contains(t, c.do("GET", "/settings", nil).Body.String(), "sign out [alice]")
+
+	// alice has a password, so the only identity can go
+	rec = c.do("POST", "/settings/oidc/unlink", url.Values{"id": {fmt.Sprint(identities[0].ID)}})
+	assert.Equal(t, "/settings", rec.Header().Get("Location"))
+	assert.Contains(t, c.do("GET", "/settings", nil).Body.String(), "Your Example Corp account is unlinked")
+	c.do("GET", "/logout", nil)
+	rec = c.viaProvider(c.do("GET", "/login/oidc", nil))
+	assert.Equal(t, "/login/oidc/signup", rec.Header().Get("Location"))
+}
+
+func TestDeleteWithoutPassword(t *testing.T) {
+	database, _ := setupDB(t)
+	c, server := web(t, database)
+	server.SetUser(carol)
+	c.viaProvider(c.do("GET", "/login/oidc", nil))
+	require.Equal(t, http.StatusFound, c.do("POST", "/login/oidc/signup", url.Values{"username": {"carol"}, "email": {carol.Email}}).Code)
+	rec := c.do("GET", "/settings", nil)
+	assert.Contains(t, rec.Body.String(), "Sign in with your Example Corp account to confirm")
+	assert.NotContains(t, rec.Body.String(), "type=password")
+
+	// another identity does not confirm it
+	server.SetUser(oidctest.User{Subject: "7a1d-dave", Email: "dave@corp.example.com"})
+	rec = c.viaProvider(c.do("POST", "/settings/delete", nil))
+	assert.Equal(t, "/settings", rec.Header().Get("Location"))
+	assert.Contains(t, c.do("GET", "/settings", nil).Body.String(), "Sign in with the Example Corp account linked to your account, it was not deleted")
+
+	server.SetUser(carol)
+	rec = c.viaProvider(c.do("POST", "/settings/delete", nil))
+	assert.Equal(t, "/public", rec.Header().Get("Location"))
+	assert.ErrorIs(t, database.Where("username = ?", "carol").Take(&models.User{}).Error, gorm.ErrRecordNotFound)
+	assert.Equal(t, "/login", c.do("GET", "/settings", nil).Header().Get("Location"), "logged out")
+}
+
+func TestCallbackChecks(t *testing.T) {
+	database, _ := setupDB(t)
+	c, server := web(t, database)
+	server.SetUser(carol)
+
+	assert.Equal(t, http.StatusBadRequest, c.do("GET", "/login/oidc/callback?code=x&state=y", nil).Code, "no login started")
+
+	start := c.do("GET", "/login/oidc", nil)
+	back := authorize(t, start.Header().Get("Location"))
+	u, _ := url.Parse(back)
+	q := u.Query()
+	q.Set("state", "forged")
+	assert.Equal(t, http.StatusBadRequest, c.do("GET", oidc.CallbackPath+"?"+q.Encode(), nil).Code)
+	assert.Equal(t, http.StatusBadRequest, c.do("GET", strings.TrimPrefix(back, baseURL), nil).Code, "a failed callback ends the login")
+
+	start = c.do("GET", "/login/oidc", nil)
+	target, _ := url.Parse(start.Header().Get("Location"))
+	state := target.Query().Get("state")
+	rec := c.do("GET", oidc.CallbackPath+"?"+url.Values{"error": {"access_denied"}, "state": {state}}.Encode(), nil)
+	assert.Equal(t, "/login", rec.Header().Get("Location"))
+
+	server.Tamper = func(claims map[string]any) { claims["nonce"] = "other" }
+	assert.Equal(t, http.StatusBadGateway, c.viaProvider(c.do("GET", "/login/oidc", nil)).Code)
+	server.Tamper = nil
+
+	start = c.do("GET", "/login/oidc", nil)
+	back = authorize(t, start.Header().Get("Location"))
+	require.Equal(t, http.StatusFound, c.do("GET", strings.TrimPrefix(back, baseURL), nil).Code)
+	assert.Equal(t, http.StatusBadRequest, c.do("GET", strings.TrimPrefix(back, baseURL), nil).Code, "callbacks work once")
+}
+
+func TestSecondFactor(t *testing.T) {
+	database, alice := setupDB(t)
+	c, server := web(t, database)
+	server.SetUser(carol)
+	now := time.Now().Add(-totp.Period)
+	secret, _, err := service.EnrollTwoFactor(database, alice, now)
+	require.NoError(t, err)
+	code, err := totp.Code(secret, totp.Step(now))
+	require.NoError(t, err)
+	_, err = service.ConfirmTwoFactor(database, alice.User_id, code, now)
+	require.NoError(t, err)
+	require.NoError(t, service.LinkIdentity(database, alice.User_id, service.ExternalIdentity{Issuer: server.URL, Subject: carol.Subject}, now))
+
+	rec := c.viaProvider(c.do("GET", "/login/oidc", nil))
+	require.Equal(t, "/login/code", rec.Header().Get("Location"))
+	assert.Equal(t, "/login", c.do("GET", "/settings", nil).Header().Get("Location"), "not logged in before the code")
+	code, _ = totp.Code(secret, totp.Step(time.Now()))
+	rec = c.do("POST", "/login/code", url.Values{"code": {code}})
+	require.Equal(t, "/", rec.Header().Get("Location"))
+	assert.Contains(t, c.do("GET", "/settings", nil).Body.String(), "sign out [alice]")
+}
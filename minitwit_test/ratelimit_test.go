@@ -0,0 +1,311 @@
+package ratelimit_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"minitwit/api"
+	"minitwit/apiv2"
+	"minitwit/config"
+	"minitwit/metrics"
+	"minitwit/middleware"
+	"minitwit/models"
+	"minitwit/ratelimit"
+	"minitwit/service"
+	"minitwit/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var svc = service.New(config.Default())
+
+const simulatorAuth = "Basic c2ltdWxhdG9yOnN1cGVyX3NhZmUh"
+
+func TestParseRules(t *testing.T) {
+	rules, err := ratelimit.ParseRules("POST /login ip 10/m; ; get /api/v2/* user 2/s burst 5")
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, ratelimit.Rule{Method: "POST", Path: "/login", Key: "ip", Limit: ratelimit.Limit{Rate: 10.0 / 60, Burst: 10}}, rules[0])
+	assert.Equal(t, ratelimit.Rule{Method: "GET", Path: "/api/v2/*", Key: "user", Limit: ratelimit.Limit{Rate: 2, Burst: 5}}, rules[1])
+
+	_, err = ratelimit.ParseRules("POST /login host 10/m; POST login ip 10/m; POST /login ip ten/m; POST /login ip 1/d; POST /login ip 1/m burst 0")
+	require.Error(t, err)
+	for _, want := range []string{`key "host"`, `path "login"`, `rate "ten/m"`, `rate "1/d"`, `burst "0"`} {
+		assert.Contains(t, err.Error(), want)
+	}
+
+	cfg := config.Default()
+	cfg.Database = config.Database{Host: "db", User: "u", Name: "n", ConnectTimeout: time.Second}
+	cfg.RateLimit.Rules = "POST /login ip"
+	assert.ErrorContains(t, cfg.Validate(), "rate_limit.rules")
+	cfg.RateLimit.Enabled = false
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, "1", ratelimit.RetryAfter(10*time.Millisecond))
+	assert.Equal(t, "6", ratelimit.RetryAfter(5100*time.Millisecond))
+}
+
+// testStore checks the token bucket of a store with a fake clock
+func testStore(t *testing.T, store ratelimit.Store) {
+	ctx := context.Background()
+	limit := ratelimit.Limit{Rate: 1, Burst: 3}
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 3; i++ {
+		allowed, _, err := store.Take(ctx, "a", limit, now)
+		require.NoError(t, err)
+		assert.True(t, allowed, "request %d is within the burst", i)
+	}
+	allowed, wait, err := store.Take(ctx, "a", limit, now)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+
+	// other keys have their own bucket
+	allowed, _, err = store.Take(ctx, "b", limit, now)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	// one token per second comes back
+	now = now.Add(1500 * time.Millisecond)
+	allowed, _, _ = store.Take(ctx, "a", limit, now)
+	assert.True(t, allowed)
+	allowed, wait, _ = store.Take(ctx, "a", limit, now)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// the bucket does not grow past the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		allowed, _, _ = store.Take(ctx, "a", limit, now)
+		assert.True(t, allowed)
+	}
+	allowed, _, _ = store.Take(ctx, "a", limit, now)
+	assert.False(t, allowed)
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	testStore(t, store)
+
+	// full buckets are dropped
+	_, _, err := store.Take(context.Background(), "c", ratelimit.Limit{Rate: 1, Burst: 3}, time.Unix(1700000000, 0).Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, store.Len())
+}
+
+func openDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.IdempotencyKey{}, &models.RateLimitBucket{}))
+	return database
+}
+
+func TestDBStoreIsShared(t *testing.T) {
+	database := openDB(t)
+	testStore(t, ratelimit.NewDBStore(database))
+
+	// a second replica sees the buckets of the first
+	limit := ratelimit.Limit{Rate: 1, Burst: 1}
+	now := time.Unix(1800000000, 0)
+	allowed, _, err := ratelimit.NewDBStore(database).Take(context.Background(), "shared", limit, now)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, wait, err := ratelimit.NewDBStore(database).Take(context.Background(), "shared", limit, now)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+
+	// full buckets are deleted
+	var count int64
+	database.Model(&models.RateLimitBucket{}).Where("key = ?", "shared").Count(&count)
+	assert.Equal(t, int64(1), count)
+	_, _, err = ratelimit.NewDBStore(database).Take(context.Background(), "other", limit, now.Add(time.Hour))
+	require.NoError(t, err)
+	database.Model(&models.RateLimitBucket{}).Where("key = ?", "shared").Count(&count)
+	assert.Zero(t, count)
+}
+
+func router(t *testing.T, rules string, opts ratelimit.Options) *mux.Router {
+	var err error
+	opts.Rules, err = ratelimit.ParseRules(rules)
+	require.NoError(t, err)
+	r := mux.NewRouter()
+	r.Use(ratelimit.Middleware(ratelimit.NewMemoryStore(), opts))
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	r.HandleFunc("/login", ok).Methods("GET", "POST")
+	r.HandleFunc("/add_message", ok).Methods("POST")
+	return r
+}
+
+func send(r http.Handler, method, path, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = remoteAddr
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMiddlewareLimitsByIP(t *testing.T) {
+	r := router(t, "POST /login ip 2/m", ratelimit.Options{})
+	before := testutil.ToFloat64(metrics.RateLimited.WithLabelValues("/login", "ip"))
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusNoContent, send(r, "POST", "/login", "10.0.0.1:1234", nil).Code)
+	}
+	rec := send(r, "POST", "/login", "10.0.0.1:5678", nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.RateLimited.WithLabelValues("/login", "ip")))
+
+	// other clients, methods and routes are not limited
+	assert.Equal(t, http.StatusNoContent, send(r, "POST", "/login", "10.0.0.2:1234", nil).Code)
+	assert.Equal(t, http.StatusNoContent, send(r, "GET", "/login", "10.0.0.1:1234", nil).Code)
+	assert.Equal(t, http.StatusNoContent, send(r, "POST", "/add_message", "10.0.0.1:1234", nil).Code)
+}
+
+func TestClientIPForwarded(t *testing.T) {
+	var ip string
+	var forwarded bool
+	r := utils.TrustProxies("X-Forwarded-For", 1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, forwarded = utils.ClientIP(r), utils.ClientIPForwarded(r)
+	}))
+	send(r, "GET", "/", "172.16.0.1:80", http.Header{"X-Forwarded-For": {"1.1.1.1"}})
+	assert.Equal(t, "1.1.1.1", ip)
+	assert.True(t, forwarded)
+	send(r, "GET", "/", "172.16.0.1:80", nil)
+	assert.Equal(t, "172.16.0.1", ip)
+	assert.False(t, forwarded, "the request did not come through the proxy")
+}
+
+func TestMiddlewareIPHeaderAndUsers(t *testing.T) {
+	limited := router(t, "POST /add_message user 1/m", ratelimit.Options{
+		ClientIP: utils.ClientIP,
+		User:     func(r *http.Request) string { return r.Header.Get("X-User") },
+	})
+	r := utils.TrustProxies("X-Forwarded-For", 1)(limited)
+	proxy := "172.16.0.1:80"
+
+	// behind the proxy, clients are told apart by the address it appended
+	for _, client := range []string{"1.1.1.1", "1.1.1.1, 2.2.2.2"} {
+		header := http.Header{"X-Forwarded-For": {client}}
+		assert.Equal(t, http.StatusNoContent, send(r, "POST", "/add_message", proxy, header).Code)
+		assert.Equal(t, http.StatusTooManyRequests, send(r, "POST", "/add_message", proxy, header).Code)
+	}
+
+	// entries sent by the client do not get a new bucket
+	spoofed := http.Header{"X-Forwarded-For": {"9.9.9.9, 1.1.1.1"}}
+	assert.Equal(t, http.StatusTooManyRequests, send(r, "POST", "/add_message", proxy, spoofed).Code)
+	spoofed = http.Header{"X-Forwarded-For": {"9.9.9.9", "2.2.2.2"}}
+	assert.Equal(t, http.StatusTooManyRequests, send(r, "POST", "/add_message", proxy, spoofed).Code)
+
+	// with two proxies the client is the second entry from the right
+	twoProxies := utils.TrustProxies("X-Forwarded-For", 2)(limited)
+	twoHops := http.Header{"X-Forwarded-For": {"9.9.9.9, 4.4.4.4, 172.16.0.2"}}
+	assert.Equal(t, http.StatusNoContent, send(twoProxies, "POST", "/add_message", proxy, twoHops).Code)
+	twoHops.Set("X-Forwarded-For", "8.8.8.8, 4.4.4.4, 172.16.0.3")
+	assert.Equal(t, http.StatusTooManyRequests, send(twoProxies, "POST", "/add_message", proxy, twoHops).Code)
+
+	// users have their own bucket wherever they post from
+	alice := http.Header{"X-User": {"1"}, "X-Forwarded-For": {"1.1.1.1"}}
+	assert.Equal(t, http.StatusNoContent, send(r, "POST", "/add_message", proxy, alice).Code)
+	alice.Set("X-Forwarded-For", "3.3.3.3")
+	assert.Equal(t, http.StatusTooManyRequests, send(r, "POST", "/add_message", proxy, alice).Code)
+}
+
+func TestMiddlewareExempt(t *testing.T) {
+	r := router(t, "* /login ip 1/h", ratelimit.Options{
+		Exempt: func(r *http.Request) bool { return r.Header.Get("Authorization") == simulatorAuth },
+	})
+	simulator := http.Header{"Authorization": {simulatorAuth}}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusNoContent, send(r, "POST", "/login", "10.0.0.1:1", simulator).Code)
+	}
+	assert.Equal(t, http.StatusNoContent, send(r, "POST", "/login", "10.0.0.1:1", nil).Code)
+	assert.Equal(t, http.StatusTooManyRequests, send(r, "POST", "/login", "10.0.0.1:1", nil).Code)
+}
+
+func TestIPRulesNeedTheClientIPHeader(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimit.Rules = "POST /login ip 1/m; POST /add_message user 1/m"
+	limit, err := middleware.RateLimit(openDB(t), cfg, nil)
+	require.NoError(t, err)
+	r := mux.NewRouter()
+	r.Use(limit)
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	r.HandleFunc("/login", ok).Methods("POST")
+	r.HandleFunc("/add_message", ok).Methods("POST")
+
+	// behind the load balancer every client has its address
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusNoContent, send(r, "POST", "/login", "10.0.0.2:1", nil).Code)
+	}
+	send(r, "POST", "/add_message", "10.0.0.2:1", nil)
+	assert.Equal(t, http.StatusTooManyRequests, send(r, "POST", "/add_message", "10.0.0.2:1", nil).Code, "the other rules still apply")
+}
+
+func TestAPIErrorFormats(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimit.Rules = "POST /register ip 1/m; POST /api/v2/users ip 1/m"
+	cfg.Server.ClientIPHeader = "X-Forwarded-For"
+	database := openDB(t)
+	r := api.NewRouter(database, cfg, svc)
+	apiv2.Register(r, database, svc)
+
+	n := 0
+	register := func(path string, header http.Header) *httptest.ResponseRecorder {
+		n++
+		user := map[string]string{"username": fmt.Sprintf("user%d", n), "email": "user@example.com", "pwd": "secret"}
+		if path != "/register" {
+			user = map[string]string{"username": fmt.Sprintf("user%d", n), "email": "user@example.com", "password": "secret"}
+		}
+		body, _ := json.Marshal(user)
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the simulator is exempt by default
+	simulator := http.Header{"Authorization": {simulatorAuth}}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusCreated, register("/register", simulator).Code)
+	}
+
+	assert.Equal(t, http.StatusCreated, register("/register", nil).Code)
+	rec := register("/register", nil)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	var apiErr api.ErrorResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&apiErr))
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.Status)
+
+	assert.Equal(t, http.StatusCreated, register("/api/v2/users", nil).Code)
+	rec = register("/api/v2/users", nil)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	var problem apiv2.Problem
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&problem))
+	assert.Equal(t, http.StatusTooManyRequests, problem.Status)
+}
@@ -109,15 +109,12 @@ def test_login_logout():
             'You have been logged out' in r.text or
             'logged out' in r.text.lower())
     
+    # unknown users get the same answer, so usernames cannot be probed
     r, _ = login('user2', 'wrongpassword')
-    assert ('Invalid password' in r.text or
-            'wrong password' in r.text.lower())
-    
+    assert 'Invalid username or password' in r.text
+
     r, _ = login('user_nonexistent', 'wrongpassword')
-    assert ('Invalid username' in r.text or
-            'wrong username' in r.text.lower() or
-            'no user' in r.text.lower() or
-            'Error getting user from db' in r.text)
+    assert 'Invalid username or password' in r.text
 
 
 @pytest.mark.api
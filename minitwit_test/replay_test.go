@@ -0,0 +1,130 @@
+package replay_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"minitwit/api"
+	"minitwit/config"
+	"minitwit/db"
+	"minitwit/models"
+	"minitwit/replay"
+	"minitwit/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// a small simulator log: 5 users tweeting and following each other
+func simulatorLog() string {
+	var lines []string
+	latest := 0
+	add := func(format string, args ...any) {
+		latest++
+		lines = append(lines, fmt.Sprintf(`{"latest":%d,`, latest)+fmt.Sprintf(format, args...)+"}")
+	}
+	for i := 0; i < 5; i++ {
+		add(`"action":"register","username":"user%d","email":"user%d@example.com","pwd":"secret"`, i, i)
+	}
+	for i := 0; i < 5; i++ {
+		add(`"action":"tweet","username":"user%d","content":"hello from user%d"`, i, i)
+		add(`"action":"follow","username":"user%d","target":"user%d"`, i, (i+1)%5)
+	}
+	add(`"action":"unfollow","username":"user0","target":"user1"`)
+	add(`"action":"msgs","no":10`)
+	add(`"action":"user_msgs","username":"user1"`)
+	add(`"action":"fllws","username":"user2"`)
+	// errors are counted, not fatal
+	add(`"action":"tweet","username":"nobody","content":"hi"`)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func setupDB(t *testing.T) (*gorm.DB, *config.Config) {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.IdempotencyKey{}))
+	// concurrent writers to a shared cache database fail with "table is
+	// locked" instead of waiting
+	sqlDB, err := database.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+
+	cfg := config.Default()
+	cfg.API.LatestFile = filepath.Join(t.TempDir(), "latest_processed_sim_action_id.txt")
+	require.NoError(t, os.WriteFile(cfg.API.LatestFile, []byte("0"), 0644))
+	return database, cfg
+}
+
+func assertReplayed(t *testing.T, database *gorm.DB, report *replay.Report) {
+	assert.Equal(t, 5, report.Endpoints["POST /register"].Count)
+	assert.Equal(t, 6, report.Endpoints["POST /msgs/{username}"].Count)
+	assert.Equal(t, 1, report.Endpoints["POST /msgs/{username}"].ErrorCount())
+	assert.Equal(t, 6, report.Endpoints["POST /fllws/{username}"].Count)
+	assert.Equal(t, 0, report.Endpoints["POST /fllws/{username}"].ErrorCount())
+	assert.Equal(t, 1, report.Endpoints["GET /msgs"].Count)
+	assert.Equal(t, 20, report.SentLatest)
+
+	var messages, follows int64
+	require.NoError(t, database.Model(&models.Message{}).Count(&messages).Error)
+	require.NoError(t, database.Model(&models.Follower{}).Count(&follows).Error)
+	assert.Equal(t, int64(5), messages)
+	assert.Equal(t, int64(4), follows)
+
+	// the workers register concurrently, the ids are in any order
+	user0, err := db.GormGetUserId(database, "user0")
+	require.NoError(t, err)
+	user1, err := db.GormGetUserId(database, "user1")
+	require.NoError(t, err)
+	following, err := db.IsUserFollowing(database, user0, user1)
+	require.NoError(t, err)
+	assert.False(t, following, "user0 unfollowed user1")
+}
+
+func TestReplayAgainstServer(t *testing.T) {
+	database, cfg := setupDB(t)
+	server := httptest.NewServer(api.NewRouter(database, cfg, service.New(cfg)))
+	defer server.Close()
+
+	// the workers keep the actions of one user in order
+	report, err := replay.Run(context.Background(), replay.NewDecoder(strings.NewReader(simulatorLog())), replay.NewHTTPTarget(server.URL, cfg.Simulator.Authorization()), replay.Options{Concurrency: 4})
+	require.NoError(t, err)
+	assertReplayed(t, database, report)
+	assert.Equal(t, map[string]int{"HTTP 404": 1}, report.Endpoints["POST /msgs/{username}"].Errors)
+	assert.Positive(t, report.Endpoints["POST /register"].Percentile(99))
+	assert.Equal(t, 20, report.TargetLatest)
+}
+
+func TestReplayAgainstStore(t *testing.T) {
+	database, cfg := setupDB(t)
+	target := &replay.StoreTarget{DB: database, Service: service.New(cfg), LatestFile: api.LatestFile(cfg.API.LatestFile)}
+
+	// the workers finish out of order, latest stays the highest id
+	report, err := replay.Run(context.Background(), replay.NewDecoder(strings.NewReader(simulatorLog())), target, replay.Options{Concurrency: 4, Rate: 1000})
+	require.NoError(t, err)
+	assertReplayed(t, database, report)
+	assert.Equal(t, 20, report.TargetLatest)
+}
+
+func TestReplayDryRun(t *testing.T) {
+	log := simulatorLog() + "\n{not json}\n" + `{"latest":21,"action":"dance"}` + "\n"
+
+	var out, errOut bytes.Buffer
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte(log), 0644))
+	code := replay.Main([]string{"-dry-run", path}, &out, &errOut)
+	require.Equal(t, 0, code, errOut.String())
+
+	assert.Contains(t, out.String(), "20 actions")
+	assert.Contains(t, out.String(), "2 invalid lines skipped")
+	assert.Contains(t, out.String(), "latest: 20")
+
+	assert.Equal(t, 2, replay.Main([]string{}, &out, &errOut))
+}
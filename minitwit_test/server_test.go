@@ -0,0 +1,181 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"minitwit/config"
+	"minitwit/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func start(t *testing.T, handler http.Handler, opts server.Options) (string, context.CancelFunc, chan error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.New(handler, opts).Serve(ctx, lis)
+	}()
+	t.Cleanup(cancel)
+	return lis.Addr().String(), cancel, done
+}
+
+func TestShutdownWaitsForInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "finished")
+	})
+	opts := server.DefaultOptions
+	opts.ShutdownTimeout = 5 * time.Second
+	addr, shutdown, done := start(t, handler, opts)
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- result{string(body), err}
+	}()
+	<-started
+
+	// SIGTERM arrives while the request is running
+	shutdown()
+	select {
+	case err := <-done:
+		t.Fatalf("server stopped before the request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// no new connections are accepted while draining
+	_, err := net.DialTimeout("tcp", addr, time.Second)
+	assert.Error(t, err)
+
+	close(release)
+	res := <-responses
+	require.NoError(t, res.err)
+	assert.Equal(t, "finished", res.body)
+	assert.NoError(t, <-done)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(2 * time.Second)
+	})
+	opts := server.DefaultOptions
+	opts.ShutdownTimeout = 100 * time.Millisecond
+	addr, shutdown, done := start(t, handler, opts)
+
+	go http.Get("http://" + addr + "/stuck")
+	<-started
+	shutdown()
+	assert.ErrorIs(t, <-done, context.DeadlineExceeded)
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	opts := server.DefaultOptions
+	opts.ReadHeaderTimeout = 100 * time.Millisecond
+	addr, _, _ := start(t, http.NotFoundHandler(), opts)
+
+	// a slowloris client never finishes its headers
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadAll(conn)
+	// the server closed the connection before our deadline
+	assert.NoError(t, err)
+}
+
+func TestFromConfig(t *testing.T) {
+	cfg := config.Default().Server
+	cfg.WriteTimeout = time.Minute
+
+	opts := server.FromConfig(":9999", cfg)
+	assert.Equal(t, ":9999", opts.Addr)
+	assert.Equal(t, time.Minute, opts.WriteTimeout)
+	assert.Equal(t, server.DefaultOptions.IdleTimeout, opts.IdleTimeout)
+	assert.Equal(t, server.DefaultOptions.ReadTimeout, opts.ReadTimeout)
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1
+func writeCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+}
+
+func servedName(t *testing.T, addr string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "first", time.Now().Add(-time.Minute))
+
+	opts := server.DefaultOptions
+	opts.TLSCert = certFile
+	opts.TLSKey = keyFile
+	addr, _, _ := start(t, http.NotFoundHandler(), opts)
+	assert.Equal(t, "first", servedName(t, addr))
+
+	// renewed on disk, no restart
+	writeCert(t, certFile, keyFile, "second", time.Now())
+	assert.Equal(t, "second", servedName(t, addr))
+
+	// a broken file keeps the old certificate
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0600))
+	assert.Equal(t, "second", servedName(t, addr))
+}
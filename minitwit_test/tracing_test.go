@@ -0,0 +1,143 @@
+package tracing_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"minitwit/config"
+	"minitwit/handlers"
+	"minitwit/middleware"
+	"minitwit/models"
+	"minitwit/service"
+	"minitwit/tracing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setup(t *testing.T) (*mux.Router, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, database.Use(tracing.GormPlugin()))
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}))
+
+	r := mux.NewRouter()
+	r.Use(tracing.Middleware)
+	r.Use(middleware.PrometheusMiddleware)
+	r.HandleFunc("/public", handlers.PublicTimelineHandler(database, config.Default(), service.New(config.Default()))).Methods("GET")
+	return r, recorder
+}
+
+func spansByName(recorder *tracetest.SpanRecorder) map[string][]sdktrace.ReadOnlySpan {
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	return spans
+}
+
+func TestRequestSpanHasQueryAndTemplateChildren(t *testing.T) {
+	r, recorder := setup(t)
+
+	// continue the trace of the caller
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("GET", "/public", nil)
+	req.Header.Set("traceparent", parent)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	spans := spansByName(recorder)
+	require.Len(t, spans["GET /public"], 1)
+	server := spans["GET /public"][0]
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+
+	require.NotEmpty(t, spans["db.select"])
+	for _, query := range spans["db.select"] {
+		assert.Equal(t, server.SpanContext().SpanID(), query.Parent().SpanID())
+		assert.Equal(t, trace.SpanKindClient, query.SpanKind())
+	}
+	attrs := map[string]string{}
+	for _, kv := range spans["db.select"][0].Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	assert.Equal(t, "sqlite", attrs["db.system"])
+	assert.Contains(t, attrs["db.query.text"], "SELECT")
+
+	require.Len(t, spans["template layout.html"], 1)
+	assert.Equal(t, server.SpanContext().SpanID(), spans["template layout.html"][0].Parent().SpanID())
+}
+
+func TestQueriesWithoutRequestContextStartTheirOwnTrace(t *testing.T) {
+	_, recorder := setup(t)
+	database, err := gorm.Open(sqlite.Open("file:no_request?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, database.Use(tracing.GormPlugin()))
+	require.NoError(t, database.AutoMigrate(&models.User{}))
+
+	require.NoError(t, database.Create(&models.User{Username: "alice"}).Error)
+	var user models.User
+	require.Error(t, database.Where("username = ?", "bob").First(&user).Error)
+
+	spans := spansByName(recorder)
+	require.Len(t, spans["db.create"], 1)
+	assert.False(t, spans["db.create"][0].Parent().IsValid())
+	// not found is not a failed query
+	require.NotEmpty(t, spans["db.select"])
+	assert.Empty(t, spans["db.select"][len(spans["db.select"])-1].Events())
+}
+
+func TestRequestDurationHasTraceExemplar(t *testing.T) {
+	r, recorder := setup(t)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/public", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	traceID := spansByName(recorder)["GET /public"][0].SpanContext().TraceID().String()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	var exemplars []string
+	for _, family := range families {
+		if family.GetName() != "http_request_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, bucket := range metric.GetHistogram().GetBucket() {
+				for _, label := range bucket.GetExemplar().GetLabel() {
+					exemplars = append(exemplars, label.GetValue())
+				}
+			}
+		}
+	}
+	assert.Contains(t, exemplars, traceID)
+}
+
+func TestMiddlewaresKeepFlushing(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(middleware.PrometheusMiddleware, tracing.Middleware)
+	r.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		require.NoError(t, http.NewResponseController(w).Flush())
+	})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/stream", nil))
+	assert.True(t, rec.Flushed)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+}
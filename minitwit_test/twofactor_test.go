@@ -0,0 +1,334 @@
+package twofactor_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"minitwit/apiv2"
+	"minitwit/config"
+	"minitwit/handlers"
+	"minitwit/models"
+	"minitwit/service"
+	"minitwit/totp"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var svc = service.New(config.Default())
+
+// the secret of the RFC 6238 test vectors, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// the last 6 digits of the SHA1 vectors of RFC 6238 appendix B
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		code, err := totp.Code(rfcSecret, totp.Step(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, want, code, "at %d", unix)
+	}
+	_, err := totp.Code("not base32!", 1)
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := totp.Step(now)
+
+	matched, ok := totp.Validate(rfcSecret, "050471", now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, step, matched)
+	_, ok = totp.Validate(rfcSecret, "050 471", now, 0)
+	assert.True(t, ok, "spaces are ignored")
+
+	// one step of clock skew either way
+	_, ok = totp.Validate(rfcSecret, "050471", now.Add(totp.Period), 0)
+	assert.True(t, ok)
+	_, ok = totp.Validate(rfcSecret, "050471", now.Add(-totp.Period), 0)
+	assert.True(t, ok)
+	_, ok = totp.Validate(rfcSecret, "050471", now.Add(2*totp.Period), 0)
+	assert.False(t, ok)
+
+	// used steps are rejected
+	_, ok = totp.Validate(rfcSecret, "050471", now, step)
+	assert.False(t, ok)
+	_, ok = totp.Validate(rfcSecret, "000000", now, 0)
+	assert.False(t, ok)
+	_, ok = totp.Validate(rfcSecret, "0504", now, 0)
+	assert.False(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	uri, err := url.Parse(totp.URI("MiniTwit", "alice smith", secret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/MiniTwit:alice smith", uri.Path)
+	assert.Equal(t, url.Values{"secret": {secret}, "issuer": {"MiniTwit"}, "algorithm": {"SHA1"}, "digits": {"6"}, "period": {"30"}}, uri.Query())
+}
+
+func setupDB(t *testing.T) (*gorm.DB, *models.User) {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(&models.User{}, &models.Message{}, &models.Follower{}, &models.FailedLogin{}, &models.TwoFactor{}, &models.RecoveryCode{}))
+	user, err := service.RegisterUser(database, "alice", "alice@example.com", "secret")
+	require.NoError(t, err)
+	return database, user
+}
+
+func code(t *testing.T, secret string, at time.Time) string {
+	c, err := totp.Code(secret, totp.Step(at))
+	require.NoError(t, err)
+	return c
+}
+
+// enable turns two-factor auth on at a fixed time and returns the secret
+// and the recovery codes
+func enable(t *testing.T, database *gorm.DB, user *models.User, now time.Time) (string, []string) {
+	secret, uri, err := service.EnrollTwoFactor(database, user, now)
+	require.NoError(t, err)
+	assert.Contains(t, uri, "secret="+secret)
+	codes, err := service.ConfirmTwoFactor(database, user.User_id, code(t, secret, now), now)
+	require.NoError(t, err)
+	return secret, codes
+}
+
+func TestEnroll(t *testing.T) {
+	database, user := setupDB(t)
+	now := time.Unix(1700000000, 0)
+
+	_, err := service.ConfirmTwoFactor(database, user.User_id, "123456", now)
+	assert.ErrorIs(t, err, service.ErrNotEnrolled)
+
+	secret, _, err := service.EnrollTwoFactor(database, user, now)
+	require.NoError(t, err)
+	pending, _, err := service.PendingTwoFactor(database, user)
+	require.NoError(t, err)
+	assert.Equal(t, secret, pending)
+	_, err = service.ConfirmTwoFactor(database, user.User_id, code(t, secret, now.Add(time.Hour)), now)
+	assert.ErrorIs(t, err, service.ErrInvalidCode)
+	enabled, err := service.TwoFactorEnabled(database, user.User_id)
+	require.NoError(t, err)
+	assert.False(t, enabled, "enabled only after a code was confirmed")
+
+	codes, err := service.ConfirmTwoFactor(database, user.User_id, code(t, secret, now), now)
+	require.NoError(t, err)
+	require.Len(t, codes, service.RecoveryCodeCount)
+	assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, codes[0])
+	enabled, _ = service.TwoFactorEnabled(database, user.User_id)
+	assert.True(t, enabled)
+	_, _, err = service.EnrollTwoFactor(database, user, now)
+	assert.ErrorIs(t, err, service.ErrTwoFactorEnabled)
+
+	// only hashes are stored
+	var stored []models.RecoveryCode
+	require.NoError(t, database.Where("user_id = ?", user.User_id).Find(&stored).Error)
+	require.Len(t, stored, service.RecoveryCodeCount)
+	for _, row := range stored {
+		assert.NotContains(t, codes, row.Hash)
+		assert.Len(t, row.Hash, 64)
+	}
+}
+
+func TestLoginWithCode(t *testing.T) {
+	database, user := setupDB(t)
+	now := time.Unix(1700000000, 0)
+	secret, _ := enable(t, database, user, now)
+	attempt := service.LoginAttempt{Username: "alice", Password: "secret", IP: "10.0.0.1", UserAgent: "test"}
+
+	// a wrong password does not get to the code
+	_, _, err := service.Login(database, service.LoginAttempt{Username: "alice", Password: "wrong", IP: "10.0.0.1"}, now)
+	assert.ErrorIs(t, err, service.ErrInvalidPassword)
+	loggedIn, failures, err := service.Login(database, attempt, now)
+	assert.ErrorIs(t, err, service.ErrSecondFactorRequired)
+	assert.Equal(t, user.User_id, loggedIn.User_id)
+	assert.Empty(t, failures, "failures stay until the code is entered")
+
+	now = now.Add(totp.Period)
+	_, _, err = service.LoginSecondFactor(database, user.User_id, "000000", attempt, now)
+	assert.ErrorIs(t, err, service.ErrInvalidCode)
+	loggedIn, failures, err = service.LoginSecondFactor(database, user.User_id, code(t, secret, now), attempt, now)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", loggedIn.Username)
+	require.Len(t, failures, 2)
+	assert.Equal(t, service.ReasonInvalidCode, failures[0].Reason)
+
+	// a code works once
+	_, _, err = service.LoginSecondFactor(database, user.User_id, code(t, secret, now), attempt, now)
+	assert.ErrorIs(t, err, service.ErrInvalidCode)
+	// the code used to confirm is too old by now
+	_, _, err = service.LoginSecondFactor(database, user.User_id, code(t, secret, now.Add(-totp.Period)), attempt, now)
+	assert.ErrorIs(t, err, service.ErrInvalidCode)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	database, user := setupDB(t)
+	now := time.Unix(1700000000, 0)
+	_, codes := enable(t, database, user, now)
+	attempt := service.LoginAttempt{IP: "10.0.0.1"}
+
+	_, _, err := service.LoginSecondFactor(database, user.User_id, strings.ToUpper(strings.ReplaceAll(codes[3], "-", " ")), attempt, now)
+	require.NoError(t, err, "case, spaces and dashes do not matter")
+	_, _, err = service.LoginSecondFactor(database, user.User_id, codes[3], attempt, now)
+	assert.ErrorIs(t, err, service.ErrInvalidCode, "a recovery code works once")
+	left, err := service.RecoveryCodesLeft(database, user.User_id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(service.RecoveryCodeCount-1), left)
+
+	require.NoError(t, service.DisableTwoFactor(database, user.User_id))
+	left, _ = service.RecoveryCodesLeft(database, user.User_id)
+	assert.Zero(t, left)
+	_, _, err = service.Login(database, service.LoginAttempt{Username: "alice", Password: "secret"}, now)
+	assert.NoError(t, err)
+}
+
+func TestWrongCodesLock(t *testing.T) {
+	database, user := setupDB(t)
+	now := time.Unix(1700000000, 0)
+	enable(t, database, user, now)
+
+	for i := 0; i < 3; i++ {
+		_, _, err := service.LoginSecondFactor(database, user.User_id, fmt.Sprintf("00000%d", i), service.LoginAttempt{IP: fmt.Sprintf("10.0.0.%d", i)}, now)
+		assert.ErrorIs(t, err, service.ErrInvalidCode)
+	}
+	_, _, err := service.LoginSecondFactor(database, user.User_id, "000009", service.LoginAttempt{IP: "10.0.0.9"}, now)
+	assert.ErrorAs(t, err, new(*service.LockedError))
+	// the password step is locked too, so it cannot clear them
+	_, _, err = service.Login(database, service.LoginAttempt{Username: "alice", Password: "secret", IP: "10.0.0.9"}, now)
+	assert.ErrorAs(t, err, new(*service.LockedError))
+}
+
+// client keeps the session cookie between requests, like a browser the
+// last one a response sets
+type client struct {
+	r       http.Handler
+	cookies []*http.Cookie
+}
+
+func (c *client) do(method, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c.r.ServeHTTP(rec, req)
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		c.cookies = cookies[len(cookies)-1:]
+	}
+	return rec
+}
+
+func web(database *gorm.DB) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/login", handlers.LoginHandler(database, nil)).Methods("GET", "POST")
+	r.HandleFunc("/login/code", handlers.LoginCodeHandler(database)).Methods("GET", "POST")
+	r.HandleFunc("/settings", handlers.SettingsHandler(database, nil)).Methods("GET")
+	r.HandleFunc("/settings/2fa", handlers.TwoFactorHandler(database)).Methods("GET", "POST")
+	r.HandleFunc("/settings/2fa/confirm", handlers.ConfirmTwoFactorHandler(database)).Methods("POST")
+	r.HandleFunc("/settings/2fa/disable", handlers.DisableTwoFactorHandler(database)).Methods("POST")
+	apiv2.Register(r, database, svc)
+	return r
+}
+
+func TestSettings(t *testing.T) {
+	database, user := setupDB(t)
+	c := &client{r: web(database)}
+	require.Equal(t, http.StatusFound, c.do("POST", "/login", url.Values{"username": {"alice"}, "password": {"secret"}}).Code)
+
+	rec := c.do("GET", "/settings", nil)
+	assert.Contains(t, rec.Body.String(), "Set up two-factor authentication")
+	rec = c.do("GET", "/settings/2fa", nil)
+	assert.Equal(t, "/settings", rec.Header().Get("Location"), "nothing to confirm yet")
+
+	rec = c.do("POST", "/settings/2fa", nil)
+	require.Equal(t, "/settings/2fa", rec.Header().Get("Location"))
+	var tf models.TwoFactor
+	require.NoError(t, database.Where("user_id = ?", user.User_id).Take(&tf).Error)
+	rec = c.do("GET", "/settings/2fa", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `<a href="otpauth://totp/MiniTwit:alice?`)
+	assert.Contains(t, rec.Body.String(), tf.Secret)
+
+	rec = c.do("POST", "/settings/2fa/confirm", url.Values{"code": {"000000"}})
+	assert.Equal(t, "/settings/2fa", rec.Header().Get("Location"))
+	assert.Contains(t, c.do("GET", "/settings/2fa", nil).Body.String(), "Invalid authentication code")
+
+	// the previous step, so the code still works to log in below
+	rec = c.do("POST", "/settings/2fa/confirm", url.Values{"code": {code(t, tf.Secret, time.Now().Add(-totp.Period))}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "recovery codes")
+	assert.Regexp(t, `<code>[a-z2-7]{5}-[a-z2-7]{5}</code>`, rec.Body.String())
+	assert.Contains(t, c.do("GET", "/settings", nil).Body.String(), "You have 10 unused recovery codes")
+
+	rec = c.do("POST", "/settings/2fa/disable", url.Values{"password": {"wrong"}})
+	assert.Equal(t, "/settings", rec.Header().Get("Location"))
+	enabled, _ := service.TwoFactorEnabled(database, user.User_id)
+	assert.True(t, enabled)
+	c.do("POST", "/settings/2fa/disable", url.Values{"password": {"secret"}})
+	enabled, _ = service.TwoFactorEnabled(database, user.User_id)
+	assert.False(t, enabled)
+}
+
+func TestTwoStepLogin(t *testing.T) {
+	database, user := setupDB(t)
+	secret, _ := enable(t, database, user, time.Now().Add(-totp.Period))
+	c := &client{r: web(database)}
+
+	rec := c.do("GET", "/login/code", nil)
+	assert.Equal(t, "/login", rec.Header().Get("Location"), "the password comes first")
+
+	rec = c.do("POST", "/login", url.Values{"username": {"alice"}, "password": {"secret"}})
+	require.Equal(t, http.StatusFound, rec.Code)
+	require.Equal(t, "/login/code", rec.Header().Get("Location"))
+	rec = c.do("GET", "/settings", nil)
+	assert.Equal(t, "/login", rec.Header().Get("Location"), "not logged in before the code")
+	rec = c.do("GET", "/login/code", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `name=code`)
+
+	rec = c.do("POST", "/login/code", url.Values{"code": {"000000"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Invalid authentication code")
+
+	rec = c.do("POST", "/login/code", url.Values{"code": {code(t, secret, time.Now())}})
+	require.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/", rec.Header().Get("Location"))
+	rec = c.do("GET", "/settings", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "You were logged in")
+	assert.Contains(t, rec.Body.String(), "There were 1 failed login attempts")
+	assert.Equal(t, "/login", c.do("GET", "/login/code", nil).Header().Get("Location"), "the code step is done")
+}
+
+func TestAPIUnaffected(t *testing.T) {
+	database, user := setupDB(t)
+	enable(t, database, user, time.Now())
+	r := web(database)
+
+	req := httptest.NewRequest("GET", "/api/v2/users/alice/timeline", nil)
+	req.SetBasicAuth("alice", "secret")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
@@ -76,7 +76,7 @@ $USE_SUDO docker-compose -f docker/docker-compose.test.yml down -v
 echo "Running Go unit tests..."
 
 # Initialize counters
-TOTAL_TESTS=3
+TOTAL_TESTS=27
 PASSED_TESTS=0
 FAILED_TESTS=0
 FAILED_TEST_NAMES=""
@@ -111,6 +111,246 @@ else
     FAILED_TESTS=$((FAILED_TESTS+1))
     FAILED_TEST_NAMES="$FAILED_TEST_NAMES db_test"
 fi
+
+# Test federation
+echo "Running federation_test.go..."
+go test -v federation_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES federation_test"
+fi
+
+# Test API against the OpenAPI document
+echo "Running api_test.go..."
+go test -v api_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES api_test"
+fi
+
+# Test API v2
+echo "Running apiv2_test.go..."
+go test -v apiv2_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES apiv2_test"
+fi
+
+# Test gRPC server
+echo "Running grpc_test.go..."
+go test -v grpc_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES grpc_test"
+fi
+
+# Test replaying simulator logs
+echo "Running replay_test.go..."
+go test -v replay_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES replay_test"
+fi
+
+# Test structured logging and request ids
+echo "Running logging_test.go..."
+go test -v logging_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES logging_test"
+fi
+
+# Test OpenTelemetry tracing
+echo "Running tracing_test.go..."
+go test -v tracing_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES tracing_test"
+fi
+
+# Test business and database metrics
+echo "Running metrics_test.go..."
+go test -v metrics_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES metrics_test"
+fi
+
+# Test health and readiness endpoints
+echo "Running health_test.go..."
+go test -v health_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES health_test"
+fi
+
+# Test graceful shutdown, timeouts and TLS reload
+echo "Running server_test.go..."
+go test -v server_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES server_test"
+fi
+
+# Test configuration loading and validation
+echo "Running config_test.go..."
+go test -v config_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES config_test"
+fi
+
+# Test the admin command
+echo "Running admin_test.go..."
+go test -v admin_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES admin_test"
+fi
+
+# Test export and import
+echo "Running backup_test.go..."
+go test -v backup_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES backup_test"
+fi
+
+# Test the data export and account deletion
+echo "Running account_test.go..."
+go test -v account_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES account_test"
+fi
+
+# Test rate limiting
+echo "Running ratelimit_test.go..."
+go test -v ratelimit_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES ratelimit_test"
+fi
+
+# Test the login lockout and failed login records
+echo "Running login_test.go..."
+go test -v login_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES login_test"
+fi
+
+# Test TOTP two-factor authentication
+echo "Running twofactor_test.go..."
+go test -v twofactor_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES twofactor_test"
+fi
+
+# Test the mailer, email verification and password reset
+echo "Running email_test.go..."
+go test -v email_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES email_test"
+fi
+
+# Test the OpenID Connect login against the mock provider
+echo "Running oidc_test.go..."
+go test -v oidc_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES oidc_test"
+fi
+
+# Timeline cache tests
+echo "Running cache_test.go..."
+go test -v cache_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES cache_test"
+fi
+
+# Fan-out timeline tests
+echo "Running fanout_test.go..."
+go test -v fanout_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES fanout_test"
+fi
+
+# Background job tests
+echo "Running jobs_test.go..."
+go test -v jobs_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES jobs_test"
+fi
+
+# Profile counter tests
+echo "Running counters_test.go..."
+go test -v counters_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES counters_test"
+fi
+
+# Follower and following lists with the viewer's follows
+echo "Running follows_test.go..."
+go test -v follows_test.go
+if [ $? -eq 0 ]; then
+    PASSED_TESTS=$((PASSED_TESTS+1))
+else
+    FAILED_TESTS=$((FAILED_TESTS+1))
+    FAILED_TEST_NAMES="$FAILED_TEST_NAMES follows_test"
+fi
 cd ..
 
 # Make sure we print the summary without trying to use /dev/tty